@@ -0,0 +1,126 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/tc/server"
+)
+
+const adminRequestTimeout = 30 * time.Second
+
+// adminClient talks to the admin api of a running TC.
+type adminClient struct {
+	baseURL  string
+	operator string
+	token    string
+	client   *http.Client
+}
+
+func newAdminClient(addr string, operator string, token string) *adminClient {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	return &adminClient{
+		baseURL:  strings.TrimSuffix(addr, "/"),
+		operator: operator,
+		token:    token,
+		client:   &http.Client{Timeout: adminRequestTimeout},
+	}
+}
+
+func (client *adminClient) listSessions(query url.Values) ([]server.GlobalSessionView, error) {
+	var views []server.GlobalSessionView
+	err := client.do(http.MethodGet, "/admin/sessions?"+query.Encode(), &views)
+	return views, err
+}
+
+func (client *adminClient) getSession(xid string) (server.GlobalSessionView, error) {
+	var view server.GlobalSessionView
+	err := client.do(http.MethodGet, "/admin/sessions/"+url.PathEscape(xid), &view)
+	return view, err
+}
+
+func (client *adminClient) sessionAction(xid string, action string) (server.GlobalSessionView, error) {
+	var view server.GlobalSessionView
+	err := client.do(http.MethodPost, "/admin/sessions/"+url.PathEscape(xid)+"/"+action, &view)
+	return view, err
+}
+
+func (client *adminClient) listLocks(query url.Values) ([]server.RowLockView, error) {
+	var views []server.RowLockView
+	err := client.do(http.MethodGet, "/admin/locks?"+query.Encode(), &views)
+	return views, err
+}
+
+func (client *adminClient) do(method string, path string, v interface{}) error {
+	request, err := http.NewRequest(method, client.baseURL+path, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if client.operator != "" {
+		request.Header.Set(server.AdminOperatorHeader, client.operator)
+	}
+	if client.token != "" {
+		request.Header.Set(server.AdminTokenHeader, "Bearer "+client.token)
+	}
+	response, err := client.client.Do(request)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		var adminError server.AdminError
+		if err := json.Unmarshal(body, &adminError); err != nil || adminError.Error == "" {
+			return errors.Errorf("%s %s: %s", method, path, response.Status)
+		}
+		if adminError.Leader != "" {
+			return errors.Errorf("%s, the leader is %s", adminError.Error, adminError.Leader)
+		}
+		return errors.New(adminError.Error)
+	}
+	return errors.WithStack(json.NewDecoder(bytes.NewReader(body)).Decode(v))
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	fmt.Println(string(data))
+	return nil
+}
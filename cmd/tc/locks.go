@@ -0,0 +1,91 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"text/tabwriter"
+)
+
+import (
+	"github.com/urfave/cli/v2"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/tc/server"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+var locksCommand = &cli.Command{
+	Name:  "locks",
+	Usage: "inspect the row locks held by global transactions",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "list",
+			Usage: "list row locks",
+			Flags: []cli.Flag{
+				adminFlag,
+				configFlag,
+				&cli.StringFlag{Name: "resource", Usage: "only locks on this resource id"},
+				&cli.StringFlag{Name: "xid", Usage: "only locks held by this global transaction"},
+			},
+			Action: listLocks,
+		},
+	},
+}
+
+func listLocks(c *cli.Context) error {
+	resourceID, xid := c.String("resource"), c.String("xid")
+	var views []server.RowLockView
+	if addr := c.String("admin"); addr != "" {
+		query := url.Values{}
+		if resourceID != "" {
+			query.Set("resource", resourceID)
+		}
+		if xid != "" {
+			query.Set("xid", xid)
+		}
+		var err error
+		if views, err = newAdminClient(addr, "", "").listLocks(query); err != nil {
+			return err
+		}
+	} else {
+		store, err := openOfflineStore(c)
+		if err != nil {
+			return err
+		}
+		var globalSessions []*session.GlobalSession
+		if xid != "" {
+			if globalSession := store.sessionManager.FindGlobalSession(xid); globalSession != nil {
+				globalSessions = append(globalSessions, globalSession)
+			}
+		} else {
+			globalSessions = store.sessionManager.AllSessions()
+		}
+		views = server.ListRowLockViews(store.lockManager, globalSessions, xid, resourceID)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "XID\tBRANCH\tRESOURCE\tTABLE\tPK")
+	for _, view := range views {
+		fmt.Fprintf(writer, "%s\t%d\t%s\t%s\t%s\n", view.XID, view.BranchID, view.ResourceID, view.TableName, view.Pk)
+	}
+	return writer.Flush()
+}
@@ -87,10 +87,15 @@ func main() {
 					holder.Init()
 
 					srv := server.NewServer()
-					srv.Start(fmt.Sprintf(":%s", conf.Port))
+					if err := srv.Start(fmt.Sprintf(":%s", conf.Port)); err != nil {
+						return cli.Exit(err.Error(), 1)
+					}
 					return nil
 				},
 			},
+			sessionsCommand,
+			locksCommand,
+			storeCommand,
 		},
 		Version: version.Print(appName),
 	}
@@ -0,0 +1,252 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/urfave/cli/v2"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/holder"
+	"github.com/transaction-mesh/starfish/pkg/tc/lock"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+	"github.com/transaction-mesh/starfish/pkg/tc/server"
+)
+
+// The inspection commands read either from the admin api of a running TC, or
+// offline straight from the store configured in config.yml. Mutations always go
+// through a running TC, which alone reaches the resource managers and writes
+// the audit log.
+var (
+	adminFlag = &cli.StringFlag{
+		Name:  "admin",
+		Usage: "address of the admin api of a running TC, such as 127.0.0.1:9899",
+	}
+	configFlag = &cli.StringFlag{
+		Name:    "config",
+		Aliases: []string{"c"},
+		Usage:   "Load configuration from `FILE` and read its store offline",
+	}
+	operatorFlag = &cli.StringFlag{
+		Name:    "operator",
+		EnvVars: []string{"USER"},
+		Usage:   "operator recorded in the audit log",
+	}
+	tokenFlag = &cli.StringFlag{
+		Name:    "token",
+		EnvVars: []string{"STARFISH_ADMIN_TOKEN"},
+		Usage:   "admin_config.token of the TC, needed to act from another host",
+	}
+)
+
+var sessionsCommand = &cli.Command{
+	Name:  "sessions",
+	Usage: "inspect and repair global transactions",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "list",
+			Usage: "list global transactions",
+			Flags: []cli.Flag{
+				adminFlag,
+				configFlag,
+				&cli.StringFlag{Name: "status", Usage: "only transactions in this status, such as CommitRetrying"},
+				&cli.StringFlag{Name: "application-id", Usage: "only transactions began by this application"},
+				&cli.StringFlag{Name: "transaction-name", Usage: "only transactions with this name"},
+				&cli.DurationFlag{Name: "min-age", Usage: "only transactions began longer ago than this, such as 5m"},
+				&cli.DurationFlag{Name: "max-age", Usage: "only transactions began within this, such as 1h"},
+				&cli.StringFlag{Name: "sort", Value: string(model.SortByBeginTime), Usage: "sort by begin_time, transaction_id or status"},
+				&cli.BoolFlag{Name: "desc", Usage: "sort in descending order"},
+				&cli.IntFlag{Name: "offset", Usage: "skip this many transactions"},
+				&cli.IntFlag{Name: "limit", Usage: "list at most this many transactions, 0 lists all"},
+				&cli.BoolFlag{Name: "history", Usage: "list the archived transactions which already finished"},
+			},
+			Action: listSessions,
+		},
+		{
+			Name:      "show",
+			Usage:     "show a global transaction with its branches and row locks",
+			ArgsUsage: "<xid>",
+			Flags:     []cli.Flag{adminFlag, configFlag},
+			Action:    showSession,
+		},
+		sessionActionCommand(server.AdminActionRollback, "roll back a transaction, or retry its rollback now"),
+		sessionActionCommand(server.AdminActionCommit, "retry the commit of a transaction now"),
+		sessionActionCommand(server.AdminActionAbandon, "stop retrying a transaction stuck in CommitRetrying or RollbackRetrying"),
+	},
+}
+
+func sessionActionCommand(action string, usage string) *cli.Command {
+	return &cli.Command{
+		Name:      action,
+		Usage:     usage,
+		ArgsUsage: "<xid>",
+		Flags:     []cli.Flag{adminFlag, operatorFlag, tokenFlag},
+		Action: func(c *cli.Context) error {
+			xid, err := xidArg(c)
+			if err != nil {
+				return err
+			}
+			if c.String("admin") == "" {
+				return errors.Errorf("%s needs --admin, only a running TC can reach the resource managers", action)
+			}
+			view, err := newAdminClient(c.String("admin"), c.String("operator"), c.String("token")).sessionAction(xid, action)
+			if err != nil {
+				return err
+			}
+			return printJSON(view)
+		},
+	}
+}
+
+func listSessions(c *cli.Context) error {
+	var views []server.GlobalSessionView
+	if addr := c.String("admin"); addr != "" {
+		query := url.Values{}
+		for flag, param := range map[string]string{"status": "status", "application-id": "application_id",
+			"transaction-name": "transaction_name"} {
+			if value := c.String(flag); value != "" {
+				query.Set(param, value)
+			}
+		}
+		for flag, param := range map[string]string{"min-age": "min_age", "max-age": "max_age"} {
+			if c.Duration(flag) > 0 {
+				query.Set(param, c.Duration(flag).String())
+			}
+		}
+		query.Set("sort", c.String("sort"))
+		if c.Bool("desc") {
+			query.Set("desc", "true")
+		}
+		for flag, param := range map[string]string{"offset": "offset", "limit": "limit"} {
+			if c.Int(flag) > 0 {
+				query.Set(param, strconv.Itoa(c.Int(flag)))
+			}
+		}
+		if c.Bool("history") {
+			query.Set("history", "true")
+		}
+		var err error
+		if views, err = newAdminClient(addr, "", "").listSessions(query); err != nil {
+			return err
+		}
+	} else if c.Bool("history") {
+		return errors.New("--history needs --admin, the archive is read by a running TC")
+	} else {
+		store, err := openOfflineStore(c)
+		if err != nil {
+			return err
+		}
+		sortBy, ok := model.ValueOfSessionSortField(c.String("sort"))
+		if !ok {
+			return errors.Errorf("invalid sort %s", c.String("sort"))
+		}
+		condition := model.SessionCondition{
+			ApplicationID:      c.String("application-id"),
+			TransactionName:    c.String("transaction-name"),
+			OverTimeAliveMills: c.Duration("min-age").Milliseconds(),
+			SortBy:             sortBy,
+			Descending:         c.Bool("desc"),
+			Offset:             c.Int("offset"),
+			Limit:              c.Int("limit"),
+		}
+		if c.Duration("max-age") > 0 {
+			condition.BeginTimeFrom = time.Now().Add(-c.Duration("max-age")).UnixNano() / int64(time.Millisecond)
+		}
+		if value := c.String("status"); value != "" {
+			if condition.Status, err = server.ParseGlobalStatus(value); err != nil {
+				return err
+			}
+		}
+		for _, globalSession := range store.sessionManager.FindGlobalSessions(condition) {
+			views = append(views, server.NewGlobalSessionView(globalSession))
+		}
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "XID\tSTATUS\tAPPLICATION\tTRANSACTION\tBEGIN\tAGE")
+	now := time.Now()
+	for _, view := range views {
+		begin := time.Unix(0, view.BeginTime*int64(time.Millisecond))
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", view.XID, view.Status, view.ApplicationID, view.TransactionName,
+			begin.Format(time.RFC3339), now.Sub(begin).Truncate(time.Second))
+	}
+	return writer.Flush()
+}
+
+func showSession(c *cli.Context) error {
+	xid, err := xidArg(c)
+	if err != nil {
+		return err
+	}
+	if addr := c.String("admin"); addr != "" {
+		view, err := newAdminClient(addr, "", "").getSession(xid)
+		if err != nil {
+			return err
+		}
+		return printJSON(view)
+	}
+
+	store, err := openOfflineStore(c)
+	if err != nil {
+		return err
+	}
+	globalSession := store.sessionManager.FindGlobalSession(xid)
+	if globalSession == nil {
+		return errors.Errorf("global session %s not found", xid)
+	}
+	return printJSON(server.NewGlobalSessionDetailView(globalSession, store.lockManager))
+}
+
+func xidArg(c *cli.Context) (string, error) {
+	if c.Args().Len() != 1 {
+		return "", errors.Errorf("%s expects exactly one xid", c.Command.Name)
+	}
+	return c.Args().First(), nil
+}
+
+type offlineStore struct {
+	sessionManager holder.SessionManager
+	lockManager    lock.LockManager
+}
+
+func openOfflineStore(c *cli.Context) (*offlineStore, error) {
+	conf, err := config.InitConf(c.String("config"))
+	if err != nil {
+		return nil, err
+	}
+	sessionManager, err := holder.OpenSessionManager(conf.StoreConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &offlineStore{
+		sessionManager: sessionManager,
+		lockManager:    lock.NewLockManager(conf.StoreConfig),
+	}, nil
+}
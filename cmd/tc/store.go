@@ -0,0 +1,114 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/urfave/cli/v2"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/holder"
+)
+
+var storeCommand = &cli.Command{
+	Name:  "store",
+	Usage: "check the session store configured in config.yml",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "verify",
+			Usage:  "report undecodable records, orphaned branches and locks, and conflicting row locks",
+			Flags:  []cli.Flag{configFlag},
+			Action: verifyStore,
+		},
+		{
+			Name: "migrate",
+			Usage: "copy the live sessions and row locks of the store in config.yml into the empty store in the target " +
+				"config, while no TC runs on either",
+			Description: "The store migrated to has to be empty and the one migrated from is left as it is. --reverse " +
+				"only swaps the two: the sessions are copied from the target store into the store in config.yml, which " +
+				"has to be cleared first.",
+			Flags: []cli.Flag{
+				configFlag,
+				&cli.StringFlag{Name: "target", Usage: "Load the store to migrate to from `FILE`"},
+				&cli.BoolFlag{Name: "reverse", Usage: "migrate from the target store back into the store in config.yml, " +
+					"which has to be empty"},
+			},
+			Action: migrateStore,
+		},
+	},
+}
+
+func verifyStore(c *cli.Context) error {
+	conf, err := config.InitConf(c.String("config"))
+	if err != nil {
+		return err
+	}
+	problems, err := holder.VerifyStore(conf.StoreConfig)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Println(problem.String())
+	}
+	if len(problems) > 0 {
+		return cli.Exit(fmt.Sprintf("%d problems found in the %s store", len(problems), conf.StoreConfig.StoreMode), 1)
+	}
+	fmt.Printf("the %s store is consistent\n", conf.StoreConfig.StoreMode)
+	return nil
+}
+
+func migrateStore(c *cli.Context) error {
+	if c.String("target") == "" {
+		return errors.New("migrate needs --target")
+	}
+	source, err := config.LoadConf(c.String("config"))
+	if err != nil {
+		return err
+	}
+	target, err := config.LoadConf(c.String("target"))
+	if err != nil {
+		return err
+	}
+	if c.Bool("reverse") {
+		source, target = target, source
+	}
+	err = config.OpenStore(&source.StoreConfig)
+	defer config.CloseStore(source.StoreConfig)
+	if err != nil {
+		return errors.WithMessage(err, "open source store")
+	}
+	err = config.OpenStore(&target.StoreConfig)
+	defer config.CloseStore(target.StoreConfig)
+	if err != nil {
+		return errors.WithMessage(err, "open target store")
+	}
+	migration, err := holder.MigrateStore(source.StoreConfig, target.StoreConfig)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("migrated %s from the %s store to the %s store\n", migration.Target,
+		source.StoreConfig.StoreMode, target.StoreConfig.StoreMode)
+	return nil
+}
@@ -0,0 +1,50 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package version
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompare(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.2", "1.2.0", 0},
+		{"v1.3.0", "1.3.0", 0},
+		{"1.3.0-rc1", "1.3.0", 0},
+		{"1.2.9", "1.10.0", -1},
+		{"2.0.0", "1.99.99", 1},
+	}
+	for _, c := range cases {
+		got, err := Compare(c.a, c.b)
+		assert.Nil(t, err)
+		assert.Equal(t, c.want, got, "%s vs %s", c.a, c.b)
+	}
+
+	for _, invalid := range []string{"", "v", "1.x", "1..2", "-1"} {
+		_, err := Compare(invalid, "1.0.0")
+		assert.NotNil(t, err, invalid)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+// The head map keys of the credential a client registers with.
+const (
+	HeadTimestamp = "auth-timestamp"
+	HeadSignature = "auth-signature"
+)
+
+// Sign returns the hex encoded HMAC-SHA256 by secret of the identity a client
+// registers with, timestamp is in milliseconds.
+func Sign(secret, applicationID, transactionServiceGroup string, timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{applicationID, transactionServiceGroup, strconv.FormatInt(timestamp, 10)}, ",")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignedHeadMap returns the head map of a register request signed at now.
+func SignedHeadMap(secret, applicationID, transactionServiceGroup string, now time.Time) map[string]string {
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	return map[string]string{
+		HeadTimestamp: strconv.FormatInt(timestamp, 10),
+		HeadSignature: Sign(secret, applicationID, transactionServiceGroup, timestamp),
+	}
+}
+
+// Verify checks headMap carries a signature by secret of applicationID and
+// transactionServiceGroup made less than maxClockSkew away from now.
+func Verify(secret, applicationID, transactionServiceGroup string, headMap map[string]string,
+	now time.Time, maxClockSkew time.Duration) error {
+	signature, ok := headMap[HeadSignature]
+	if !ok {
+		return errors.New("register request carries no signature")
+	}
+	timestamp, err := strconv.ParseInt(headMap[HeadTimestamp], 10, 64)
+	if err != nil {
+		return errors.Errorf("invalid signature timestamp %q", headMap[HeadTimestamp])
+	}
+	skew := now.Sub(time.Unix(0, timestamp*int64(time.Millisecond)))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return errors.Errorf("signature timestamp is %s away from the server clock", skew)
+	}
+	expected := Sign(secret, applicationID, transactionServiceGroup, timestamp)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
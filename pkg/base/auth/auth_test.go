@@ -0,0 +1,41 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	headMap := SignedHeadMap("s3cret", "order-service", "my_test_tx_group", now)
+
+	assert.Nil(t, Verify("s3cret", "order-service", "my_test_tx_group", headMap, now.Add(time.Minute), 5*time.Minute))
+	assert.NotNil(t, Verify("other", "order-service", "my_test_tx_group", headMap, now, 5*time.Minute))
+	assert.NotNil(t, Verify("s3cret", "stock-service", "my_test_tx_group", headMap, now, 5*time.Minute))
+	assert.NotNil(t, Verify("s3cret", "order-service", "other_tx_group", headMap, now, 5*time.Minute))
+	assert.NotNil(t, Verify("s3cret", "order-service", "my_test_tx_group", headMap, now.Add(10*time.Minute), 5*time.Minute))
+	assert.NotNil(t, Verify("s3cret", "order-service", "my_test_tx_group", nil, now, 5*time.Minute))
+	assert.NotNil(t, Verify("s3cret", "order-service", "my_test_tx_group",
+		map[string]string{HeadSignature: headMap[HeadSignature], HeadTimestamp: "yesterday"}, now, 5*time.Minute))
+}
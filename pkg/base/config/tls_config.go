@@ -0,0 +1,39 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"time"
+)
+
+// TLSConfig tls of the connections between the clients and the transaction
+// coordinator, certificates are reloaded when their files change.
+type TLSConfig struct {
+	Enabled  bool   `default:"false" yaml:"enabled" json:"enabled,omitempty"`
+	CertFile string `yaml:"cert_file" json:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file" json:"key_file,omitempty"`
+	// CAFile verifies the certificates of the peer, the system roots are used
+	// by the client when it is empty
+	CAFile string `yaml:"ca_file" json:"ca_file,omitempty"`
+	// ClientAuth requires clients to present a certificate issued by CAFile whose
+	// identity is their application id, server only
+	ClientAuth bool `default:"false" yaml:"client_auth" json:"client_auth,omitempty"`
+	// ServerName verifies the host name of the server certificate, client only
+	ServerName     string        `yaml:"server_name" json:"server_name,omitempty"`
+	ReloadInterval time.Duration `default:"1m" yaml:"reload_interval" json:"reload_interval,omitempty"`
+}
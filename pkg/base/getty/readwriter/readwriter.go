@@ -33,6 +33,7 @@ import (
 import (
 	"github.com/transaction-mesh/starfish/pkg/base/protocal"
 	"github.com/transaction-mesh/starfish/pkg/base/protocal/codec"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal/compressor"
 )
 
 /**
@@ -60,10 +61,13 @@ import (
  */
 const (
 	StarfishV1PackageHeaderReservedLength = 16
+	// DefaultMaxMsgLen is the default max_msg_len of getty sessions, the
+	// decompressed body of a package is no longer than it either.
+	DefaultMaxMsgLen = 4096
 )
 
 var (
-	// RpcPkgHandler
+	// RpcPkgHandler writes bodies uncompressed
 	RpcPkgHandler = &RpcPackageHandler{}
 )
 
@@ -72,9 +76,41 @@ var (
 	ErrTooLargePackage = errors.New("package length is exceed the getty package's legal maximum length.")
 	ErrInvalidPackage  = errors.New("invalid rpc package")
 	ErrIllegalMagic    = errors.New("package magic is not right.")
+	// ErrUnsupportedVersion the package is of a protocol version this side
+	// can not decode, the session is closed rather than misreading it
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
 )
 
-type RpcPackageHandler struct{}
+// RpcPackageHandler reads and writes rpc packages, bodies of at least
+// compressThreshold bytes are compressed with compressType. Compressed bodies
+// are refused once they decompress to more than maxMsgLen bytes, the limit
+// the session puts on packages sent uncompressed.
+type RpcPackageHandler struct {
+	compressType      byte
+	compressThreshold int
+	maxMsgLen         int
+}
+
+// NewRpcPackageHandler returns a package handler compressing bodies with the
+// named compressor, a threshold <= 0 falls back to compressor.DefaultThreshold
+// and a maxMsgLen <= 0 to DefaultMaxMsgLen.
+func NewRpcPackageHandler(compressorName string, threshold int, maxMsgLen int) (*RpcPackageHandler, error) {
+	compressType, err := compressor.ParseCompressType(compressorName)
+	if err != nil {
+		return nil, err
+	}
+	if threshold <= 0 {
+		threshold = compressor.DefaultThreshold
+	}
+	if maxMsgLen <= 0 {
+		maxMsgLen = DefaultMaxMsgLen
+	}
+	return &RpcPackageHandler{
+		compressType:      compressType,
+		compressThreshold: threshold,
+		maxMsgLen:         maxMsgLen,
+	}, nil
+}
 
 type StarfishV1PackageHeader struct {
 	Magic0       byte
@@ -110,7 +146,10 @@ func (h *StarfishV1PackageHeader) Unmarshal(buf *bytes.Buffer) (int, error) {
 	if err := binary.Read(buf, binary.BigEndian, &(h.Version)); err != nil {
 		return 0, err
 	}
-	// TODO  check version compatible here
+	if h.Version < protocal.MinSupportedVersion || h.Version > protocal.VERSION {
+		return 0, errors.Wrapf(ErrUnsupportedVersion, "version %d, supported versions are %s",
+			h.Version, protocal.SupportedProtocolVersions())
+	}
 
 	// total length
 	if err := binary.Read(buf, binary.BigEndian, &(h.TotalLength)); err != nil {
@@ -180,8 +219,11 @@ func (p *RpcPackageHandler) Read(ss getty.Session, data []byte) (interface{}, in
 		rpcMessage.Body = protocal.HeartBeatMessagePong
 	} else {
 		if header.BodyLength > 0 {
-			//todo compress
-			msg, _ := codec.MessageDecoder(header.CodecType, data[header.HeadLength:])
+			body, err := decompress(header.CompressType, data[header.HeadLength:header.TotalLength], p.maxLength())
+			if err != nil {
+				return nil, 0, err
+			}
+			msg, _ := codec.MessageDecoder(header.CodecType, body)
 			rpcMessage.Body = msg
 		}
 	}
@@ -203,12 +245,31 @@ func (p *RpcPackageHandler) Write(ss getty.Session, pkg interface{}) ([]byte, er
 	var b bytes.Buffer
 	w := byteio.BigEndianWriter{Writer: &b}
 
+	var bodyBytes []byte
+	compressType := compressor.None
+	if msg.MessageType != protocal.MSGTypeHeartbeatRequest &&
+		msg.MessageType != protocal.MSGTypeHeartbeatResponse {
+
+		bodyBytes = codec.MessageEncoder(msg.Codec, msg.Body)
+		if p.compressType != compressor.None && len(bodyBytes) >= p.compressThreshold {
+			compressed, err := compress(p.compressType, bodyBytes)
+			if err != nil {
+				return nil, err
+			}
+			// incompressible bodies are sent as they are
+			if len(compressed) < len(bodyBytes) {
+				bodyBytes = compressed
+				compressType = p.compressType
+			}
+		}
+	}
+
 	result = append(result, protocal.MAGIC_CODE_BYTES[:2]...)
 	result = append(result, protocal.VERSION)
 
 	w.WriteByte(msg.MessageType)
 	w.WriteByte(msg.Codec)
-	w.WriteByte(msg.Compressor)
+	w.WriteByte(compressType)
 	w.WriteInt32(msg.ID)
 
 	if msg.HeadMap != nil && len(msg.HeadMap) > 0 {
@@ -218,13 +279,8 @@ func (p *RpcPackageHandler) Write(ss getty.Session, pkg interface{}) ([]byte, er
 		w.Write(headMapBytes)
 	}
 
-	if msg.MessageType != protocal.MSGTypeHeartbeatRequest &&
-		msg.MessageType != protocal.MSGTypeHeartbeatResponse {
-
-		bodyBytes := codec.MessageEncoder(msg.Codec, msg.Body)
-		fullLength += len(bodyBytes)
-		w.Write(bodyBytes)
-	}
+	fullLength += len(bodyBytes)
+	w.Write(bodyBytes)
 
 	fullLen := int32(fullLength)
 	headLen := int16(headLength)
@@ -235,6 +291,37 @@ func (p *RpcPackageHandler) Write(ss getty.Session, pkg interface{}) ([]byte, er
 	return result, nil
 }
 
+func compress(compressType byte, data []byte) ([]byte, error) {
+	c, err := compressor.GetCompressor(compressType)
+	if err != nil {
+		return nil, err
+	}
+	return c.Compress(data)
+}
+
+// maxLength bounds the decompressed body, RpcPkgHandler has no maxMsgLen set.
+func (p *RpcPackageHandler) maxLength() int {
+	if p.maxMsgLen <= 0 {
+		return DefaultMaxMsgLen
+	}
+	return p.maxMsgLen
+}
+
+func decompress(compressType byte, data []byte, maxLength int) ([]byte, error) {
+	if compressType == compressor.None {
+		return data, nil
+	}
+	c, err := compressor.GetCompressor(compressType)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.Decompress(data, maxLength)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decompress package body with compress type %d", compressType)
+	}
+	return body, nil
+}
+
 func headMapDecode(data []byte) map[string]string {
 	size := len(data)
 	if size == 0 {
@@ -247,8 +334,8 @@ func headMapDecode(data []byte) map[string]string {
 	readLength := 0
 	for readLength < size {
 		var key, value string
-		lengthK, _, _ := r.ReadUint16()
-		if lengthK < 0 {
+		lengthK, _, err := r.ReadUint16()
+		if err != nil {
 			break
 		} else if lengthK == 0 {
 			key = ""
@@ -256,8 +343,8 @@ func headMapDecode(data []byte) map[string]string {
 			key, _, _ = r.ReadString(int(lengthK))
 		}
 
-		lengthV, _, _ := r.ReadUint16()
-		if lengthV < 0 {
+		lengthV, _, err := r.ReadUint16()
+		if err != nil {
 			break
 		} else if lengthV == 0 {
 			value = ""
@@ -266,7 +353,8 @@ func headMapDecode(data []byte) map[string]string {
 		}
 
 		mp[key] = value
-		readLength += int(lengthK + lengthV)
+		// both lengths are 2 bytes
+		readLength += 4 + int(lengthK) + int(lengthV)
 	}
 
 	return mp
@@ -0,0 +1,138 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package readwriter
+
+import (
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal/codec"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal/compressor"
+)
+
+func TestRpcPackageHandler_Compress(t *testing.T) {
+	handler, err := NewRpcPackageHandler("gzip", 256, 0)
+	assert.Nil(t, err)
+
+	small := protocal.RpcMessage{
+		ID:          1,
+		MessageType: protocal.MSGTypeRequest,
+		Codec:       codec.SEATA,
+		Body:        protocal.GlobalBeginRequest{Timeout: 60000, TransactionName: "CreateOrder"},
+	}
+	large := protocal.RpcMessage{
+		ID:          2,
+		MessageType: protocal.MSGTypeRequest,
+		Codec:       codec.SEATA,
+		Body:        protocal.GlobalBeginRequest{Timeout: 60000, TransactionName: strings.Repeat("CreateOrder", 100)},
+	}
+
+	for _, msg := range []protocal.RpcMessage{small, large} {
+		data, err := handler.Write(nil, msg)
+		assert.Nil(t, err)
+
+		pkg, length, err := handler.Read(nil, data)
+		assert.Nil(t, err)
+		assert.Equal(t, len(data), length)
+		rpcMessage := pkg.(protocal.RpcMessage)
+		assert.Equal(t, msg.Body, rpcMessage.Body)
+		if msg.ID == small.ID {
+			assert.Equal(t, compressor.None, rpcMessage.Compressor)
+		} else {
+			assert.Equal(t, compressor.Gzip, rpcMessage.Compressor)
+		}
+
+		// an uncompressing handler still reads compressed packages
+		pkg, _, err = RpcPkgHandler.Read(nil, data)
+		assert.Nil(t, err)
+		assert.Equal(t, msg.Body, pkg.(protocal.RpcMessage).Body)
+	}
+
+	_, err = NewRpcPackageHandler("brotli", 0, 0)
+	assert.NotNil(t, err)
+}
+
+func TestRpcPackageHandler_DecompressLimit(t *testing.T) {
+	writer, err := NewRpcPackageHandler("zstd", 256, 0)
+	assert.Nil(t, err)
+	reader, err := NewRpcPackageHandler("zstd", 256, 512)
+	assert.Nil(t, err)
+
+	// a small frame which decompresses past the max message length
+	msg := protocal.RpcMessage{
+		ID:          1,
+		MessageType: protocal.MSGTypeRequest,
+		Codec:       codec.SEATA,
+		Body:        protocal.GlobalBeginRequest{Timeout: 60000, TransactionName: strings.Repeat("CreateOrder", 100)},
+	}
+	data, err := writer.Write(nil, msg)
+	assert.Nil(t, err)
+	assert.True(t, len(data) < 512)
+
+	_, _, err = reader.Read(nil, data)
+	assert.True(t, errors.Is(err, compressor.ErrTooLarge))
+	_, _, err = writer.Read(nil, data)
+	assert.Nil(t, err)
+}
+
+func TestRpcPackageHandler_HeadMap(t *testing.T) {
+	msg := protocal.RpcMessage{
+		ID:          1,
+		MessageType: protocal.MSGTypeRequest,
+		Codec:       codec.SEATA,
+		HeadMap:     map[string]string{"auth-timestamp": "1626000000000", "auth-signature": "9f86d081884c7d65", "empty": ""},
+		Body:        protocal.GlobalBeginRequest{Timeout: 60000, TransactionName: "CreateOrder"},
+	}
+	data, err := RpcPkgHandler.Write(nil, msg)
+	assert.Nil(t, err)
+
+	pkg, _, err := RpcPkgHandler.Read(nil, data)
+	assert.Nil(t, err)
+	rpcMessage := pkg.(protocal.RpcMessage)
+	assert.Equal(t, msg.HeadMap, rpcMessage.HeadMap)
+	assert.Equal(t, msg.Body, rpcMessage.Body)
+}
+
+func TestRpcPackageHandler_UnsupportedVersion(t *testing.T) {
+	msg := protocal.RpcMessage{
+		ID:          1,
+		MessageType: protocal.MSGTypeRequest,
+		Codec:       codec.SEATA,
+		Body:        protocal.GlobalBeginRequest{Timeout: 60000, TransactionName: "CreateOrder"},
+	}
+	data, err := RpcPkgHandler.Write(nil, msg)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(protocal.VERSION), data[2])
+
+	for _, version := range []byte{protocal.MinSupportedVersion - 1, protocal.VERSION + 1} {
+		data[2] = version
+		pkg, length, err := RpcPkgHandler.Read(nil, data)
+		assert.Equal(t, ErrUnsupportedVersion, errors.Cause(err))
+		assert.Nil(t, pkg)
+		assert.Equal(t, 0, length)
+	}
+}
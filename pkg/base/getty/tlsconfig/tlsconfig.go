@@ -0,0 +1,249 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/config"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+)
+
+const defaultReloadInterval = time.Minute
+
+// Builder builds the tls config of getty servers and clients, certificates
+// and the CA pool are taken from the files of TLSConfig on every handshake so
+// that rotated files are picked up without restarting.
+type Builder struct {
+	conf   config.TLSConfig
+	server bool
+	store  *certificateStore
+}
+
+// NewServerBuilder returns the builder of the transaction coordinator.
+func NewServerBuilder(conf config.TLSConfig) (*Builder, error) {
+	if conf.CertFile == "" || conf.KeyFile == "" {
+		return nil, errors.New("tls cert_file and key_file are required by the server")
+	}
+	if conf.ClientAuth && conf.CAFile == "" {
+		return nil, errors.New("tls ca_file is required to verify client certificates")
+	}
+	return newBuilder(conf, true)
+}
+
+// NewClientBuilder returns the builder of clients, the certificate is only
+// needed when the transaction coordinator requires client authentication.
+func NewClientBuilder(conf config.TLSConfig) (*Builder, error) {
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return nil, errors.New("tls cert_file and key_file should be set together")
+	}
+	return newBuilder(conf, false)
+}
+
+func newBuilder(conf config.TLSConfig, server bool) (*Builder, error) {
+	reloadInterval := conf.ReloadInterval
+	if reloadInterval <= 0 {
+		reloadInterval = defaultReloadInterval
+	}
+	store := &certificateStore{
+		certFile:       conf.CertFile,
+		keyFile:        conf.KeyFile,
+		caFile:         conf.CAFile,
+		reloadInterval: reloadInterval,
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	store.checkedAt = time.Now()
+	return &Builder{
+		conf:   conf,
+		server: server,
+		store:  store,
+	}, nil
+}
+
+// BuildTlsConfig implements getty.TlsConfigBuilder.
+func (builder *Builder) BuildTlsConfig() (*tls.Config, error) {
+	if builder.server {
+		return &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return builder.serverConfig(), nil
+			},
+		}, nil
+	}
+	return builder.clientConfig(), nil
+}
+
+func (builder *Builder) serverConfig() *tls.Config {
+	certificate, pool := builder.store.current()
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*certificate},
+	}
+	if builder.conf.ClientAuth {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = pool
+	}
+	return tlsConfig
+}
+
+func (builder *Builder) clientConfig() *tls.Config {
+	_, pool := builder.store.current()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+		ServerName: builder.conf.ServerName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certificate, _ := builder.store.current()
+			if certificate == nil {
+				// an empty certificate lets the server reject the handshake
+				return &tls.Certificate{}, nil
+			}
+			return certificate, nil
+		},
+	}
+}
+
+// VerifyApplicationID checks the certificate the client presented on conn
+// identifies applicationID by its common name or one of its dns names.
+func VerifyApplicationID(conn net.Conn, applicationID string) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return errors.New("connection is not secured by tls")
+	}
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return errors.New("client presented no certificate")
+	}
+	leaf := certificates[0]
+	if leaf.Subject.CommonName == applicationID {
+		return nil
+	}
+	for _, name := range leaf.DNSNames {
+		if name == applicationID {
+			return nil
+		}
+	}
+	return errors.Errorf("client certificate %s does not identify application %s",
+		leaf.Subject.CommonName, applicationID)
+}
+
+// certificateStore holds the certificate and the CA pool loaded from files,
+// files are checked for changes at most once every reloadInterval.
+type certificateStore struct {
+	certFile       string
+	keyFile        string
+	caFile         string
+	reloadInterval time.Duration
+
+	mu          sync.Mutex
+	certificate *tls.Certificate
+	pool        *x509.CertPool
+	modTimes    map[string]time.Time
+	checkedAt   time.Time
+}
+
+func (store *certificateStore) current() (*tls.Certificate, *x509.CertPool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if time.Since(store.checkedAt) >= store.reloadInterval {
+		store.checkedAt = time.Now()
+		if store.changed() {
+			if err := store.load(); err != nil {
+				log.Errorf("reload tls certificates failed, keep using the loaded ones: %v", err)
+			} else {
+				log.Infof("tls certificates reloaded")
+			}
+		}
+	}
+	return store.certificate, store.pool
+}
+
+func (store *certificateStore) files() []string {
+	var files []string
+	for _, file := range []string{store.certFile, store.keyFile, store.caFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+func (store *certificateStore) changed() bool {
+	for _, file := range store.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			log.Errorf("stat tls file %s failed: %v", file, err)
+			continue
+		}
+		if !info.ModTime().Equal(store.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (store *certificateStore) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range store.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	var certificate *tls.Certificate
+	if store.certFile != "" {
+		keyPair, err := tls.LoadX509KeyPair(store.certFile, store.keyFile)
+		if err != nil {
+			return errors.Wrapf(err, "load tls certificate %s", store.certFile)
+		}
+		certificate = &keyPair
+	}
+
+	var pool *x509.CertPool
+	if store.caFile != "" {
+		pem, err := ioutil.ReadFile(store.caFile)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.Errorf("no certificate found in tls ca_file %s", store.caFile)
+		}
+	}
+
+	store.certificate = certificate
+	store.pool = pool
+	store.modTimes = modTimes
+	return nil
+}
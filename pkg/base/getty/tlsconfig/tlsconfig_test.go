@@ -0,0 +1,270 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/config"
+)
+
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pem         []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return &testCA{
+		certificate: certificate,
+		key:         key,
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns the pem encoded certificate and key of commonName.
+func (ca *testCA) issue(t *testing.T, commonName string, serial int64) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	assert.Nil(t, ioutil.WriteFile(path, data, 0600))
+	assert.Nil(t, os.Chtimes(path, modTime, modTime))
+}
+
+// handshake connects a client to a server built from the given configs and
+// returns the server side of the connection.
+func handshake(t *testing.T, server, client *tls.Config) (*tls.Conn, *tls.Conn, error) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	accepted := make(chan *tls.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		serverConn := conn.(*tls.Conn)
+		if serverConn.Handshake() == nil {
+			serverConn.Write([]byte{1})
+		} else {
+			serverConn.Close()
+		}
+		accepted <- serverConn
+	}()
+
+	clientConn, err := tls.Dial("tcp", listener.Addr().String(), client)
+	if err == nil {
+		// the server verifies the client certificate after the client finished
+		// its side of the handshake, the first read reports the rejection
+		_, err = clientConn.Read(make([]byte, 1))
+	}
+	serverConn := <-accepted
+	return serverConn, clientConn, err
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsconfig")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "starfish ca")
+	serverCert, serverKey := ca.issue(t, "starfish tc", 2)
+	clientCert, clientKey := ca.issue(t, "order-service", 3)
+	now := time.Now()
+	writeFile(t, filepath.Join(dir, "ca.pem"), ca.pem, now)
+	writeFile(t, filepath.Join(dir, "server.pem"), serverCert, now)
+	writeFile(t, filepath.Join(dir, "server.key"), serverKey, now)
+	writeFile(t, filepath.Join(dir, "client.pem"), clientCert, now)
+	writeFile(t, filepath.Join(dir, "client.key"), clientKey, now)
+
+	serverBuilder, err := NewServerBuilder(config.TLSConfig{
+		Enabled:    true,
+		CertFile:   filepath.Join(dir, "server.pem"),
+		KeyFile:    filepath.Join(dir, "server.key"),
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		ClientAuth: true,
+	})
+	assert.Nil(t, err)
+	serverConfig, err := serverBuilder.BuildTlsConfig()
+	assert.Nil(t, err)
+
+	clientBuilder, err := NewClientBuilder(config.TLSConfig{
+		Enabled:    true,
+		CertFile:   filepath.Join(dir, "client.pem"),
+		KeyFile:    filepath.Join(dir, "client.key"),
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		ServerName: "localhost",
+	})
+	assert.Nil(t, err)
+	clientConfig, err := clientBuilder.BuildTlsConfig()
+	assert.Nil(t, err)
+
+	serverConn, clientConn, err := handshake(t, serverConfig, clientConfig)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyApplicationID(serverConn, "order-service"))
+	assert.NotNil(t, VerifyApplicationID(serverConn, "stock-service"))
+	serverConn.Close()
+	clientConn.Close()
+
+	// a client without certificate is rejected
+	anonymousBuilder, err := NewClientBuilder(config.TLSConfig{
+		Enabled:    true,
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		ServerName: "localhost",
+	})
+	assert.Nil(t, err)
+	anonymousConfig, err := anonymousBuilder.BuildTlsConfig()
+	assert.Nil(t, err)
+	serverConn, _, err = handshake(t, serverConfig, anonymousConfig)
+	assert.NotNil(t, err)
+	assert.False(t, serverConn.ConnectionState().HandshakeComplete)
+	serverConn.Close()
+
+	// a certificate of another CA is rejected
+	otherCert, otherKey := newTestCA(t, "other ca").issue(t, "order-service", 4)
+	writeFile(t, filepath.Join(dir, "other.pem"), otherCert, now)
+	writeFile(t, filepath.Join(dir, "other.key"), otherKey, now)
+	otherBuilder, err := NewClientBuilder(config.TLSConfig{
+		Enabled:    true,
+		CertFile:   filepath.Join(dir, "other.pem"),
+		KeyFile:    filepath.Join(dir, "other.key"),
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		ServerName: "localhost",
+	})
+	assert.Nil(t, err)
+	otherConfig, err := otherBuilder.BuildTlsConfig()
+	assert.Nil(t, err)
+	serverConn, _, err = handshake(t, serverConfig, otherConfig)
+	assert.NotNil(t, err)
+	assert.False(t, serverConn.ConnectionState().HandshakeComplete)
+	serverConn.Close()
+
+	_, err = NewServerBuilder(config.TLSConfig{Enabled: true, CertFile: filepath.Join(dir, "server.pem")})
+	assert.NotNil(t, err)
+	_, err = NewServerBuilder(config.TLSConfig{
+		Enabled:    true,
+		CertFile:   filepath.Join(dir, "server.pem"),
+		KeyFile:    filepath.Join(dir, "server.key"),
+		ClientAuth: true,
+	})
+	assert.NotNil(t, err)
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsconfig")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "starfish ca")
+	serverCert, serverKey := ca.issue(t, "starfish tc", 2)
+	now := time.Now()
+	writeFile(t, filepath.Join(dir, "ca.pem"), ca.pem, now)
+	writeFile(t, filepath.Join(dir, "server.pem"), serverCert, now)
+	writeFile(t, filepath.Join(dir, "server.key"), serverKey, now)
+
+	serverBuilder, err := NewServerBuilder(config.TLSConfig{
+		Enabled:        true,
+		CertFile:       filepath.Join(dir, "server.pem"),
+		KeyFile:        filepath.Join(dir, "server.key"),
+		ReloadInterval: time.Millisecond,
+	})
+	assert.Nil(t, err)
+	serverConfig, err := serverBuilder.BuildTlsConfig()
+	assert.Nil(t, err)
+	clientBuilder, err := NewClientBuilder(config.TLSConfig{
+		Enabled:    true,
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		ServerName: "localhost",
+	})
+	assert.Nil(t, err)
+	clientConfig, err := clientBuilder.BuildTlsConfig()
+	assert.Nil(t, err)
+
+	serial := func() int64 {
+		serverConn, clientConn, err := handshake(t, serverConfig, clientConfig)
+		assert.Nil(t, err)
+		defer serverConn.Close()
+		defer clientConn.Close()
+		return clientConn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(2), serial())
+
+	// a half written key pair keeps the loaded certificate
+	rotatedCert, rotatedKey := ca.issue(t, "starfish tc", 5)
+	writeFile(t, filepath.Join(dir, "server.pem"), rotatedCert, now.Add(time.Minute))
+	time.Sleep(2 * time.Millisecond)
+	assert.Equal(t, int64(2), serial())
+
+	writeFile(t, filepath.Join(dir, "server.key"), rotatedKey, now.Add(time.Minute))
+	time.Sleep(2 * time.Millisecond)
+	assert.Equal(t, int64(5), serial())
+}
@@ -34,6 +34,9 @@ const (
 
 	// The BranchType_SAGA.
 	BranchTypeSAGA
+
+	// The BranchType_XA.
+	BranchTypeXA
 )
 
 // String string of branch type
@@ -45,6 +48,8 @@ func (t BranchType) String() string {
 		return "TCC"
 	case BranchTypeSAGA:
 		return "SAGA"
+	case BranchTypeXA:
+		return "XA"
 	default:
 		return fmt.Sprintf("%d", t)
 	}
@@ -59,6 +64,8 @@ func ValueOfBranchType(branchType string) BranchType {
 		return BranchTypeTCC
 	case "SAGA":
 		return BranchTypeSAGA
+	case "XA":
+		return BranchTypeXA
 	default:
 		return 0
 	}
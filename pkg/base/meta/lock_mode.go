@@ -0,0 +1,60 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package meta
+
+import (
+	"fmt"
+)
+
+// LockMode is how a global row lock is held.
+type LockMode byte
+
+const (
+	// LockModeExclusive conflicts with the locks of every other global
+	// transaction, the rows written by AT branches are locked so.
+	LockModeExclusive LockMode = iota
+
+	// LockModeShared coexists with the shared locks of the other global
+	// transactions and conflicts with their exclusive ones, for the reads
+	// isolated by select for update or a global lock.
+	LockModeShared
+)
+
+// String string of lock mode
+func (m LockMode) String() string {
+	switch m {
+	case LockModeExclusive:
+		return "Exclusive"
+	case LockModeShared:
+		return "Shared"
+	default:
+		return fmt.Sprintf("%d", m)
+	}
+}
+
+// Compatible reports whether a lock of mode m may be held on a row on which
+// another global transaction holds a lock of mode other.
+func (m LockMode) Compatible(other LockMode) bool {
+	return m == LockModeShared && other == LockModeShared
+}
+
+// Covers reports whether a lock of mode m already held on a row by a global
+// transaction grants it a lock of mode other too.
+func (m LockMode) Covers(other LockMode) bool {
+	return m == LockModeExclusive || other == LockModeShared
+}
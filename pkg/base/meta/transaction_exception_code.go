@@ -80,6 +80,12 @@ const (
 
 	// Failed to holder exception code
 	FailedStore
+
+	// Client not authorized to operate on the global transaction exception code.
+	TransactionExceptionCodeUnauthorized
+
+	// Branch registration chosen as the victim of a lock wait deadlock exception code.
+	TransactionExceptionCodeDeadlock
 )
 
 // TransactionException
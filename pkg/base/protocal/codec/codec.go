@@ -19,9 +19,12 @@ package codec
 
 import (
 	"bytes"
+	"strings"
 )
 
 import (
+	"github.com/pkg/errors"
+
 	"vimagination.zapto.org/byteio"
 )
 
@@ -43,10 +46,25 @@ type Encoder func(in interface{}) []byte
 
 type Decoder func(in []byte) (interface{}, int)
 
+// ParseCodecType returns the serializer byte of a codec name, the empty name
+// stands for the default SEATA codec.
+func ParseCodecType(name string) (byte, error) {
+	switch strings.ToLower(name) {
+	case "", "seata":
+		return SEATA, nil
+	case "protobuf":
+		return PROTOBUF, nil
+	default:
+		return 0, errors.Errorf("not support codec %s", name)
+	}
+}
+
 func MessageEncoder(codecType byte, in interface{}) []byte {
 	switch codecType {
 	case SEATA:
 		return StarfishEncoder(in)
+	case PROTOBUF:
+		return ProtobufEncoder(in)
 	default:
 		log.Errorf("not support codecType, %s", codecType)
 		return nil
@@ -57,6 +75,8 @@ func MessageDecoder(codecType byte, in []byte) (interface{}, int) {
 	switch codecType {
 	case SEATA:
 		return StarfishDecoder(in)
+	case PROTOBUF:
+		return ProtobufDecoder(in)
 	default:
 		log.Errorf("not support codecType, %s", codecType)
 		return nil, 0
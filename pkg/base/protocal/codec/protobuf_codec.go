@@ -0,0 +1,827 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package codec
+
+import (
+	"encoding/binary"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+)
+
+// ProtobufEncoder encodes in as its type code followed by the protobuf message
+// described in starfish.proto.
+func ProtobufEncoder(in interface{}) []byte {
+	msg := in.(protocal.MessageTypeAware)
+	typeCode := msg.GetTypeCode()
+	body, ok := marshalMessage(msg)
+	if !ok {
+		log.Errorf("not support typeCode, %d", typeCode)
+		return nil
+	}
+	typeC := uint16(typeCode)
+	return append([]byte{byte(typeC >> 8), byte(typeC)}, body...)
+}
+
+func ProtobufDecoder(in []byte) (interface{}, int) {
+	if len(in) < 2 {
+		return nil, 0
+	}
+	typeCode := int16(binary.BigEndian.Uint16(in))
+	msg, err := unmarshalMessage(typeCode, in[2:])
+	if err != nil {
+		log.Errorf("decode protobuf message of typeCode %d failed: %v", typeCode, err)
+		return nil, 0
+	}
+	return msg, len(in)
+}
+
+func marshalMessage(msg protocal.MessageTypeAware) ([]byte, bool) {
+	switch m := msg.(type) {
+	case protocal.GlobalBeginRequest:
+		return marshalGlobalBeginRequest(m), true
+	case protocal.GlobalBeginResponse:
+		return marshalGlobalBeginResponse(m), true
+	case protocal.BranchCommitRequest:
+		return marshalBranchEndRequest(m.AbstractBranchEndRequest), true
+	case protocal.BranchCommitResponse:
+		return marshalBranchEndResponse(m.AbstractBranchEndResponse), true
+	case protocal.BranchRollbackRequest:
+		return marshalBranchEndRequest(m.AbstractBranchEndRequest), true
+	case protocal.BranchRollbackResponse:
+		return marshalBranchEndResponse(m.AbstractBranchEndResponse), true
+	case protocal.GlobalCommitRequest:
+		return marshalGlobalEndRequest(m.AbstractGlobalEndRequest), true
+	case protocal.GlobalCommitResponse:
+		return marshalGlobalEndResponse(m.AbstractGlobalEndResponse), true
+	case protocal.GlobalRollbackRequest:
+		return marshalGlobalEndRequest(m.AbstractGlobalEndRequest), true
+	case protocal.GlobalRollbackResponse:
+		return marshalGlobalEndResponse(m.AbstractGlobalEndResponse), true
+	case protocal.GlobalStatusRequest:
+		return marshalGlobalEndRequest(m.AbstractGlobalEndRequest), true
+	case protocal.GlobalStatusResponse:
+		return marshalGlobalEndResponse(m.AbstractGlobalEndResponse), true
+	case protocal.GlobalReportRequest:
+		return marshalGlobalReportRequest(m), true
+	case protocal.GlobalReportResponse:
+		return marshalGlobalEndResponse(m.AbstractGlobalEndResponse), true
+	case protocal.BranchRegisterRequest:
+		return marshalBranchRegisterRequest(m), true
+	case protocal.BranchRegisterResponse:
+		return marshalBranchRegisterResponse(m), true
+	case protocal.BranchReportRequest:
+		return marshalBranchReportRequest(m), true
+	case protocal.BranchReportResponse:
+		return marshalTransactionResponse(m.AbstractTransactionResponse), true
+	case protocal.GlobalLockQueryRequest:
+		return marshalBranchRegisterRequest(m.BranchRegisterRequest), true
+	case protocal.GlobalLockQueryResponse:
+		return marshalGlobalLockQueryResponse(m), true
+	case protocal.MergedWarpMessage:
+		return marshalMergedWarpMessage(m)
+	case protocal.MergeResultMessage:
+		return marshalMergeResultMessage(m)
+	case protocal.RegisterTMRequest:
+		return marshalIdentifyRequest(m.AbstractIdentifyRequest), true
+	case protocal.RegisterTMResponse:
+		return marshalIdentifyResponse(m.AbstractIdentifyResponse), true
+	case protocal.RegisterRMRequest:
+		return marshalRegisterRMRequest(m), true
+	case protocal.RegisterRMResponse:
+		return marshalIdentifyResponse(m.AbstractIdentifyResponse), true
+	case protocal.UndoLogDeleteRequest:
+		return marshalUndoLogDeleteRequest(m), true
+	default:
+		return nil, false
+	}
+}
+
+func unmarshalMessage(typeCode int16, in []byte) (protocal.MessageTypeAware, error) {
+	fields, err := readProtoFields(in)
+	if err != nil {
+		return nil, err
+	}
+	switch typeCode {
+	case protocal.TypeGlobalBegin:
+		return unmarshalGlobalBeginRequest(fields), nil
+	case protocal.TypeGlobalBeginResult:
+		return unmarshalGlobalBeginResponse(fields)
+	case protocal.TypeBranchCommit:
+		return protocal.BranchCommitRequest{AbstractBranchEndRequest: unmarshalBranchEndRequest(fields)}, nil
+	case protocal.TypeBranchCommitResult:
+		resp, err := unmarshalBranchEndResponse(fields)
+		return protocal.BranchCommitResponse{AbstractBranchEndResponse: resp}, err
+	case protocal.TypeBranchRollback:
+		return protocal.BranchRollbackRequest{AbstractBranchEndRequest: unmarshalBranchEndRequest(fields)}, nil
+	case protocal.TypeBranchRollbackResult:
+		resp, err := unmarshalBranchEndResponse(fields)
+		return protocal.BranchRollbackResponse{AbstractBranchEndResponse: resp}, err
+	case protocal.TypeGlobalCommit:
+		return protocal.GlobalCommitRequest{AbstractGlobalEndRequest: unmarshalGlobalEndRequest(fields)}, nil
+	case protocal.TypeGlobalCommitResult:
+		resp, err := unmarshalGlobalEndResponse(fields)
+		return protocal.GlobalCommitResponse{AbstractGlobalEndResponse: resp}, err
+	case protocal.TypeGlobalRollback:
+		return protocal.GlobalRollbackRequest{AbstractGlobalEndRequest: unmarshalGlobalEndRequest(fields)}, nil
+	case protocal.TypeGlobalRollbackResult:
+		resp, err := unmarshalGlobalEndResponse(fields)
+		return protocal.GlobalRollbackResponse{AbstractGlobalEndResponse: resp}, err
+	case protocal.TypeGlobalStatus:
+		return protocal.GlobalStatusRequest{AbstractGlobalEndRequest: unmarshalGlobalEndRequest(fields)}, nil
+	case protocal.TypeGlobalStatusResult:
+		resp, err := unmarshalGlobalEndResponse(fields)
+		return protocal.GlobalStatusResponse{AbstractGlobalEndResponse: resp}, err
+	case protocal.TypeGlobalReport:
+		return unmarshalGlobalReportRequest(fields)
+	case protocal.TypeGlobalReportResult:
+		resp, err := unmarshalGlobalEndResponse(fields)
+		return protocal.GlobalReportResponse{AbstractGlobalEndResponse: resp}, err
+	case protocal.TypeBranchRegister:
+		return unmarshalBranchRegisterRequest(fields), nil
+	case protocal.TypeBranchRegisterResult:
+		return unmarshalBranchRegisterResponse(fields)
+	case protocal.TypeBranchStatusReport:
+		return unmarshalBranchReportRequest(fields), nil
+	case protocal.TypeBranchStatusReportResult:
+		resp, err := unmarshalTransactionResponse(fields)
+		return protocal.BranchReportResponse{AbstractTransactionResponse: resp}, err
+	case protocal.TypeGlobalLockQuery:
+		return protocal.GlobalLockQueryRequest{BranchRegisterRequest: unmarshalBranchRegisterRequest(fields)}, nil
+	case protocal.TypeGlobalLockQueryResult:
+		return unmarshalGlobalLockQueryResponse(fields)
+	case protocal.TypeStarfishMerge:
+		return unmarshalMergedWarpMessage(fields)
+	case protocal.TypeStarfishMergeResult:
+		return unmarshalMergeResultMessage(fields)
+	case protocal.TypeRegClt:
+		return protocal.RegisterTMRequest{AbstractIdentifyRequest: unmarshalIdentifyRequest(fields)}, nil
+	case protocal.TypeRegCltResult:
+		resp, err := unmarshalIdentifyResponse(fields)
+		return protocal.RegisterTMResponse{AbstractIdentifyResponse: resp}, err
+	case protocal.TypeRegRm:
+		return unmarshalRegisterRMRequest(fields)
+	case protocal.TypeRegRmResult:
+		resp, err := unmarshalIdentifyResponse(fields)
+		return protocal.RegisterRMResponse{AbstractIdentifyResponse: resp}, err
+	case protocal.TypeRmDeleteUndolog:
+		return unmarshalUndoLogDeleteRequest(fields), nil
+	default:
+		return nil, errors.Errorf("not support typeCode, %d", typeCode)
+	}
+}
+
+func marshalResultMessage(msg protocal.AbstractResultMessage) []byte {
+	var b protoBuffer
+	b.appendVarint(1, uint64(msg.ResultCode))
+	b.appendString(2, msg.Msg)
+	return b
+}
+
+func unmarshalResultMessage(in []byte) (protocal.AbstractResultMessage, error) {
+	var msg protocal.AbstractResultMessage
+	fields, err := readProtoFields(in)
+	if err != nil {
+		return msg, err
+	}
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			msg.ResultCode = protocal.ResultCode(field.varint)
+		case 2:
+			msg.Msg = string(field.bytes)
+		}
+	}
+	return msg, nil
+}
+
+func marshalTransactionResponse(resp protocal.AbstractTransactionResponse) []byte {
+	var b protoBuffer
+	b.appendMessage(1, marshalResultMessage(resp.AbstractResultMessage))
+	b.appendVarint(2, uint64(resp.TransactionExceptionCode))
+	return b
+}
+
+func unmarshalTransactionResponse(fields []protoField) (protocal.AbstractTransactionResponse, error) {
+	var (
+		resp protocal.AbstractTransactionResponse
+		err  error
+	)
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			resp.AbstractResultMessage, err = unmarshalResultMessage(field.bytes)
+		case 2:
+			resp.TransactionExceptionCode = meta.TransactionExceptionCode(field.varint)
+		}
+	}
+	return resp, err
+}
+
+// unmarshalNestedTransactionResponse decodes the TransactionResponse nested
+// in field 1 of the response messages.
+func unmarshalNestedTransactionResponse(in []byte) (protocal.AbstractTransactionResponse, error) {
+	fields, err := readProtoFields(in)
+	if err != nil {
+		return protocal.AbstractTransactionResponse{}, err
+	}
+	return unmarshalTransactionResponse(fields)
+}
+
+func marshalIdentifyRequest(req protocal.AbstractIdentifyRequest) []byte {
+	var b protoBuffer
+	b.appendString(1, req.Version)
+	b.appendString(2, req.ApplicationID)
+	b.appendString(3, req.TransactionServiceGroup)
+	b.appendBytes(4, req.ExtraData)
+	return b
+}
+
+func unmarshalIdentifyRequest(fields []protoField) protocal.AbstractIdentifyRequest {
+	var req protocal.AbstractIdentifyRequest
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			req.Version = string(field.bytes)
+		case 2:
+			req.ApplicationID = string(field.bytes)
+		case 3:
+			req.TransactionServiceGroup = string(field.bytes)
+		case 4:
+			req.ExtraData = copyBytes(field.bytes)
+		}
+	}
+	return req
+}
+
+func marshalIdentifyResponse(resp protocal.AbstractIdentifyResponse) []byte {
+	var b protoBuffer
+	b.appendMessage(1, marshalResultMessage(resp.AbstractResultMessage))
+	b.appendString(2, resp.Version)
+	b.appendBytes(3, resp.ExtraData)
+	b.appendBool(4, resp.Identified)
+	return b
+}
+
+func unmarshalIdentifyResponse(fields []protoField) (protocal.AbstractIdentifyResponse, error) {
+	var (
+		resp protocal.AbstractIdentifyResponse
+		err  error
+	)
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			resp.AbstractResultMessage, err = unmarshalResultMessage(field.bytes)
+		case 2:
+			resp.Version = string(field.bytes)
+		case 3:
+			resp.ExtraData = copyBytes(field.bytes)
+		case 4:
+			resp.Identified = field.varint != 0
+		}
+	}
+	return resp, err
+}
+
+func marshalRegisterRMRequest(req protocal.RegisterRMRequest) []byte {
+	var b protoBuffer
+	b.appendMessage(1, marshalIdentifyRequest(req.AbstractIdentifyRequest))
+	b.appendString(2, req.ResourceIDs)
+	return b
+}
+
+func unmarshalRegisterRMRequest(fields []protoField) (protocal.RegisterRMRequest, error) {
+	var req protocal.RegisterRMRequest
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			identifyFields, err := readProtoFields(field.bytes)
+			if err != nil {
+				return req, err
+			}
+			req.AbstractIdentifyRequest = unmarshalIdentifyRequest(identifyFields)
+		case 2:
+			req.ResourceIDs = string(field.bytes)
+		}
+	}
+	return req, nil
+}
+
+func marshalGlobalBeginRequest(req protocal.GlobalBeginRequest) []byte {
+	var b protoBuffer
+	b.appendInt(1, int64(req.Timeout))
+	b.appendString(2, req.TransactionName)
+	return b
+}
+
+func unmarshalGlobalBeginRequest(fields []protoField) protocal.GlobalBeginRequest {
+	var req protocal.GlobalBeginRequest
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			req.Timeout = int32(field.varint)
+		case 2:
+			req.TransactionName = string(field.bytes)
+		}
+	}
+	return req
+}
+
+func marshalGlobalBeginResponse(resp protocal.GlobalBeginResponse) []byte {
+	var b protoBuffer
+	b.appendMessage(1, marshalTransactionResponse(resp.AbstractTransactionResponse))
+	b.appendString(2, resp.Xid)
+	b.appendBytes(3, resp.ExtraData)
+	return b
+}
+
+func unmarshalGlobalBeginResponse(fields []protoField) (protocal.GlobalBeginResponse, error) {
+	var (
+		resp protocal.GlobalBeginResponse
+		err  error
+	)
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			resp.AbstractTransactionResponse, err = unmarshalNestedTransactionResponse(field.bytes)
+		case 2:
+			resp.Xid = string(field.bytes)
+		case 3:
+			resp.ExtraData = copyBytes(field.bytes)
+		}
+	}
+	return resp, err
+}
+
+func marshalGlobalEndRequest(req protocal.AbstractGlobalEndRequest) []byte {
+	var b protoBuffer
+	b.appendString(1, req.XID)
+	b.appendBytes(2, req.ExtraData)
+	return b
+}
+
+func unmarshalGlobalEndRequest(fields []protoField) protocal.AbstractGlobalEndRequest {
+	var req protocal.AbstractGlobalEndRequest
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			req.XID = string(field.bytes)
+		case 2:
+			req.ExtraData = copyBytes(field.bytes)
+		}
+	}
+	return req
+}
+
+func marshalGlobalEndResponse(resp protocal.AbstractGlobalEndResponse) []byte {
+	var b protoBuffer
+	b.appendMessage(1, marshalTransactionResponse(resp.AbstractTransactionResponse))
+	b.appendInt(2, int64(resp.GlobalStatus))
+	return b
+}
+
+func unmarshalGlobalEndResponse(fields []protoField) (protocal.AbstractGlobalEndResponse, error) {
+	var (
+		resp protocal.AbstractGlobalEndResponse
+		err  error
+	)
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			resp.AbstractTransactionResponse, err = unmarshalNestedTransactionResponse(field.bytes)
+		case 2:
+			resp.GlobalStatus = meta.GlobalStatus(int32(field.varint))
+		}
+	}
+	return resp, err
+}
+
+func marshalGlobalReportRequest(req protocal.GlobalReportRequest) []byte {
+	var b protoBuffer
+	b.appendMessage(1, marshalGlobalEndRequest(req.AbstractGlobalEndRequest))
+	b.appendInt(2, int64(req.GlobalStatus))
+	return b
+}
+
+func unmarshalGlobalReportRequest(fields []protoField) (protocal.GlobalReportRequest, error) {
+	var req protocal.GlobalReportRequest
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			globalEndFields, err := readProtoFields(field.bytes)
+			if err != nil {
+				return req, err
+			}
+			req.AbstractGlobalEndRequest = unmarshalGlobalEndRequest(globalEndFields)
+		case 2:
+			req.GlobalStatus = meta.GlobalStatus(int32(field.varint))
+		}
+	}
+	return req, nil
+}
+
+func marshalBranchRegisterRequest(req protocal.BranchRegisterRequest) []byte {
+	var b protoBuffer
+	b.appendString(1, req.XID)
+	b.appendVarint(2, uint64(req.BranchType))
+	b.appendString(3, req.ResourceID)
+	b.appendString(4, req.LockKey)
+	b.appendBytes(5, req.ApplicationData)
+	b.appendVarint(6, uint64(req.LockMode))
+	return b
+}
+
+func unmarshalBranchRegisterRequest(fields []protoField) protocal.BranchRegisterRequest {
+	var req protocal.BranchRegisterRequest
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			req.XID = string(field.bytes)
+		case 2:
+			req.BranchType = meta.BranchType(field.varint)
+		case 3:
+			req.ResourceID = string(field.bytes)
+		case 4:
+			req.LockKey = string(field.bytes)
+		case 5:
+			req.ApplicationData = copyBytes(field.bytes)
+		case 6:
+			req.LockMode = meta.LockMode(field.varint)
+		}
+	}
+	return req
+}
+
+func marshalBranchRegisterResponse(resp protocal.BranchRegisterResponse) []byte {
+	var b protoBuffer
+	b.appendMessage(1, marshalTransactionResponse(resp.AbstractTransactionResponse))
+	b.appendInt(2, resp.BranchID)
+	return b
+}
+
+func unmarshalBranchRegisterResponse(fields []protoField) (protocal.BranchRegisterResponse, error) {
+	var (
+		resp protocal.BranchRegisterResponse
+		err  error
+	)
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			resp.AbstractTransactionResponse, err = unmarshalNestedTransactionResponse(field.bytes)
+		case 2:
+			resp.BranchID = int64(field.varint)
+		}
+	}
+	return resp, err
+}
+
+func marshalBranchReportRequest(req protocal.BranchReportRequest) []byte {
+	var b protoBuffer
+	b.appendString(1, req.XID)
+	b.appendInt(2, req.BranchID)
+	b.appendString(3, req.ResourceID)
+	b.appendVarint(4, uint64(req.Status))
+	b.appendBytes(5, req.ApplicationData)
+	b.appendVarint(6, uint64(req.BranchType))
+	return b
+}
+
+func unmarshalBranchReportRequest(fields []protoField) protocal.BranchReportRequest {
+	var req protocal.BranchReportRequest
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			req.XID = string(field.bytes)
+		case 2:
+			req.BranchID = int64(field.varint)
+		case 3:
+			req.ResourceID = string(field.bytes)
+		case 4:
+			req.Status = meta.BranchStatus(field.varint)
+		case 5:
+			req.ApplicationData = copyBytes(field.bytes)
+		case 6:
+			req.BranchType = meta.BranchType(field.varint)
+		}
+	}
+	return req
+}
+
+func marshalBranchEndRequest(req protocal.AbstractBranchEndRequest) []byte {
+	var b protoBuffer
+	b.appendString(1, req.XID)
+	b.appendInt(2, req.BranchID)
+	b.appendVarint(3, uint64(req.BranchType))
+	b.appendString(4, req.ResourceID)
+	b.appendBytes(5, req.ApplicationData)
+	return b
+}
+
+func unmarshalBranchEndRequest(fields []protoField) protocal.AbstractBranchEndRequest {
+	var req protocal.AbstractBranchEndRequest
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			req.XID = string(field.bytes)
+		case 2:
+			req.BranchID = int64(field.varint)
+		case 3:
+			req.BranchType = meta.BranchType(field.varint)
+		case 4:
+			req.ResourceID = string(field.bytes)
+		case 5:
+			req.ApplicationData = copyBytes(field.bytes)
+		}
+	}
+	return req
+}
+
+func marshalBranchEndResponse(resp protocal.AbstractBranchEndResponse) []byte {
+	var b protoBuffer
+	b.appendMessage(1, marshalTransactionResponse(resp.AbstractTransactionResponse))
+	b.appendString(2, resp.XID)
+	b.appendInt(3, resp.BranchID)
+	b.appendVarint(4, uint64(resp.BranchStatus))
+	return b
+}
+
+func unmarshalBranchEndResponse(fields []protoField) (protocal.AbstractBranchEndResponse, error) {
+	var (
+		resp protocal.AbstractBranchEndResponse
+		err  error
+	)
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			resp.AbstractTransactionResponse, err = unmarshalNestedTransactionResponse(field.bytes)
+		case 2:
+			resp.XID = string(field.bytes)
+		case 3:
+			resp.BranchID = int64(field.varint)
+		case 4:
+			resp.BranchStatus = meta.BranchStatus(field.varint)
+		}
+	}
+	return resp, err
+}
+
+func marshalGlobalLockQueryResponse(resp protocal.GlobalLockQueryResponse) []byte {
+	var b protoBuffer
+	b.appendMessage(1, marshalTransactionResponse(resp.AbstractTransactionResponse))
+	b.appendBool(2, resp.Lockable)
+	return b
+}
+
+func unmarshalGlobalLockQueryResponse(fields []protoField) (protocal.GlobalLockQueryResponse, error) {
+	var (
+		resp protocal.GlobalLockQueryResponse
+		err  error
+	)
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			resp.AbstractTransactionResponse, err = unmarshalNestedTransactionResponse(field.bytes)
+		case 2:
+			resp.Lockable = field.varint != 0
+		}
+	}
+	return resp, err
+}
+
+func marshalUndoLogDeleteRequest(req protocal.UndoLogDeleteRequest) []byte {
+	var b protoBuffer
+	b.appendString(1, req.ResourceID)
+	b.appendInt(2, int64(req.SaveDays))
+	b.appendVarint(3, uint64(req.BranchType))
+	return b
+}
+
+func unmarshalUndoLogDeleteRequest(fields []protoField) protocal.UndoLogDeleteRequest {
+	var req protocal.UndoLogDeleteRequest
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			req.ResourceID = string(field.bytes)
+		case 2:
+			req.SaveDays = int16(field.varint)
+		case 3:
+			req.BranchType = meta.BranchType(field.varint)
+		}
+	}
+	return req
+}
+
+func marshalTypedMessages(b *protoBuffer, msgs []protocal.MessageTypeAware) bool {
+	for _, msg := range msgs {
+		body, ok := marshalMessage(msg)
+		if !ok {
+			log.Errorf("not support typeCode, %d", msg.GetTypeCode())
+			return false
+		}
+		var typed protoBuffer
+		typed.appendInt(1, int64(msg.GetTypeCode()))
+		typed.appendBytes(2, body)
+		b.appendMessage(1, typed)
+	}
+	return true
+}
+
+func unmarshalTypedMessage(in []byte) (protocal.MessageTypeAware, error) {
+	fields, err := readProtoFields(in)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		typeCode int16
+		body     []byte
+	)
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			typeCode = int16(field.varint)
+		case 2:
+			body = field.bytes
+		}
+	}
+	return unmarshalMessage(typeCode, body)
+}
+
+func marshalMergedWarpMessage(req protocal.MergedWarpMessage) ([]byte, bool) {
+	var b protoBuffer
+	if !marshalTypedMessages(&b, req.Msgs) {
+		return nil, false
+	}
+	var msgIDs []byte
+	for _, msgID := range req.MsgIDs {
+		msgIDs = protowire.AppendVarint(msgIDs, uint64(msgID))
+	}
+	b.appendBytes(2, msgIDs)
+	return b, true
+}
+
+func unmarshalMergedWarpMessage(fields []protoField) (protocal.MergedWarpMessage, error) {
+	req := protocal.MergedWarpMessage{
+		Msgs:   make([]protocal.MessageTypeAware, 0),
+		MsgIDs: make([]int32, 0),
+	}
+	for _, field := range fields {
+		switch field.num {
+		case 1:
+			msg, err := unmarshalTypedMessage(field.bytes)
+			if err != nil {
+				return req, err
+			}
+			req.Msgs = append(req.Msgs, msg)
+		case 2:
+			// repeated scalars may arrive packed or one per field
+			if field.typ == protowire.VarintType {
+				req.MsgIDs = append(req.MsgIDs, int32(field.varint))
+				continue
+			}
+			for packed := field.bytes; len(packed) > 0; {
+				msgID, n := protowire.ConsumeVarint(packed)
+				if n < 0 {
+					return req, protowire.ParseError(n)
+				}
+				req.MsgIDs = append(req.MsgIDs, int32(msgID))
+				packed = packed[n:]
+			}
+		}
+	}
+	return req, nil
+}
+
+func marshalMergeResultMessage(resp protocal.MergeResultMessage) ([]byte, bool) {
+	var b protoBuffer
+	if !marshalTypedMessages(&b, resp.Msgs) {
+		return nil, false
+	}
+	return b, true
+}
+
+func unmarshalMergeResultMessage(fields []protoField) (protocal.MergeResultMessage, error) {
+	resp := protocal.MergeResultMessage{Msgs: make([]protocal.MessageTypeAware, 0)}
+	for _, field := range fields {
+		if field.num != 1 {
+			continue
+		}
+		msg, err := unmarshalTypedMessage(field.bytes)
+		if err != nil {
+			return resp, err
+		}
+		resp.Msgs = append(resp.Msgs, msg)
+	}
+	return resp, nil
+}
+
+// protoBuffer appends the fields of a protobuf message, scalars holding the
+// zero value are omitted as proto3 does.
+type protoBuffer []byte
+
+func (b *protoBuffer) appendVarint(num protowire.Number, v uint64) {
+	if v == 0 {
+		return
+	}
+	*b = protowire.AppendTag(*b, num, protowire.VarintType)
+	*b = protowire.AppendVarint(*b, v)
+}
+
+func (b *protoBuffer) appendInt(num protowire.Number, v int64) {
+	b.appendVarint(num, uint64(v))
+}
+
+func (b *protoBuffer) appendBool(num protowire.Number, v bool) {
+	if v {
+		b.appendVarint(num, 1)
+	}
+}
+
+func (b *protoBuffer) appendString(num protowire.Number, v string) {
+	if v == "" {
+		return
+	}
+	*b = protowire.AppendTag(*b, num, protowire.BytesType)
+	*b = protowire.AppendString(*b, v)
+}
+
+func (b *protoBuffer) appendBytes(num protowire.Number, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	*b = protowire.AppendTag(*b, num, protowire.BytesType)
+	*b = protowire.AppendBytes(*b, v)
+}
+
+// appendMessage always appends the nested message, even an empty one.
+func (b *protoBuffer) appendMessage(num protowire.Number, v []byte) {
+	*b = protowire.AppendTag(*b, num, protowire.BytesType)
+	*b = protowire.AppendBytes(*b, v)
+}
+
+type protoField struct {
+	num    protowire.Number
+	typ    protowire.Type
+	varint uint64
+	bytes  []byte
+}
+
+// readProtoFields splits a protobuf message into its varint and length
+// delimited fields, the fields of other wire types are skipped.
+func readProtoFields(in []byte) ([]protoField, error) {
+	fields := make([]protoField, 0)
+	for len(in) > 0 {
+		num, typ, n := protowire.ConsumeTag(in)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		in = in[n:]
+		field := protoField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			field.varint, n = protowire.ConsumeVarint(in)
+		case protowire.BytesType:
+			field.bytes, n = protowire.ConsumeBytes(in)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, in)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		in = in[n:]
+		if typ == protowire.VarintType || typ == protowire.BytesType {
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+func copyBytes(in []byte) []byte {
+	if len(in) == 0 {
+		return nil
+	}
+	return append([]byte(nil), in...)
+}
@@ -0,0 +1,119 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package codec
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+)
+
+func TestProtobufCodec(t *testing.T) {
+	transactionResponse := protocal.AbstractTransactionResponse{
+		AbstractResultMessage: protocal.AbstractResultMessage{
+			ResultCode: protocal.ResultCodeFailed,
+			Msg:        "lock conflict",
+		},
+		TransactionExceptionCode: meta.TransactionExceptionCodeLockKeyConflict,
+	}
+	branchEnd := protocal.AbstractBranchEndRequest{
+		XID:             "127.0.0.1:8091:2000042948",
+		BranchID:        2000042936,
+		BranchType:      meta.BranchTypeAT,
+		ResourceID:      "jdbc:mysql://mysql:3306/orders",
+		ApplicationData: []byte(`{"autoCommit":false}`),
+	}
+	messages := []protocal.MessageTypeAware{
+		protocal.GlobalBeginRequest{Timeout: 60000, TransactionName: "CreateOrder"},
+		protocal.GlobalBeginResponse{AbstractTransactionResponse: transactionResponse, Xid: "127.0.0.1:8091:2000042948"},
+		protocal.GlobalCommitRequest{AbstractGlobalEndRequest: protocal.AbstractGlobalEndRequest{XID: "127.0.0.1:8091:2000042948"}},
+		protocal.GlobalRollbackResponse{AbstractGlobalEndResponse: protocal.AbstractGlobalEndResponse{
+			AbstractTransactionResponse: transactionResponse,
+			GlobalStatus:                meta.GlobalStatusRollbackRetrying,
+		}},
+		protocal.GlobalReportRequest{
+			AbstractGlobalEndRequest: protocal.AbstractGlobalEndRequest{XID: "127.0.0.1:8091:2000042948"},
+			GlobalStatus:             meta.GlobalStatusCommitted,
+		},
+		protocal.BranchRegisterRequest{
+			XID:        "127.0.0.1:8091:2000042948",
+			BranchType: meta.BranchTypeAT,
+			ResourceID: "jdbc:mysql://mysql:3306/orders",
+			LockKey:    "so_master:1,2",
+		},
+		protocal.BranchRegisterResponse{BranchID: 2000042936},
+		protocal.BranchReportRequest{XID: "127.0.0.1:8091:2000042948", BranchID: 2000042936, Status: meta.BranchStatusPhaseOneFailed},
+		protocal.BranchCommitRequest{AbstractBranchEndRequest: branchEnd},
+		protocal.BranchRollbackResponse{AbstractBranchEndResponse: protocal.AbstractBranchEndResponse{
+			XID:          "127.0.0.1:8091:2000042948",
+			BranchID:     2000042936,
+			BranchStatus: meta.BranchStatusPhaseTwoRolledBack,
+		}},
+		protocal.GlobalLockQueryRequest{BranchRegisterRequest: protocal.BranchRegisterRequest{
+			LockKey:  "so_master:1",
+			LockMode: meta.LockModeShared,
+		}},
+		protocal.GlobalLockQueryResponse{Lockable: true},
+		protocal.RegisterTMRequest{AbstractIdentifyRequest: protocal.AbstractIdentifyRequest{
+			Version:                 "1.0.0",
+			ApplicationID:           "order-svc",
+			TransactionServiceGroup: "my_test_tx_group",
+		}},
+		protocal.RegisterRMRequest{
+			AbstractIdentifyRequest: protocal.AbstractIdentifyRequest{ApplicationID: "order-svc"},
+			ResourceIDs:             "jdbc:mysql://mysql:3306/orders",
+		},
+		protocal.RegisterRMResponse{AbstractIdentifyResponse: protocal.AbstractIdentifyResponse{Identified: true, Version: "1.0.0"}},
+		protocal.UndoLogDeleteRequest{ResourceID: "jdbc:mysql://mysql:3306/orders", SaveDays: 7, BranchType: meta.BranchTypeAT},
+		protocal.MergedWarpMessage{
+			Msgs: []protocal.MessageTypeAware{
+				protocal.GlobalBeginRequest{Timeout: 60000},
+				protocal.BranchCommitRequest{AbstractBranchEndRequest: branchEnd},
+			},
+			MsgIDs: []int32{1, -2},
+		},
+		protocal.MergeResultMessage{Msgs: []protocal.MessageTypeAware{protocal.BranchReportResponse{}}},
+	}
+	for _, msg := range messages {
+		decoded, n := MessageDecoder(PROTOBUF, MessageEncoder(PROTOBUF, msg))
+		assert.NotZero(t, n)
+		assert.Equal(t, msg, decoded)
+	}
+}
+
+func TestProtobufDecoder_UnpackedMsgIDs(t *testing.T) {
+	var body protoBuffer
+	body.appendInt(2, 7)
+	body.appendInt(2, 8)
+	in := append([]byte{0, byte(protocal.TypeStarfishMerge)}, body...)
+
+	decoded, _ := ProtobufDecoder(in)
+	assert.Equal(t, []int32{7, 8}, decoded.(protocal.MergedWarpMessage).MsgIDs)
+
+	_, n := ProtobufDecoder(append([]byte{0, byte(protocal.TypeGlobalBegin)}, protowire.AppendTag(nil, 1, protowire.BytesType)...))
+	assert.Zero(t, n)
+}
@@ -0,0 +1,60 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package codec
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+)
+
+func TestSeataCodec_LockMode(t *testing.T) {
+	shared := protocal.BranchRegisterRequest{
+		XID:        "127.0.0.1:8091:2000042948",
+		BranchType: meta.BranchTypeAT,
+		ResourceID: "jdbc:mysql://mysql:3306/orders",
+		LockKey:    "so_master:1,2",
+		LockMode:   meta.LockModeShared,
+	}
+	exclusive := shared
+	exclusive.BranchType, exclusive.LockMode = meta.BranchTypeXA, meta.LockModeExclusive
+	messages := []protocal.MessageTypeAware{
+		shared,
+		exclusive,
+		protocal.GlobalLockQueryRequest{BranchRegisterRequest: shared},
+		protocal.MergedWarpMessage{
+			Msgs: []protocal.MessageTypeAware{shared, protocal.GlobalLockQueryRequest{BranchRegisterRequest: exclusive}},
+		},
+	}
+	for _, msg := range messages {
+		decoded, n := MessageDecoder(SEATA, MessageEncoder(SEATA, msg))
+		assert.NotZero(t, n)
+		assert.Equal(t, msg, decoded)
+	}
+
+	// an exclusive request keeps the layout of the versions without lock modes.
+	encoded := BranchRegisterRequestEncoder(exclusive)
+	assert.Equal(t, byte(meta.BranchTypeXA), encoded[2+len(exclusive.XID)])
+}
@@ -459,7 +459,10 @@ func BranchRegisterRequestDecoder(in []byte) (interface{}, int) {
 
 	branchType, _ := r.ReadByte()
 	totalReadN += 1
-	msg.BranchType = meta.BranchType(branchType)
+	msg.BranchType = meta.BranchType(branchType &^ sharedLockModeFlag)
+	if branchType&sharedLockModeFlag != 0 {
+		msg.LockMode = meta.LockModeShared
+	}
 
 	length16, readN, _ = r.ReadUint16()
 	totalReadN += readN
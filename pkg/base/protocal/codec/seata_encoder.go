@@ -26,10 +26,16 @@ import (
 )
 
 import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
 	"github.com/transaction-mesh/starfish/pkg/base/protocal"
 	"github.com/transaction-mesh/starfish/pkg/util/log"
 )
 
+// sharedLockModeFlag marks the branch type byte of a BranchRegisterRequest or
+// GlobalLockQueryRequest asking for shared locks. The exclusive requests keep
+// the layout of the earlier versions, which know no lock mode.
+const sharedLockModeFlag = 0x80
+
 func AbstractResultMessageEncoder(in interface{}) []byte {
 	var (
 		zero16 int16 = 0
@@ -344,7 +350,13 @@ func BranchRegisterRequestEncoder(in interface{}) []byte {
 	)
 	w := byteio.BigEndianWriter{Writer: &b}
 
-	req, _ := in.(protocal.BranchRegisterRequest)
+	var req protocal.BranchRegisterRequest
+	switch msg := in.(type) {
+	case protocal.BranchRegisterRequest:
+		req = msg
+	case protocal.GlobalLockQueryRequest:
+		req = msg.BranchRegisterRequest
+	}
 
 	if req.XID != "" {
 		w.WriteInt16(int16(len(req.XID)))
@@ -353,7 +365,11 @@ func BranchRegisterRequestEncoder(in interface{}) []byte {
 		w.WriteInt16(zero16)
 	}
 
-	w.WriteByte(byte(req.BranchType))
+	branchType := byte(req.BranchType)
+	if req.LockMode == meta.LockModeShared {
+		branchType |= sharedLockModeFlag
+	}
+	w.WriteByte(branchType)
 
 	if req.ResourceID != "" {
 		w.WriteInt16(int16(len(req.ResourceID)))
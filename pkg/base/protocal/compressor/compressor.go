@@ -0,0 +1,102 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compressor
+
+import (
+	"strings"
+	"sync"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+// The compress type is carried in the Compress byte of the rpc package header,
+// the values follow the ones of the java implementation.
+const (
+	None   = byte(0)
+	Gzip   = byte(1)
+	LZ4    = byte(5)
+	Zstd   = byte(7)
+	Snappy = byte(8)
+)
+
+// DefaultThreshold is the size in bytes below which message bodies are sent
+// uncompressed.
+const DefaultThreshold = 4096
+
+// ErrTooLarge is returned by Decompress when the decompressed data would be
+// longer than the limit it was given.
+var ErrTooLarge = errors.New("decompressed data exceeds the length limit")
+
+// Compressor compresses the body of rpc packages.
+type Compressor interface {
+	Compress(in []byte) ([]byte, error)
+	// Decompress returns ErrTooLarge rather than decompressing more than
+	// maxLength bytes.
+	Decompress(in []byte, maxLength int) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = make(map[byte]Compressor)
+	names         = make(map[string]byte)
+)
+
+func init() {
+	Register("gzip", Gzip, gzipCompressor{})
+	Register("lz4", LZ4, lz4Compressor{})
+	Register("zstd", Zstd, newZstdCompressor())
+	Register("snappy", Snappy, snappyCompressor{})
+}
+
+// Register makes compressor available under name and compressType, it
+// replaces the compressor registered before under the same compressType.
+func Register(name string, compressType byte, compressor Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[compressType] = compressor
+	names[strings.ToLower(name)] = compressType
+}
+
+// GetCompressor returns the compressor of a package header compress type.
+func GetCompressor(compressType byte) (Compressor, error) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	compressor, ok := compressors[compressType]
+	if !ok {
+		return nil, errors.Errorf("not support compress type %d", compressType)
+	}
+	return compressor, nil
+}
+
+// ParseCompressType returns the compress type of a compressor name, the empty
+// name and "none" disable compression.
+func ParseCompressType(name string) (byte, error) {
+	name = strings.ToLower(name)
+	if name == "" || name == "none" {
+		return None, nil
+	}
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	compressType, ok := names[name]
+	if !ok {
+		return None, errors.Errorf("not support compressor %s", name)
+	}
+	return compressType, nil
+}
@@ -0,0 +1,85 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compressor
+
+import (
+	"bytes"
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressors(t *testing.T) {
+	data := bytes.Repeat([]byte("127.0.0.1:8091:2000042948 jdbc:mysql://mysql:3306/orders "), 200)
+	for _, name := range []string{"gzip", "zstd", "snappy", "lz4"} {
+		compressType, err := ParseCompressType(name)
+		assert.Nil(t, err)
+		compressor, err := GetCompressor(compressType)
+		assert.Nil(t, err)
+
+		compressed, err := compressor.Compress(data)
+		assert.Nil(t, err, name)
+		assert.True(t, len(compressed) < len(data), name)
+
+		decompressed, err := compressor.Decompress(compressed, len(data))
+		assert.Nil(t, err, name)
+		assert.Equal(t, data, decompressed, name)
+
+		_, err = compressor.Decompress([]byte{0xff, 0xff, 0xff, 0xff, 0xff}, len(data))
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestCompressors_Oversized(t *testing.T) {
+	// a few kilobytes decompressing to 16MiB
+	data := make([]byte, 16<<20)
+	for _, name := range []string{"gzip", "zstd", "snappy", "lz4"} {
+		compressType, _ := ParseCompressType(name)
+		compressor, _ := GetCompressor(compressType)
+
+		compressed, err := compressor.Compress(data)
+		assert.Nil(t, err, name)
+
+		_, err = compressor.Decompress(compressed, 4096)
+		assert.Equal(t, ErrTooLarge, err, name)
+		_, err = compressor.Decompress(compressed, len(data)-1)
+		assert.Equal(t, ErrTooLarge, err, name)
+
+		decompressed, err := compressor.Decompress(compressed, len(data))
+		assert.Nil(t, err, name)
+		assert.Equal(t, len(data), len(decompressed), name)
+	}
+}
+
+func TestParseCompressType(t *testing.T) {
+	compressType, err := ParseCompressType("")
+	assert.Nil(t, err)
+	assert.Equal(t, None, compressType)
+
+	compressType, err = ParseCompressType("ZSTD")
+	assert.Nil(t, err)
+	assert.Equal(t, Zstd, compressType)
+
+	_, err = ParseCompressType("brotli")
+	assert.NotNil(t, err)
+
+	_, err = GetCompressor(byte(3))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,146 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compressor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+import (
+	lz4 "github.com/bkaradzic/go-lz4"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(in []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(in); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(in []byte, maxLength int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(maxLength)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxLength {
+		return nil, ErrTooLarge
+	}
+	return out, nil
+}
+
+// lz4Compressor writes lz4 blocks prefixed with the uncompressed length.
+type lz4Compressor struct{}
+
+func (lz4Compressor) Compress(in []byte) ([]byte, error) {
+	return lz4.Encode(nil, in)
+}
+
+func (lz4Compressor) Decompress(in []byte, maxLength int) ([]byte, error) {
+	// the length prefix is checked before the block is decoded into a buffer
+	// of that length
+	if len(in) >= 4 && uint64(binary.LittleEndian.Uint32(in)) > uint64(maxLength) {
+		return nil, ErrTooLarge
+	}
+	return lz4.Decode(nil, in)
+}
+
+// zstdCompressor shares one encoder, and one decoder per length limit, all
+// are safe for concurrent use through EncodeAll and DecodeAll.
+type zstdCompressor struct {
+	encoder  *zstd.Encoder
+	decoders *sync.Map
+}
+
+func newZstdCompressor() zstdCompressor {
+	encoder, _ := zstd.NewWriter(nil)
+	return zstdCompressor{encoder: encoder, decoders: &sync.Map{}}
+}
+
+func (compressor zstdCompressor) Compress(in []byte) ([]byte, error) {
+	return compressor.encoder.EncodeAll(in, nil), nil
+}
+
+func (compressor zstdCompressor) Decompress(in []byte, maxLength int) ([]byte, error) {
+	decoder, err := compressor.decoder(maxLength)
+	if err != nil {
+		return nil, err
+	}
+	out, err := decoder.DecodeAll(in, nil)
+	// frames asking for a window past maxLength are refused before decoding
+	if err == zstd.ErrDecoderSizeExceeded || err == zstd.ErrWindowSizeExceeded || len(out) > maxLength {
+		return nil, ErrTooLarge
+	}
+	return out, err
+}
+
+// decoder returns the decoder refusing to decode more than maxLength bytes,
+// the package handlers of a process use a few limits at most.
+func (compressor zstdCompressor) decoder(maxLength int) (*zstd.Decoder, error) {
+	if decoder, ok := compressor.decoders.Load(maxLength); ok {
+		return decoder.(*zstd.Decoder), nil
+	}
+	if maxLength <= 0 {
+		return nil, ErrTooLarge
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxLength)))
+	if err != nil {
+		return nil, err
+	}
+	actual, loaded := compressor.decoders.LoadOrStore(maxLength, decoder)
+	if loaded {
+		decoder.Close()
+	}
+	return actual.(*zstd.Decoder), nil
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(in []byte) ([]byte, error) {
+	return snappy.Encode(nil, in), nil
+}
+
+func (snappyCompressor) Decompress(in []byte, maxLength int) ([]byte, error) {
+	length, err := snappy.DecodedLen(in)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxLength {
+		return nil, ErrTooLarge
+	}
+	return snappy.Decode(nil, in)
+}
@@ -23,6 +23,10 @@ const (
 	// version
 	VERSION = 1
 
+	// MinSupportedVersion the oldest protocol version still decoded, packages
+	// of a version outside [MinSupportedVersion, VERSION] are refused
+	MinSupportedVersion = 1
+
 	// MaxFrameLength max frame length
 	MaxFrameLength = 8 * 1024 * 1024
 
@@ -66,6 +66,9 @@ type BranchRegisterRequest struct {
 	ResourceID      string
 	LockKey         string
 	ApplicationData []byte
+	// LockMode is the mode the rows of LockKey are locked, or checked by a
+	// GlobalLockQueryRequest, in.
+	LockMode meta.LockMode
 }
 
 func (req BranchRegisterRequest) GetTypeCode() int16 {
@@ -196,7 +199,7 @@ type GlobalReportRequest struct {
 }
 
 func (req GlobalReportRequest) GetTypeCode() int16 {
-	return TypeGlobalStatus
+	return TypeGlobalReport
 }
 
 type GlobalReportResponse struct {
@@ -204,7 +207,7 @@ type GlobalReportResponse struct {
 }
 
 func (resp GlobalReportResponse) GetTypeCode() int16 {
-	return TypeGlobalStatusResult
+	return TypeGlobalReportResult
 }
 
 type GlobalCommitRequest struct {
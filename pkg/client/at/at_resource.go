@@ -0,0 +1,135 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package at
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+import (
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/client/config"
+	"github.com/transaction-mesh/starfish/pkg/client/rm"
+)
+
+const queryPrimaryKeySQL = `SELECT COLUMN_NAME FROM INFORMATION_SCHEMA.KEY_COLUMN_USAGE
+	WHERE TABLE_SCHEMA = %s AND TABLE_NAME = ? AND CONSTRAINT_NAME = 'PRIMARY' ORDER BY ORDINAL_POSITION`
+
+// ATResource is a database taking part in global transactions through undo logs.
+type ATResource struct {
+	ResourceGroupID string
+	ResourceID      string
+	// DB talks to the database directly, undo logs are replayed and purged through it.
+	DB *sql.DB
+
+	dataSource      *sql.DB
+	conf            config.ATConfig
+	resourceManager rm.ResourceManagerOutbound
+
+	mu        sync.Mutex
+	pkColumns map[string][]string
+}
+
+// NewATResource wraps connector, the statements run through DataSource register
+// a branch of the global transaction bound to their context.
+func NewATResource(resourceGroupID string, resourceID string, connector driver.Connector) *ATResource {
+	resource := &ATResource{
+		ResourceGroupID: resourceGroupID,
+		ResourceID:      resourceID,
+		DB:              sql.OpenDB(connector),
+		pkColumns:       make(map[string][]string),
+	}
+	if clientConfig := config.GetClientConfig(); clientConfig != nil {
+		resource.conf = clientConfig.ATConfig
+	}
+	resource.dataSource = sql.OpenDB(&atConnector{resource: resource, target: connector})
+	return resource
+}
+
+// NewATResourceFromDSN opens a mysql database, the resource is identified by its
+// address and database name.
+func NewATResourceFromDSN(resourceGroupID string, dsn string) (*ATResource, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return NewATResource(resourceGroupID, fmt.Sprintf("%s/%s", cfg.Addr, cfg.DBName), connector), nil
+}
+
+func (resource *ATResource) GetResourceGroupID() string {
+	return resource.ResourceGroupID
+}
+
+func (resource *ATResource) GetResourceID() string {
+	return resource.ResourceID
+}
+
+func (resource *ATResource) GetBranchType() meta.BranchType {
+	return meta.BranchTypeAT
+}
+
+// DataSource returns the database business code should run its statements on.
+func (resource *ATResource) DataSource() *sql.DB {
+	return resource.dataSource
+}
+
+func (resource *ATResource) getPKColumns(ctx context.Context, conn *atConn, tableName string) ([]string, error) {
+	resource.mu.Lock()
+	pkColumns, ok := resource.pkColumns[tableName]
+	resource.mu.Unlock()
+	if ok {
+		return pkColumns, nil
+	}
+
+	query := fmt.Sprintf(queryPrimaryKeySQL, "DATABASE()")
+	args := []interface{}{tableName}
+	if idx := strings.IndexByte(tableName, '.'); idx >= 0 {
+		query = fmt.Sprintf(queryPrimaryKeySQL, "?")
+		args = []interface{}{tableName[:idx], tableName[idx+1:]}
+	}
+	rows, err := conn.selectRows(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		pkColumns = append(pkColumns, formatValue(row[0].Value))
+	}
+	if len(pkColumns) == 0 {
+		return nil, errors.Errorf("table %s has no primary key, AT mode needs one", tableName)
+	}
+
+	resource.mu.Lock()
+	resource.pkColumns[tableName] = pkColumns
+	resource.mu.Unlock()
+	return pkColumns, nil
+}
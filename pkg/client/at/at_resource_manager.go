@@ -0,0 +1,245 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package at
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/base/model"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/client/config"
+	"github.com/transaction-mesh/starfish/pkg/client/rm"
+	"github.com/transaction-mesh/starfish/pkg/client/rpc_client"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+)
+
+var (
+	atResourceManager ATResourceManager
+	// dsnResource is the resource opened from at.dsn.
+	dsnResource *ATResource
+)
+
+var _ rm.ResourceManager = ATResourceManager{}
+var _ rm.LockModeResourceManagerOutbound = ATResourceManager{}
+
+// InitATResourceManager starts serving AT branches, the database configured by
+// at.dsn is registered as a resource right away.
+func InitATResourceManager() {
+	client := rpc_client.GetRpcRemoteClient()
+	atResourceManager = ATResourceManager{
+		AbstractResourceManager: rm.NewAbstractResourceManager(client),
+	}
+	if dsn := config.GetATConfig().DSN; dsn != "" {
+		resource, err := NewATResourceFromDSN(config.GetClientConfig().TransactionServiceGroup, dsn)
+		if err != nil {
+			log.Errorf("open AT resource failed, err: %v", err)
+		} else {
+			dsnResource = resource
+			atResourceManager.RegisterResource(resource)
+		}
+	}
+	commitChannel, rollbackChannel := client.RegisterBranchChannels(meta.BranchTypeAT)
+	go atResourceManager.handleBranchCommit(commitChannel)
+	go atResourceManager.handleBranchRollback(rollbackChannel)
+	go atResourceManager.handleUndoLogDelete(client.RegisterUndoLogDeleteChannel())
+}
+
+func GetATResourceManager() ATResourceManager {
+	return atResourceManager
+}
+
+// GetDataSource returns the data source of the database configured by at.dsn.
+func GetDataSource() *sql.DB {
+	if dsnResource == nil {
+		return nil
+	}
+	return dsnResource.DataSource()
+}
+
+type ATResourceManager struct {
+	rm.AbstractResourceManager
+}
+
+// RegisterResource lets an ATResource register its branches through this resource manager.
+func (resourceManager ATResourceManager) RegisterResource(resource model.IResource) {
+	if atResource, ok := resource.(*ATResource); ok {
+		atResource.resourceManager = resourceManager
+	}
+	resourceManager.AbstractResourceManager.RegisterResource(resource)
+}
+
+// BranchCommit only purges the undo log, the local transaction committed in phase one.
+// An undo log that fails to be deleted here is purged by the TC's UndoLogDeleteRequest.
+func (resourceManager ATResourceManager) BranchCommit(branchType meta.BranchType, xid string, branchID int64,
+	resourceID string, applicationData []byte) (meta.BranchStatus, error) {
+	resource, err := resourceManager.getATResource(resourceID)
+	if err != nil {
+		return 0, err
+	}
+	if err := resource.deleteUndoLog(context.Background(), xid, branchID); err != nil {
+		log.Warnf("delete undo log failed, XID: %s, BranchID: %d, err: %v", xid, branchID, err)
+	}
+	return meta.BranchStatusPhaseTwoCommitted, nil
+}
+
+func (resourceManager ATResourceManager) BranchRollback(branchType meta.BranchType, xid string, branchID int64,
+	resourceID string, applicationData []byte) (meta.BranchStatus, error) {
+	resource, err := resourceManager.getATResource(resourceID)
+	if err != nil {
+		return 0, err
+	}
+	if err := resource.undo(context.Background(), xid, branchID); err != nil {
+		log.Errorf("undo failed, XID: %s, BranchID: %d, ResourceID: %s, err: %v", xid, branchID, resourceID, err)
+		if errors.Is(err, errDirtyUndo) {
+			return meta.BranchStatusPhaseTwoRollbackFailedCanNotRetry, nil
+		}
+		return meta.BranchStatusPhaseTwoRollbackFailedRetryable, nil
+	}
+	return meta.BranchStatusPhaseTwoRolledBack, nil
+}
+
+func (resourceManager ATResourceManager) LockQuery(branchType meta.BranchType, resourceID string, xid string,
+	lockKeys string) (bool, error) {
+	return resourceManager.LockQueryWithLockMode(branchType, resourceID, xid, lockKeys, meta.LockModeExclusive)
+}
+
+func (resourceManager ATResourceManager) LockQueryWithLockMode(branchType meta.BranchType, resourceID string, xid string,
+	lockKeys string, lockMode meta.LockMode) (bool, error) {
+	request := protocal.GlobalLockQueryRequest{
+		BranchRegisterRequest: protocal.BranchRegisterRequest{
+			XID:        xid,
+			BranchType: branchType,
+			ResourceID: resourceID,
+			LockKey:    lockKeys,
+			LockMode:   lockMode,
+		},
+	}
+	resp, err := resourceManager.RpcClient.SendMsgWithResponse(request)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	response := resp.(protocal.GlobalLockQueryResponse)
+	if response.ResultCode == protocal.ResultCodeFailed {
+		return false, response.GetError()
+	}
+	return response.Lockable, nil
+}
+
+func (resourceManager ATResourceManager) GetBranchType() meta.BranchType {
+	return meta.BranchTypeAT
+}
+
+func (resourceManager ATResourceManager) getATResource(resourceID string) (*ATResource, error) {
+	resource := resourceManager.ResourceCache[resourceID]
+	if resource == nil {
+		log.Errorf("AT resource does not exist, resourceID: %s", resourceID)
+		return nil, errors.Errorf("AT resource does not exist, resourceID: %s", resourceID)
+	}
+	atResource, ok := resource.(*ATResource)
+	if !ok {
+		log.Errorf("AT resource is not available, resourceID: %s", resourceID)
+		return nil, errors.Errorf("AT resource is not available, resourceID: %s", resourceID)
+	}
+	return atResource, nil
+}
+
+func (resourceManager ATResourceManager) handleBranchCommit(channel <-chan rpc_client.RpcRMMessage) {
+	for {
+		rpcRMMessage := <-channel
+		rpcMessage := rpcRMMessage.RpcMessage
+		serviceAddress := rpcRMMessage.ServerAddress
+
+		req := rpcMessage.Body.(protocal.BranchCommitRequest)
+		resp := resourceManager.doBranchCommit(req)
+		resourceManager.RpcClient.SendResponse(rpcMessage, serviceAddress, resp)
+	}
+}
+
+func (resourceManager ATResourceManager) handleBranchRollback(channel <-chan rpc_client.RpcRMMessage) {
+	for {
+		rpcRMMessage := <-channel
+		rpcMessage := rpcRMMessage.RpcMessage
+		serviceAddress := rpcRMMessage.ServerAddress
+
+		req := rpcMessage.Body.(protocal.BranchRollbackRequest)
+		resp := resourceManager.doBranchRollback(req)
+		resourceManager.RpcClient.SendResponse(rpcMessage, serviceAddress, resp)
+	}
+}
+
+func (resourceManager ATResourceManager) handleUndoLogDelete(channel <-chan rpc_client.RpcRMMessage) {
+	for {
+		rpcRMMessage := <-channel
+		req := rpcRMMessage.RpcMessage.Body.(protocal.UndoLogDeleteRequest)
+		resource, err := resourceManager.getATResource(req.ResourceID)
+		if err != nil {
+			continue
+		}
+		deleted, err := resource.deleteExpiredUndoLogs(context.Background(), req.SaveDays)
+		if err != nil {
+			log.Errorf("delete expired undo log failed, ResourceID: %s, err: %v", req.ResourceID, err)
+			continue
+		}
+		log.Infof("deleted %d expired undo logs, ResourceID: %s", deleted, req.ResourceID)
+	}
+}
+
+func (resourceManager ATResourceManager) doBranchCommit(request protocal.BranchCommitRequest) protocal.BranchCommitResponse {
+	var resp = protocal.BranchCommitResponse{}
+
+	log.Infof("Branch committing, XID: %s, BranchID: %d, ResourceID: %s", request.XID, request.BranchID, request.ResourceID)
+	status, err := resourceManager.BranchCommit(request.BranchType, request.XID, request.BranchID, request.ResourceID, request.ApplicationData)
+	if err != nil {
+		resp.ResultCode = protocal.ResultCodeFailed
+		resp.Msg = fmt.Sprintf("RuntimeException[%s]", err.Error())
+		log.Errorf("Catch RuntimeException while do RPC, request: %v", request)
+		return resp
+	}
+	resp.XID = request.XID
+	resp.BranchID = request.BranchID
+	resp.BranchStatus = status
+	resp.ResultCode = protocal.ResultCodeSuccess
+	return resp
+}
+
+func (resourceManager ATResourceManager) doBranchRollback(request protocal.BranchRollbackRequest) protocal.BranchRollbackResponse {
+	var resp = protocal.BranchRollbackResponse{}
+
+	log.Infof("Branch rolling back: XID: %s, BranchID: %d, ResourceID: %s", request.XID, request.BranchID, request.ResourceID)
+	status, err := resourceManager.BranchRollback(request.BranchType, request.XID, request.BranchID, request.ResourceID, request.ApplicationData)
+	if err != nil {
+		resp.ResultCode = protocal.ResultCodeFailed
+		resp.Msg = fmt.Sprintf("RuntimeException[%s]", err.Error())
+		log.Errorf("Catch RuntimeException while do RPC, request: %v", request)
+		return resp
+	}
+	resp.XID = request.XID
+	resp.BranchID = request.BranchID
+	resp.BranchStatus = status
+	resp.ResultCode = protocal.ResultCodeSuccess
+	return resp
+}
@@ -0,0 +1,563 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package at
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	context2 "github.com/transaction-mesh/starfish/pkg/client/context"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+)
+
+const insertUndoLogSQL = `INSERT INTO undo_log (branch_id, xid, context, rollback_info, log_status, log_created, log_modified)
+	VALUES (?, ?, ?, ?, ?, now(6), now(6))`
+
+// atConnector proxies the connections of the target driver, the DML a connection
+// runs inside a global transaction is recorded in the undo_log table.
+type atConnector struct {
+	resource *ATResource
+	target   driver.Connector
+}
+
+func (connector *atConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := connector.target.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &atConn{resource: connector.resource, target: conn}, nil
+}
+
+func (connector *atConnector) Driver() driver.Driver {
+	return connector.target.Driver()
+}
+
+type atConn struct {
+	resource *ATResource
+	target   driver.Conn
+	tx       *atTx
+}
+
+func (conn *atConn) Prepare(query string) (driver.Stmt, error) {
+	return conn.PrepareContext(context.Background(), query)
+}
+
+func (conn *atConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := conn.prepareTarget(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &atStmt{conn: conn, query: query, target: stmt}, nil
+}
+
+func (conn *atConn) Close() error {
+	return conn.target.Close()
+}
+
+func (conn *atConn) Begin() (driver.Tx, error) {
+	return conn.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (conn *atConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var (
+		tx  driver.Tx
+		err error
+	)
+	if beginner, ok := conn.target.(driver.ConnBeginTx); ok {
+		tx, err = beginner.BeginTx(ctx, opts)
+	} else {
+		tx, err = conn.target.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.tx = &atTx{conn: conn, target: tx, xid: xidFromContext(ctx)}
+	return conn.tx, nil
+}
+
+func (conn *atConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return conn.exec(ctx, query, args, func() (driver.Result, error) {
+		return conn.execTarget(ctx, query, args)
+	})
+}
+
+func (conn *atConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := conn.target.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	return queryer.QueryContext(ctx, query, args)
+}
+
+func (conn *atConn) Ping(ctx context.Context) error {
+	if pinger, ok := conn.target.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (conn *atConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := conn.target.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (conn *atConn) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := conn.target.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return driver.ErrSkip
+}
+
+// exec runs a statement through run, taking the images of the DML executed inside a
+// global transaction. Outside of a local transaction the statement and its undo log
+// are committed together.
+func (conn *atConn) exec(ctx context.Context, query string, args []driver.NamedValue,
+	run func() (driver.Result, error)) (driver.Result, error) {
+	xid := xidFromContext(ctx)
+	if conn.tx != nil {
+		xid = conn.tx.xid
+	}
+	if xid == "" {
+		return run()
+	}
+	stmt, err := parseDML(query)
+	if err != nil {
+		return nil, err
+	}
+	if stmt == nil {
+		return run()
+	}
+	if conn.tx != nil {
+		return conn.execDML(ctx, stmt, args, run)
+	}
+
+	tx, err := conn.BeginTx(ctx, driver.TxOptions{})
+	if err != nil {
+		return nil, err
+	}
+	result, err := conn.execDML(ctx, stmt, args, run)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.Errorf("rollback local transaction failed, xid: %s, err: %v", xid, rollbackErr)
+		}
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (conn *atConn) execDML(ctx context.Context, stmt *dmlStatement, args []driver.NamedValue,
+	run func() (driver.Result, error)) (driver.Result, error) {
+	pkColumns, err := conn.resource.getPKColumns(ctx, conn, stmt.tableName)
+	if err != nil {
+		return nil, err
+	}
+	undoLog := SQLUndoLog{
+		SQLType:     stmt.sqlType,
+		TableName:   stmt.tableName,
+		BeforeImage: TableRecords{TableName: stmt.tableName, PKColumns: pkColumns},
+		AfterImage:  TableRecords{TableName: stmt.tableName, PKColumns: pkColumns},
+	}
+
+	var result driver.Result
+	switch stmt.sqlType {
+	case SQLTypeInsert:
+		if result, err = run(); err != nil {
+			return nil, err
+		}
+		inserted, err := insertedPKRows(stmt, pkColumns, args, result)
+		if err != nil {
+			return nil, err
+		}
+		undoLog.AfterImage.Rows = inserted
+		if undoLog.AfterImage, err = conn.selectImage(ctx, undoLog.AfterImage); err != nil {
+			return nil, err
+		}
+	case SQLTypeUpdate, SQLTypeDelete:
+		for _, column := range stmt.setColumns {
+			if containsColumn(pkColumns, column) {
+				return nil, errors.Errorf("AT mode does not support updating the primary key of %s", stmt.tableName)
+			}
+		}
+		if undoLog.BeforeImage.Rows, err = conn.selectBeforeImage(ctx, stmt, args); err != nil {
+			return nil, err
+		}
+		if result, err = run(); err != nil {
+			return nil, err
+		}
+		if stmt.sqlType == SQLTypeUpdate {
+			if undoLog.AfterImage, err = conn.selectImage(ctx, undoLog.BeforeImage); err != nil {
+				return nil, err
+			}
+		}
+	}
+	conn.tx.addUndoLog(undoLog)
+	return result, nil
+}
+
+func (conn *atConn) selectBeforeImage(ctx context.Context, stmt *dmlStatement, args []driver.NamedValue) ([]Row, error) {
+	var sb strings.Builder
+	sb.WriteString("SELECT * FROM ")
+	sb.WriteString(stmt.tableRef)
+	if stmt.where != "" {
+		sb.WriteString(" WHERE ")
+		sb.WriteString(stmt.where)
+	}
+	sb.WriteString(" FOR UPDATE")
+
+	whereArgs := args[len(args)-stmt.whereArgCount(len(args)):]
+	values := make([]interface{}, 0, len(whereArgs))
+	for _, arg := range whereArgs {
+		values = append(values, arg.Value)
+	}
+	return conn.selectRows(ctx, sb.String(), values)
+}
+
+// selectImage selects the current state of the rows of records by primary key.
+func (conn *atConn) selectImage(ctx context.Context, records TableRecords) (TableRecords, error) {
+	if len(records.Rows) == 0 {
+		return records, nil
+	}
+	condition, args := records.pkCondition()
+	rows, err := conn.selectRows(ctx, "SELECT * FROM "+quoteName(records.TableName)+" WHERE "+condition, args)
+	if err != nil {
+		return records, err
+	}
+	records.Rows = rows
+	return records, nil
+}
+
+func (conn *atConn) selectRows(ctx context.Context, query string, args []interface{}) ([]Row, error) {
+	namedArgs := make([]driver.NamedValue, 0, len(args))
+	for i, arg := range args {
+		namedArgs = append(namedArgs, driver.NamedValue{Ordinal: i + 1, Value: arg})
+	}
+	rows, closeFunc, err := conn.queryTarget(ctx, query, namedArgs)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFunc()
+
+	columns := rows.Columns()
+	dest := make([]driver.Value, len(columns))
+	result := make([]Row, 0)
+	for {
+		if err := rows.Next(dest); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		row := make(Row, 0, len(columns))
+		for i, column := range columns {
+			row = append(row, Field{Name: column, Value: normalizeValue(dest[i])})
+		}
+		result = append(result, row)
+	}
+	return result, nil
+}
+
+func (conn *atConn) queryTarget(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, func(), error) {
+	if queryer, ok := conn.target.(driver.QueryerContext); ok {
+		rows, err := queryer.QueryContext(ctx, query, args)
+		if err != driver.ErrSkip {
+			if err != nil {
+				return nil, nil, err
+			}
+			return rows, func() { rows.Close() }, nil
+		}
+	}
+	stmt, err := conn.prepareTarget(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := queryStmt(ctx, stmt, args)
+	if err != nil {
+		stmt.Close()
+		return nil, nil, err
+	}
+	return rows, func() {
+		rows.Close()
+		stmt.Close()
+	}, nil
+}
+
+func (conn *atConn) execTarget(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if execer, ok := conn.target.(driver.ExecerContext); ok {
+		result, err := execer.ExecContext(ctx, query, args)
+		if err != driver.ErrSkip {
+			return result, err
+		}
+	}
+	stmt, err := conn.prepareTarget(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	return execStmt(ctx, stmt, args)
+}
+
+func (conn *atConn) prepareTarget(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := conn.target.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return conn.target.Prepare(query)
+}
+
+type atStmt struct {
+	conn   *atConn
+	query  string
+	target driver.Stmt
+}
+
+func (stmt *atStmt) Close() error {
+	return stmt.target.Close()
+}
+
+func (stmt *atStmt) NumInput() int {
+	return stmt.target.NumInput()
+}
+
+func (stmt *atStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return stmt.ExecContext(context.Background(), namedValues(args))
+}
+
+func (stmt *atStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return stmt.conn.exec(ctx, stmt.query, args, func() (driver.Result, error) {
+		return execStmt(ctx, stmt.target, args)
+	})
+}
+
+func (stmt *atStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return stmt.target.Query(args)
+}
+
+func (stmt *atStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return queryStmt(ctx, stmt.target, args)
+}
+
+func (stmt *atStmt) CheckNamedValue(value *driver.NamedValue) error {
+	if checker, ok := stmt.target.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+	return stmt.conn.CheckNamedValue(value)
+}
+
+// atTx registers the branch right before the local transaction commits, so the
+// global row locks are held no longer than the local ones.
+type atTx struct {
+	conn     *atConn
+	target   driver.Tx
+	xid      string
+	undoLogs []SQLUndoLog
+	lockKeys lockKeyBuilder
+}
+
+func (tx *atTx) addUndoLog(undoLog SQLUndoLog) {
+	tx.undoLogs = append(tx.undoLogs, undoLog)
+	if undoLog.SQLType == SQLTypeInsert {
+		tx.lockKeys.add(undoLog.TableName, undoLog.AfterImage.pkKeys())
+	} else {
+		tx.lockKeys.add(undoLog.TableName, undoLog.BeforeImage.pkKeys())
+	}
+}
+
+func (tx *atTx) Commit() error {
+	defer func() { tx.conn.tx = nil }()
+	lockKeys := tx.lockKeys.String()
+	if tx.xid == "" || lockKeys == "" {
+		return tx.target.Commit()
+	}
+
+	resource := tx.conn.resource
+	branchID, err := resource.registerBranch(tx.xid, lockKeys)
+	if err != nil {
+		tx.rollbackTarget()
+		return err
+	}
+	undoLog := &BranchUndoLog{XID: tx.xid, BranchID: branchID, SQLUndoLogs: tx.undoLogs}
+	rollbackInfo, err := undoLog.Encode()
+	if err == nil {
+		_, err = tx.conn.execTarget(context.Background(), insertUndoLogSQL, namedValues([]driver.Value{
+			branchID, tx.xid, undoLogContext, rollbackInfo, int64(undoLogStatusNormal),
+		}))
+	}
+	if err != nil {
+		tx.rollbackTarget()
+		resource.reportBranch(tx.xid, branchID, meta.BranchStatusPhaseOneFailed)
+		return errors.WithStack(err)
+	}
+	if err := tx.target.Commit(); err != nil {
+		resource.reportBranch(tx.xid, branchID, meta.BranchStatusPhaseOneFailed)
+		return err
+	}
+	if resource.conf.ReportSuccessEnable {
+		resource.reportBranch(tx.xid, branchID, meta.BranchStatusPhaseOneDone)
+	}
+	return nil
+}
+
+func (tx *atTx) Rollback() error {
+	defer func() { tx.conn.tx = nil }()
+	return tx.target.Rollback()
+}
+
+func (tx *atTx) rollbackTarget() {
+	if err := tx.target.Rollback(); err != nil {
+		log.Errorf("rollback local transaction failed, xid: %s, err: %v", tx.xid, err)
+	}
+}
+
+// registerBranch retries while the TC reports the rows are locked by another global transaction.
+func (resource *ATResource) registerBranch(xid string, lockKeys string) (int64, error) {
+	if resource.resourceManager == nil {
+		return 0, errors.Errorf("AT resource %s is not registered to the resource manager", resource.ResourceID)
+	}
+	for retry := 0; ; retry++ {
+		branchID, err := resource.resourceManager.BranchRegister(meta.BranchTypeAT, resource.ResourceID, "", xid, nil, lockKeys)
+		if err == nil {
+			return branchID, nil
+		}
+		var trxException *meta.TransactionException
+		if !errors.As(err, &trxException) || trxException.Code != meta.TransactionExceptionCodeLockKeyConflict ||
+			retry >= resource.conf.LockRetryTimes {
+			return 0, err
+		}
+		time.Sleep(resource.conf.LockRetryInterval)
+	}
+}
+
+func (resource *ATResource) reportBranch(xid string, branchID int64, status meta.BranchStatus) {
+	retry := resource.conf.ReportRetryCount
+	for {
+		err := resource.resourceManager.BranchReport(meta.BranchTypeAT, xid, branchID, status, nil)
+		if err == nil {
+			return
+		}
+		if retry <= 0 {
+			log.Errorf("branch report err, xid: %s, branchID: %d, status: %s, err: %v", xid, branchID, status.String(), err)
+			return
+		}
+		retry--
+	}
+}
+
+// insertedPKRows collects the primary keys of the inserted rows from the statement,
+// falling back to the last insert id for auto increment keys.
+func insertedPKRows(stmt *dmlStatement, pkColumns []string, args []driver.NamedValue, result driver.Result) ([]Row, error) {
+	rows := make([]Row, 0, len(stmt.insertValues))
+	argIndex := 0
+	for rowIndex, values := range stmt.insertValues {
+		row := make(Row, 0, len(pkColumns))
+		for i, item := range values {
+			var (
+				value interface{}
+				known bool
+			)
+			switch {
+			case item == "?":
+				if argIndex < len(args) {
+					value, known = args[argIndex].Value, true
+				}
+				argIndex++
+			case strings.ContainsRune(item, '?'):
+				argIndex += countPlaceholders(item)
+			case !strings.EqualFold(item, "DEFAULT") && !strings.Contains(item, "("):
+				value, known = literalValue(item), true
+			}
+			if containsColumn(pkColumns, stmt.insertColumns[i]) && known && value != nil {
+				row = append(row, Field{Name: stmt.insertColumns[i], Value: normalizeValue(value)})
+			}
+		}
+		if len(row) == len(pkColumns) {
+			rows = append(rows, row)
+			continue
+		}
+		if len(pkColumns) > 1 {
+			return nil, errors.Errorf("AT mode needs every primary key column of %s in the INSERT", stmt.tableName)
+		}
+		lastInsertID, err := result.LastInsertId()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		rows = append(rows, Row{{Name: pkColumns[0], Value: lastInsertID + int64(rowIndex)}})
+	}
+	return rows, nil
+}
+
+func containsColumn(columns []string, column string) bool {
+	for _, c := range columns {
+		if strings.EqualFold(c, column) {
+			return true
+		}
+	}
+	return false
+}
+
+func xidFromContext(ctx context.Context) string {
+	if rootContext, ok := ctx.(*context2.RootContext); ok {
+		return rootContext.GetXID()
+	}
+	if xid, ok := ctx.Value(context2.KEY_XID).(string); ok {
+		return xid
+	}
+	return ""
+}
+
+func execStmt(ctx context.Context, stmt driver.Stmt, args []driver.NamedValue) (driver.Result, error) {
+	if execer, ok := stmt.(driver.StmtExecContext); ok {
+		return execer.ExecContext(ctx, args)
+	}
+	return stmt.Exec(driverValues(args))
+}
+
+func queryStmt(ctx context.Context, stmt driver.Stmt, args []driver.NamedValue) (driver.Rows, error) {
+	if queryer, ok := stmt.(driver.StmtQueryContext); ok {
+		return queryer.QueryContext(ctx, args)
+	}
+	return stmt.Query(driverValues(args))
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, 0, len(args))
+	for i, arg := range args {
+		named = append(named, driver.NamedValue{Ordinal: i + 1, Value: arg})
+	}
+	return named
+}
+
+func driverValues(args []driver.NamedValue) []driver.Value {
+	result := make([]driver.Value, 0, len(args))
+	for _, arg := range args {
+		result = append(result, arg.Value)
+	}
+	return result
+}
@@ -0,0 +1,340 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package at
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	context2 "github.com/transaction-mesh/starfish/pkg/client/context"
+)
+
+const testXID = "127.0.0.1:8091:2000042"
+
+func TestDataSourceProxy_Update(t *testing.T) {
+	resource, fake, outbound := atResourceProvider(t)
+	fake.respond("SELECT * FROM account WHERE id = ? FOR UPDATE", []string{"id", "money"}, []driver.Value{int64(1), []byte("10")})
+	fake.respond("SELECT * FROM `account` WHERE `id` IN (?)", []string{"id", "money"}, []driver.Value{int64(1), []byte("9")})
+
+	_, err := resource.DataSource().ExecContext(globalContextProvider(), "UPDATE account SET money = money - ? WHERE id = ?", 1, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"BEGIN",
+		fmt.Sprintf(queryPrimaryKeySQL, "DATABASE()"),
+		"SELECT * FROM account WHERE id = ? FOR UPDATE",
+		"UPDATE account SET money = money - ? WHERE id = ?",
+		"SELECT * FROM `account` WHERE `id` IN (?)",
+		insertUndoLogSQL,
+		"COMMIT",
+	}, fake.statements())
+	assert.Equal(t, []string{"account:1"}, outbound.lockKeys)
+
+	undoLog := fake.undoLog(t)
+	assert.Equal(t, testXID, undoLog.XID)
+	assert.Equal(t, int64(11), undoLog.BranchID)
+	assert.Equal(t, 1, len(undoLog.SQLUndoLogs))
+	assert.Equal(t, SQLTypeUpdate, undoLog.SQLUndoLogs[0].SQLType)
+	assert.Equal(t, "10", formatValue(undoLog.SQLUndoLogs[0].BeforeImage.Rows[0].value("money")))
+	assert.Equal(t, "9", formatValue(undoLog.SQLUndoLogs[0].AfterImage.Rows[0].value("money")))
+}
+
+func TestDataSourceProxy_InsertInLocalTransaction(t *testing.T) {
+	resource, fake, outbound := atResourceProvider(t)
+	fake.lastInsertID = 5
+	fake.respond("SELECT * FROM `account` WHERE `id` IN (?,?)", []string{"id", "name"},
+		[]driver.Value{int64(5), []byte("a")}, []driver.Value{int64(6), []byte("b")})
+	fake.respond("SELECT * FROM orders WHERE account_id = ? FOR UPDATE", []string{"id", "account_id"},
+		[]driver.Value{int64(7), int64(5)})
+
+	ctx := globalContextProvider()
+	tx, err := resource.DataSource().BeginTx(ctx, nil)
+	assert.Nil(t, err)
+	_, err = tx.ExecContext(ctx, "INSERT INTO account (name) VALUES (?), (?)", "a", "b")
+	assert.Nil(t, err)
+	_, err = tx.ExecContext(ctx, "DELETE FROM orders WHERE account_id = ?", 5)
+	assert.Nil(t, err)
+	assert.Empty(t, outbound.lockKeys)
+	assert.Nil(t, tx.Commit())
+	assert.Equal(t, []string{"account:5,6;orders:7"}, outbound.lockKeys)
+	assert.Equal(t, 2, len(fake.undoLog(t).SQLUndoLogs))
+}
+
+func TestDataSourceProxy_NotInGlobalTransaction(t *testing.T) {
+	resource, fake, outbound := atResourceProvider(t)
+
+	_, err := resource.DataSource().ExecContext(context.Background(), "UPDATE account SET money = 0 WHERE id = ?", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"UPDATE account SET money = 0 WHERE id = ?"}, fake.statements())
+	assert.Empty(t, outbound.lockKeys)
+}
+
+func TestDataSourceProxy_RegisterFailed(t *testing.T) {
+	resource, fake, outbound := atResourceProvider(t)
+	outbound.err = &meta.TransactionException{Code: meta.TransactionExceptionCodeLockKeyConflict}
+	fake.respond("SELECT * FROM account WHERE id = ? FOR UPDATE", []string{"id", "money"}, []driver.Value{int64(1), int64(10)})
+
+	_, err := resource.DataSource().ExecContext(globalContextProvider(), "DELETE FROM account WHERE id = ?", 1)
+	assert.NotNil(t, err)
+	assert.Equal(t, "ROLLBACK", fake.statements()[len(fake.statements())-1])
+	assert.Equal(t, resource.conf.LockRetryTimes+1, len(outbound.lockKeys))
+}
+
+func TestATResource_Undo(t *testing.T) {
+	resource, fake, _ := atResourceProvider(t)
+	fake.respond(selectUndoLogSQL, []string{"rollback_info", "log_status"},
+		[]driver.Value{branchUndoLogProvider(t), int64(undoLogStatusNormal)})
+	fake.respond("SELECT * FROM `account` WHERE `id` IN (?) FOR UPDATE", []string{"id", "money"}, []driver.Value{int64(1), []byte("9")})
+
+	assert.Nil(t, resource.undo(context.Background(), testXID, 11))
+	assert.Equal(t, []string{
+		"BEGIN",
+		selectUndoLogSQL,
+		"SELECT * FROM `account` WHERE `id` IN (?) FOR UPDATE",
+		"UPDATE `account` SET `money` = ? WHERE `id` IN (?)",
+		deleteUndoLogSQL,
+		"COMMIT",
+	}, fake.statements())
+}
+
+func TestATResource_UndoDirty(t *testing.T) {
+	resource, fake, _ := atResourceProvider(t)
+	fake.respond(selectUndoLogSQL, []string{"rollback_info", "log_status"},
+		[]driver.Value{branchUndoLogProvider(t), int64(undoLogStatusNormal)})
+	fake.respond("SELECT * FROM `account` WHERE `id` IN (?) FOR UPDATE", []string{"id", "money"}, []driver.Value{int64(1), []byte("3")})
+
+	err := resource.undo(context.Background(), testXID, 11)
+	assert.True(t, errors.Is(err, errDirtyUndo))
+	assert.Equal(t, "ROLLBACK", fake.statements()[len(fake.statements())-1])
+}
+
+func TestATResource_UndoBeforePhaseOne(t *testing.T) {
+	resource, fake, _ := atResourceProvider(t)
+
+	assert.Nil(t, resource.undo(context.Background(), testXID, 11))
+	assert.Equal(t, []string{"BEGIN", selectUndoLogSQL, insertUndoLogSQL, "COMMIT"}, fake.statements())
+	assert.Equal(t, int64(undoLogStatusGlobalFinished), fake.undoLogArgs[4])
+}
+
+func atResourceProvider(t *testing.T) (*ATResource, *fakeDriver, *outboundRecorder) {
+	fake := &fakeDriver{responses: make(map[string]fakeRows)}
+	fake.respond("SELECT COLUMN_NAME", []string{"COLUMN_NAME"}, []driver.Value{[]byte("id")})
+	resource := NewATResource("my_test_tx_group", "127.0.0.1:3306/order", fake)
+	t.Cleanup(func() {
+		resource.DB.Close()
+		resource.DataSource().Close()
+	})
+	resource.conf.LockRetryTimes = 2
+	outbound := &outboundRecorder{branchID: 11}
+	resource.resourceManager = outbound
+	return resource, fake, outbound
+}
+
+func globalContextProvider() *context2.RootContext {
+	ctx := context2.NewRootContext(context.Background())
+	ctx.Bind(testXID)
+	return ctx
+}
+
+func branchUndoLogProvider(t *testing.T) []byte {
+	records := TableRecords{TableName: "account", PKColumns: []string{"id"}}
+	undoLog := SQLUndoLog{SQLType: SQLTypeUpdate, TableName: "account", BeforeImage: records, AfterImage: records}
+	undoLog.BeforeImage.Rows = []Row{{{Name: "id", Value: int64(1)}, {Name: "money", Value: "10"}}}
+	undoLog.AfterImage.Rows = []Row{{{Name: "id", Value: int64(1)}, {Name: "money", Value: "9"}}}
+	data, err := (&BranchUndoLog{XID: testXID, BranchID: 11, SQLUndoLogs: []SQLUndoLog{undoLog}}).Encode()
+	assert.Nil(t, err)
+	return data
+}
+
+type outboundRecorder struct {
+	branchID int64
+	err      error
+	lockKeys []string
+	reported []meta.BranchStatus
+}
+
+func (outbound *outboundRecorder) BranchRegister(branchType meta.BranchType, resourceID string, clientID string,
+	xid string, applicationData []byte, lockKeys string) (int64, error) {
+	outbound.lockKeys = append(outbound.lockKeys, lockKeys)
+	return outbound.branchID, outbound.err
+}
+
+func (outbound *outboundRecorder) BranchReport(branchType meta.BranchType, xid string, branchID int64,
+	status meta.BranchStatus, applicationData []byte) error {
+	outbound.reported = append(outbound.reported, status)
+	return nil
+}
+
+func (outbound *outboundRecorder) LockQuery(branchType meta.BranchType, resourceID string, xid string,
+	lockKeys string) (bool, error) {
+	return true, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+// fakeDriver records every statement, queries are answered with the rows registered
+// for the longest matching prefix.
+type fakeDriver struct {
+	mu           sync.Mutex
+	executed     []string
+	undoLogArgs  []driver.Value
+	responses    map[string]fakeRows
+	lastInsertID int64
+}
+
+func (fake *fakeDriver) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeConn{driver: fake}, nil
+}
+
+func (fake *fakeDriver) Driver() driver.Driver {
+	return nil
+}
+
+func (fake *fakeDriver) respond(prefix string, columns []string, rows ...[]driver.Value) {
+	fake.responses[prefix] = fakeRows{columns: columns, rows: rows}
+}
+
+func (fake *fakeDriver) statements() []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return append([]string(nil), fake.executed...)
+}
+
+func (fake *fakeDriver) undoLog(t *testing.T) *BranchUndoLog {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	undoLog := &BranchUndoLog{}
+	assert.Nil(t, undoLog.Decode(fake.undoLogArgs[3].([]byte)))
+	return undoLog
+}
+
+func (fake *fakeDriver) record(query string, args []driver.NamedValue) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.executed = append(fake.executed, query)
+	if query == insertUndoLogSQL {
+		fake.undoLogArgs = driverValues(args)
+	}
+}
+
+func (fake *fakeDriver) rowsFor(query string) fakeRows {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	var (
+		matched string
+		result  fakeRows
+	)
+	for prefix, rows := range fake.responses {
+		if strings.HasPrefix(query, prefix) && len(prefix) > len(matched) {
+			matched, result = prefix, rows
+		}
+	}
+	return result
+}
+
+type fakeConn struct {
+	driver *fakeDriver
+}
+
+func (conn *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	conn.driver.record(query, args)
+	return fakeResult{lastInsertID: conn.driver.lastInsertID}, nil
+}
+
+func (conn *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	conn.driver.record(query, args)
+	rows := conn.driver.rowsFor(query)
+	return &fakeResultRows{columns: rows.columns, rows: rows.rows}, nil
+}
+
+func (conn *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fake driver does not support prepared statements")
+}
+
+func (conn *fakeConn) Close() error {
+	return nil
+}
+
+func (conn *fakeConn) Begin() (driver.Tx, error) {
+	conn.driver.record("BEGIN", nil)
+	return &fakeTx{driver: conn.driver}, nil
+}
+
+type fakeTx struct {
+	driver *fakeDriver
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.driver.record("COMMIT", nil)
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.driver.record("ROLLBACK", nil)
+	return nil
+}
+
+type fakeResult struct {
+	lastInsertID int64
+}
+
+func (result fakeResult) LastInsertId() (int64, error) {
+	return result.lastInsertID, nil
+}
+
+func (result fakeResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+type fakeResultRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (rows *fakeResultRows) Columns() []string {
+	return rows.columns
+}
+
+func (rows *fakeResultRows) Close() error {
+	return nil
+}
+
+func (rows *fakeResultRows) Next(dest []driver.Value) error {
+	if len(rows.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.rows[0])
+	rows.rows = rows.rows[1:]
+	return nil
+}
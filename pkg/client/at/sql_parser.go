@@ -0,0 +1,380 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package at
+
+import (
+	"strings"
+	"unicode"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+type SQLType byte
+
+const (
+	SQLTypeInsert SQLType = iota + 1
+	SQLTypeUpdate
+	SQLTypeDelete
+)
+
+func (t SQLType) String() string {
+	switch t {
+	case SQLTypeInsert:
+		return "INSERT"
+	case SQLTypeUpdate:
+		return "UPDATE"
+	case SQLTypeDelete:
+		return "DELETE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// dmlStatement is a single table INSERT, UPDATE or DELETE recognized from a sql text.
+type dmlStatement struct {
+	sqlType SQLType
+	// tableRef is the table as written, alias included, used to query the before image.
+	tableRef string
+	// tableName is the bare table name, used for the table meta and the lock keys.
+	tableName string
+
+	// insertColumns and insertValues hold the column list and every value tuple of an INSERT.
+	insertColumns []string
+	insertValues  [][]string
+
+	// setColumns are the columns assigned by an UPDATE, setArgCount the placeholders among them.
+	setColumns  []string
+	setArgCount int
+
+	// where is the WHERE clause of an UPDATE or DELETE without the keyword, ORDER BY and
+	// LIMIT included.
+	where string
+}
+
+// parseDML recognizes the statements AT mode has to take images of, it returns nil
+// for every other statement.
+func parseDML(query string) (*dmlStatement, error) {
+	query = strings.TrimRight(strings.TrimSpace(query), ";")
+	switch strings.ToUpper(firstWord(query)) {
+	case "INSERT":
+		return parseInsert(query)
+	case "UPDATE":
+		return parseUpdate(query)
+	case "DELETE":
+		return parseDelete(query)
+	default:
+		return nil, nil
+	}
+}
+
+func parseInsert(query string) (*dmlStatement, error) {
+	into := findKeyword(query, "INTO", 0)
+	values := findKeyword(query, "VALUES", 0)
+	if values < 0 {
+		values = findKeyword(query, "VALUE", 0)
+	}
+	if into < 0 || values < 0 {
+		return nil, errors.Errorf("AT mode only supports INSERT INTO ... VALUES, sql: %s", query)
+	}
+	if findKeyword(query, "DUPLICATE", values) >= 0 {
+		return nil, errors.Errorf("AT mode does not support INSERT ... ON DUPLICATE KEY UPDATE, sql: %s", query)
+	}
+	if strings.Contains(strings.ToUpper(query[:into]), "IGNORE") {
+		return nil, errors.Errorf("AT mode does not support INSERT IGNORE, sql: %s", query)
+	}
+
+	stmt := &dmlStatement{sqlType: SQLTypeInsert}
+	target := strings.TrimSpace(query[into+len("INTO") : values])
+	columnsStart := strings.IndexByte(target, '(')
+	if columnsStart < 0 {
+		return nil, errors.Errorf("AT mode needs the column list of an INSERT, sql: %s", query)
+	}
+	stmt.tableRef = strings.TrimSpace(target[:columnsStart])
+	stmt.tableName = unquoteTableName(stmt.tableRef)
+	columns, rest, err := takeParenthesized(target[columnsStart:])
+	if err != nil || strings.TrimSpace(rest) != "" {
+		return nil, errors.Errorf("malformed INSERT column list, sql: %s", query)
+	}
+	for _, column := range splitTopLevel(columns, ',') {
+		stmt.insertColumns = append(stmt.insertColumns, unquoteColumnName(column))
+	}
+
+	keywordLength := len("VALUE")
+	if strings.EqualFold(query[values:values+len("VALUES")], "VALUES") {
+		keywordLength = len("VALUES")
+	}
+	for _, tuple := range splitTopLevel(query[values+keywordLength:], ',') {
+		row, rest, err := takeParenthesized(tuple)
+		if err != nil || strings.TrimSpace(rest) != "" {
+			return nil, errors.Errorf("malformed INSERT values, sql: %s", query)
+		}
+		items := splitTopLevel(row, ',')
+		if len(items) != len(stmt.insertColumns) {
+			return nil, errors.Errorf("INSERT column count does not match value count, sql: %s", query)
+		}
+		stmt.insertValues = append(stmt.insertValues, items)
+	}
+	return stmt, nil
+}
+
+func parseUpdate(query string) (*dmlStatement, error) {
+	set := findKeyword(query, "SET", 0)
+	if set < 0 {
+		return nil, errors.Errorf("malformed UPDATE, sql: %s", query)
+	}
+	stmt := &dmlStatement{sqlType: SQLTypeUpdate}
+	if err := stmt.setTable(query, query[len("UPDATE"):set]); err != nil {
+		return nil, err
+	}
+
+	setClause := query[set+len("SET"):]
+	if where := findKeyword(query, "WHERE", set); where >= 0 {
+		setClause = query[set+len("SET") : where]
+		stmt.where = strings.TrimSpace(query[where+len("WHERE"):])
+	} else if findKeyword(setClause, "ORDER", 0) >= 0 || findKeyword(setClause, "LIMIT", 0) >= 0 {
+		return nil, errors.Errorf("AT mode does not support UPDATE with ORDER BY or LIMIT but no WHERE, sql: %s", query)
+	}
+	for _, assignment := range splitTopLevel(setClause, ',') {
+		idx := strings.IndexByte(assignment, '=')
+		if idx < 0 {
+			return nil, errors.Errorf("malformed UPDATE assignment, sql: %s", query)
+		}
+		stmt.setColumns = append(stmt.setColumns, unquoteColumnName(assignment[:idx]))
+	}
+	stmt.setArgCount = countPlaceholders(setClause)
+	return stmt, nil
+}
+
+func parseDelete(query string) (*dmlStatement, error) {
+	from := findKeyword(query, "FROM", 0)
+	if from < 0 {
+		return nil, errors.Errorf("malformed DELETE, sql: %s", query)
+	}
+	stmt := &dmlStatement{sqlType: SQLTypeDelete}
+	tableRef := query[from+len("FROM"):]
+	if where := findKeyword(query, "WHERE", from); where >= 0 {
+		tableRef = query[from+len("FROM") : where]
+		stmt.where = strings.TrimSpace(query[where+len("WHERE"):])
+	} else if findKeyword(tableRef, "ORDER", 0) >= 0 || findKeyword(tableRef, "LIMIT", 0) >= 0 {
+		return nil, errors.Errorf("AT mode does not support DELETE with ORDER BY or LIMIT but no WHERE, sql: %s", query)
+	}
+	if strings.TrimSpace(query[len("DELETE"):from]) != "" {
+		return nil, errors.Errorf("AT mode only supports single table DELETE, sql: %s", query)
+	}
+	if err := stmt.setTable(query, tableRef); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func (stmt *dmlStatement) setTable(query string, tableRef string) error {
+	tableRef = strings.TrimSpace(tableRef)
+	upper := strings.ToUpper(tableRef)
+	if tableRef == "" || strings.ContainsAny(tableRef, ",()") || strings.Contains(upper, " JOIN ") {
+		return errors.Errorf("AT mode only supports single table %s, sql: %s", stmt.sqlType.String(), query)
+	}
+	stmt.tableRef = tableRef
+	stmt.tableName = unquoteTableName(strings.Fields(tableRef)[0])
+	return nil
+}
+
+// whereArgCount returns how many of args are bound to the WHERE clause placeholders.
+func (stmt *dmlStatement) whereArgCount(args int) int {
+	if stmt.sqlType == SQLTypeUpdate {
+		return args - stmt.setArgCount
+	}
+	return args
+}
+
+func firstWord(query string) string {
+	end := strings.IndexFunc(query, unicode.IsSpace)
+	if end < 0 {
+		return query
+	}
+	return query[:end]
+}
+
+// scanTopLevel calls fn with the offset of every byte outside quotes and parentheses,
+// it stops when fn returns true.
+func scanTopLevel(s string, fn func(i int) bool) {
+	var (
+		quote byte
+		depth int
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quote != 0 {
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '\'', '"', '`':
+			quote = c
+		case '(':
+			depth++
+		case ')':
+			depth--
+		default:
+			if depth == 0 && fn(i) {
+				return
+			}
+		}
+	}
+}
+
+// findKeyword returns the offset of the first top level occurrence of keyword at or
+// after from, or -1.
+func findKeyword(s string, keyword string, from int) int {
+	found := -1
+	scanTopLevel(s, func(i int) bool {
+		if i < from || i+len(keyword) > len(s) || !strings.EqualFold(s[i:i+len(keyword)], keyword) {
+			return false
+		}
+		if i > 0 && isIdentifierByte(s[i-1]) {
+			return false
+		}
+		if end := i + len(keyword); end < len(s) && isIdentifierByte(s[end]) {
+			return false
+		}
+		found = i
+		return true
+	})
+	return found
+}
+
+func isIdentifierByte(c byte) bool {
+	return c == '_' || c == '.' || c == '`' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func splitTopLevel(s string, sep byte) []string {
+	var (
+		parts []string
+		start int
+	)
+	scanTopLevel(s, func(i int) bool {
+		if s[i] == sep {
+			parts = append(parts, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+		return false
+	})
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// takeParenthesized returns the content of the parentheses s starts with and the text after them.
+func takeParenthesized(s string) (string, string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") {
+		return "", "", errors.New("missing opening parenthesis")
+	}
+	var (
+		quote byte
+		depth int
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quote != 0 {
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '\'', '"', '`':
+			quote = c
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return s[1:i], s[i+1:], nil
+			}
+		}
+	}
+	return "", "", errors.New("missing closing parenthesis")
+}
+
+func countPlaceholders(s string) int {
+	var (
+		count int
+		quote byte
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quote != 0 {
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '\'', '"', '`':
+			quote = c
+		case '?':
+			count++
+		}
+	}
+	return count
+}
+
+// unquoteTableName strips the back quotes of a table name, the schema is kept.
+func unquoteTableName(name string) string {
+	return strings.ReplaceAll(strings.TrimSpace(name), "`", "")
+}
+
+// unquoteColumnName strips the table qualifier and the back quotes of a column name.
+func unquoteColumnName(name string) string {
+	name = unquoteTableName(name)
+	if idx := strings.LastIndexByte(name, '.'); idx >= 0 {
+		name = name[idx+1:]
+	}
+	return name
+}
+
+// quoteName back quotes every part of a possibly schema qualified name.
+func quoteName(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = "`" + part + "`"
+	}
+	return strings.Join(parts, ".")
+}
+
+// literalValue returns the value of a sql literal, quotes removed.
+func literalValue(literal string) interface{} {
+	literal = strings.TrimSpace(literal)
+	if strings.EqualFold(literal, "NULL") {
+		return nil
+	}
+	if len(literal) >= 2 && (literal[0] == '\'' || literal[0] == '"') && literal[len(literal)-1] == literal[0] {
+		unquoted := literal[1 : len(literal)-1]
+		unquoted = strings.ReplaceAll(unquoted, `\`+string(literal[0]), string(literal[0]))
+		return strings.ReplaceAll(unquoted, string(literal[0])+string(literal[0]), string(literal[0]))
+	}
+	return literal
+}
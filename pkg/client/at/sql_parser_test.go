@@ -0,0 +1,73 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package at
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDML_Insert(t *testing.T) {
+	stmt, err := parseDML("INSERT INTO `order`.`account` (`id`, name, money) VALUES (?, 'it''s', 10), (?, ?, now());")
+	assert.Nil(t, err)
+	assert.Equal(t, SQLTypeInsert, stmt.sqlType)
+	assert.Equal(t, "order.account", stmt.tableName)
+	assert.Equal(t, []string{"id", "name", "money"}, stmt.insertColumns)
+	assert.Equal(t, [][]string{{"?", "'it''s'", "10"}, {"?", "?", "now()"}}, stmt.insertValues)
+	assert.Equal(t, "it's", literalValue(stmt.insertValues[0][1]))
+
+	_, err = parseDML("INSERT INTO account (id) VALUES (?) ON DUPLICATE KEY UPDATE id = id")
+	assert.NotNil(t, err)
+	_, err = parseDML("INSERT INTO account SELECT * FROM account_bak")
+	assert.NotNil(t, err)
+}
+
+func TestParseDML_Update(t *testing.T) {
+	stmt, err := parseDML("update account a set a.money = a.money - ?, `name` = 'where' where a.id = ? and a.money > ?")
+	assert.Nil(t, err)
+	assert.Equal(t, SQLTypeUpdate, stmt.sqlType)
+	assert.Equal(t, "account a", stmt.tableRef)
+	assert.Equal(t, "account", stmt.tableName)
+	assert.Equal(t, []string{"money", "name"}, stmt.setColumns)
+	assert.Equal(t, "a.id = ? and a.money > ?", stmt.where)
+	assert.Equal(t, 2, stmt.whereArgCount(3))
+
+	_, err = parseDML("UPDATE account JOIN orders ON account.id = orders.account_id SET money = 0")
+	assert.NotNil(t, err)
+}
+
+func TestParseDML_Delete(t *testing.T) {
+	stmt, err := parseDML("DELETE FROM account WHERE id IN (?, ?) LIMIT 2")
+	assert.Nil(t, err)
+	assert.Equal(t, SQLTypeDelete, stmt.sqlType)
+	assert.Equal(t, "account", stmt.tableName)
+	assert.Equal(t, "id IN (?, ?) LIMIT 2", stmt.where)
+	assert.Equal(t, 2, stmt.whereArgCount(2))
+
+	_, err = parseDML("DELETE a, b FROM account a JOIN orders b WHERE a.id = b.account_id")
+	assert.NotNil(t, err)
+}
+
+func TestParseDML_Other(t *testing.T) {
+	stmt, err := parseDML("SELECT * FROM account WHERE id = ?")
+	assert.Nil(t, err)
+	assert.Nil(t, stmt)
+}
@@ -0,0 +1,215 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package at
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+const (
+	undoLogContext = "serializer=json"
+
+	undoLogStatusNormal = 0
+	// undoLogStatusGlobalFinished marks a branch rolled back before its phase one
+	// committed, the late phase one then fails on the unique key instead of leaving
+	// dirty data behind.
+	undoLogStatusGlobalFinished = 1
+
+	defaultUndoLogSaveDays = 7
+	undoLogDeleteLimit     = 1000
+
+	selectUndoLogSQL        = "SELECT rollback_info, log_status FROM undo_log WHERE branch_id = ? AND xid = ? FOR UPDATE"
+	deleteUndoLogSQL        = "DELETE FROM undo_log WHERE branch_id = ? AND xid = ?"
+	deleteExpiredUndoLogSQL = "DELETE FROM undo_log WHERE log_created <= ? LIMIT ?"
+)
+
+// errDirtyUndo means the rows were changed outside of the global transaction after
+// phase one, replaying the undo log would lose that change.
+var errDirtyUndo = errors.New("rows were modified outside of the global transaction")
+
+// undo replays the undo log of a branch in reverse order and deletes it, all in one
+// local transaction.
+func (resource *ATResource) undo(ctx context.Context, xid string, branchID int64) error {
+	tx, err := resource.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer tx.Rollback()
+
+	var (
+		rollbackInfo []byte
+		logStatus    int
+	)
+	err = tx.QueryRowContext(ctx, selectUndoLogSQL, branchID, xid).Scan(&rollbackInfo, &logStatus)
+	if err == sql.ErrNoRows {
+		_, err = tx.ExecContext(ctx, insertUndoLogSQL, branchID, xid, undoLogContext, []byte("{}"), undoLogStatusGlobalFinished)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(tx.Commit())
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if logStatus == undoLogStatusGlobalFinished {
+		return nil
+	}
+
+	branchUndoLog := &BranchUndoLog{}
+	if err := branchUndoLog.Decode(rollbackInfo); err != nil {
+		return errors.WithStack(err)
+	}
+	for i := len(branchUndoLog.SQLUndoLogs) - 1; i >= 0; i-- {
+		if err := executeUndo(ctx, tx, branchUndoLog.SQLUndoLogs[i]); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, deleteUndoLogSQL, branchID, xid); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(tx.Commit())
+}
+
+func executeUndo(ctx context.Context, tx *sql.Tx, undoLog SQLUndoLog) error {
+	// The primary keys of both images are the same except for inserts, which only
+	// have an after image.
+	records := undoLog.BeforeImage
+	if undoLog.SQLType == SQLTypeInsert {
+		records = undoLog.AfterImage
+	}
+	if len(records.Rows) == 0 {
+		return nil
+	}
+	current, err := queryCurrentImage(ctx, tx, records)
+	if err != nil {
+		return err
+	}
+	if !current.equals(undoLog.AfterImage) {
+		if current.equals(undoLog.BeforeImage) {
+			return nil
+		}
+		return errors.Wrapf(errDirtyUndo, "table %s", undoLog.TableName)
+	}
+
+	tableName := quoteName(undoLog.TableName)
+	switch undoLog.SQLType {
+	case SQLTypeInsert:
+		condition, args := records.pkCondition()
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+tableName+" WHERE "+condition, args...)
+		return errors.WithStack(err)
+	case SQLTypeUpdate:
+		for _, row := range records.Rows {
+			assignments := make([]string, 0, len(row))
+			args := make([]interface{}, 0, len(row))
+			for _, field := range row {
+				if containsColumn(records.PKColumns, field.Name) {
+					continue
+				}
+				assignments = append(assignments, quoteName(field.Name)+" = ?")
+				args = append(args, field.Value)
+			}
+			condition, pkArgs := TableRecords{PKColumns: records.PKColumns, Rows: []Row{row}}.pkCondition()
+			query := fmt.Sprintf("UPDATE %s SET %s WHERE %s", tableName, strings.Join(assignments, ", "), condition)
+			if _, err := tx.ExecContext(ctx, query, append(args, pkArgs...)...); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	case SQLTypeDelete:
+		for _, row := range records.Rows {
+			columns := make([]string, 0, len(row))
+			args := make([]interface{}, 0, len(row))
+			for _, field := range row {
+				columns = append(columns, quoteName(field.Name))
+				args = append(args, field.Value)
+			}
+			query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (?%s)", tableName, strings.Join(columns, ", "),
+				strings.Repeat(", ?", len(columns)-1))
+			if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
+
+func queryCurrentImage(ctx context.Context, tx *sql.Tx, records TableRecords) (TableRecords, error) {
+	current := TableRecords{TableName: records.TableName, PKColumns: records.PKColumns}
+	condition, args := records.pkCondition()
+	rows, err := tx.QueryContext(ctx, "SELECT * FROM "+quoteName(records.TableName)+" WHERE "+condition+" FOR UPDATE", args...)
+	if err != nil {
+		return current, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return current, errors.WithStack(err)
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return current, errors.WithStack(err)
+		}
+		row := make(Row, 0, len(columns))
+		for i, column := range columns {
+			row = append(row, Field{Name: column, Value: normalizeValue(values[i])})
+		}
+		current.Rows = append(current.Rows, row)
+	}
+	return current, errors.WithStack(rows.Err())
+}
+
+func (resource *ATResource) deleteUndoLog(ctx context.Context, xid string, branchID int64) error {
+	_, err := resource.DB.ExecContext(ctx, deleteUndoLogSQL, branchID, xid)
+	return errors.WithStack(err)
+}
+
+// deleteExpiredUndoLogs removes, in batches, the undo logs older than saveDays.
+func (resource *ATResource) deleteExpiredUndoLogs(ctx context.Context, saveDays int16) (int64, error) {
+	if saveDays <= 0 {
+		saveDays = defaultUndoLogSaveDays
+	}
+	logCreated := time.Now().AddDate(0, 0, -int(saveDays))
+	var deleted int64
+	for {
+		result, err := resource.DB.ExecContext(ctx, deleteExpiredUndoLogSQL, logCreated, undoLogDeleteLimit)
+		if err != nil {
+			return deleted, errors.WithStack(err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return deleted, errors.WithStack(err)
+		}
+		deleted += affected
+		if affected < undoLogDeleteLimit {
+			return deleted, nil
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package at
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const undoLogTimeFormat = "2006-01-02 15:04:05.999999"
+
+// Field is a column value of a row image.
+type Field struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+type Row []Field
+
+func (row Row) value(name string) interface{} {
+	for _, field := range row {
+		if strings.EqualFold(field.Name, name) {
+			return field.Value
+		}
+	}
+	return nil
+}
+
+// TableRecords is the image of the rows a statement touched.
+type TableRecords struct {
+	TableName string   `json:"tableName"`
+	PKColumns []string `json:"pkColumns"`
+	Rows      []Row    `json:"rows"`
+}
+
+// pkKey formats the primary key of row the way the TC expects it in lock keys,
+// the values of a composite key are joined with '_'.
+func (records TableRecords) pkKey(row Row) string {
+	values := make([]string, 0, len(records.PKColumns))
+	for _, column := range records.PKColumns {
+		values = append(values, formatValue(row.value(column)))
+	}
+	return strings.Join(values, "_")
+}
+
+func (records TableRecords) pkKeys() []string {
+	keys := make([]string, 0, len(records.Rows))
+	for _, row := range records.Rows {
+		keys = append(keys, records.pkKey(row))
+	}
+	return keys
+}
+
+// pkCondition returns the WHERE condition selecting the rows of records by primary key.
+func (records TableRecords) pkCondition() (string, []interface{}) {
+	columns := make([]string, 0, len(records.PKColumns))
+	for _, column := range records.PKColumns {
+		columns = append(columns, quoteName(column))
+	}
+	placeholders := "?" + strings.Repeat(",?", len(columns)-1)
+
+	tuples := make([]string, 0, len(records.Rows))
+	args := make([]interface{}, 0, len(records.Rows)*len(columns))
+	for _, row := range records.Rows {
+		for _, column := range records.PKColumns {
+			args = append(args, row.value(column))
+		}
+		if len(columns) == 1 {
+			tuples = append(tuples, placeholders)
+		} else {
+			tuples = append(tuples, "("+placeholders+")")
+		}
+	}
+	if len(columns) == 1 {
+		return fmt.Sprintf("%s IN (%s)", columns[0], strings.Join(tuples, ",")), args
+	}
+	return fmt.Sprintf("(%s) IN (%s)", strings.Join(columns, ","), strings.Join(tuples, ",")), args
+}
+
+// equals compares the rows of both images by primary key and column values.
+func (records TableRecords) equals(other TableRecords) bool {
+	if len(records.Rows) != len(other.Rows) {
+		return false
+	}
+	otherRows := make(map[string]Row, len(other.Rows))
+	for _, row := range other.Rows {
+		otherRows[other.pkKey(row)] = row
+	}
+	for _, row := range records.Rows {
+		otherRow, ok := otherRows[records.pkKey(row)]
+		if !ok || len(otherRow) != len(row) {
+			return false
+		}
+		for _, field := range row {
+			if formatValue(field.Value) != formatValue(otherRow.value(field.Name)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SQLUndoLog holds the images of a single statement.
+type SQLUndoLog struct {
+	SQLType     SQLType      `json:"sqlType"`
+	TableName   string       `json:"tableName"`
+	BeforeImage TableRecords `json:"beforeImage"`
+	AfterImage  TableRecords `json:"afterImage"`
+}
+
+// BranchUndoLog is the rollback_info of an undo_log row.
+type BranchUndoLog struct {
+	XID         string       `json:"xid"`
+	BranchID    int64        `json:"branchID"`
+	SQLUndoLogs []SQLUndoLog `json:"sqlUndoLogs"`
+}
+
+func (undoLog *BranchUndoLog) Encode() ([]byte, error) {
+	return json.Marshal(undoLog)
+}
+
+// Decode keeps numbers as json.Number so that bigint keys survive the round trip.
+func (undoLog *BranchUndoLog) Decode(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(undoLog)
+}
+
+// normalizeValue turns the values drivers return into values that encode to JSON
+// and bind back as arguments unchanged.
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(undoLogTimeFormat)
+	default:
+		return v
+	}
+}
+
+func formatValue(value interface{}) string {
+	return fmt.Sprint(normalizeValue(value))
+}
+
+// lockKeyBuilder collects the primary keys a local transaction touched and
+// formats them as table1:pk1,pk2;table2:pk3.
+type lockKeyBuilder struct {
+	tables []string
+	keys   map[string][]string
+	seen   map[string]bool
+}
+
+func (builder *lockKeyBuilder) add(tableName string, pkKeys []string) {
+	if builder.keys == nil {
+		builder.keys = make(map[string][]string)
+		builder.seen = make(map[string]bool)
+	}
+	if _, ok := builder.keys[tableName]; !ok {
+		builder.tables = append(builder.tables, tableName)
+		builder.keys[tableName] = nil
+	}
+	for _, pkKey := range pkKeys {
+		if builder.seen[tableName+":"+pkKey] {
+			continue
+		}
+		builder.seen[tableName+":"+pkKey] = true
+		builder.keys[tableName] = append(builder.keys[tableName], pkKey)
+	}
+}
+
+func (builder *lockKeyBuilder) String() string {
+	tableGroupedKeys := make([]string, 0, len(builder.tables))
+	for _, tableName := range builder.tables {
+		if len(builder.keys[tableName]) == 0 {
+			continue
+		}
+		tableGroupedKeys = append(tableGroupedKeys, tableName+":"+strings.Join(builder.keys[tableName], ","))
+	}
+	return strings.Join(tableGroupedKeys, ";")
+}
@@ -47,6 +47,8 @@ type ClientConfig struct {
 	TransactionServiceGroup      string      `yaml:"transaction_service_group" json:"transaction_service_group,omitempty"`
 	EnableClientBatchSendRequest bool        `yaml:"enable-client-batch-send-request" json:"enable-client-batch-send-request,omitempty"`
 	StarfishVersion              string      `yaml:"starfish_version" json:"starfish_version,omitempty"`
+	Codec                        string      `yaml:"codec" json:"codec,omitempty"`   // seata or protobuf
+	Secret                       string      `yaml:"secret" json:"secret,omitempty"` // signs register requests
 	GettyConfig                  GettyConfig `yaml:"getty" json:"getty,omitempty"`
 
 	TMConfig TMConfig `yaml:"tm" json:"tm,omitempty"`
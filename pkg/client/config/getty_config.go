@@ -35,6 +35,12 @@ type GettyConfig struct {
 	// heartbeat
 	HeartbeatPeriod time.Duration `default:"15s" yaml:"heartbeat_period" json:"heartbeat_period,omitempty"`
 
+	// message body compression, gzip, zstd, snappy, lz4 or none
+	Compressor        string `default:"none" yaml:"compressor" json:"compressor,omitempty"`
+	CompressThreshold int    `default:"4096" yaml:"compress_threshold" json:"compress_threshold,omitempty"`
+
+	TLSConfig config2.TLSConfig `yaml:"tls" json:"tls,omitempty"`
+
 	// getty_session tcp parameters
 	GettySessionParam config2.GettySessionParam `required:"true" yaml:"getty_session_param" json:"getty_session_param,omitempty"`
 }
@@ -45,6 +51,8 @@ func GetDefaultGettyConfig() GettyConfig {
 		ReconnectInterval: 0,
 		ConnectionNum:     1,
 		HeartbeatPeriod:   10 * time.Second,
+		Compressor:        "none",
+		CompressThreshold: 4096,
 		GettySessionParam: config2.GettySessionParam{
 			CompressEncoding: false,
 			TCPNoDelay:       true,
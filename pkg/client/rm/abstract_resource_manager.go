@@ -48,7 +48,7 @@ func NewAbstractResourceManager(client *rpc_client.RpcRemoteClient) AbstractReso
 		RpcClient:     client,
 		ResourceCache: make(map[string]model.IResource),
 	}
-	go resourceManager.handleRegisterRM()
+	go resourceManager.handleRegisterRM(client.SubscribeSessionOpen())
 	return resourceManager
 }
 
@@ -66,12 +66,19 @@ func (resourceManager AbstractResourceManager) GetManagedResources() map[string]
 
 func (resourceManager AbstractResourceManager) BranchRegister(branchType meta.BranchType, resourceID string,
 	clientID string, xid string, applicationData []byte, lockKeys string) (int64, error) {
+	return resourceManager.BranchRegisterWithLockMode(branchType, resourceID, clientID, xid, applicationData, lockKeys,
+		meta.LockModeExclusive)
+}
+
+func (resourceManager AbstractResourceManager) BranchRegisterWithLockMode(branchType meta.BranchType, resourceID string,
+	clientID string, xid string, applicationData []byte, lockKeys string, lockMode meta.LockMode) (int64, error) {
 	request := protocal.BranchRegisterRequest{
 		XID:             xid,
 		BranchType:      branchType,
 		ResourceID:      resourceID,
 		LockKey:         lockKeys,
 		ApplicationData: applicationData,
+		LockMode:        lockMode,
 	}
 	resp, err := resourceManager.RpcClient.SendMsgWithResponse(request)
 	if err != nil {
@@ -109,9 +116,9 @@ func (resourceManager AbstractResourceManager) LockQuery(ctx *context.RootContex
 	return false, nil
 }
 
-func (resourceManager AbstractResourceManager) handleRegisterRM() {
+func (resourceManager AbstractResourceManager) handleRegisterRM(sessionOpenChannel <-chan string) {
 	for {
-		serverAddress := <-resourceManager.RpcClient.GettySessionOnOpenChannel
+		serverAddress := <-sessionOpenChannel
 		resourceManager.doRegisterResource(serverAddress)
 	}
 }
@@ -41,6 +41,19 @@ type ResourceManagerOutbound interface {
 	LockQuery(branchType meta.BranchType, resourceID string, xid string, lockKeys string) (bool, error)
 }
 
+// LockModeResourceManagerOutbound registers branches and queries row locks in a
+// given lock mode, its BranchRegister and LockQuery use meta.LockModeExclusive.
+type LockModeResourceManagerOutbound interface {
+	ResourceManagerOutbound
+
+	// Branch register long, the row locks of lockKeys are held in lockMode.
+	BranchRegisterWithLockMode(branchType meta.BranchType, resourceID string, clientID string, xid string, applicationData []byte,
+		lockKeys string, lockMode meta.LockMode) (int64, error)
+
+	// Lock query boolean, whether the row locks of lockKeys could be held in lockMode.
+	LockQueryWithLockMode(branchType meta.BranchType, resourceID string, xid string, lockKeys string, lockMode meta.LockMode) (bool, error)
+}
+
 type ResourceManager interface {
 	ResourceManagerInbound
 	ResourceManagerOutbound
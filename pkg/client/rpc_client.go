@@ -18,6 +18,7 @@
 package client
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 )
@@ -34,6 +35,7 @@ import (
 import (
 	"github.com/transaction-mesh/starfish/pkg/base/extension"
 	"github.com/transaction-mesh/starfish/pkg/base/getty/readwriter"
+	"github.com/transaction-mesh/starfish/pkg/base/getty/tlsconfig"
 	_ "github.com/transaction-mesh/starfish/pkg/base/registry/etcdv3"
 	_ "github.com/transaction-mesh/starfish/pkg/base/registry/file"
 	_ "github.com/transaction-mesh/starfish/pkg/base/registry/nacos"
@@ -46,6 +48,8 @@ type RpcClient struct {
 	conf         *config.ClientConfig
 	gettyClients []getty.Client
 	rpcHandler   *getty2.RpcRemoteClient
+	pkgHandler   *readwriter.RpcPackageHandler
+	tlsBuilder   *tlsconfig.Builder
 }
 
 func NewRpcClient() *RpcClient {
@@ -54,6 +58,20 @@ func NewRpcClient() *RpcClient {
 		gettyClients: make([]getty.Client, 0),
 		rpcHandler:   getty2.InitRpcRemoteClient(),
 	}
+	pkgHandler, err := readwriter.NewRpcPackageHandler(rpcClient.conf.GettyConfig.Compressor,
+		rpcClient.conf.GettyConfig.CompressThreshold, rpcClient.conf.GettyConfig.GettySessionParam.MaxMsgLen)
+	if err != nil {
+		log.Errorf("%v, send message bodies uncompressed instead", err)
+		pkgHandler = readwriter.RpcPkgHandler
+	}
+	rpcClient.pkgHandler = pkgHandler
+	if rpcClient.conf.GettyConfig.TLSConfig.Enabled {
+		tlsBuilder, err := tlsconfig.NewClientBuilder(rpcClient.conf.GettyConfig.TLSConfig)
+		if err != nil {
+			panic(err)
+		}
+		rpcClient.tlsBuilder = tlsBuilder
+	}
 	rpcClient.init()
 	return rpcClient
 }
@@ -64,12 +82,19 @@ func (c *RpcClient) init() {
 		log.Warn("no have valid starfish server list")
 	}
 	for _, address := range addressList {
-		gettyClient := getty.NewTCPClient(
+		options := []getty.ClientOption{
 			getty.WithServerAddress(address),
 			getty.WithConnectionNumber((int)(c.conf.GettyConfig.ConnectionNum)),
 			getty.WithReconnectInterval(c.conf.GettyConfig.ReconnectInterval),
 			getty.WithClientTaskPool(gxsync.NewTaskPoolSimple(0)),
-		)
+		}
+		if c.tlsBuilder != nil {
+			options = append(options,
+				getty.WithClientSslEnabled(true),
+				getty.WithClientTlsConfigBuilder(c.tlsBuilder),
+			)
+		}
+		gettyClient := getty.NewTCPClient(options...)
 		go gettyClient.RunEventLoop(c.newSession)
 		// c.gettyClients = append(c.gettyClients, gettyClient)
 	}
@@ -99,21 +124,22 @@ func (c *RpcClient) newSession(session getty.Session) error {
 		session.SetCompressType(getty.CompressZip)
 	}
 
-	if tcpConn, ok = session.Conn().(*net.TCPConn); !ok {
+	// tcp parameters do not apply to tls connections, getty dials and accepts them
+	if tcpConn, ok = session.Conn().(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(c.conf.GettyConfig.GettySessionParam.TCPNoDelay)
+		tcpConn.SetKeepAlive(c.conf.GettyConfig.GettySessionParam.TCPKeepAlive)
+		if c.conf.GettyConfig.GettySessionParam.TCPKeepAlive {
+			tcpConn.SetKeepAlivePeriod(c.conf.GettyConfig.GettySessionParam.KeepAlivePeriod)
+		}
+		tcpConn.SetReadBuffer(c.conf.GettyConfig.GettySessionParam.TCPRBufSize)
+		tcpConn.SetWriteBuffer(c.conf.GettyConfig.GettySessionParam.TCPWBufSize)
+	} else if _, ok = session.Conn().(*tls.Conn); !ok {
 		panic(fmt.Sprintf("%s, session.conn{%#v} is not tcp connection\n", session.Stat(), session.Conn()))
 	}
 
-	tcpConn.SetNoDelay(c.conf.GettyConfig.GettySessionParam.TCPNoDelay)
-	tcpConn.SetKeepAlive(c.conf.GettyConfig.GettySessionParam.TCPKeepAlive)
-	if c.conf.GettyConfig.GettySessionParam.TCPKeepAlive {
-		tcpConn.SetKeepAlivePeriod(c.conf.GettyConfig.GettySessionParam.KeepAlivePeriod)
-	}
-	tcpConn.SetReadBuffer(c.conf.GettyConfig.GettySessionParam.TCPRBufSize)
-	tcpConn.SetWriteBuffer(c.conf.GettyConfig.GettySessionParam.TCPWBufSize)
-
 	session.SetName(c.conf.GettyConfig.GettySessionParam.SessionName)
 	session.SetMaxMsgLen(c.conf.GettyConfig.GettySessionParam.MaxMsgLen)
-	session.SetPkgHandler(readwriter.RpcPkgHandler)
+	session.SetPkgHandler(c.pkgHandler)
 	session.SetEventListener(c.rpcHandler)
 	session.SetReadTimeout(c.conf.GettyConfig.GettySessionParam.TCPReadTimeout)
 	session.SetWriteTimeout(c.conf.GettyConfig.GettySessionParam.TCPWriteTimeout)
@@ -35,7 +35,9 @@ import (
 )
 
 import (
+	"github.com/transaction-mesh/starfish/pkg/base/auth"
 	getty2 "github.com/transaction-mesh/starfish/pkg/base/getty"
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
 	"github.com/transaction-mesh/starfish/pkg/base/protocal"
 	"github.com/transaction-mesh/starfish/pkg/base/protocal/codec"
 	"github.com/transaction-mesh/starfish/pkg/client/config"
@@ -58,8 +60,16 @@ func InitRpcRemoteClient() *RpcRemoteClient {
 		rpcMessageChannel:            make(chan protocal.RpcMessage, 100),
 		BranchRollbackRequestChannel: make(chan RpcRMMessage),
 		BranchCommitRequestChannel:   make(chan RpcRMMessage),
-		GettySessionOnOpenChannel:    make(chan string),
+		branchChannels:               make(map[meta.BranchType]branchRequestChannels),
+		openedServerAddresses:        make(map[string]bool),
+		sessionCodecs:                &sync.Map{},
 	}
+	codecType, err := codec.ParseCodecType(rpcRemoteClient.conf.Codec)
+	if err != nil {
+		log.Errorf("%v, use seata codec instead", err)
+		codecType = codec.SEATA
+	}
+	rpcRemoteClient.codec = codecType
 	if rpcRemoteClient.conf.EnableClientBatchSendRequest {
 		go rpcRemoteClient.processMergedMessage()
 	}
@@ -78,7 +88,72 @@ type RpcRemoteClient struct {
 	rpcMessageChannel            chan protocal.RpcMessage
 	BranchCommitRequestChannel   chan RpcRMMessage
 	BranchRollbackRequestChannel chan RpcRMMessage
-	GettySessionOnOpenChannel    chan string
+
+	// codec is the configured codec, sessionCodecs holds the codec each server
+	// session settled on when the client registered.
+	codec         byte
+	sessionCodecs *sync.Map
+
+	mu                     sync.RWMutex
+	branchChannels         map[meta.BranchType]branchRequestChannels
+	sessionOpenSubscribers []chan string
+	openedServerAddresses  map[string]bool
+	undoLogDeleteChannel   chan RpcRMMessage
+}
+
+type branchRequestChannels struct {
+	commit   chan RpcRMMessage
+	rollback chan RpcRMMessage
+}
+
+// RegisterBranchChannels routes the branch commit and rollback requests of branchType to
+// dedicated channels, requests of the other branch types keep arriving on
+// BranchCommitRequestChannel and BranchRollbackRequestChannel.
+func (client *RpcRemoteClient) RegisterBranchChannels(branchType meta.BranchType) (chan RpcRMMessage, chan RpcRMMessage) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	channels, ok := client.branchChannels[branchType]
+	if !ok {
+		channels = branchRequestChannels{
+			commit:   make(chan RpcRMMessage),
+			rollback: make(chan RpcRMMessage),
+		}
+		client.branchChannels[branchType] = channels
+	}
+	return channels.commit, channels.rollback
+}
+
+// RegisterUndoLogDeleteChannel returns the channel UndoLogDeleteRequest is delivered
+// to, the request is dropped while no channel is registered.
+func (client *RpcRemoteClient) RegisterUndoLogDeleteChannel() chan RpcRMMessage {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.undoLogDeleteChannel == nil {
+		client.undoLogDeleteChannel = make(chan RpcRMMessage)
+	}
+	return client.undoLogDeleteChannel
+}
+
+// SubscribeSessionOpen returns a channel receiving the address of every registered
+// server session, the sessions opened before subscribing are replayed first. Each
+// resource manager subscribes on its own.
+func (client *RpcRemoteClient) SubscribeSessionOpen() <-chan string {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	subscriber := make(chan string)
+	client.sessionOpenSubscribers = append(client.sessionOpenSubscribers, subscriber)
+	opened := make([]string, 0, len(client.openedServerAddresses))
+	for serverAddress := range client.openedServerAddresses {
+		opened = append(opened, serverAddress)
+	}
+	if len(opened) > 0 {
+		go func() {
+			for _, serverAddress := range opened {
+				subscriber <- serverAddress
+			}
+		}()
+	}
+	return subscriber
 }
 
 // OnOpen ...
@@ -89,10 +164,30 @@ func (client *RpcRemoteClient) OnOpen(session getty.Session) error {
 			ApplicationID:           client.conf.ApplicationID,
 			TransactionServiceGroup: client.conf.TransactionServiceGroup,
 		}}
-		_, err := client.sendAsyncRequestWithResponse(session, request, RPC_REQUEST_TIMEOUT)
+		client.sessionCodecs.Store(session, client.codec)
+		resp, err := client.sendAsyncRequestWithResponse(session, request, RPC_REQUEST_TIMEOUT)
+		if err != nil && client.codec != codec.SEATA {
+			log.Warnf("register on %s with codec %d failed, fall back to seata codec: %v", session.RemoteAddr(), client.codec, err)
+			client.sessionCodecs.Store(session, codec.SEATA)
+			resp, err = client.sendAsyncRequestWithResponse(session, request, RPC_REQUEST_TIMEOUT)
+		}
+		if response, ok := resp.(protocal.RegisterTMResponse); ok && !response.Identified {
+			log.Errorf("register on %s refused: %s", session.RemoteAddr(), response.Msg)
+			session.Close()
+			return
+		}
 		if err == nil {
+			if response, ok := resp.(protocal.RegisterTMResponse); ok && response.Version != "" {
+				log.Infof("registered on %s, server version %s", session.RemoteAddr(), response.Version)
+			}
 			clientSessionManager.RegisterGettySession(session)
-			client.GettySessionOnOpenChannel <- session.RemoteAddr()
+			client.mu.Lock()
+			client.openedServerAddresses[session.RemoteAddr()] = true
+			subscribers := client.sessionOpenSubscribers
+			client.mu.Unlock()
+			for _, subscriber := range subscribers {
+				subscriber <- session.RemoteAddr()
+			}
 		}
 	}()
 
@@ -102,11 +197,29 @@ func (client *RpcRemoteClient) OnOpen(session getty.Session) error {
 // OnError ...
 func (client *RpcRemoteClient) OnError(session getty.Session, err error) {
 	clientSessionManager.ReleaseGettySession(session)
+	client.sessionCodecs.Delete(session)
+	client.forgetServerAddress(session.RemoteAddr())
 }
 
 // OnClose ...
 func (client *RpcRemoteClient) OnClose(session getty.Session) {
 	clientSessionManager.ReleaseGettySession(session)
+	client.sessionCodecs.Delete(session)
+	client.forgetServerAddress(session.RemoteAddr())
+}
+
+// codecOf returns the codec the messages sent on session are encoded with.
+func (client *RpcRemoteClient) codecOf(session getty.Session) byte {
+	if codecType, ok := client.sessionCodecs.Load(session); ok {
+		return codecType.(byte)
+	}
+	return client.codec
+}
+
+func (client *RpcRemoteClient) forgetServerAddress(serverAddress string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	delete(client.openedServerAddresses, serverAddress)
 }
 
 // OnMessage ...
@@ -171,22 +284,47 @@ func (client *RpcRemoteClient) onMessage(rpcMessage protocal.RpcMessage, serverA
 	log.Debugf("onMessage: %#v", msg)
 	switch msg.GetTypeCode() {
 	case protocal.TypeBranchCommit:
-		client.BranchCommitRequestChannel <- RpcRMMessage{
+		channel := client.BranchCommitRequestChannel
+		if channels, ok := client.getBranchChannels(msg.(protocal.BranchCommitRequest).BranchType); ok {
+			channel = channels.commit
+		}
+		channel <- RpcRMMessage{
 			RpcMessage:    rpcMessage,
 			ServerAddress: serverAddress,
 		}
 	case protocal.TypeBranchRollback:
-		client.BranchRollbackRequestChannel <- RpcRMMessage{
+		channel := client.BranchRollbackRequestChannel
+		if channels, ok := client.getBranchChannels(msg.(protocal.BranchRollbackRequest).BranchType); ok {
+			channel = channels.rollback
+		}
+		channel <- RpcRMMessage{
 			RpcMessage:    rpcMessage,
 			ServerAddress: serverAddress,
 		}
 	case protocal.TypeRmDeleteUndolog:
-		break
+		client.mu.RLock()
+		channel := client.undoLogDeleteChannel
+		client.mu.RUnlock()
+		if channel == nil {
+			log.Debugf("no resource manager handles undo log delete request: %v", msg)
+			break
+		}
+		channel <- RpcRMMessage{
+			RpcMessage:    rpcMessage,
+			ServerAddress: serverAddress,
+		}
 	default:
 		break
 	}
 }
 
+func (client *RpcRemoteClient) getBranchChannels(branchType meta.BranchType) (branchRequestChannels, bool) {
+	client.mu.RLock()
+	defer client.mu.RUnlock()
+	channels, ok := client.branchChannels[branchType]
+	return channels, ok
+}
+
 //*************************************
 // ClientMessageSender
 //*************************************
@@ -226,8 +364,9 @@ func (client *RpcRemoteClient) sendAsyncRequest(session getty.Session, msg inter
 	rpcMessage := protocal.RpcMessage{
 		ID:          int32(client.idGenerator.Inc()),
 		MessageType: protocal.MSGTypeRequestOneway,
-		Codec:       codec.SEATA,
+		Codec:       client.codecOf(session),
 		Compressor:  0,
+		HeadMap:     client.headMapOf(msg),
 		Body:        msg,
 	}
 	resp := getty2.NewMessageFuture(rpcMessage)
@@ -260,12 +399,29 @@ func (client *RpcRemoteClient) sendAsyncRequest(session getty.Session, msg inter
 	return nil, err
 }
 
+// headMapOf signs the register requests when the client has a secret.
+func (client *RpcRemoteClient) headMapOf(msg interface{}) map[string]string {
+	if client.conf.Secret == "" {
+		return nil
+	}
+	var request protocal.AbstractIdentifyRequest
+	switch req := msg.(type) {
+	case protocal.RegisterTMRequest:
+		request = req.AbstractIdentifyRequest
+	case protocal.RegisterRMRequest:
+		request = req.AbstractIdentifyRequest
+	default:
+		return nil
+	}
+	return auth.SignedHeadMap(client.conf.Secret, request.ApplicationID, request.TransactionServiceGroup, time.Now())
+}
+
 func (client *RpcRemoteClient) sendAsyncRequest2(msg interface{}, timeout time.Duration) (interface{}, error) {
 	var err error
 	rpcMessage := protocal.RpcMessage{
 		ID:          int32(client.idGenerator.Inc()),
 		MessageType: protocal.MSGTypeRequest,
-		Codec:       codec.SEATA,
+		Codec:       client.codec,
 		Compressor:  0,
 		Body:        msg,
 	}
@@ -297,8 +453,9 @@ func (client *RpcRemoteClient) sendAsync(session getty.Session, msg interface{})
 	rpcMessage := protocal.RpcMessage{
 		ID:          int32(client.idGenerator.Inc()),
 		MessageType: protocal.MSGTypeRequestOneway,
-		Codec:       codec.SEATA,
+		Codec:       client.codecOf(session),
 		Compressor:  0,
+		HeadMap:     client.headMapOf(msg),
 		Body:        msg,
 	}
 	log.Infof("store message, id %d : %#v", rpcMessage.ID, msg)
@@ -318,7 +475,7 @@ func (client *RpcRemoteClient) sendAsync(session getty.Session, msg interface{})
 func (client *RpcRemoteClient) defaultSendRequest(session getty.Session, msg interface{}) {
 	rpcMessage := protocal.RpcMessage{
 		ID:         int32(client.idGenerator.Inc()),
-		Codec:      codec.SEATA,
+		Codec:      client.codecOf(session),
 		Compressor: 0,
 		Body:       msg,
 	}
@@ -0,0 +1,45 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xa
+
+import (
+	"database/sql"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+)
+
+// XAResource is a database whose driver supports the XA statements.
+type XAResource struct {
+	ResourceGroupID string
+	ResourceID      string
+	DB              *sql.DB
+}
+
+func (resource *XAResource) GetResourceGroupID() string {
+	return resource.ResourceGroupID
+}
+
+func (resource *XAResource) GetResourceID() string {
+	return resource.ResourceID
+}
+
+func (resource *XAResource) GetBranchType() meta.BranchType {
+	return meta.BranchTypeXA
+}
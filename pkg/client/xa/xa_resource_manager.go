@@ -0,0 +1,337 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xa
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+import (
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/client/context"
+	"github.com/transaction-mesh/starfish/pkg/client/rm"
+	"github.com/transaction-mesh/starfish/pkg/client/rpc_client"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+)
+
+// ER_XAER_NOTA, the database does not know the xa transaction any more.
+const mysqlErrXAErNota = 1397
+
+var xaResourceManager XAResourceManager
+
+// phaseOne counts per xid the branches this process is registering or running
+// phase one of, until they are prepared or rolled back.
+var phaseOne = struct {
+	sync.Mutex
+	xids map[string]int
+}{xids: make(map[string]int)}
+
+var _ rm.ResourceManager = XAResourceManager{}
+var _ rm.LockModeResourceManagerOutbound = XAResourceManager{}
+
+func InitXAResourceManager() {
+	client := rpc_client.GetRpcRemoteClient()
+	xaResourceManager = XAResourceManager{
+		AbstractResourceManager: rm.NewAbstractResourceManager(client),
+	}
+	commitChannel, rollbackChannel := client.RegisterBranchChannels(meta.BranchTypeXA)
+	go xaResourceManager.handleBranchCommit(commitChannel)
+	go xaResourceManager.handleBranchRollback(rollbackChannel)
+}
+
+func GetXAResourceManager() XAResourceManager {
+	return xaResourceManager
+}
+
+// XAResourceManager prepares the branch of every XAResource in phase one and
+// commits or rolls back the prepared xa transaction when the TC asks to.
+type XAResourceManager struct {
+	rm.AbstractResourceManager
+}
+
+func (resourceManager XAResourceManager) BranchCommit(branchType meta.BranchType, xid string, branchID int64,
+	resourceID string, applicationData []byte) (meta.BranchStatus, error) {
+	resource, err := resourceManager.getXAResource(resourceID)
+	if err != nil {
+		return 0, err
+	}
+	err = execXA(resource.DB, "XA COMMIT "+xaBranchID(xid, branchID))
+	if err != nil && !isXAErNota(err) {
+		log.Errorf("XA resource commit failed, XID: %s, BranchID: %d, ResourceID: %s, err: %v", xid, branchID, resourceID, err)
+		return meta.BranchStatusPhaseTwoCommitFailedRetryable, nil
+	}
+	return meta.BranchStatusPhaseTwoCommitted, nil
+}
+
+func (resourceManager XAResourceManager) BranchRollback(branchType meta.BranchType, xid string, branchID int64,
+	resourceID string, applicationData []byte) (meta.BranchStatus, error) {
+	resource, err := resourceManager.getXAResource(resourceID)
+	if err != nil {
+		return 0, err
+	}
+	xaID := xaBranchID(xid, branchID)
+	// the branch is registered before XA START, the database does not know it
+	// yet and would take it up again once the TC considers it rolled back
+	if inPhaseOne(xid) {
+		log.Infof("XA branch may still be in phase one, retry rollback later, XID: %s, BranchID: %d", xid, branchID)
+		return meta.BranchStatusPhaseTwoRollbackFailedRetryable, nil
+	}
+	err = execXA(resource.DB, "XA ROLLBACK "+xaID)
+	if err != nil && isXAErNota(err) {
+		// unknown to the database, rolled back unless it is prepared anyway
+		var recovered bool
+		if recovered, err = xaRecovered(resource.DB, xid, branchID); err == nil && recovered {
+			err = errors.Errorf("XA ROLLBACK %s reported XAER_NOTA for a prepared branch", xaID)
+		}
+	}
+	if err != nil {
+		log.Errorf("XA resource rollback failed, XID: %s, BranchID: %d, ResourceID: %s, err: %v", xid, branchID, resourceID, err)
+		return meta.BranchStatusPhaseTwoRollbackFailedRetryable, nil
+	}
+	return meta.BranchStatusPhaseTwoRolledBack, nil
+}
+
+// LockQuery always succeeds, the database holds the row locks of an xa branch until phase two.
+func (resourceManager XAResourceManager) LockQuery(branchType meta.BranchType, resourceID string, xid string,
+	lockKeys string) (bool, error) {
+	return true, nil
+}
+
+func (resourceManager XAResourceManager) LockQueryWithLockMode(branchType meta.BranchType, resourceID string, xid string,
+	lockKeys string, lockMode meta.LockMode) (bool, error) {
+	return true, nil
+}
+
+func (resourceManager XAResourceManager) GetBranchType() meta.BranchType {
+	return meta.BranchTypeXA
+}
+
+func (resourceManager XAResourceManager) getXAResource(resourceID string) (*XAResource, error) {
+	resource := resourceManager.ResourceCache[resourceID]
+	if resource == nil {
+		log.Errorf("XA resource does not exist, resourceID: %s", resourceID)
+		return nil, errors.Errorf("XA resource does not exist, resourceID: %s", resourceID)
+	}
+	xaResource, ok := resource.(*XAResource)
+	if !ok || xaResource.DB == nil {
+		log.Errorf("XA resource is not available, resourceID: %s", resourceID)
+		return nil, errors.Errorf("XA resource is not available, resourceID: %s", resourceID)
+	}
+	return xaResource, nil
+}
+
+// Execute runs fn inside an xa branch of the global transaction bound to ctx, the
+// branch is registered before XA START and left prepared when fn succeeds. Until
+// then rollbacks of the branches of the global transaction are answered as
+// retryable. Outside of a global transaction fn runs on a plain connection.
+func Execute(ctx *context.RootContext, resource *XAResource, fn func(conn *sql.Conn) error) error {
+	return execute(ctx, xaResourceManager, resource, fn)
+}
+
+func execute(ctx *context.RootContext, outbound rm.ResourceManagerOutbound, resource *XAResource,
+	fn func(conn *sql.Conn) error) error {
+	conn, err := resource.DB.Conn(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	if !ctx.InGlobalTransaction() {
+		return fn(conn)
+	}
+
+	xid := ctx.GetXID()
+	beginPhaseOne(xid)
+	defer endPhaseOne(xid)
+	branchID, err := outbound.BranchRegister(meta.BranchTypeXA, resource.GetResourceID(), "", xid, nil, "")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	xaID := xaBranchID(xid, branchID)
+
+	if _, err = conn.ExecContext(ctx, "XA START "+xaID); err != nil {
+		reportPhaseOneFailed(outbound, xid, branchID)
+		return errors.WithStack(err)
+	}
+	if err = fn(conn); err != nil {
+		if _, endErr := conn.ExecContext(ctx, "XA END "+xaID); endErr != nil {
+			log.Errorf("XA END failed, XID: %s, BranchID: %d, err: %v", xid, branchID, endErr)
+		}
+		rollbackPhaseOne(ctx, conn, outbound, xid, branchID)
+		return err
+	}
+	if _, err = conn.ExecContext(ctx, "XA END "+xaID); err != nil {
+		rollbackPhaseOne(ctx, conn, outbound, xid, branchID)
+		return errors.WithStack(err)
+	}
+	if _, err = conn.ExecContext(ctx, "XA PREPARE "+xaID); err != nil {
+		rollbackPhaseOne(ctx, conn, outbound, xid, branchID)
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func rollbackPhaseOne(ctx *context.RootContext, conn *sql.Conn, outbound rm.ResourceManagerOutbound, xid string, branchID int64) {
+	if _, err := conn.ExecContext(ctx, "XA ROLLBACK "+xaBranchID(xid, branchID)); err != nil && !isXAErNota(err) {
+		log.Errorf("XA ROLLBACK failed, XID: %s, BranchID: %d, err: %v", xid, branchID, err)
+	}
+	reportPhaseOneFailed(outbound, xid, branchID)
+}
+
+func beginPhaseOne(xid string) {
+	phaseOne.Lock()
+	defer phaseOne.Unlock()
+	phaseOne.xids[xid]++
+}
+
+func endPhaseOne(xid string) {
+	phaseOne.Lock()
+	defer phaseOne.Unlock()
+	if phaseOne.xids[xid] <= 1 {
+		delete(phaseOne.xids, xid)
+	} else {
+		phaseOne.xids[xid]--
+	}
+}
+
+// inPhaseOne tells whether a branch of xid is in phase one, its id is unknown
+// until the registration returns.
+func inPhaseOne(xid string) bool {
+	phaseOne.Lock()
+	defer phaseOne.Unlock()
+	return phaseOne.xids[xid] > 0
+}
+
+func reportPhaseOneFailed(outbound rm.ResourceManagerOutbound, xid string, branchID int64) {
+	err := outbound.BranchReport(meta.BranchTypeXA, xid, branchID, meta.BranchStatusPhaseOneFailed, nil)
+	if err != nil {
+		log.Errorf("branch report err: %v", err)
+	}
+}
+
+func execXA(db *sql.DB, statement string) error {
+	_, err := db.Exec(statement)
+	return err
+}
+
+// xaRecovered tells whether XA RECOVER lists the branch as prepared.
+func xaRecovered(db *sql.DB, xid string, branchID int64) (bool, error) {
+	rows, err := db.Query("XA RECOVER")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	bqual := strconv.FormatInt(branchID, 10)
+	for rows.Next() {
+		var (
+			formatID, gtridLength, bqualLength int
+			data                               string
+		)
+		if err = rows.Scan(&formatID, &gtridLength, &bqualLength, &data); err != nil {
+			return false, err
+		}
+		if gtridLength == len(xid) && bqualLength == len(bqual) && data == xid+bqual {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// xaBranchID builds the 'gtrid','bqual' pair identifying a branch in XA statements.
+func xaBranchID(xid string, branchID int64) string {
+	return fmt.Sprintf("'%s','%s'", strings.ReplaceAll(xid, "'", "''"), strconv.FormatInt(branchID, 10))
+}
+
+func isXAErNota(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == mysqlErrXAErNota
+	}
+	return strings.Contains(err.Error(), "XAER_NOTA")
+}
+
+func (resourceManager XAResourceManager) handleBranchCommit(channel <-chan rpc_client.RpcRMMessage) {
+	for {
+		rpcRMMessage := <-channel
+		rpcMessage := rpcRMMessage.RpcMessage
+		serviceAddress := rpcRMMessage.ServerAddress
+
+		req := rpcMessage.Body.(protocal.BranchCommitRequest)
+		resp := resourceManager.doBranchCommit(req)
+		resourceManager.RpcClient.SendResponse(rpcMessage, serviceAddress, resp)
+	}
+}
+
+func (resourceManager XAResourceManager) handleBranchRollback(channel <-chan rpc_client.RpcRMMessage) {
+	for {
+		rpcRMMessage := <-channel
+		rpcMessage := rpcRMMessage.RpcMessage
+		serviceAddress := rpcRMMessage.ServerAddress
+
+		req := rpcMessage.Body.(protocal.BranchRollbackRequest)
+		resp := resourceManager.doBranchRollback(req)
+		resourceManager.RpcClient.SendResponse(rpcMessage, serviceAddress, resp)
+	}
+}
+
+func (resourceManager XAResourceManager) doBranchCommit(request protocal.BranchCommitRequest) protocal.BranchCommitResponse {
+	var resp = protocal.BranchCommitResponse{}
+
+	log.Infof("Branch committing, XID: %s, BranchID: %d, ResourceID: %s", request.XID, request.BranchID, request.ResourceID)
+	status, err := resourceManager.BranchCommit(request.BranchType, request.XID, request.BranchID, request.ResourceID, request.ApplicationData)
+	if err != nil {
+		resp.ResultCode = protocal.ResultCodeFailed
+		resp.Msg = fmt.Sprintf("RuntimeException[%s]", err.Error())
+		log.Errorf("Catch RuntimeException while do RPC, request: %v", request)
+		return resp
+	}
+	resp.XID = request.XID
+	resp.BranchID = request.BranchID
+	resp.BranchStatus = status
+	resp.ResultCode = protocal.ResultCodeSuccess
+	return resp
+}
+
+func (resourceManager XAResourceManager) doBranchRollback(request protocal.BranchRollbackRequest) protocal.BranchRollbackResponse {
+	var resp = protocal.BranchRollbackResponse{}
+
+	log.Infof("Branch rolling back: XID: %s, BranchID: %d, ResourceID: %s", request.XID, request.BranchID, request.ResourceID)
+	status, err := resourceManager.BranchRollback(request.BranchType, request.XID, request.BranchID, request.ResourceID, request.ApplicationData)
+	if err != nil {
+		resp.ResultCode = protocal.ResultCodeFailed
+		resp.Msg = fmt.Sprintf("RuntimeException[%s]", err.Error())
+		log.Errorf("Catch RuntimeException while do RPC, request: %v", request)
+		return resp
+	}
+	resp.XID = request.XID
+	resp.BranchID = request.BranchID
+	resp.BranchStatus = status
+	resp.ResultCode = protocal.ResultCodeSuccess
+	return resp
+}
@@ -0,0 +1,383 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package xa
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+import (
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/pkg/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/base/model"
+	rootcontext "github.com/transaction-mesh/starfish/pkg/client/context"
+	"github.com/transaction-mesh/starfish/pkg/client/rm"
+)
+
+const testXID = "127.0.0.1:8091:2000042"
+
+func TestXAResourceManager_BranchCommit(t *testing.T) {
+	resource, fake := xaResourceProvider(t)
+	resourceManager := xaResourceManagerProvider(resource)
+
+	status, err := resourceManager.BranchCommit(meta.BranchTypeXA, testXID, 1, resource.ResourceID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.BranchStatusPhaseTwoCommitted, status)
+	assert.Equal(t, []string{"XA COMMIT '127.0.0.1:8091:2000042','1'"}, fake.statements())
+
+	// The branch is already committed, a retried commit must not block the global transaction.
+	fake.failOn("XA COMMIT", &mysql.MySQLError{Number: mysqlErrXAErNota, Message: "XAER_NOTA: Unknown XID"})
+	status, err = resourceManager.BranchCommit(meta.BranchTypeXA, testXID, 1, resource.ResourceID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.BranchStatusPhaseTwoCommitted, status)
+
+	fake.failOn("XA COMMIT", errors.New("connection refused"))
+	status, err = resourceManager.BranchCommit(meta.BranchTypeXA, testXID, 1, resource.ResourceID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.BranchStatusPhaseTwoCommitFailedRetryable, status)
+
+	_, err = resourceManager.BranchCommit(meta.BranchTypeXA, testXID, 1, "unknown", nil)
+	assert.NotNil(t, err)
+}
+
+func TestXAResourceManager_BranchRollback(t *testing.T) {
+	resource, fake := xaResourceProvider(t)
+	resourceManager := xaResourceManagerProvider(resource)
+
+	status, err := resourceManager.BranchRollback(meta.BranchTypeXA, testXID, 2, resource.ResourceID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.BranchStatusPhaseTwoRolledBack, status)
+	assert.Equal(t, []string{"XA ROLLBACK '127.0.0.1:8091:2000042','2'"}, fake.statements())
+
+	fake.failOn("XA ROLLBACK", errors.New("XAER_NOTA: Unknown XID"))
+	status, err = resourceManager.BranchRollback(meta.BranchTypeXA, testXID, 2, resource.ResourceID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.BranchStatusPhaseTwoRolledBack, status)
+
+	fake.failOn("XA ROLLBACK", errors.New("connection refused"))
+	status, err = resourceManager.BranchRollback(meta.BranchTypeXA, testXID, 2, resource.ResourceID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.BranchStatusPhaseTwoRollbackFailedRetryable, status)
+}
+
+func TestXAResourceManager_BranchRollbackPrepared(t *testing.T) {
+	resource, fake := xaResourceProvider(t)
+	resourceManager := xaResourceManagerProvider(resource)
+
+	// XAER_NOTA is only trusted once XA RECOVER no longer lists the branch.
+	fake.failOn("XA ROLLBACK", &mysql.MySQLError{Number: mysqlErrXAErNota, Message: "XAER_NOTA: Unknown XID"})
+	fake.prepare(testXID, "2")
+	status, err := resourceManager.BranchRollback(meta.BranchTypeXA, testXID, 2, resource.ResourceID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.BranchStatusPhaseTwoRollbackFailedRetryable, status)
+	assert.Equal(t, []string{"XA ROLLBACK '127.0.0.1:8091:2000042','2'", "XA RECOVER"}, fake.statements())
+
+	// another branch of the same global transaction is prepared
+	status, err = resourceManager.BranchRollback(meta.BranchTypeXA, testXID, 20, resource.ResourceID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.BranchStatusPhaseTwoRolledBack, status)
+
+	fake.failOn("XA RECOVER", errors.New("connection refused"))
+	status, err = resourceManager.BranchRollback(meta.BranchTypeXA, testXID, 3, resource.ResourceID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.BranchStatusPhaseTwoRollbackFailedRetryable, status)
+}
+
+func TestExecute_RollbackDuringPhaseOne(t *testing.T) {
+	resource, fake := xaResourceProvider(t)
+	resourceManager := xaResourceManagerProvider(resource)
+	fake.failOn("XA ROLLBACK", &mysql.MySQLError{Number: mysqlErrXAErNota, Message: "XAER_NOTA: Unknown XID"})
+
+	// the TC rolls the branch back between its registration and XA START, then
+	// again while it runs, neither may be reported as rolled back.
+	var statuses []meta.BranchStatus
+	rollback := func() {
+		status, err := resourceManager.BranchRollback(meta.BranchTypeXA, testXID, 9, resource.ResourceID, nil)
+		assert.Nil(t, err)
+		statuses = append(statuses, status)
+	}
+	outbound := &outboundRecorder{branchID: 9, onRegister: rollback}
+	err := execute(globalContextProvider(), outbound, resource, func(conn *sql.Conn) error {
+		rollback()
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []meta.BranchStatus{
+		meta.BranchStatusPhaseTwoRollbackFailedRetryable,
+		meta.BranchStatusPhaseTwoRollbackFailedRetryable,
+	}, statuses)
+	assert.Equal(t, []string{
+		"XA START '127.0.0.1:8091:2000042','9'",
+		"XA END '127.0.0.1:8091:2000042','9'",
+		"XA PREPARE '127.0.0.1:8091:2000042','9'",
+	}, fake.statements())
+
+	// the retried rollback reaches the prepared branch
+	fake.reset()
+	status, err := resourceManager.BranchRollback(meta.BranchTypeXA, testXID, 9, resource.ResourceID, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.BranchStatusPhaseTwoRolledBack, status)
+	assert.Equal(t, []string{"XA ROLLBACK '127.0.0.1:8091:2000042','9'"}, fake.statements())
+}
+
+func TestExecute_PhaseOne(t *testing.T) {
+	resource, fake := xaResourceProvider(t)
+	outbound := &outboundRecorder{branchID: 7}
+
+	err := execute(globalContextProvider(), outbound, resource, func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(context.Background(), "UPDATE account SET money = money - 1")
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []meta.BranchType{meta.BranchTypeXA}, outbound.registered)
+	assert.Equal(t, []string{
+		"XA START '127.0.0.1:8091:2000042','7'",
+		"UPDATE account SET money = money - 1",
+		"XA END '127.0.0.1:8091:2000042','7'",
+		"XA PREPARE '127.0.0.1:8091:2000042','7'",
+	}, fake.statements())
+	assert.Empty(t, outbound.reported)
+}
+
+func TestExecute_PhaseOneFailed(t *testing.T) {
+	resource, fake := xaResourceProvider(t)
+	outbound := &outboundRecorder{branchID: 8}
+
+	businessErr := errors.New("insufficient balance")
+	err := execute(globalContextProvider(), outbound, resource, func(conn *sql.Conn) error {
+		return businessErr
+	})
+	assert.Equal(t, businessErr, err)
+	assert.Equal(t, []string{
+		"XA START '127.0.0.1:8091:2000042','8'",
+		"XA END '127.0.0.1:8091:2000042','8'",
+		"XA ROLLBACK '127.0.0.1:8091:2000042','8'",
+	}, fake.statements())
+	assert.Equal(t, []meta.BranchStatus{meta.BranchStatusPhaseOneFailed}, outbound.reported)
+
+	fake.reset()
+	outbound.reported = nil
+	fake.failOn("XA PREPARE", errors.New("deadlock found"))
+	err = execute(globalContextProvider(), outbound, resource, func(conn *sql.Conn) error {
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, "XA ROLLBACK '127.0.0.1:8091:2000042','8'", fake.statements()[3])
+	assert.Equal(t, []meta.BranchStatus{meta.BranchStatusPhaseOneFailed}, outbound.reported)
+}
+
+func TestExecute_NotInGlobalTransaction(t *testing.T) {
+	resource, fake := xaResourceProvider(t)
+	outbound := &outboundRecorder{}
+
+	err := execute(rootcontext.NewRootContext(context.Background()), outbound, resource, func(conn *sql.Conn) error {
+		_, err := conn.ExecContext(context.Background(), "SELECT 1")
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, outbound.registered)
+	assert.Equal(t, []string{"SELECT 1"}, fake.statements())
+}
+
+func TestXABranchID(t *testing.T) {
+	assert.Equal(t, "'it''s','3'", xaBranchID("it's", 3))
+}
+
+func xaResourceProvider(t *testing.T) (*XAResource, *fakeXADriver) {
+	fake := &fakeXADriver{failures: make(map[string]error)}
+	db := sql.OpenDB(fake)
+	t.Cleanup(func() { db.Close() })
+	return &XAResource{ResourceGroupID: "my_test_tx_group", ResourceID: "jdbc:mysql://127.0.0.1:3306/order", DB: db}, fake
+}
+
+func xaResourceManagerProvider(resource *XAResource) XAResourceManager {
+	return XAResourceManager{
+		AbstractResourceManager: rm.AbstractResourceManager{
+			ResourceCache: map[string]model.IResource{resource.GetResourceID(): resource},
+		},
+	}
+}
+
+func globalContextProvider() *rootcontext.RootContext {
+	ctx := rootcontext.NewRootContext(context.Background())
+	ctx.Bind(testXID)
+	return ctx
+}
+
+type outboundRecorder struct {
+	branchID   int64
+	registered []meta.BranchType
+	reported   []meta.BranchStatus
+	onRegister func()
+}
+
+func (outbound *outboundRecorder) BranchRegister(branchType meta.BranchType, resourceID string, clientID string,
+	xid string, applicationData []byte, lockKeys string) (int64, error) {
+	outbound.registered = append(outbound.registered, branchType)
+	if outbound.onRegister != nil {
+		outbound.onRegister()
+	}
+	return outbound.branchID, nil
+}
+
+func (outbound *outboundRecorder) BranchReport(branchType meta.BranchType, xid string, branchID int64,
+	status meta.BranchStatus, applicationData []byte) error {
+	outbound.reported = append(outbound.reported, status)
+	return nil
+}
+
+func (outbound *outboundRecorder) LockQuery(branchType meta.BranchType, resourceID string, xid string,
+	lockKeys string) (bool, error) {
+	return true, nil
+}
+
+// fakeXADriver records every statement and fails those starting with a configured prefix,
+// XA RECOVER lists the branches passed to prepare.
+type fakeXADriver struct {
+	mu       sync.Mutex
+	executed []string
+	failures map[string]error
+	prepared [][2]string
+}
+
+func (fake *fakeXADriver) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fakeXAConn{driver: fake}, nil
+}
+
+func (fake *fakeXADriver) Driver() driver.Driver {
+	return nil
+}
+
+func (fake *fakeXADriver) failOn(prefix string, err error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.failures[prefix] = err
+}
+
+func (fake *fakeXADriver) prepare(gtrid, bqual string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.prepared = append(fake.prepared, [2]string{gtrid, bqual})
+}
+
+func (fake *fakeXADriver) recover() ([][]driver.Value, error) {
+	if err := fake.exec("XA RECOVER"); err != nil {
+		return nil, err
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	var rows [][]driver.Value
+	for _, branch := range fake.prepared {
+		rows = append(rows, []driver.Value{int64(1), int64(len(branch[0])), int64(len(branch[1])), []byte(branch[0] + branch[1])})
+	}
+	return rows, nil
+}
+
+func (fake *fakeXADriver) reset() {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.executed = nil
+	fake.failures = make(map[string]error)
+	fake.prepared = nil
+}
+
+func (fake *fakeXADriver) statements() []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return append([]string(nil), fake.executed...)
+}
+
+func (fake *fakeXADriver) exec(query string) error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.executed = append(fake.executed, query)
+	for prefix, err := range fake.failures {
+		if strings.HasPrefix(query, prefix) {
+			return err
+		}
+	}
+	return nil
+}
+
+type fakeXAConn struct {
+	driver *fakeXADriver
+}
+
+func (conn *fakeXAConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := conn.driver.exec(query); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (conn *fakeXAConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if query != "XA RECOVER" {
+		return nil, errors.New("fake xa driver only queries XA RECOVER")
+	}
+	rows, err := conn.driver.recover()
+	if err != nil {
+		return nil, err
+	}
+	return &fakeXARows{rows: rows}, nil
+}
+
+func (conn *fakeXAConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fake xa driver only supports Exec and XA RECOVER")
+}
+
+func (conn *fakeXAConn) Close() error {
+	return nil
+}
+
+func (conn *fakeXAConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fake xa driver does not support local transactions")
+}
+
+type fakeXARows struct {
+	rows [][]driver.Value
+}
+
+func (rows *fakeXARows) Columns() []string {
+	return []string{"formatID", "gtrid_length", "bqual_length", "data"}
+}
+
+func (rows *fakeXARows) Close() error {
+	return nil
+}
+
+func (rows *fakeXARows) Next(dest []driver.Value) error {
+	if len(rows.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.rows[0])
+	rows.rows = rows.rows[1:]
+	return nil
+}
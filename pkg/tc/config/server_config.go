@@ -30,6 +30,8 @@ import (
 
 	"github.com/creasty/defaults"
 
+	"github.com/go-redis/redis/v7"
+
 	"github.com/go-xorm/xorm"
 
 	"github.com/imdario/mergo"
@@ -40,9 +42,12 @@ import (
 )
 
 import (
+	"github.com/transaction-mesh/starfish/common/version"
 	"github.com/transaction-mesh/starfish/pkg/base/config"
 	"github.com/transaction-mesh/starfish/pkg/base/config_center"
 	"github.com/transaction-mesh/starfish/pkg/base/extension"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal/compressor"
+	"github.com/transaction-mesh/starfish/pkg/tc/embedded"
 	"github.com/transaction-mesh/starfish/pkg/util/log"
 	"github.com/transaction-mesh/starfish/pkg/util/parser"
 )
@@ -61,9 +66,19 @@ type ServerConfig struct {
 	AsyncCommittingRetryPeriod time.Duration `default:"1s" yaml:"async_committing_retry_period" json:"async_committing_retry_period,omitempty"`
 	LogDeletePeriod            time.Duration `default:"24h" yaml:"log_delete_period" json:"log_delete_period,omitempty"`
 
+	// ShutdownTimeout bounds how long the server waits for in-flight requests
+	// and retry rounds when it is asked to stop.
+	ShutdownTimeout time.Duration `default:"30s" yaml:"shutdown_timeout" json:"shutdown_timeout,omitempty"`
+
 	GettyConfig struct {
 		SessionTimeout time.Duration `default:"60s" yaml:"session_timeout" json:"session_timeout,omitempty"`
 
+		// message body compression, gzip, zstd, snappy, lz4 or none
+		Compressor        string `default:"none" yaml:"compressor" json:"compressor,omitempty"`
+		CompressThreshold int    `default:"4096" yaml:"compress_threshold" json:"compress_threshold,omitempty"`
+
+		TLSConfig config.TLSConfig `yaml:"tls" json:"tls,omitempty"`
+
 		GettySessionParam config.GettySessionParam `required:"true" yaml:"getty_session_param" json:"getty_session_param,omitempty"`
 	} `required:"true" yaml:"getty_config" json:"getty_config,omitempty"`
 
@@ -72,10 +87,93 @@ type ServerConfig struct {
 	} `required:"true" yaml:"undo_config" json:"undo_config,omitempty"`
 
 	StoreConfig        StoreConfig               `required:"true" yaml:"store_config" json:"store_config,omitempty"`
+	AdminConfig        AdminConfig               `yaml:"admin_config" json:"admin_config,omitempty"`
+	LockConfig         LockConfig                `yaml:"lock_config" json:"lock_config,omitempty"`
+	PhaseTwoConfig     PhaseTwoConfig            `yaml:"phase_two_config" json:"phase_two_config,omitempty"`
+	AuthConfig         AuthConfig                `yaml:"auth_config" json:"auth_config,omitempty"`
+	VersionConfig      VersionConfig             `yaml:"version_config" json:"version_config,omitempty"`
 	RegistryConfig     config.RegistryConfig     `yaml:"registry_config" json:"registry_config,omitempty"` //注册中心配置信息
 	ConfigCenterConfig config.ConfigCenterConfig `yaml:"config_center" json:"config_center,omitempty"`     //配置中心配置信息
 }
 
+// AdminConfig configures the admin http endpoint operators use to inspect and
+// operate on global transactions.
+type AdminConfig struct {
+	Enabled      bool   `default:"false" yaml:"enabled" json:"enabled,omitempty"`
+	Address      string `default:"127.0.0.1:9899" yaml:"address" json:"address,omitempty"`
+	AuditLogPath string `default:"admin_audit.log" yaml:"audit_log_path" json:"audit_log_path,omitempty"`
+	// Token is required from the POST actions as a bearer token. Without it
+	// only the callers on the loopback interface may act.
+	Token string `yaml:"token" json:"token,omitempty"`
+}
+
+// PhaseTwoConfig configures how the branches of a global transaction are
+// committed or rolled back. With Workers above 1 the branch requests are sent
+// concurrently by a pool of that many workers shared by all the global
+// transactions, otherwise one after another.
+type PhaseTwoConfig struct {
+	Workers int `default:"0" yaml:"workers" json:"workers,omitempty"`
+}
+
+// DefaultLockWaitRetryInterval is how often the first waiter of a row retries
+// the locks when it is not woken by a release.
+const DefaultLockWaitRetryInterval = 100 * time.Millisecond
+
+// LockConfig configures the global row locks. A branch registration conflicting
+// with the locks of another global transaction fails at once unless WaitTimeout
+// is set, then it waits in the FIFO queues of the rows until they are released,
+// WaitTimeout elapses or its global transaction times out. When the waiting
+// registrations wait for each other in a cycle, the one of the victim chosen by
+// DeadlockVictim fails at once.
+type LockConfig struct {
+	WaitTimeout time.Duration `default:"0s" yaml:"wait_timeout" json:"wait_timeout,omitempty"`
+	// WaitRetryInterval also catches the releases made by the other TC
+	// nodes sharing the store, they do not wake the waiters of this one.
+	WaitRetryInterval time.Duration `default:"100ms" yaml:"wait_retry_interval" json:"wait_retry_interval,omitempty"`
+	// DeadlockVictim picks the global transaction whose registration fails
+	// when the waiting registrations form a cycle, one of youngest,
+	// fewest_branches or lowest_priority.
+	DeadlockVictim string `default:"youngest" yaml:"deadlock_victim" json:"deadlock_victim,omitempty"`
+	// Priorities ranks the global transactions by name for the lowest_priority
+	// victim policy, the transactions not listed have priority 0.
+	Priorities map[string]int `yaml:"priorities" json:"priorities,omitempty"`
+}
+
+const (
+	// DeadlockVictimYoungest fails the global transaction that began last.
+	DeadlockVictimYoungest = "youngest"
+	// DeadlockVictimFewestBranches fails the global transaction with the
+	// fewest branches, the cheapest to roll back.
+	DeadlockVictimFewestBranches = "fewest_branches"
+	// DeadlockVictimLowestPriority fails the global transaction of the lowest
+	// priority in Priorities.
+	DeadlockVictimLowestPriority = "lowest_priority"
+)
+
+// AuthConfig authenticates the clients registering to the transaction
+// coordinator and restricts them to the global transactions of their own.
+type AuthConfig struct {
+	Enabled      bool              `default:"false" yaml:"enabled" json:"enabled,omitempty"`
+	MaxClockSkew time.Duration     `default:"5m" yaml:"max_clock_skew" json:"max_clock_skew,omitempty"`
+	Applications []ApplicationAuth `yaml:"applications" json:"applications,omitempty"`
+}
+
+// ApplicationAuth is the shared secret an application signs its register
+// requests with and the transaction service groups it may register to.
+type ApplicationAuth struct {
+	ApplicationID            string   `yaml:"application_id" json:"application_id,omitempty"`
+	Secret                   string   `yaml:"secret" json:"secret,omitempty"`
+	TransactionServiceGroups []string `yaml:"transaction_service_groups" json:"transaction_service_groups,omitempty"`
+}
+
+// VersionConfig is the window of client versions allowed to register, an
+// empty bound leaves that side of the window open. Once a bound is set clients
+// that do not report a parsable version are refused too.
+type VersionConfig struct {
+	MinClientVersion string `yaml:"min_client_version" json:"min_client_version,omitempty"`
+	MaxClientVersion string `yaml:"max_client_version" json:"max_client_version,omitempty"`
+}
+
 func GetServerConfig() *ServerConfig {
 	return serverConfig
 }
@@ -91,6 +189,15 @@ func GetStoreConfig() StoreConfig {
 	return serverConfig.StoreConfig
 }
 
+// GetLockConfig returns the lock config, row locks do not wait unless the
+// server config enables it.
+func GetLockConfig() LockConfig {
+	if serverConfig == nil {
+		return LockConfig{}
+	}
+	return serverConfig.LockConfig
+}
+
 // Parse parses an input configuration yaml document into a ServerConfig struct
 //
 // Environment variables may be used to override configuration parameters other than version,
@@ -148,6 +255,25 @@ func updateConf(config *ServerConfig, remoteConfig string) {
 }
 
 func InitConf(configPath string) (*ServerConfig, error) {
+	conf, err := LoadConf(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	loadConfigCenterConfig(conf)
+	config.InitRegistryConfig(&conf.RegistryConfig)
+	serverConfig = conf
+
+	if err := OpenStore(&conf.StoreConfig); err != nil {
+		return nil, err
+	}
+	return serverConfig, nil
+}
+
+// LoadConf parses and validates the config at configPath. Unlike InitConf it
+// neither replaces the server config nor opens the stores, so that the tools
+// can load several configs.
+func LoadConf(configPath string) (*ServerConfig, error) {
 	var configFilePath string
 
 	if configPath != "" {
@@ -174,20 +300,100 @@ func InitConf(configPath string) (*ServerConfig, error) {
 
 	if conf.GettyConfig.SessionTimeout >= time.Duration(getty.MaxWheelTimeSpan) {
 		return nil, errors.Errorf("session_timeout %s should be less than %s",
-			serverConfig.GettyConfig.SessionTimeout, time.Duration(getty.MaxWheelTimeSpan))
+			conf.GettyConfig.SessionTimeout, time.Duration(getty.MaxWheelTimeSpan))
 	}
+	if _, err := compressor.ParseCompressType(conf.GettyConfig.Compressor); err != nil {
+		return nil, err
+	}
+	if driver := conf.StoreConfig.DBStoreConfig.DriverName(); driver != DBDriverMySQL && driver != DBDriverPostgres {
+		return nil, errors.Errorf("unsupported db driver %s, should be %s or %s", driver, DBDriverMySQL, DBDriverPostgres)
+	}
+	if mode := conf.StoreConfig.HistoryConfig.Mode; mode != "" && mode != HistoryModeDB && mode != HistoryModeFile {
+		return nil, errors.Errorf("unsupported history mode %s, should be %s or %s", mode, HistoryModeDB, HistoryModeFile)
+	}
+	switch victim := conf.LockConfig.DeadlockVictim; victim {
+	case "", DeadlockVictimYoungest, DeadlockVictimFewestBranches, DeadlockVictimLowestPriority:
+	default:
+		return nil, errors.Errorf("unsupported deadlock victim %s, should be %s, %s or %s", victim,
+			DeadlockVictimYoungest, DeadlockVictimFewestBranches, DeadlockVictimLowestPriority)
+	}
+	if conf.PhaseTwoConfig.Workers < 0 {
+		return nil, errors.Errorf("phase two workers %d should not be negative", conf.PhaseTwoConfig.Workers)
+	}
+	for _, bound := range []string{conf.VersionConfig.MinClientVersion, conf.VersionConfig.MaxClientVersion} {
+		if bound == "" {
+			continue
+		}
+		if _, err := version.Parse(bound); err != nil {
+			return nil, errors.WithMessage(err, "version_config")
+		}
+	}
+	return conf, nil
+}
 
-	loadConfigCenterConfig(conf)
-	config.InitRegistryConfig(&conf.RegistryConfig)
-	serverConfig = conf
-
-	if conf.StoreConfig.StoreMode == "db" && conf.StoreConfig.DBStoreConfig.DSN != "" {
-		engine, err := xorm.NewEngine("mysql", conf.StoreConfig.DBStoreConfig.DSN)
+// OpenStore opens the db engine, the embedded database and the redis client
+// conf configures, CloseStore closes them.
+func OpenStore(conf *StoreConfig) error {
+	if (conf.StoreMode == "db" || conf.HistoryConfig.Mode == HistoryModeDB) &&
+		conf.DBStoreConfig.DSN != "" {
+		engine, err := xorm.NewEngine(conf.DBStoreConfig.DriverName(), conf.DBStoreConfig.DSN)
+		if err != nil {
+			return err
+		}
+		conf.DBStoreConfig.Engine = engine
+	}
+	if conf.StoreMode == "embedded" {
+		embeddedConfig := conf.EmbeddedStoreConfig
+		if embeddedConfig.Path == "" {
+			embeddedConfig.Path = DefaultEmbeddedStorePath
+		}
+		if embeddedConfig.OpenTimeout <= 0 {
+			embeddedConfig.OpenTimeout = DefaultEmbeddedStoreOpenTimeout
+		}
+		db, err := embedded.Open(embeddedConfig.Path, embeddedConfig.OpenTimeout, embeddedConfig.NoSync)
 		if err != nil {
-			panic(err)
+			return err
+		}
+		conf.EmbeddedStoreConfig.DB = db
+	}
+	if conf.StoreMode == "redis" {
+		redisConfig := conf.RedisStoreConfig
+		if redisConfig.Addr == "" {
+			redisConfig.Addr = DefaultRedisAddr
 		}
-		conf.StoreConfig.DBStoreConfig.Engine = engine
+		client := redis.NewClient(&redis.Options{
+			Addr:        redisConfig.Addr,
+			Password:    redisConfig.Password,
+			DB:          redisConfig.DB,
+			PoolSize:    redisConfig.PoolSize,
+			DialTimeout: redisConfig.DialTimeout,
+		})
+		if err := client.Ping().Err(); err != nil {
+			client.Close()
+			return errors.Wrapf(err, "connect redis store %s", redisConfig.Addr)
+		}
+		conf.RedisStoreConfig.Client = client
 	}
+	return nil
+}
 
-	return serverConfig, nil
+// CloseStore closes what OpenStore opened for conf, the first error is
+// returned.
+func CloseStore(conf StoreConfig) error {
+	var err error
+	keep := func(closeErr error) {
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if conf.DBStoreConfig.Engine != nil {
+		keep(conf.DBStoreConfig.Engine.Close())
+	}
+	if conf.EmbeddedStoreConfig.DB != nil {
+		keep(conf.EmbeddedStoreConfig.DB.Close())
+	}
+	if conf.RedisStoreConfig.Client != nil {
+		keep(conf.RedisStoreConfig.Client.Close())
+	}
+	return err
 }
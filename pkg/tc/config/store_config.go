@@ -17,10 +17,20 @@
 
 package config
 
+import (
+	"time"
+)
+
 import (
 	_ "github.com/go-sql-driver/mysql"
 
+	"github.com/go-redis/redis/v7"
+
 	"github.com/go-xorm/xorm"
+
+	_ "github.com/lib/pq"
+
+	bolt "go.etcd.io/bbolt"
 )
 
 const (
@@ -29,8 +39,39 @@ const (
 	DefaultMaxGlobalSessionSize         = 512
 	DefaultWriteBufferSize              = 1024 * 16
 	DefaultServiceSessionReloadReadSize = 100
+	DefaultFlushDiskInterval            = time.Second
+	DefaultSegmentSize                  = 16 * 1024 * 1024
+	DefaultMaxSegments                  = 8
+	DefaultDBMaxBatchSize               = 64
+	DefaultEmbeddedStorePath            = "starfish.db"
+	DefaultEmbeddedStoreOpenTimeout     = time.Second
+	DefaultRedisAddr                    = "127.0.0.1:6379"
+	DefaultRedisKeyPrefix               = "starfish:"
+	DefaultHistoryRetention             = 7 * 24 * time.Hour
+	DefaultHistoryPurgeInterval         = time.Hour
+	DefaultHistoryQueryLimit            = 100
+	DefaultHistoryFileDir               = "history"
+	DefaultHistoryFileSize              = 64 * 1024 * 1024
+)
+
+const (
+	// HistoryModeDB archives into global_table_history and branch_table_history
+	// of the database configured by DBStoreConfig.
+	HistoryModeDB = "db"
+	// HistoryModeFile archives into rolling files of HistoryConfig.FileDir.
+	HistoryModeFile = "file"
+)
+
+const (
+	// DBDriverMySQL the driver of the db store mode by default
+	DBDriverMySQL = "mysql"
+	// DBDriverPostgres stores the sessions and locks in PostgreSQL
+	DBDriverPostgres = "postgres"
 )
 
+// FlushDiskMode is when the file store fsyncs its data file: on every write
+// when sync, once every FlushDiskInterval for the writes in between when async,
+// never when none.
 type FlushDiskMode int
 
 const (
@@ -43,6 +84,11 @@ const (
 	 * async flush disk
 	 */
 	FlushdiskModeAsyncModel
+
+	/**
+	 * never flush disk, left to the operating system
+	 */
+	FlushdiskModeNoneModel
 )
 
 type StoreConfig struct {
@@ -51,19 +97,144 @@ type StoreConfig struct {
 	StoreMode            string          `default:"file" yaml:"mode" json:"mode,omitempty"`
 	FileStoreConfig      FileStoreConfig `yaml:"file" json:"file,omitempty"`
 	DBStoreConfig        DBStoreConfig   `yaml:"db" json:"db,omitempty"`
+	RaftStoreConfig      RaftStoreConfig `yaml:"raft" json:"raft,omitempty"`
+
+	EmbeddedStoreConfig EmbeddedStoreConfig `yaml:"embedded" json:"embedded,omitempty"`
+	RedisStoreConfig    RedisStoreConfig    `yaml:"redis" json:"redis,omitempty"`
+
+	HistoryConfig HistoryConfig `yaml:"history" json:"history,omitempty"`
 }
 
+// HistoryConfig archives every finished global session with its branches
+// before it is deleted from the store, Mode is db or file and the archive is
+// disabled when it is empty. The archived sessions are purged once they ended
+// Retention ago.
+type HistoryConfig struct {
+	Mode          string        `yaml:"mode" json:"mode,omitempty"`
+	Retention     time.Duration `default:"168h" yaml:"retention" json:"retention,omitempty"`
+	PurgeInterval time.Duration `default:"1h" yaml:"purge_interval" json:"purge_interval,omitempty"`
+	// QueryLimit bounds the sessions returned by a query, the latest ended first.
+	QueryLimit int `default:"100" yaml:"query_limit" json:"query_limit,omitempty"`
+	// FileDir and FileSize are the directory and the size of the rolling files
+	// of the file mode.
+	FileDir  string `default:"history" yaml:"file_dir" json:"file_dir,omitempty"`
+	FileSize int64  `default:"67108864" yaml:"file_size" json:"file_size,omitempty"`
+}
+
+// FileStoreConfig is the file store, a log split in segments of SegmentSize
+// bytes named after FileDir. Once MaxSegments segments are written after the
+// latest snapshot they are compacted into a new one.
 type FileStoreConfig struct {
 	FileDir                  string        `default:"root.data" yaml:"file_dir" json:"file_dir,omitempty"`
 	FileWriteBufferCacheSize int           `default:"16384" yaml:"file_write_buffer_cache_size" json:"file_write_buffer_cache_size,omitempty"`
 	FlushDiskMode            FlushDiskMode `default:"1" yaml:"flush_disk_mode" json:"flush_disk_mode,omitempty"`
+	FlushDiskInterval        time.Duration `default:"1s" yaml:"flush_disk_interval" json:"flush_disk_interval,omitempty"`
 	SessionReloadReadSize    int           `default:"100" yaml:"session_reload_read_size" json:"session_reload_read_size,omitempty"`
+	SegmentSize              int64         `default:"16777216" yaml:"segment_size" json:"segment_size,omitempty"`
+	MaxSegments              int           `default:"8" yaml:"max_segments" json:"max_segments,omitempty"`
 }
 
 type DBStoreConfig struct {
-	LogQueryLimit int    `default:"100" yaml:"log_query_limit" json:"log_query_limit"`
-	DSN           string `yaml:"dsn" json:"dsn"`
-	Engine        *xorm.Engine
+	LogQueryLimit int `default:"100" yaml:"log_query_limit" json:"log_query_limit"`
+	// Driver is mysql or postgres, the schema of each is under scripts/server/db.
+	Driver string `default:"mysql" yaml:"driver" json:"driver,omitempty"`
+	DSN    string `yaml:"dsn" json:"dsn"`
+	// MaxBatchSize bounds the session writes committed in one transaction, 1
+	// writes them one statement at a time.
+	MaxBatchSize int `default:"64" yaml:"max_batch_size" json:"max_batch_size,omitempty"`
+	// MaxBatchDelay is how long a batch waits for more writes, by default it
+	// only takes the writes queued while the previous batch was committed.
+	MaxBatchDelay time.Duration `default:"0s" yaml:"max_batch_delay" json:"max_batch_delay,omitempty"`
+
+	Engine *xorm.Engine
+}
+
+// BatchSize returns MaxBatchSize, DefaultDBMaxBatchSize when it is not
+// configured.
+func (conf DBStoreConfig) BatchSize() int {
+	if conf.MaxBatchSize <= 0 {
+		return DefaultDBMaxBatchSize
+	}
+	return conf.MaxBatchSize
+}
+
+// DriverName returns Driver, mysql when it is not configured.
+func (conf DBStoreConfig) DriverName() string {
+	if conf.Driver == "" {
+		return DBDriverMySQL
+	}
+	return conf.Driver
+}
+
+// EmbeddedStoreConfig configures the embedded store mode, the sessions and the
+// locks are kept in a single bbolt database file and no external service is
+// needed.
+type EmbeddedStoreConfig struct {
+	Path string `default:"starfish.db" yaml:"path" json:"path,omitempty"`
+	// OpenTimeout bounds the wait for another process holding the file.
+	OpenTimeout time.Duration `default:"1s" yaml:"open_timeout" json:"open_timeout,omitempty"`
+	// NoSync skips the fsync of every commit, a crash may lose the last writes.
+	NoSync bool `default:"false" yaml:"no_sync" json:"no_sync,omitempty"`
+	DB     *bolt.DB
+}
+
+// RedisStoreConfig configures the redis store mode. Every TC node sharing the
+// sessions and the locks connects to the same redis and uses the same KeyPrefix.
+type RedisStoreConfig struct {
+	Addr     string `default:"127.0.0.1:6379" yaml:"addr" json:"addr,omitempty"`
+	Password string `yaml:"password" json:"-"`
+	DB       int    `default:"0" yaml:"db" json:"db,omitempty"`
+	// KeyPrefix is prepended to every key written by the TC.
+	KeyPrefix   string        `default:"starfish:" yaml:"key_prefix" json:"key_prefix,omitempty"`
+	PoolSize    int           `default:"0" yaml:"pool_size" json:"pool_size,omitempty"`
+	DialTimeout time.Duration `default:"5s" yaml:"dial_timeout" json:"dial_timeout,omitempty"`
+	Client      *redis.Client
+}
+
+// Prefix returns KeyPrefix, starfish: when it is not configured.
+func (conf RedisStoreConfig) Prefix() string {
+	if conf.KeyPrefix == "" {
+		return DefaultRedisKeyPrefix
+	}
+	return conf.KeyPrefix
+}
+
+// RaftStoreConfig configures the raft replicated session store. Every node of
+// the cluster lists the same Servers, NodeID picks the local one.
+type RaftStoreConfig struct {
+	NodeID            string             `yaml:"node_id" json:"node_id,omitempty"`
+	Servers           []RaftServerConfig `yaml:"servers" json:"servers,omitempty"`
+	DataDir           string             `yaml:"data_dir" json:"data_dir,omitempty"`
+	SnapshotRetain    int                `default:"2" yaml:"snapshot_retain" json:"snapshot_retain,omitempty"`
+	SnapshotThreshold uint64             `default:"8192" yaml:"snapshot_threshold" json:"snapshot_threshold,omitempty"`
+	SnapshotInterval  time.Duration      `default:"120s" yaml:"snapshot_interval" json:"snapshot_interval,omitempty"`
+	ApplyTimeout      time.Duration      `default:"5s" yaml:"apply_timeout" json:"apply_timeout,omitempty"`
+	// ForwardTimeout bounds connecting to another node and waiting for the
+	// response of a forwarded request.
+	ForwardTimeout time.Duration `default:"30s" yaml:"forward_timeout" json:"forward_timeout,omitempty"`
+	// Secret signs the requests the nodes forward and deliver to each other,
+	// every node of the cluster uses the same one.
+	Secret string `yaml:"secret" json:"secret,omitempty"`
+}
+
+type RaftServerConfig struct {
+	NodeID string `yaml:"node_id" json:"node_id,omitempty"`
+	// Addr is the address raft replicates on.
+	Addr string `yaml:"addr" json:"addr,omitempty"`
+	// ForwardAddr is the address followers forward client requests to
+	// when this node is the leader, and the leader delivers phase two requests
+	// to the resource managers connected to this node through.
+	ForwardAddr string `yaml:"forward_addr" json:"forward_addr,omitempty"`
+}
+
+// LocalServer returns the entry of Servers matching NodeID.
+func (conf RaftStoreConfig) LocalServer() (RaftServerConfig, bool) {
+	for _, server := range conf.Servers {
+		if server.NodeID == conf.NodeID {
+			return server, true
+		}
+	}
+	return RaftServerConfig{}, false
 }
 
 func GetDefaultFileStoreConfig() FileStoreConfig {
@@ -72,5 +243,7 @@ func GetDefaultFileStoreConfig() FileStoreConfig {
 		FileWriteBufferCacheSize: DefaultWriteBufferSize,
 		FlushDiskMode:            0,
 		SessionReloadReadSize:    DefaultServiceSessionReloadReadSize,
+		SegmentSize:              DefaultSegmentSize,
+		MaxSegments:              DefaultMaxSegments,
 	}
 }
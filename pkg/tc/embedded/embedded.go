@@ -0,0 +1,115 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package embedded lays out the embedded store, a bbolt database file holding
+// the sessions and the row locks of a TC that runs without an external service.
+package embedded
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// GlobalBucket xid -> encoded global session
+	GlobalBucket = []byte("global")
+	// TransactionIDBucket transaction id -> xid
+	TransactionIDBucket = []byte("global_transaction_id")
+	// StatusBucket status, begin time, xid -> nothing
+	StatusBucket = []byte("global_status")
+	// BeginTimeBucket begin time, xid -> nothing
+	BeginTimeBucket = []byte("global_begin_time")
+	// BranchBucket xid, branch id -> encoded branch session
+	BranchBucket = []byte("branch")
+	// LockBucket row key -> lock
+	LockBucket = []byte("lock")
+	// BranchLockBucket xid, branch id, row key -> nothing
+	BranchLockBucket = []byte("branch_lock")
+
+	buckets = [][]byte{GlobalBucket, TransactionIDBucket, StatusBucket, BeginTimeBucket,
+		BranchBucket, LockBucket, BranchLockBucket}
+)
+
+// Open opens the database file at path and creates the buckets. It waits at
+// most timeout for another process holding the file to release it.
+func Open(path string, timeout time.Duration, noSync bool) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, errors.Wrapf(err, "open embedded store %s", path)
+	}
+	db.NoSync = noSync
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "create buckets of embedded store %s", path)
+	}
+	return db, nil
+}
+
+// XIDPrefix is the prefix of the keys of the branches of xid, xids never hold
+// a zero byte.
+func XIDPrefix(xid string) []byte {
+	return append([]byte(xid), 0)
+}
+
+// BranchKey is the key of a branch in BranchBucket and the prefix of the keys
+// of its locks in BranchLockBucket.
+func BranchKey(xid string, branchID int64) []byte {
+	return append(XIDPrefix(xid), Int64Key(branchID)...)
+}
+
+// ParseBranchKey returns the xid and the branch id of a key of BranchBucket or
+// BranchLockBucket, and the rest of the key.
+func ParseBranchKey(key []byte) (string, int64, []byte) {
+	for i, b := range key {
+		if b == 0 && len(key) >= i+9 {
+			return string(key[:i]), int64(binary.BigEndian.Uint64(key[i+1 : i+9])), key[i+9:]
+		}
+	}
+	return string(key), 0, nil
+}
+
+// Int64Key encodes v big endian so that the keys sort as the numbers do.
+func Int64Key(v int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(v))
+	return key
+}
+
+// StatusKey is the key of a global session in StatusBucket, the sessions of a
+// status are ordered by begin time.
+func StatusKey(status byte, beginTime int64, xid string) []byte {
+	return append([]byte{status}, BeginTimeKey(beginTime, xid)...)
+}
+
+// BeginTimeKey is the key of a global session in BeginTimeBucket.
+func BeginTimeKey(beginTime int64, xid string) []byte {
+	return append(Int64Key(beginTime), xid...)
+}
@@ -17,10 +17,6 @@
 
 package holder
 
-import (
-	"github.com/pkg/errors"
-)
-
 import (
 	"github.com/transaction-mesh/starfish/pkg/base/meta"
 	"github.com/transaction-mesh/starfish/pkg/tc/config"
@@ -28,6 +24,14 @@ import (
 	"github.com/transaction-mesh/starfish/pkg/tc/session"
 )
 
+// activeGlobalStatuses are the statuses of the global sessions still kept in the
+// store, finished sessions are removed.
+var activeGlobalStatuses = []meta.GlobalStatus{meta.GlobalStatusUnknown, meta.GlobalStatusBegin,
+	meta.GlobalStatusCommitting, meta.GlobalStatusCommitRetrying, meta.GlobalStatusRollingBack,
+	meta.GlobalStatusRollbackRetrying, meta.GlobalStatusTimeoutRollingBack, meta.GlobalStatusTimeoutRollbackRetrying,
+	meta.GlobalStatusAsyncCommitting,
+}
+
 type DataBaseSessionManager struct {
 	TaskName                string
 	conf                    config.DBStoreConfig
@@ -35,10 +39,12 @@ type DataBaseSessionManager struct {
 }
 
 func NewDataBaseSessionManager(taskName string, conf config.DBStoreConfig) SessionManager {
-	logStore := &LogStoreDataBaseDAO{engine: conf.Engine}
+	logStore := NewLogStoreDataBaseDAO(conf.Engine, conf.DriverName())
 	transactionStoreManager := &DBTransactionStoreManager{
-		logQueryLimit: conf.LogQueryLimit,
-		LogStore:      logStore,
+		LogStore: logStore,
+	}
+	if conf.BatchSize() > 1 {
+		transactionStoreManager.groupCommit = newGroupCommitWriter(logStore, conf.BatchSize(), conf.MaxBatchDelay)
 	}
 	sessionManager := &DataBaseSessionManager{
 		TaskName:                taskName,
@@ -50,17 +56,9 @@ func NewDataBaseSessionManager(taskName string, conf config.DBStoreConfig) Sessi
 
 func (sessionManager *DataBaseSessionManager) AddGlobalSession(session *session.GlobalSession) error {
 	if sessionManager.TaskName == "" {
-		ret := sessionManager.TransactionStoreManager.WriteSession(LogOperationGlobalAdd, session)
-		if !ret {
-			return errors.New("addGlobalSession failed.")
-		}
-	} else {
-		ret := sessionManager.TransactionStoreManager.WriteSession(LogOperationGlobalUpdate, session)
-		if !ret {
-			return errors.New("addGlobalSession failed.")
-		}
+		return writeSession(sessionManager.TransactionStoreManager, LogOperationGlobalAdd, session)
 	}
-	return nil
+	return writeSession(sessionManager.TransactionStoreManager, LogOperationGlobalUpdate, session)
 }
 
 func (sessionManager *DataBaseSessionManager) FindGlobalSession(xid string) *session.GlobalSession {
@@ -76,19 +74,11 @@ func (sessionManager *DataBaseSessionManager) UpdateGlobalSessionStatus(session
 		return nil
 	}
 	session.Status = status
-	ret := sessionManager.TransactionStoreManager.WriteSession(LogOperationGlobalUpdate, session)
-	if !ret {
-		return errors.New("updateGlobalSessionStatus failed.")
-	}
-	return nil
+	return writeSession(sessionManager.TransactionStoreManager, LogOperationGlobalUpdate, session)
 }
 
 func (sessionManager *DataBaseSessionManager) RemoveGlobalSession(session *session.GlobalSession) error {
-	ret := sessionManager.TransactionStoreManager.WriteSession(LogOperationGlobalRemove, session)
-	if !ret {
-		return errors.New("removeGlobalSession failed.")
-	}
-	return nil
+	return writeSession(sessionManager.TransactionStoreManager, LogOperationGlobalRemove, session)
 }
 
 func (sessionManager *DataBaseSessionManager) AddBranchSession(globalSession *session.GlobalSession, session *session.BranchSession) error {
@@ -108,57 +98,45 @@ func (sessionManager *DataBaseSessionManager) UpdateBranchSessionStatus(session
 	if sessionManager.TaskName != "" {
 		return nil
 	}
-	ret := sessionManager.TransactionStoreManager.WriteSession(LogOperationBranchUpdate, session)
-	if !ret {
-		return errors.New("updateBranchSessionStatus failed.")
-	}
-	return nil
+	return writeSession(sessionManager.TransactionStoreManager, LogOperationBranchUpdate, session)
 }
 
 func (sessionManager *DataBaseSessionManager) RemoveBranchSession(globalSession *session.GlobalSession, session *session.BranchSession) error {
 	if sessionManager.TaskName != "" {
 		return nil
 	}
-	ret := sessionManager.TransactionStoreManager.WriteSession(LogOperationBranchRemove, session)
-	if !ret {
-		return errors.New("addBranchSession failed.")
-	}
-	return nil
+	return writeSession(sessionManager.TransactionStoreManager, LogOperationBranchRemove, session)
 }
 
+// AllSessions returns the sessions the task of the session manager handles,
+// at most LogQueryLimit of them when it is set, the ones began first.
 func (sessionManager *DataBaseSessionManager) AllSessions() []*session.GlobalSession {
-	if sessionManager.TaskName == ASYNC_COMMITTING_SESSION_MANAGER_NAME {
-		return sessionManager.FindGlobalSessions(model.SessionCondition{
-			Statuses: []meta.GlobalStatus{meta.GlobalStatusAsyncCommitting},
-		})
-	} else if sessionManager.TaskName == RETRY_COMMITTING_SESSION_MANAGER_NAME {
-		return sessionManager.FindGlobalSessions(model.SessionCondition{
-			Statuses: []meta.GlobalStatus{meta.GlobalStatusCommitRetrying},
-		})
-	} else if sessionManager.TaskName == RETRY_ROLLBACKING_SESSION_MANAGER_NAME {
-		ss := sessionManager.FindGlobalSessions(model.SessionCondition{
-			Statuses: []meta.GlobalStatus{meta.GlobalStatusRollbackRetrying,
-				meta.GlobalStatusRollingBack,
-				meta.GlobalStatusTimeoutRollingBack,
-				meta.GlobalStatusTimeoutRollbackRetrying,
-			},
-		})
-		return ss
-	} else {
-		return sessionManager.FindGlobalSessions(model.SessionCondition{
-			Statuses: []meta.GlobalStatus{meta.GlobalStatusUnknown, meta.GlobalStatusBegin,
-				meta.GlobalStatusCommitting, meta.GlobalStatusCommitRetrying, meta.GlobalStatusRollingBack,
-				meta.GlobalStatusRollbackRetrying, meta.GlobalStatusTimeoutRollingBack, meta.GlobalStatusTimeoutRollbackRetrying,
-				meta.GlobalStatusAsyncCommitting,
-			},
-		})
+	condition := model.SessionCondition{
+		Statuses: activeGlobalStatuses,
+		Limit:    sessionManager.conf.LogQueryLimit,
+	}
+	switch sessionManager.TaskName {
+	case ASYNC_COMMITTING_SESSION_MANAGER_NAME:
+		condition.Statuses = []meta.GlobalStatus{meta.GlobalStatusAsyncCommitting}
+	case RETRY_COMMITTING_SESSION_MANAGER_NAME:
+		condition.Statuses = []meta.GlobalStatus{meta.GlobalStatusCommitRetrying}
+	case RETRY_ROLLBACKING_SESSION_MANAGER_NAME:
+		condition.Statuses = []meta.GlobalStatus{meta.GlobalStatusRollbackRetrying,
+			meta.GlobalStatusRollingBack,
+			meta.GlobalStatusTimeoutRollingBack,
+			meta.GlobalStatusTimeoutRollbackRetrying,
+		}
 	}
+	return sessionManager.FindGlobalSessions(condition)
 }
 
 func (sessionManager *DataBaseSessionManager) FindGlobalSessions(condition model.SessionCondition) []*session.GlobalSession {
+	if condition.History {
+		return GetSessionArchive().FindGlobalSessions(condition)
+	}
 	return sessionManager.TransactionStoreManager.ReadSessionWithSessionCondition(condition)
 }
 
-func (sessionManager *DataBaseSessionManager) Reload() {
-
+func (sessionManager *DataBaseSessionManager) Reload() error {
+	return nil
 }
@@ -0,0 +1,246 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package holder
+
+import (
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+)
+
+var (
+	// DBStoreBatchSize samples the session writes committed by each group
+	// commit of the db store.
+	DBStoreBatchSize = metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+	// DBStoreBatchLatency samples the microseconds each group commit of the db
+	// store took.
+	DBStoreBatchLatency = metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+)
+
+var errGroupCommitStopped = errors.New("group commit is shut down")
+
+// sessionWrite is a session write of the db store waiting for its group commit.
+type sessionWrite struct {
+	logOperation        LogOperation
+	globalTransactionDO *model.GlobalTransactionDO
+	branchTransactionDO *model.BranchTransactionDO
+	done                chan error
+}
+
+func newSessionWrite(logOperation LogOperation, sessionStorable session.SessionStorable) (*sessionWrite, error) {
+	write := &sessionWrite{logOperation: logOperation}
+	switch logOperation {
+	case LogOperationGlobalAdd, LogOperationGlobalUpdate, LogOperationGlobalRemove:
+		write.globalTransactionDO = convertGlobalTransactionDO(sessionStorable)
+		if write.globalTransactionDO == nil {
+			return nil, errors.Errorf("%s of %T", logOperation, sessionStorable)
+		}
+	case LogOperationBranchAdd, LogOperationBranchUpdate, LogOperationBranchRemove:
+		write.branchTransactionDO = convertBranchTransactionDO(sessionStorable)
+		if write.branchTransactionDO == nil {
+			return nil, errors.Errorf("%s of %T", logOperation, sessionStorable)
+		}
+	default:
+		return nil, errors.Errorf("unknown LogOperation %v", logOperation)
+	}
+	return write, nil
+}
+
+func (write *sessionWrite) xid() string {
+	if write.globalTransactionDO != nil {
+		return write.globalTransactionDO.XID
+	}
+	return write.branchTransactionDO.XID
+}
+
+// updateStatus is the status set by an update, zero for the other writes.
+func (write *sessionWrite) updateStatus() int32 {
+	switch write.logOperation {
+	case LogOperationGlobalUpdate:
+		return write.globalTransactionDO.Status
+	case LogOperationBranchUpdate:
+		return write.branchTransactionDO.Status
+	default:
+		return 0
+	}
+}
+
+// batchLogStore is a LogStore writing the session writes of a group commit in
+// a single transaction.
+type batchLogStore interface {
+	WriteBatch(writes []*sessionWrite) error
+}
+
+// groupCommitWriter commits the session writes of concurrent callers together,
+// a write returns once the transaction holding it is committed. When a batch
+// fails its writes are committed one by one, so that a write only fails on its
+// own error.
+type groupCommitWriter struct {
+	store         batchLogStore
+	maxBatchSize  int
+	maxBatchDelay time.Duration
+
+	writes  chan *sessionWrite
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+func newGroupCommitWriter(store batchLogStore, maxBatchSize int, maxBatchDelay time.Duration) *groupCommitWriter {
+	writer := &groupCommitWriter{
+		store:         store,
+		maxBatchSize:  maxBatchSize,
+		maxBatchDelay: maxBatchDelay,
+		writes:        make(chan *sessionWrite),
+		stop:          make(chan struct{}),
+	}
+	writer.stopped.Add(1)
+	go writer.run()
+	return writer
+}
+
+func (writer *groupCommitWriter) write(write *sessionWrite) error {
+	write.done = make(chan error, 1)
+	select {
+	case writer.writes <- write:
+		return <-write.done
+	case <-writer.stop:
+		return errGroupCommitStopped
+	}
+}
+
+func (writer *groupCommitWriter) shutdown() {
+	close(writer.stop)
+	writer.stopped.Wait()
+}
+
+func (writer *groupCommitWriter) run() {
+	defer writer.stopped.Done()
+	for {
+		select {
+		case write := <-writer.writes:
+			writer.commit(writer.collect(write))
+		case <-writer.stop:
+			return
+		}
+	}
+}
+
+// collect adds to first the writes already waiting, or arriving within
+// maxBatchDelay, up to maxBatchSize writes.
+func (writer *groupCommitWriter) collect(first *sessionWrite) []*sessionWrite {
+	batch := []*sessionWrite{first}
+	if writer.maxBatchDelay <= 0 {
+		for len(batch) < writer.maxBatchSize {
+			select {
+			case write := <-writer.writes:
+				batch = append(batch, write)
+			default:
+				return batch
+			}
+		}
+		return batch
+	}
+
+	timer := time.NewTimer(writer.maxBatchDelay)
+	defer timer.Stop()
+	for len(batch) < writer.maxBatchSize {
+		select {
+		case write := <-writer.writes:
+			batch = append(batch, write)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (writer *groupCommitWriter) commit(batch []*sessionWrite) {
+	start := time.Now()
+	err := writer.store.WriteBatch(batch)
+	DBStoreBatchSize.Update(int64(len(batch)))
+	DBStoreBatchLatency.Update(time.Since(start).Microseconds())
+	if err != nil && len(batch) > 1 {
+		log.Warnf("group commit of %d session writes failed, committing them one by one: %v", len(batch), err)
+	}
+	settleBatch(len(batch), err, func(i int) error {
+		return writer.store.WriteBatch(batch[i : i+1])
+	}, func(i int, err error) {
+		batch[i].done <- err
+	})
+}
+
+// settleBatch ends the size entries of a batch written together with err. When
+// the batch failed its entries are written one by one through write, so that
+// an entry only fails on its own error. done gets the error of each entry.
+func settleBatch(size int, err error, write func(i int) error, done func(i int, err error)) {
+	if err == nil || size == 1 {
+		for i := 0; i < size; i++ {
+			done(i, err)
+		}
+		return
+	}
+	for i := 0; i < size; i++ {
+		done(i, write(i))
+	}
+}
+
+// batchStatement is a multi-row statement of a group commit, the writes of
+// one LogOperation, and of one status for the updates.
+type batchStatement struct {
+	logOperation LogOperation
+	status       int32
+	writes       []*sessionWrite
+	xids         map[string]bool
+}
+
+// groupSessionWrites merges the writes into batch statements. A write joins
+// the last statement of its kind unless a statement after it touches the same
+// global transaction, so the writes of a transaction keep their order.
+func groupSessionWrites(writes []*sessionWrite) []*batchStatement {
+	var statements []*batchStatement
+	for _, write := range writes {
+		var target *batchStatement
+		for i := len(statements) - 1; i >= 0; i-- {
+			statement := statements[i]
+			if statement.logOperation == write.logOperation && statement.status == write.updateStatus() {
+				target = statement
+				break
+			}
+			if statement.xids[write.xid()] {
+				break
+			}
+		}
+		if target == nil {
+			target = &batchStatement{logOperation: write.logOperation, status: write.updateStatus(), xids: make(map[string]bool)}
+			statements = append(statements, target)
+		}
+		target.writes = append(target.writes, write)
+		target.xids[write.xid()] = true
+	}
+	return statements
+}
@@ -0,0 +1,163 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package holder
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+)
+
+type mockBatchLogStore struct {
+	sync.Mutex
+	batches  [][]*sessionWrite
+	failXIDs map[string]bool
+}
+
+func (store *mockBatchLogStore) WriteBatch(writes []*sessionWrite) error {
+	store.Lock()
+	defer store.Unlock()
+	store.batches = append(store.batches, writes)
+	for _, write := range writes {
+		if store.failXIDs[write.xid()] {
+			return errors.Errorf("duplicate entry %s", write.xid())
+		}
+	}
+	return nil
+}
+
+func globalWrite(logOperation LogOperation, xid string, status meta.GlobalStatus) *sessionWrite {
+	return &sessionWrite{logOperation: logOperation,
+		globalTransactionDO: &model.GlobalTransactionDO{XID: xid, Status: int32(status)}}
+}
+
+func branchWrite(logOperation LogOperation, xid string, branchID int64, status meta.BranchStatus) *sessionWrite {
+	return &sessionWrite{logOperation: logOperation,
+		branchTransactionDO: &model.BranchTransactionDO{XID: xid, BranchID: branchID, Status: int32(status)}}
+}
+
+func TestGroupSessionWrites(t *testing.T) {
+	statements := groupSessionWrites([]*sessionWrite{
+		globalWrite(LogOperationGlobalAdd, "a", meta.GlobalStatusBegin),
+		branchWrite(LogOperationBranchAdd, "a", 1, meta.BranchStatusRegistered),
+		globalWrite(LogOperationGlobalAdd, "b", meta.GlobalStatusBegin),
+		branchWrite(LogOperationBranchAdd, "b", 2, meta.BranchStatusRegistered),
+		globalWrite(LogOperationGlobalUpdate, "a", meta.GlobalStatusCommitting),
+		globalWrite(LogOperationGlobalUpdate, "b", meta.GlobalStatusRollingBack),
+		branchWrite(LogOperationBranchAdd, "a", 3, meta.BranchStatusRegistered),
+		branchWrite(LogOperationBranchAdd, "c", 4, meta.BranchStatusRegistered),
+	})
+
+	var shapes [][]string
+	for _, statement := range statements {
+		shape := []string{statement.logOperation.String()}
+		for _, write := range statement.writes {
+			shape = append(shape, write.xid())
+		}
+		shapes = append(shapes, shape)
+	}
+	assert.Equal(t, [][]string{
+		{LogOperationGlobalAdd.String(), "a", "b"},
+		{LogOperationBranchAdd.String(), "a", "b"},
+		{LogOperationGlobalUpdate.String(), "a"},
+		{LogOperationGlobalUpdate.String(), "b"},
+		{LogOperationBranchAdd.String(), "a", "c"},
+	}, shapes)
+}
+
+func TestLogStoreDataBaseDAO_BatchSQL(t *testing.T) {
+	insert := multiRowInsert("insert into t (a, b) values(?, now())", 3)
+	assert.Equal(t, "insert into t (a, b) values (?, now()), (?, now()), (?, now())", insert)
+
+	mysql := NewLogStoreDataBaseDAO(nil, config.DBDriverMySQL)
+	statements := groupSessionWrites([]*sessionWrite{
+		branchWrite(LogOperationBranchUpdate, "a", 1, meta.BranchStatusPhaseTwoCommitted),
+		branchWrite(LogOperationBranchUpdate, "b", 2, meta.BranchStatusPhaseTwoCommitted),
+	})
+	assert.Equal(t, 1, len(statements))
+	assert.Equal(t, []interface{}{
+		"update branch_table set status = ?, gmt_modified = now(6) where branch_id in (?, ?)",
+		int32(meta.BranchStatusPhaseTwoCommitted), int64(1), int64(2),
+	}, mysql.batchSQL(statements[0]))
+
+	postgres := NewLogStoreDataBaseDAO(nil, config.DBDriverPostgres)
+	statements = groupSessionWrites([]*sessionWrite{
+		branchWrite(LogOperationBranchAdd, "a", 1, meta.BranchStatusRegistered),
+		branchWrite(LogOperationBranchAdd, "a", 2, meta.BranchStatusRegistered),
+	})
+	args := postgres.batchSQL(statements[0])
+	assert.Equal(t, 1+2*9, len(args))
+	assert.NotContains(t, args[0], "now(6)")
+}
+
+func TestGroupCommitWriter(t *testing.T) {
+	store := &mockBatchLogStore{failXIDs: map[string]bool{"bad": true}}
+	writer := newGroupCommitWriter(store, 4, time.Second)
+	defer writer.shutdown()
+
+	var wg sync.WaitGroup
+	results := make(map[string]error)
+	var resultsLock sync.Mutex
+	for _, xid := range []string{"a", "b", "bad", "c"} {
+		wg.Add(1)
+		go func(xid string) {
+			defer wg.Done()
+			err := writer.write(globalWrite(LogOperationGlobalAdd, xid, meta.GlobalStatusBegin))
+			resultsLock.Lock()
+			results[xid] = err
+			resultsLock.Unlock()
+		}(xid)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 5, len(store.batches))
+	assert.Equal(t, 4, len(store.batches[0]))
+	assert.Nil(t, results["a"])
+	assert.Nil(t, results["b"])
+	assert.Nil(t, results["c"])
+	assert.NotNil(t, results["bad"])
+	assert.Equal(t, int64(4), DBStoreBatchSize.Max())
+}
+
+func TestDataBaseSessionManager_WriteFailure(t *testing.T) {
+	store := &mockBatchLogStore{failXIDs: make(map[string]bool)}
+	transactionStoreManager := &DBTransactionStoreManager{groupCommit: newGroupCommitWriter(store, 8, 0)}
+	defer transactionStoreManager.Shutdown()
+	sessionManager := &DataBaseSessionManager{TransactionStoreManager: transactionStoreManager}
+
+	gs := globalSessionProvider(t)
+	assert.Nil(t, sessionManager.AddGlobalSession(gs))
+
+	store.failXIDs[gs.XID] = true
+	err := sessionManager.UpdateGlobalSessionStatus(gs, meta.GlobalStatusCommitting)
+	assert.NotNil(t, err)
+	transactionException, ok := err.(*meta.TransactionException)
+	assert.True(t, ok)
+	assert.Equal(t, meta.TransactionExceptionCodeFailedWriteSession, transactionException.Code)
+}
@@ -25,50 +25,40 @@ import (
 )
 
 type DBTransactionStoreManager struct {
-	logQueryLimit int
-	LogStore      LogStore
+	LogStore LogStore
+	// groupCommit batches the writes of concurrent callers, nil when they are
+	// written one statement at a time.
+	groupCommit *groupCommitWriter
 }
 
 func (storeManager *DBTransactionStoreManager) WriteSession(logOperation LogOperation, session session.SessionStorable) bool {
-	if LogOperationGlobalAdd == logOperation {
-		globalSession := convertGlobalTransactionDO(session)
-		if globalSession != nil {
-			storeManager.LogStore.InsertGlobalTransactionDO(*globalSession)
-		}
-		return true
-	} else if LogOperationGlobalUpdate == logOperation {
-		globalSession := convertGlobalTransactionDO(session)
-		if globalSession != nil {
-			storeManager.LogStore.UpdateGlobalTransactionDO(*globalSession)
-		}
-		return true
-	} else if LogOperationGlobalRemove == logOperation {
-		globalSession := convertGlobalTransactionDO(session)
-		if globalSession != nil {
-			storeManager.LogStore.DeleteGlobalTransactionDO(*globalSession)
-		}
-		return true
-	} else if LogOperationBranchAdd == logOperation {
-		branchSession := convertBranchTransactionDO(session)
-		if branchSession != nil {
-			storeManager.LogStore.InsertBranchTransactionDO(*branchSession)
-		}
-		return true
-	} else if LogOperationBranchUpdate == logOperation {
-		branchSession := convertBranchTransactionDO(session)
-		if branchSession != nil {
-			storeManager.LogStore.UpdateBranchTransactionDO(*branchSession)
-		}
-		return true
-	} else if LogOperationBranchRemove == logOperation {
-		branchSession := convertBranchTransactionDO(session)
-		if branchSession != nil {
-			storeManager.LogStore.DeleteBranchTransactionDO(*branchSession)
+	write, err := newSessionWrite(logOperation, session)
+	if err != nil {
+		log.Errorf("the parameter of SessionStorable is not available: %v", err)
+		return false
+	}
+	if storeManager.groupCommit != nil {
+		if err := storeManager.groupCommit.write(write); err != nil {
+			log.Errorf("%s of %s failed: %v", logOperation, write.xid(), err)
+			return false
 		}
 		return true
 	}
-	log.Errorf("Unknown LogOperation:%v", logOperation)
-	return false
+
+	switch logOperation {
+	case LogOperationGlobalAdd:
+		return storeManager.LogStore.InsertGlobalTransactionDO(*write.globalTransactionDO)
+	case LogOperationGlobalUpdate:
+		return storeManager.LogStore.UpdateGlobalTransactionDO(*write.globalTransactionDO)
+	case LogOperationGlobalRemove:
+		return storeManager.LogStore.DeleteGlobalTransactionDO(*write.globalTransactionDO)
+	case LogOperationBranchAdd:
+		return storeManager.LogStore.InsertBranchTransactionDO(*write.branchTransactionDO)
+	case LogOperationBranchUpdate:
+		return storeManager.LogStore.UpdateBranchTransactionDO(*write.branchTransactionDO)
+	default:
+		return storeManager.LogStore.DeleteBranchTransactionDO(*write.branchTransactionDO)
+	}
 }
 
 func (storeManager *DBTransactionStoreManager) ReadSession(xid string) *session.GlobalSession {
@@ -100,12 +90,9 @@ func (storeManager *DBTransactionStoreManager) ReadSessionByTransactionID(transa
 	return getGlobalSession(globalTransactionDO, branchTransactionDOs)
 }
 
-func (storeManager *DBTransactionStoreManager) readSessionByStatuses(statuses []meta.GlobalStatus) []*session.GlobalSession {
-	states := make([]int, 0)
-	for _, status := range statuses {
-		states = append(states, int(status))
-	}
-	globalTransactionDOs := storeManager.LogStore.QueryGlobalTransactionDOByStatuses(states, storeManager.logQueryLimit)
+// readGlobalSessions loads the branches of globalTransactionDOs, the sessions
+// keep their order.
+func (storeManager *DBTransactionStoreManager) readGlobalSessions(globalTransactionDOs []*model.GlobalTransactionDO) []*session.GlobalSession {
 	if len(globalTransactionDOs) == 0 {
 		return nil
 	}
@@ -134,30 +121,18 @@ func (storeManager *DBTransactionStoreManager) readSessionByStatuses(statuses []
 	return globalSessions
 }
 
+// ReadSessionWithSessionCondition queries the sessions matching every field of
+// sessionCondition, sorted and paged by the database. An empty condition
+// matches every session.
 func (storeManager *DBTransactionStoreManager) ReadSessionWithSessionCondition(sessionCondition model.SessionCondition) []*session.GlobalSession {
-	if sessionCondition.XID != "" {
-		globalSession := storeManager.ReadSession(sessionCondition.XID)
-		if globalSession != nil {
-			globalSessions := make([]*session.GlobalSession, 0)
-			globalSessions = append(globalSessions, globalSession)
-			return globalSessions
-		}
-	} else if sessionCondition.TransactionID != 0 {
-		globalSession := storeManager.ReadSessionByTransactionID(sessionCondition.TransactionID)
-		if globalSession != nil {
-			globalSessions := make([]*session.GlobalSession, 0)
-			globalSessions = append(globalSessions, globalSession)
-			return globalSessions
-		}
-	} else if sessionCondition.Statuses != nil && len(sessionCondition.Statuses) > 0 {
-		return storeManager.readSessionByStatuses(sessionCondition.Statuses)
-	}
-
-	return nil
+	globalTransactionDOs := storeManager.LogStore.QueryGlobalTransactionDOByCondition(sessionCondition)
+	return storeManager.readGlobalSessions(globalTransactionDOs)
 }
 
 func (storeManager *DBTransactionStoreManager) Shutdown() {
-
+	if storeManager.groupCommit != nil {
+		storeManager.groupCommit.shutdown()
+	}
 }
 
 func getGlobalSession(globalTransactionDO *model.GlobalTransactionDO, branchTransactionDOs []*model.BranchTransactionDO) *session.GlobalSession {
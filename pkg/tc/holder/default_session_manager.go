@@ -20,7 +20,6 @@ package holder
 import (
 	"github.com/transaction-mesh/starfish/pkg/tc/model"
 	"github.com/transaction-mesh/starfish/pkg/tc/session"
-	"github.com/transaction-mesh/starfish/pkg/util/time"
 )
 
 type DefaultSessionManager struct {
@@ -39,7 +38,9 @@ func NewDefaultSessionManager(name string) SessionManager {
 }
 
 func (sessionManager *DefaultSessionManager) AddGlobalSession(session *session.GlobalSession) error {
-	sessionManager.AbstractSessionManager.AddGlobalSession(session)
+	if err := sessionManager.AbstractSessionManager.AddGlobalSession(session); err != nil {
+		return err
+	}
 	sessionManager.SessionMap[session.XID] = session
 	return nil
 }
@@ -53,7 +54,9 @@ func (sessionManager *DefaultSessionManager) FindGlobalSessionWithBranchSessions
 }
 
 func (sessionManager *DefaultSessionManager) RemoveGlobalSession(session *session.GlobalSession) error {
-	sessionManager.AbstractSessionManager.RemoveGlobalSession(session)
+	if err := sessionManager.AbstractSessionManager.RemoveGlobalSession(session); err != nil {
+		return err
+	}
 	delete(sessionManager.SessionMap, session.XID)
 	return nil
 }
@@ -67,13 +70,10 @@ func (sessionManager *DefaultSessionManager) AllSessions() []*session.GlobalSess
 }
 
 func (sessionManager *DefaultSessionManager) FindGlobalSessions(condition model.SessionCondition) []*session.GlobalSession {
-	var sessions = make([]*session.GlobalSession, 0)
-	for _, session := range sessionManager.SessionMap {
-		if int64(time.CurrentTimeMillis())-session.BeginTime > condition.OverTimeAliveMills {
-			sessions = append(sessions, session)
-		}
+	if condition.History {
+		return GetSessionArchive().FindGlobalSessions(condition)
 	}
-	return sessions
+	return selectGlobalSessions(sessionManager.AllSessions(), condition)
 }
 
 func (sessionManager *DefaultSessionManager) SetTransactionStoreManager(transactionStoreManager TransactionStoreManager) {
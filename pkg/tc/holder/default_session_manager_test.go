@@ -28,7 +28,9 @@ import (
 import (
 	"github.com/transaction-mesh/starfish/pkg/base/common"
 	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
 	"github.com/transaction-mesh/starfish/pkg/tc/session"
+	"github.com/transaction-mesh/starfish/pkg/util/time"
 )
 
 func TestDefaultSessionManager_AddGlobalSession_RemoveGlobalSession(t *testing.T) {
@@ -55,6 +57,34 @@ func TestDefaultSessionManager_FindGlobalSession(t *testing.T) {
 	sessionManager.RemoveGlobalSession(gs)
 }
 
+func TestDefaultSessionManager_FindGlobalSessions(t *testing.T) {
+	gs := globalSessionProvider(t)
+	gs.Begin()
+	gs2 := session.NewGlobalSession(
+		session.WithGsApplicationID("demo-order"),
+		session.WithGsTransactionName("create-order"),
+		session.WithGsStatus(meta.GlobalStatusCommitRetrying),
+		session.WithGsBeginTime(int64(time.CurrentTimeMillis())-60000),
+	)
+	sessionManager := NewDefaultSessionManager("default")
+	sessionManager.AddGlobalSession(gs)
+	sessionManager.AddGlobalSession(gs2)
+
+	assert.Equal(t, 2, len(sessionManager.FindGlobalSessions(model.SessionCondition{})))
+	assert.Equal(t, []*session.GlobalSession{gs2},
+		sessionManager.FindGlobalSessions(model.SessionCondition{Status: meta.GlobalStatusCommitRetrying}))
+	assert.Equal(t, []*session.GlobalSession{gs2},
+		sessionManager.FindGlobalSessions(model.SessionCondition{ApplicationID: "demo-order"}))
+	assert.Equal(t, []*session.GlobalSession{gs},
+		sessionManager.FindGlobalSessions(model.SessionCondition{TransactionName: "test"}))
+	assert.Equal(t, []*session.GlobalSession{gs2},
+		sessionManager.FindGlobalSessions(model.SessionCondition{OverTimeAliveMills: 30000}))
+	assert.Equal(t, 0, len(sessionManager.FindGlobalSessions(model.SessionCondition{
+		Statuses:      []meta.GlobalStatus{meta.GlobalStatusBegin, meta.GlobalStatusRollbackRetrying},
+		ApplicationID: "demo-order",
+	})))
+}
+
 func globalSessionsProvider() []*session.GlobalSession {
 	common.Init("127.0.0.1", 9876)
 
@@ -0,0 +1,273 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/embedded"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+)
+
+// EmbeddedTransactionStoreManager keeps the sessions in the embedded bbolt
+// store, every write is a transaction of its own. The global sessions are
+// indexed by transaction id, status and begin time.
+type EmbeddedTransactionStoreManager struct {
+	db *bolt.DB
+}
+
+func NewEmbeddedTransactionStoreManager(db *bolt.DB) *EmbeddedTransactionStoreManager {
+	return &EmbeddedTransactionStoreManager{db: db}
+}
+
+// NewEmbeddedSessionManager returns a session manager backed by the embedded
+// store, it behaves as the one of the db store mode.
+func NewEmbeddedSessionManager(taskName string, storeManager *EmbeddedTransactionStoreManager) SessionManager {
+	return &DataBaseSessionManager{
+		TaskName:                taskName,
+		TransactionStoreManager: storeManager,
+	}
+}
+
+func (storeManager *EmbeddedTransactionStoreManager) WriteSession(logOperation LogOperation, sessionStorable session.SessionStorable) bool {
+	err := storeManager.db.Update(func(tx *bolt.Tx) error {
+		switch logOperation {
+		case LogOperationGlobalAdd, LogOperationGlobalUpdate:
+			globalSession, ok := sessionStorable.(*session.GlobalSession)
+			if !ok {
+				return errors.Errorf("%v is not a global session", sessionStorable)
+			}
+			return putGlobalSession(tx, globalSession)
+		case LogOperationGlobalRemove:
+			globalSession, ok := sessionStorable.(*session.GlobalSession)
+			if !ok {
+				return errors.Errorf("%v is not a global session", sessionStorable)
+			}
+			return deleteGlobalSession(tx, globalSession.XID)
+		case LogOperationBranchAdd, LogOperationBranchUpdate:
+			branchSession, ok := sessionStorable.(*session.BranchSession)
+			if !ok {
+				return errors.Errorf("%v is not a branch session", sessionStorable)
+			}
+			data, err := branchSession.Encode()
+			if err != nil {
+				return err
+			}
+			return tx.Bucket(embedded.BranchBucket).Put(embedded.BranchKey(branchSession.XID, branchSession.BranchID), data)
+		case LogOperationBranchRemove:
+			branchSession, ok := sessionStorable.(*session.BranchSession)
+			if !ok {
+				return errors.Errorf("%v is not a branch session", sessionStorable)
+			}
+			return tx.Bucket(embedded.BranchBucket).Delete(embedded.BranchKey(branchSession.XID, branchSession.BranchID))
+		default:
+			return errors.Errorf("unknown LogOperation:%v", logOperation)
+		}
+	})
+	if err != nil {
+		log.Errorf("write %s to embedded store failed: %v", logOperation, err)
+		return false
+	}
+	return true
+}
+
+// putGlobalSession stores globalSession and moves its index entries when its
+// status changed.
+func putGlobalSession(tx *bolt.Tx, globalSession *session.GlobalSession) error {
+	if err := deleteGlobalSessionIndexes(tx, globalSession.XID); err != nil {
+		return err
+	}
+	data, err := globalSession.Encode()
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(embedded.GlobalBucket).Put([]byte(globalSession.XID), data); err != nil {
+		return err
+	}
+	if err := tx.Bucket(embedded.TransactionIDBucket).Put(embedded.Int64Key(globalSession.TransactionID), []byte(globalSession.XID)); err != nil {
+		return err
+	}
+	statusKey := embedded.StatusKey(byte(globalSession.Status), globalSession.BeginTime, globalSession.XID)
+	if err := tx.Bucket(embedded.StatusBucket).Put(statusKey, nil); err != nil {
+		return err
+	}
+	return tx.Bucket(embedded.BeginTimeBucket).Put(embedded.BeginTimeKey(globalSession.BeginTime, globalSession.XID), nil)
+}
+
+func deleteGlobalSession(tx *bolt.Tx, xid string) error {
+	if err := deleteGlobalSessionIndexes(tx, xid); err != nil {
+		return err
+	}
+	return tx.Bucket(embedded.GlobalBucket).Delete([]byte(xid))
+}
+
+// deleteGlobalSessionIndexes removes the index entries of the stored version
+// of the global session xid.
+func deleteGlobalSessionIndexes(tx *bolt.Tx, xid string) error {
+	data := tx.Bucket(embedded.GlobalBucket).Get([]byte(xid))
+	if data == nil {
+		return nil
+	}
+	stored := &session.GlobalSession{}
+	stored.Decode(data)
+	if err := tx.Bucket(embedded.TransactionIDBucket).Delete(embedded.Int64Key(stored.TransactionID)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(embedded.StatusBucket).Delete(embedded.StatusKey(byte(stored.Status), stored.BeginTime, xid)); err != nil {
+		return err
+	}
+	return tx.Bucket(embedded.BeginTimeBucket).Delete(embedded.BeginTimeKey(stored.BeginTime, xid))
+}
+
+func (storeManager *EmbeddedTransactionStoreManager) ReadSession(xid string) *session.GlobalSession {
+	return storeManager.ReadSessionWithBranchSessions(xid, true)
+}
+
+func (storeManager *EmbeddedTransactionStoreManager) ReadSessionWithBranchSessions(xid string, withBranchSessions bool) *session.GlobalSession {
+	var globalSession *session.GlobalSession
+	storeManager.view(func(tx *bolt.Tx) error {
+		globalSession = readGlobalSession(tx, xid, withBranchSessions)
+		return nil
+	})
+	return globalSession
+}
+
+// ReadSessionWithSessionCondition looks the sessions up by the most selective
+// indexed field of sessionCondition, then filters them by the other fields
+// and sorts and pages them. An empty condition matches every session.
+func (storeManager *EmbeddedTransactionStoreManager) ReadSessionWithSessionCondition(sessionCondition model.SessionCondition) []*session.GlobalSession {
+	var globalSessions []*session.GlobalSession
+	storeManager.view(func(tx *bolt.Tx) error {
+		var xids []string
+		switch {
+		case sessionCondition.XID != "":
+			xids = []string{sessionCondition.XID}
+		case sessionCondition.TransactionID != 0:
+			if xid := tx.Bucket(embedded.TransactionIDBucket).Get(embedded.Int64Key(sessionCondition.TransactionID)); xid != nil {
+				xids = []string{string(xid)}
+			}
+		case len(sessionCondition.Statuses) > 0 || sessionCondition.Status != meta.GlobalStatusUnknown:
+			statuses := sessionCondition.Statuses
+			if len(statuses) == 0 {
+				statuses = []meta.GlobalStatus{sessionCondition.Status}
+			}
+			for _, status := range statuses {
+				xids = append(xids, scanStatusIndex(tx, status)...)
+			}
+		default:
+			beforeBeginTime := beginTimeBefore(sessionCondition)
+			if beforeBeginTime <= 0 {
+				beforeBeginTime = -1
+			}
+			xids = scanBeginTimeIndex(tx, beforeBeginTime)
+		}
+		for _, xid := range xids {
+			if globalSession := readGlobalSession(tx, xid, true); globalSession != nil {
+				globalSessions = append(globalSessions, globalSession)
+			}
+		}
+		return nil
+	})
+	return selectGlobalSessions(globalSessions, sessionCondition)
+}
+
+// OrphanBranchSessions returns the branches whose global session no longer exists.
+func (storeManager *EmbeddedTransactionStoreManager) OrphanBranchSessions() []*session.BranchSession {
+	var branchSessions []*session.BranchSession
+	storeManager.view(func(tx *bolt.Tx) error {
+		globals := tx.Bucket(embedded.GlobalBucket)
+		return tx.Bucket(embedded.BranchBucket).ForEach(func(key, value []byte) error {
+			xid, _, _ := embedded.ParseBranchKey(key)
+			if globals.Get([]byte(xid)) == nil {
+				branchSession := &session.BranchSession{}
+				branchSession.Decode(value)
+				branchSessions = append(branchSessions, branchSession)
+			}
+			return nil
+		})
+	})
+	return branchSessions
+}
+
+func (storeManager *EmbeddedTransactionStoreManager) Shutdown() {
+	if err := storeManager.db.Close(); err != nil {
+		log.Errorf("close embedded store failed: %v", err)
+	}
+}
+
+func (storeManager *EmbeddedTransactionStoreManager) view(fn func(tx *bolt.Tx) error) {
+	if err := storeManager.db.View(fn); err != nil {
+		log.Errorf("read embedded store failed: %v", err)
+	}
+}
+
+func readGlobalSession(tx *bolt.Tx, xid string, withBranchSessions bool) *session.GlobalSession {
+	data := tx.Bucket(embedded.GlobalBucket).Get([]byte(xid))
+	if data == nil {
+		return nil
+	}
+	globalSession := session.NewGlobalSession()
+	globalSession.Decode(data)
+	if withBranchSessions {
+		cursor := tx.Bucket(embedded.BranchBucket).Cursor()
+		prefix := embedded.XIDPrefix(xid)
+		for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+			branchSession := &session.BranchSession{}
+			branchSession.Decode(value)
+			globalSession.Add(branchSession)
+		}
+	}
+	return globalSession
+}
+
+// scanStatusIndex returns the xids of status ordered by begin time.
+func scanStatusIndex(tx *bolt.Tx, status meta.GlobalStatus) []string {
+	var xids []string
+	cursor := tx.Bucket(embedded.StatusBucket).Cursor()
+	prefix := []byte{byte(status)}
+	for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+		xids = append(xids, string(key[9:]))
+	}
+	return xids
+}
+
+// scanBeginTimeIndex returns the xids ordered by begin time, only the ones that
+// began before beforeBeginTime unless it is negative.
+func scanBeginTimeIndex(tx *bolt.Tx, beforeBeginTime int64) []string {
+	var xids []string
+	cursor := tx.Bucket(embedded.BeginTimeBucket).Cursor()
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+		if beforeBeginTime >= 0 && int64(binary.BigEndian.Uint64(key[:8])) >= beforeBeginTime {
+			break
+		}
+		xids = append(xids, string(key[8:]))
+	}
+	return xids
+}
@@ -0,0 +1,114 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/embedded"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+	timeutil "github.com/transaction-mesh/starfish/pkg/util/time"
+)
+
+func openEmbeddedStore(t *testing.T, dir string) *EmbeddedTransactionStoreManager {
+	db, err := embedded.Open(filepath.Join(dir, "starfish.db"), time.Second, true)
+	assert.Nil(t, err)
+	return NewEmbeddedTransactionStoreManager(db)
+}
+
+func TestEmbeddedTransactionStoreManager_WriteSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedded")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storeManager := openEmbeddedStore(t, dir)
+	sessionManager := NewEmbeddedSessionManager("", storeManager)
+	gs := globalSessionProvider(t)
+	gs.Status = meta.GlobalStatusBegin
+	gs.BeginTime = int64(timeutil.CurrentTimeMillis()) - 60000
+	bs := branchSessionProvider(gs)
+	bs.XID = gs.XID
+	sessionManager.AddGlobalSession(gs)
+	sessionManager.AddBranchSession(gs, bs)
+
+	expected := sessionManager.FindGlobalSession(gs.XID)
+	assert.NotNil(t, expected)
+	assert.Equal(t, gs.TransactionID, expected.TransactionID)
+	assert.Equal(t, 1, len(expected.BranchSessions))
+
+	byTransactionID := storeManager.ReadSessionWithSessionCondition(model.SessionCondition{TransactionID: gs.TransactionID})
+	assert.Equal(t, 1, len(byTransactionID))
+	byStatus := storeManager.ReadSessionWithSessionCondition(model.SessionCondition{Status: meta.GlobalStatusBegin})
+	assert.Equal(t, 1, len(byStatus))
+	byAge := storeManager.ReadSessionWithSessionCondition(model.SessionCondition{OverTimeAliveMills: 30000})
+	assert.Equal(t, 1, len(byAge))
+	byAge = storeManager.ReadSessionWithSessionCondition(model.SessionCondition{OverTimeAliveMills: 120000})
+	assert.Equal(t, 0, len(byAge))
+
+	gs.Status = meta.GlobalStatusCommitting
+	sessionManager.UpdateGlobalSessionStatus(gs, meta.GlobalStatusCommitting)
+	byStatus = storeManager.ReadSessionWithSessionCondition(model.SessionCondition{Status: meta.GlobalStatusBegin})
+	assert.Equal(t, 0, len(byStatus))
+	byStatus = storeManager.ReadSessionWithSessionCondition(model.SessionCondition{
+		Statuses: []meta.GlobalStatus{meta.GlobalStatusCommitting, meta.GlobalStatusRollingBack}})
+	assert.Equal(t, 1, len(byStatus))
+
+	sessionManager.RemoveBranchSession(gs, bs)
+	sessionManager.RemoveGlobalSession(gs)
+	assert.Nil(t, sessionManager.FindGlobalSession(gs.XID))
+	assert.Equal(t, 0, len(sessionManager.AllSessions()))
+	storeManager.Shutdown()
+}
+
+func TestEmbeddedTransactionStoreManager_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedded")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storeManager := openEmbeddedStore(t, dir)
+	gs := globalSessionProvider(t)
+	bs := branchSessionProvider(gs)
+	bs.XID = gs.XID
+	assert.True(t, storeManager.WriteSession(LogOperationGlobalAdd, gs))
+	assert.True(t, storeManager.WriteSession(LogOperationBranchAdd, bs))
+	orphan := session.NewBranchSession(session.WithBsXid(gs.XID+"-removed"), session.WithBsBranchID(2))
+	assert.True(t, storeManager.WriteSession(LogOperationBranchAdd, orphan))
+	storeManager.Shutdown()
+
+	storeManager = openEmbeddedStore(t, dir)
+	defer storeManager.Shutdown()
+	expected := storeManager.ReadSession(gs.XID)
+	assert.NotNil(t, expected)
+	assert.Equal(t, gs.TransactionName, expected.TransactionName)
+	assert.Equal(t, 1, len(expected.BranchSessions))
+	orphans := storeManager.OrphanBranchSessions()
+	assert.Equal(t, 1, len(orphans))
+	assert.Equal(t, int64(2), orphans[0].BranchID)
+}
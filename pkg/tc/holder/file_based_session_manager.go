@@ -17,6 +17,10 @@
 
 package holder
 
+import (
+	"github.com/pkg/errors"
+)
+
 import (
 	"github.com/transaction-mesh/starfish/pkg/base/meta"
 	"github.com/transaction-mesh/starfish/pkg/tc/config"
@@ -27,39 +31,74 @@ import (
 type FileBasedSessionManager struct {
 	conf config.FileStoreConfig
 	DefaultSessionManager
+
+	// orphanBranchSessions are the restored branches whose global session is
+	// not in the store.
+	orphanBranchSessions []*session.BranchSession
 }
 
 func NewFileBasedSessionManager(conf config.FileStoreConfig) SessionManager {
-	transactionStoreManager := &FileTransactionStoreManager{}
-	transactionStoreManager.InitFile(conf.FileDir)
-	sessionManager := DefaultSessionManager{
-		AbstractSessionManager: AbstractSessionManager{
-			TransactionStoreManager: transactionStoreManager,
-			Name:                    conf.FileDir,
+	return &FileBasedSessionManager{
+		conf: conf,
+		DefaultSessionManager: DefaultSessionManager{
+			AbstractSessionManager: AbstractSessionManager{
+				TransactionStoreManager: NewFileTransactionStoreManager(conf),
+				Name:                    conf.FileDir,
+			},
+			SessionMap: make(map[string]*session.GlobalSession),
 		},
-		SessionMap: make(map[string]*session.GlobalSession),
 	}
-	transactionStoreManager.SessionManager = &sessionManager
+}
+
+// newReadOnlyFileBasedSessionManager reads the file store of conf without
+// writing to it, a torn tail of the log is neither truncated nor replayed.
+func newReadOnlyFileBasedSessionManager(conf config.FileStoreConfig) *FileBasedSessionManager {
 	return &FileBasedSessionManager{
-		conf:                  conf,
-		DefaultSessionManager: sessionManager,
+		conf: conf,
+		DefaultSessionManager: DefaultSessionManager{
+			AbstractSessionManager: AbstractSessionManager{
+				TransactionStoreManager: newReadOnlyFileTransactionStoreManager(conf),
+				Name:                    conf.FileDir,
+			},
+			SessionMap: make(map[string]*session.GlobalSession),
+		},
 	}
 }
 
-func (sessionManager *FileBasedSessionManager) Reload() {
-	sessionManager.restoreSessions()
+// Reload restores the sessions from the latest snapshot and the segments
+// written after it, it fails on a corrupt frame rather than losing the
+// sessions after it.
+func (sessionManager *FileBasedSessionManager) Reload() error {
+	transactionStoreManager, ok := sessionManager.TransactionStoreManager.(ReloadableStore)
+	if !ok {
+		return nil
+	}
+	err := sessionManager.restoreSessions(func(restore func(stores []*TransactionWriteStore)) error {
+		return transactionStoreManager.ReadWriteStores(sessionManager.conf.SessionReloadReadSize, restore)
+	})
+	if err != nil {
+		return err
+	}
 	sessionManager.washSessions()
+	return nil
 }
 
-func (sessionManager *FileBasedSessionManager) restoreSessions() {
+// restoreSessions replays the stores read hands to restore, the compaction of
+// the file store replays its segments the same way.
+func (sessionManager *FileBasedSessionManager) restoreSessions(read func(restore func(stores []*TransactionWriteStore)) error) error {
 	unhandledBranchBuffer := make(map[int64]*session.BranchSession)
-	sessionManager.restoreSessionsToUnhandledBranchBuffer(true, unhandledBranchBuffer)
-	sessionManager.restoreSessionsToUnhandledBranchBuffer(false, unhandledBranchBuffer)
+	err := read(func(stores []*TransactionWriteStore) {
+		sessionManager.restore(stores, unhandledBranchBuffer)
+	})
+	if err != nil {
+		return errors.WithMessage(err, "reload sessions")
+	}
 	if len(unhandledBranchBuffer) > 0 {
 		for _, branchSession := range unhandledBranchBuffer {
 			found := sessionManager.SessionMap[branchSession.XID]
 			if found == nil {
 				log.Warnf("GlobalSession Does Not Exists For BranchSession [%d/%s]", branchSession.BranchID, branchSession.XID)
+				sessionManager.orphanBranchSessions = append(sessionManager.orphanBranchSessions, branchSession)
 			} else {
 				existingBranch := found.GetBranch(branchSession.BranchID)
 				if existingBranch == nil {
@@ -70,21 +109,7 @@ func (sessionManager *FileBasedSessionManager) restoreSessions() {
 			}
 		}
 	}
-}
-
-func (sessionManager *FileBasedSessionManager) restoreSessionsToUnhandledBranchBuffer(isHistory bool, unhandledBranchSessions map[int64]*session.BranchSession) {
-	transactionStoreManager, ok := sessionManager.TransactionStoreManager.(ReloadableStore)
-	if !ok {
-		return
-	}
-	for {
-		if transactionStoreManager.HasRemaining(isHistory) {
-			stores := transactionStoreManager.ReadWriteStore(sessionManager.conf.SessionReloadReadSize, isHistory)
-			sessionManager.restore(stores, unhandledBranchSessions)
-		} else {
-			break
-		}
-	}
+	return nil
 }
 
 func (sessionManager *FileBasedSessionManager) washSessions() {
@@ -14,88 +14,316 @@
  * See the License for the specific language governing permissions and
  * limitations under the License.
  */
-
 package holder
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
 import (
-	"vimagination.zapto.org/byteio"
+	"github.com/pkg/errors"
 )
 
 import (
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
 	"github.com/transaction-mesh/starfish/pkg/tc/model"
 	"github.com/transaction-mesh/starfish/pkg/tc/session"
 	"github.com/transaction-mesh/starfish/pkg/util/log"
-	"github.com/transaction-mesh/starfish/pkg/util/time"
 )
 
-var FileTrxNum int64 = 0
-var PerFileBlockSize int64 = 65535 * 8
+// HisDataFilenamePostfix is the suffix of the history data file written before
+// the log was split in segments, it is replayed before the data file itself
+// until the first compaction removes both.
 var HisDataFilenamePostfix = ".1"
-var MaxTrxTimeoutMills int64 = 30 * 60 * 1000
+
+const (
+	segmentFilePostfix  = ".log"
+	snapshotFilePostfix = ".snapshot"
+	tmpFilePostfix      = ".tmp"
+)
+
+// frameChecksumFlag is set in the length of the frames followed by the CRC32
+// of their payload, frames written before checksums were added have none.
+const frameChecksumFlag = 1 << 31
+
+// ErrCorruptDataFile is returned on reload when a frame that is not the last
+// one of the log can not be read, restoring the frames after it would
+// silently lose the sessions it held.
+var ErrCorruptDataFile = errors.New("corrupt transaction data file")
+
+// errTornFrame is a last frame cut short by a crash during its write.
+var errTornFrame = errors.New("torn frame")
+
+// tornTail is what a replay does with a torn last frame of the log.
+type tornTail int
+
+const (
+	// tornTailCorrupt fails the replay with ErrCorruptDataFile.
+	tornTailCorrupt tornTail = iota
+	// tornTailTruncate cuts the frame off the file, the next write appends
+	// after the last whole frame.
+	tornTailTruncate
+	// tornTailSkip stops the replay before the frame and leaves the file as
+	// it is, a TC may still be writing to it.
+	tornTailSkip
+)
+
+var frameCrcTable = crc32.MakeTable(crc32.Castagnoli)
 
 type ReloadableStore interface {
-	/**
-	 * Read write holder.
-	 *
-	 * @param readSize  the read size
-	 * @param isHistory the is history
-	 * @return the list
-	 */
-	ReadWriteStore(readSize int, isHistory bool) []*TransactionWriteStore
-
-	/**
-	 * Has remaining boolean.
-	 *
-	 * @param isHistory the is history
-	 * @return the boolean
-	 */
-	HasRemaining(isHistory bool) bool
+	// ReadWriteStores replays the stores of the latest snapshot and of the
+	// segments written after it in order, handing them to restore readSize at
+	// a time.
+	ReadWriteStores(readSize int, restore func(stores []*TransactionWriteStore)) error
 }
 
+// FileTransactionStoreManager appends the session writes to a log split in
+// segments of at most SegmentSize bytes, named <FileDir>.<seq>.log. Once
+// MaxSegments segments are closed a background compaction replays them and
+// writes the sessions still alive to <FileDir>.<seq>.snapshot, the segments
+// before seq are then removed. A reload reads the latest snapshot and the
+// segments from its seq on.
 type FileTransactionStoreManager struct {
-	SessionManager SessionManager
+	fileName      string
+	segmentSize   int64
+	maxSegments   int
+	readSize      int
+	flushDiskMode config.FlushDiskMode
+	// readOnly refuses every write and leaves a torn tail of the log in place.
+	readOnly bool
 
-	currFullFileName  string
-	hisFullFileName   string
-	currFileChannel   *os.File
-	LastModifiedTime  int64
-	TrxStartTimeMills int64
 	sync.Mutex
+	// segment is opened by the first write after a reload or a roll, so that a
+	// TC restarting before writing anything leaves the torn tail of the last
+	// segment at the end of the log.
+	segment *os.File
+	// segmentSeq is the seq of segment, or of the next one while it is nil,
+	// zero until the log files are scanned.
+	segmentSeq    int64
+	segmentOffset int64
+	// firstSeq is the first segment not covered by a snapshot.
+	firstSeq int64
+	// unflushed is set by the writes not yet fsynced in async flush mode.
+	unflushed bool
+	stopFlush chan struct{}
+
+	compacting bool
+	compaction sync.WaitGroup
+}
+
+func NewFileTransactionStoreManager(conf config.FileStoreConfig) *FileTransactionStoreManager {
+	storeManager := &FileTransactionStoreManager{
+		fileName:      conf.FileDir,
+		segmentSize:   conf.SegmentSize,
+		maxSegments:   conf.MaxSegments,
+		readSize:      conf.SessionReloadReadSize,
+		flushDiskMode: conf.FlushDiskMode,
+	}
+	if storeManager.segmentSize <= 0 {
+		storeManager.segmentSize = config.DefaultSegmentSize
+	}
+	if storeManager.maxSegments <= 0 {
+		storeManager.maxSegments = config.DefaultMaxSegments
+	}
+	if conf.FlushDiskMode == config.FlushdiskModeAsyncModel {
+		storeManager.startFlusher(conf.FlushDiskInterval)
+	}
+	return storeManager
+}
+
+// startFlusher fsyncs the writes of the last interval in async flush mode.
+// newReadOnlyFileTransactionStoreManager returns a store manager reading the
+// log of conf without ever writing to it, for inspecting the store offline.
+func newReadOnlyFileTransactionStoreManager(conf config.FileStoreConfig) *FileTransactionStoreManager {
+	return &FileTransactionStoreManager{
+		fileName: conf.FileDir,
+		readSize: conf.SessionReloadReadSize,
+		readOnly: true,
+	}
+}
+
+func (storeManager *FileTransactionStoreManager) startFlusher(interval time.Duration) {
+	if interval <= 0 {
+		interval = config.DefaultFlushDiskInterval
+	}
+	storeManager.stopFlush = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				storeManager.Lock()
+				storeManager.flush()
+				storeManager.Unlock()
+			case <-storeManager.stopFlush:
+				return
+			}
+		}
+	}()
+}
 
-	recoverHisOffset  int64
-	recoverCurrOffset int64
+func (storeManager *FileTransactionStoreManager) flush() {
+	if !storeManager.unflushed || storeManager.segment == nil {
+		return
+	}
+	if err := storeManager.segment.Sync(); err != nil {
+		log.Errorf("flush %s failed: %v", storeManager.segment.Name(), err)
+		return
+	}
+	storeManager.unflushed = false
 }
 
-func (storeManager *FileTransactionStoreManager) InitFile(fullFileName string) {
-	storeManager.currFullFileName = fullFileName
-	storeManager.hisFullFileName = fullFileName + HisDataFilenamePostfix
-	storeManager.currFileChannel, _ = os.OpenFile(fullFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0777)
-	storeManager.TrxStartTimeMills = int64(time.CurrentTimeMillis())
+// openSegment creates the segment of segmentSeq, scanning the log files first
+// to find it.
+func (storeManager *FileTransactionStoreManager) openSegment() error {
+	if storeManager.segmentSeq == 0 {
+		files, err := scanLogFiles(storeManager.fileName)
+		if err != nil {
+			return err
+		}
+		storeManager.segmentSeq = files.nextSeq()
+		storeManager.firstSeq = files.firstSeq()
+	}
+	fileName := segmentFileName(storeManager.fileName, storeManager.segmentSeq)
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.WithStack(err)
+	}
+	if err := syncDir(filepath.Dir(fileName)); err != nil {
+		file.Close()
+		return err
+	}
+	storeManager.segment = file
+	storeManager.segmentOffset = fi.Size()
+	return nil
 }
 
-func (storeManager *FileTransactionStoreManager) writeDataFrame(data []byte) {
-	dataLength := uint32(len(data))
-	dataLengthBytes := [4]byte{
-		byte(dataLength >> 24),
-		byte(dataLength >> 16),
-		byte(dataLength >> 8),
-		byte(dataLength),
+// roll closes the full segment, the next write opens the following one. A
+// compaction is started once maxSegments segments are not covered by a
+// snapshot.
+func (storeManager *FileTransactionStoreManager) roll() {
+	if storeManager.flushDiskMode != config.FlushdiskModeNoneModel {
+		if err := storeManager.segment.Sync(); err != nil {
+			log.Errorf("flush %s failed: %v", storeManager.segment.Name(), err)
+		}
+	}
+	storeManager.segment.Close()
+	storeManager.segment = nil
+	storeManager.unflushed = false
+	storeManager.segmentSeq++
+
+	if storeManager.compacting || storeManager.segmentSeq-storeManager.firstSeq < int64(storeManager.maxSegments) {
+		return
 	}
-	storeManager.currFileChannel.Write(dataLengthBytes[:4])
-	storeManager.currFileChannel.Write(data)
+	seq := storeManager.segmentSeq
+	storeManager.compacting = true
+	storeManager.compaction.Add(1)
+	go func() {
+		defer storeManager.compaction.Done()
+		err := storeManager.compact(seq)
+		storeManager.Lock()
+		storeManager.compacting = false
+		if err == nil {
+			storeManager.firstSeq = seq
+		}
+		storeManager.Unlock()
+		if err != nil {
+			log.Errorf("compact %s failed: %v", storeManager.fileName, err)
+		}
+	}()
+}
+
+// compact replays the files of the log before the segment seq, writes the
+// sessions still alive to the snapshot of seq and removes the files it covers.
+// It does not hold the lock, the segments it reads are closed.
+func (storeManager *FileTransactionStoreManager) compact(seq int64) error {
+	files, err := scanLogFiles(storeManager.fileName)
+	if err != nil {
+		return err
+	}
+	replayed := files.replay(seq)
+	sessionManager := &FileBasedSessionManager{
+		DefaultSessionManager: DefaultSessionManager{SessionMap: make(map[string]*session.GlobalSession)},
+	}
+	err = sessionManager.restoreSessions(func(restore func(stores []*TransactionWriteStore)) error {
+		return replayLogFiles(replayed, tornTailCorrupt, storeManager.readSize, restore)
+	})
+	if err != nil {
+		return err
+	}
+	sessionManager.washSessions()
+
+	if err := writeSnapshot(snapshotFileName(storeManager.fileName, seq), sessionManager); err != nil {
+		return err
+	}
+	for _, fileName := range append(replayed, files.stale...) {
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+	return syncDir(filepath.Dir(storeManager.fileName))
+}
+
+// writeDataFrame appends [length | checksum flag][crc32][data] in a single
+// write. A frame only partly written is cut off so that the next frames do
+// not follow garbage.
+func (storeManager *FileTransactionStoreManager) writeDataFrame(data []byte) error {
+	if storeManager.segment == nil {
+		if err := storeManager.openSegment(); err != nil {
+			return err
+		}
+	}
+	n, err := storeManager.segment.Write(encodeDataFrame(data))
+	if err != nil {
+		if n > 0 {
+			if err := storeManager.segment.Truncate(storeManager.segmentOffset); err != nil {
+				log.Errorf("truncate partial frame of %s failed: %v", storeManager.segment.Name(), err)
+			}
+		}
+		return errors.Wrapf(err, "write %s", storeManager.segment.Name())
+	}
+	storeManager.segmentOffset += int64(n)
+
+	switch storeManager.flushDiskMode {
+	case config.FlushdiskModeSyncModel:
+		if err := storeManager.segment.Sync(); err != nil {
+			return errors.Wrapf(err, "flush %s", storeManager.segment.Name())
+		}
+	case config.FlushdiskModeAsyncModel:
+		storeManager.unflushed = true
+	}
+	if storeManager.segmentOffset >= storeManager.segmentSize {
+		storeManager.roll()
+	}
+	return nil
 }
 
 func (storeManager *FileTransactionStoreManager) WriteSession(logOperation LogOperation, session session.SessionStorable) bool {
+	if storeManager.readOnly {
+		log.Errorf("write %s refused, %s is opened read only", logOperation, storeManager.fileName)
+		return false
+	}
 	storeManager.Lock()
 	defer storeManager.Unlock()
-	var curFileTrxNum int64 = 0
 	data, err := (&TransactionWriteStore{
 		SessionRequest: session,
 		LogOperation:   logOperation,
@@ -104,12 +332,9 @@ func (storeManager *FileTransactionStoreManager) WriteSession(logOperation LogOp
 		log.Info(err.Error())
 		return false
 	}
-	storeManager.writeDataFrame(data)
-	storeManager.LastModifiedTime = int64(time.CurrentTimeMillis())
-	curFileTrxNum = atomic.AddInt64(&FileTrxNum, 1)
-	if curFileTrxNum%PerFileBlockSize == 0 &&
-		int64(time.CurrentTimeMillis())-storeManager.TrxStartTimeMills > MaxTrxTimeoutMills {
-		storeManager.saveHistory()
+	if err := storeManager.writeDataFrame(data); err != nil {
+		log.Errorf("write %s failed: %v", logOperation, err)
+		return false
 	}
 	return true
 }
@@ -127,122 +352,422 @@ func (storeManager *FileTransactionStoreManager) ReadSessionWithSessionCondition
 }
 
 func (storeManager *FileTransactionStoreManager) Shutdown() {
-	storeManager.currFileChannel.Close()
+	if storeManager.stopFlush != nil {
+		close(storeManager.stopFlush)
+	}
+	storeManager.compaction.Wait()
+	storeManager.Lock()
+	defer storeManager.Unlock()
+	if storeManager.segment == nil {
+		return
+	}
+	if err := storeManager.segment.Sync(); err != nil {
+		log.Errorf("flush %s failed: %v", storeManager.segment.Name(), err)
+	}
+	storeManager.segment.Close()
+	storeManager.segment = nil
 }
 
-func (storeManager *FileTransactionStoreManager) saveHistory() {
-	storeManager.findTimeoutAndSave()
-	os.Rename(storeManager.currFullFileName, storeManager.hisFullFileName)
-	storeManager.InitFile(storeManager.currFullFileName)
+func (storeManager *FileTransactionStoreManager) ReadWriteStores(readSize int, restore func(stores []*TransactionWriteStore)) error {
+	files, err := scanLogFiles(storeManager.fileName)
+	if err != nil {
+		return err
+	}
+	// A snapshot is renamed in place once synced, it can not be torn.
+	fileNames := files.replay(0)
+	tail := tornTailCorrupt
+	if len(fileNames) > 0 && fileNames[len(fileNames)-1] != files.snapshot {
+		tail = tornTailTruncate
+		if storeManager.readOnly {
+			tail = tornTailSkip
+		}
+	}
+	return replayLogFiles(fileNames, tail, readSize, restore)
 }
 
-func (storeManager *FileTransactionStoreManager) findTimeoutAndSave() (bool, error) {
-	globalSessionsOverMaxTimeout := storeManager.SessionManager.FindGlobalSessions(model.SessionCondition{OverTimeAliveMills: MaxTrxTimeoutMills})
+// replayLogFiles decodes the frames of fileNames in order and hands them to
+// restore readSize at a time. A torn last frame of the last file is handled
+// as tail says, any other unreadable frame is reported as ErrCorruptDataFile.
+func replayLogFiles(fileNames []string, tail tornTail, readSize int, restore func(stores []*TransactionWriteStore)) error {
+	if readSize <= 0 {
+		readSize = config.DefaultServiceSessionReloadReadSize
+	}
+	for i, fileName := range fileNames {
+		fileTail := tornTailCorrupt
+		if i == len(fileNames)-1 {
+			fileTail = tail
+		}
+		if err := replayDataFile(fileName, fileTail, readSize, restore); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if globalSessionsOverMaxTimeout == nil {
-		return true, nil
+func replayDataFile(fileName string, tail tornTail, readSize int, restore func(stores []*TransactionWriteStore)) error {
+	flag := os.O_RDONLY
+	if tail == tornTailTruncate {
+		flag = os.O_RDWR
+	}
+	file, err := os.OpenFile(fileName, flag, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return errors.WithStack(err)
 	}
 
-	for _, globalSession := range globalSessionsOverMaxTimeout {
-		globalWriteStore := &TransactionWriteStore{
-			SessionRequest: globalSession,
-			LogOperation:   LogOperationGlobalAdd,
+	fileSize := fi.Size()
+	stores := make([]*TransactionWriteStore, 0, readSize)
+	for offset := int64(0); offset < fileSize; {
+		data, next, err := readDataFrame(file, offset, fileSize)
+		if err == errTornFrame {
+			if tail == tornTailCorrupt {
+				return errors.Wrapf(ErrCorruptDataFile, "%s: frame at offset %d is torn", fileName, offset)
+			}
+			if tail == tornTailSkip {
+				log.Warnf("%s: frame at offset %d is torn, %d bytes are not read", fileName, offset, fileSize-offset)
+				break
+			}
+			log.Warnf("%s: frame at offset %d is torn, truncating %d bytes", fileName, offset, fileSize-offset)
+			if err := file.Truncate(offset); err != nil {
+				return errors.WithStack(err)
+			}
+			if err := file.Sync(); err != nil {
+				return errors.WithStack(err)
+			}
+			break
 		}
-		data, err := globalWriteStore.Encode()
 		if err != nil {
-			return false, err
-		}
-		storeManager.writeDataFrame(data)
-
-		branchSessIonsOverMaXTimeout := globalSession.GetSortedBranches()
-		if len(branchSessIonsOverMaXTimeout) > 0 {
-			for _, branchSession := range branchSessIonsOverMaXTimeout {
-				branchWriteStore := &TransactionWriteStore{
-					SessionRequest: branchSession,
-					LogOperation:   LogOperationBranchAdd,
-				}
-				data, err := branchWriteStore.Encode()
-				if err != nil {
-					return false, err
-				}
-				storeManager.writeDataFrame(data)
-			}
+			return errors.WithMessagef(err, "%s: frame at offset %d", fileName, offset)
+		}
+
+		store := &TransactionWriteStore{LogOperation: LogOperation(data[len(data)-1])}
+		if _, err := store.getSessionInstanceByOperation(); err != nil {
+			return errors.Wrapf(ErrCorruptDataFile, "%s: frame at offset %d has unknown operation %d",
+				fileName, offset, store.LogOperation)
 		}
+		store.Decode(data)
+		stores = append(stores, store)
+		if len(stores) == readSize {
+			restore(stores)
+			stores = make([]*TransactionWriteStore, 0, readSize)
+		}
+		offset = next
+	}
+	if len(stores) > 0 {
+		restore(stores)
 	}
-	return true, nil
+	return nil
 }
 
-func (storeManager *FileTransactionStoreManager) ReadWriteStore(readSize int, isHistory bool) []*TransactionWriteStore {
-	var (
-		file          *os.File
-		currentOffset int64
-	)
-	if isHistory {
-		file, _ = os.OpenFile(storeManager.hisFullFileName, os.O_RDWR|os.O_CREATE, 0777)
-		currentOffset = storeManager.recoverHisOffset
-	} else {
-		file, _ = os.OpenFile(storeManager.currFullFileName, os.O_RDWR|os.O_CREATE, 0777)
-		currentOffset = storeManager.recoverCurrOffset
+// writeSnapshot writes the global sessions of sessionManager with their
+// branches, and the orphan branches it restored, to a temporary file renamed
+// to fileName once synced.
+func writeSnapshot(fileName string, sessionManager *FileBasedSessionManager) error {
+	tmpFileName := fileName + tmpFilePostfix
+	file, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	writeStore := func(logOperation LogOperation, storable session.SessionStorable) error {
+		data, err := (&TransactionWriteStore{SessionRequest: storable, LogOperation: logOperation}).Encode()
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(encodeDataFrame(data))
+		return errors.WithStack(err)
+	}
+
+	xids := make([]string, 0, len(sessionManager.SessionMap))
+	for xid := range sessionManager.SessionMap {
+		xids = append(xids, xid)
+	}
+	sort.Strings(xids)
+	for _, xid := range xids {
+		globalSession := sessionManager.SessionMap[xid]
+		if err := writeStore(LogOperationGlobalAdd, globalSession); err != nil {
+			return err
+		}
+		for _, branchSession := range globalSession.GetSortedBranches() {
+			if err := writeStore(LogOperationBranchAdd, branchSession); err != nil {
+				return err
+			}
+		}
+	}
+	for _, branchSession := range sessionManager.orphanBranchSessions {
+		if err := writeStore(LogOperationBranchAdd, branchSession); err != nil {
+			return err
+		}
 	}
 
-	return storeManager.parseDataFile(file, readSize, currentOffset)
+	if err := writer.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := file.Sync(); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(tmpFileName, fileName); err != nil {
+		return errors.WithStack(err)
+	}
+	return syncDir(filepath.Dir(fileName))
+}
+
+func encodeDataFrame(data []byte) []byte {
+	frame := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data))|frameChecksumFlag)
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(data, frameCrcTable))
+	copy(frame[8:], data)
+	return frame
 }
 
-func (storeManager *FileTransactionStoreManager) HasRemaining(isHistory bool) bool {
-	var (
-		file          *os.File
-		currentOffset int64
-	)
-	if isHistory {
-		file, _ = os.OpenFile(storeManager.hisFullFileName, os.O_RDWR|os.O_CREATE, 0777)
-		currentOffset = storeManager.recoverHisOffset
-	} else {
-		file, _ = os.OpenFile(storeManager.currFullFileName, os.O_RDWR|os.O_CREATE, 0777)
-		currentOffset = storeManager.recoverCurrOffset
+// readDataFrame reads the frame at offset of a data file of fileSize bytes,
+// it returns the payload and the offset of the next frame. A last frame cut
+// short, failing its checksum or followed by zeros only is errTornFrame. A
+// length running past the end of the file is only taken for a cut short frame
+// when no whole frame follows, a corrupt length in the middle of the file
+// would drop the frames after it.
+func readDataFrame(file io.ReaderAt, offset int64, fileSize int64) ([]byte, int64, error) {
+	header := make([]byte, 8)
+	if fileSize-offset < 4 {
+		return nil, 0, errTornFrame
+	}
+	if _, err := file.ReadAt(header[:4], offset); err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	length := binary.BigEndian.Uint32(header)
+	headerSize := int64(4)
+	if length&frameChecksumFlag != 0 {
+		length &^= frameChecksumFlag
+		headerSize = 8
+	}
+	frameSize := headerSize + int64(length)
+	if fileSize-offset < frameSize {
+		followed, err := frameFollows(file, offset+4, fileSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		if followed {
+			return nil, 0, errors.Wrapf(ErrCorruptDataFile, "frame length %d runs past the end of the file", length)
+		}
+		return nil, 0, errTornFrame
+	}
+	if length == 0 {
+		if zeroTail(file, offset, fileSize) {
+			return nil, 0, errTornFrame
+		}
+		return nil, 0, errors.Wrap(ErrCorruptDataFile, "empty frame")
 	}
-	defer file.Close()
 
-	fi, _ := file.Stat()
-	return currentOffset < fi.Size()
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset+headerSize); err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	if headerSize == 8 {
+		if _, err := file.ReadAt(header[4:], offset+4); err != nil {
+			return nil, 0, errors.WithStack(err)
+		}
+		if crc32.Checksum(data, frameCrcTable) != binary.BigEndian.Uint32(header[4:]) {
+			if offset+frameSize == fileSize {
+				return nil, 0, errTornFrame
+			}
+			return nil, 0, errors.Wrap(ErrCorruptDataFile, "checksum mismatch")
+		}
+	}
+	return data, offset + frameSize, nil
 }
 
-func (storeManager *FileTransactionStoreManager) parseDataFile(file *os.File, readSize int, currentOffset int64) []*TransactionWriteStore {
-	defer file.Close()
-	var result = make([]*TransactionWriteStore, 0)
-	fi, _ := file.Stat()
-	fileSize := fi.Size()
-	reader := byteio.BigEndianReader{Reader: file}
-	offset := currentOffset
+// frameFollows tells whether a whole checksummed frame starts anywhere in the
+// file from offset on.
+func frameFollows(file io.ReaderAt, offset int64, fileSize int64) (bool, error) {
+	if fileSize-offset < 8 {
+		return false, nil
+	}
+	tail := make([]byte, fileSize-offset)
+	if _, err := file.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return false, errors.WithStack(err)
+	}
+	for i := 0; i+8 <= len(tail); i++ {
+		length := binary.BigEndian.Uint32(tail[i:])
+		if length&frameChecksumFlag == 0 {
+			continue
+		}
+		length &^= frameChecksumFlag
+		if length == 0 || int64(length) > int64(len(tail)-i-8) {
+			continue
+		}
+		payload := tail[i+8 : i+8+int(length)]
+		if crc32.Checksum(payload, frameCrcTable) == binary.BigEndian.Uint32(tail[i+4:]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// zeroTail tells whether the file only holds zeros from offset, the space a
+// file system allocated for a write the crash did not let happen.
+func zeroTail(file io.ReaderAt, offset int64, fileSize int64) bool {
+	buf := make([]byte, 4096)
 	for offset < fileSize {
-		file.Seek(offset, 0)
-		dataLength, n, _ := reader.ReadUint32()
-		if n < 4 {
-			break
+		n, err := file.ReadAt(buf, offset)
+		if n == 0 && err != nil {
+			return false
 		}
+		if !bytes.Equal(buf[:n], make([]byte, n)) {
+			return false
+		}
+		offset += int64(n)
+	}
+	return true
+}
 
-		data := make([]byte, int(dataLength))
-		length, _ := reader.Read(data)
-		offset += int64(length + 4)
+func segmentFileName(fileName string, seq int64) string {
+	return fmt.Sprintf("%s.%016d%s", fileName, seq, segmentFilePostfix)
+}
 
-		if length == int(dataLength) {
-			st := &TransactionWriteStore{}
-			st.Decode(data)
-			result = append(result, st)
-			if len(result) == readSize {
-				break
+func snapshotFileName(fileName string, seq int64) string {
+	return fmt.Sprintf("%s.%016d%s", fileName, seq, snapshotFilePostfix)
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	return errors.WithStack(file.Sync())
+}
+
+type logSegment struct {
+	fileName string
+	seq      int64
+}
+
+// logFiles are the files found next to the file name of a log.
+type logFiles struct {
+	// snapshot holds the sessions alive before the segment snapshotSeq.
+	snapshot    string
+	snapshotSeq int64
+	// segments are sorted by seq, from snapshotSeq on.
+	segments []logSegment
+	// legacy are the history and data files written before the log was split
+	// in segments, replayed first while there is no snapshot.
+	legacy []string
+	// stale are covered by the snapshot, left behind by a compaction that
+	// crashed before removing them.
+	stale []string
+}
+
+func scanLogFiles(fileName string) (*logFiles, error) {
+	dir, base := filepath.Split(fileName)
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return &logFiles{}, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	files := &logFiles{}
+	var segments, snapshots []logSegment
+	for _, info := range infos {
+		name := info.Name()
+		path := filepath.Join(dir, name)
+		switch {
+		case name == base+HisDataFilenamePostfix:
+			files.legacy = append([]string{path}, files.legacy...)
+		case name == base:
+			files.legacy = append(files.legacy, path)
+		case strings.HasPrefix(name, base+".") && strings.HasSuffix(name, tmpFilePostfix):
+			files.stale = append(files.stale, path)
+		default:
+			if seq, ok := parseLogSeq(name, base, segmentFilePostfix); ok {
+				segments = append(segments, logSegment{fileName: path, seq: seq})
+			} else if seq, ok := parseLogSeq(name, base, snapshotFilePostfix); ok {
+				snapshots = append(snapshots, logSegment{fileName: path, seq: seq})
 			}
-		} else if length == 0 {
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].seq < snapshots[j].seq })
+
+	if len(snapshots) > 0 {
+		latest := snapshots[len(snapshots)-1]
+		files.snapshot, files.snapshotSeq = latest.fileName, latest.seq
+		for _, snapshot := range snapshots[:len(snapshots)-1] {
+			files.stale = append(files.stale, snapshot.fileName)
+		}
+		files.stale = append(files.stale, files.legacy...)
+		files.legacy = nil
+	}
+	for _, segment := range segments {
+		if segment.seq < files.snapshotSeq {
+			files.stale = append(files.stale, segment.fileName)
+		} else {
+			files.segments = append(files.segments, segment)
+		}
+	}
+	return files, nil
+}
+
+func parseLogSeq(name string, base string, postfix string) (int64, bool) {
+	if !strings.HasPrefix(name, base+".") || !strings.HasSuffix(name, postfix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(name[len(base)+1:len(name)-len(postfix)], 10, 64)
+	if err != nil || seq <= 0 {
+		return 0, false
+	}
+	return seq, true
+}
+
+// replay returns the files a reload reads in order, the segments from
+// beforeSeq on are left out unless it is zero.
+func (files *logFiles) replay(beforeSeq int64) []string {
+	var fileNames []string
+	if files.snapshot != "" {
+		fileNames = append(fileNames, files.snapshot)
+	}
+	fileNames = append(fileNames, files.legacy...)
+	for _, segment := range files.segments {
+		if beforeSeq != 0 && segment.seq >= beforeSeq {
 			break
 		}
+		fileNames = append(fileNames, segment.fileName)
 	}
-	if isHisFile(fi.Name()) {
-		storeManager.recoverHisOffset = offset
-	} else {
-		storeManager.recoverCurrOffset = offset
+	return fileNames
+}
+
+// nextSeq is the seq of the segment written after the log files.
+func (files *logFiles) nextSeq() int64 {
+	seq := files.snapshotSeq
+	if len(files.segments) > 0 {
+		seq = files.segments[len(files.segments)-1].seq + 1
+	}
+	if seq < 1 {
+		seq = 1
 	}
-	return result
+	return seq
 }
 
-func isHisFile(path string) bool {
-	return strings.HasSuffix(path, HisDataFilenamePostfix)
+// firstSeq is the first segment not covered by a snapshot.
+func (files *logFiles) firstSeq() int64 {
+	if files.snapshot != "" {
+		return files.snapshotSeq
+	}
+	if len(files.segments) > 0 {
+		return files.segments[0].seq
+	}
+	return files.nextSeq()
 }
@@ -0,0 +1,279 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+// writeFileStore writes a global session and one of its branches to a new
+// file store under dir and returns its configuration.
+func writeFileStore(t *testing.T, dir string) (config.FileStoreConfig, *session.GlobalSession) {
+	conf := config.FileStoreConfig{FileDir: filepath.Join(dir, "root.data"), FlushDiskMode: config.FlushdiskModeNoneModel}
+	sessionManager := NewFileBasedSessionManager(conf).(*FileBasedSessionManager)
+	gs := globalSessionProvider(t)
+	gs.Begin()
+	assert.Nil(t, sessionManager.AddGlobalSession(gs))
+	assert.Nil(t, sessionManager.AddBranchSession(gs, session.NewBranchSessionByGlobal(gs, session.WithBsResourceID("tb_1"))))
+	sessionManager.TransactionStoreManager.Shutdown()
+	return conf, gs
+}
+
+func reloadFileStore(conf config.FileStoreConfig) (*FileBasedSessionManager, error) {
+	sessionManager := NewFileBasedSessionManager(conf).(*FileBasedSessionManager)
+	defer sessionManager.TransactionStoreManager.Shutdown()
+	return sessionManager, sessionManager.Reload()
+}
+
+func appendBytes(t *testing.T, fileName string, data []byte) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write(data)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+}
+
+func TestFileTransactionStoreManager_TornTail(t *testing.T) {
+	for name, tail := range map[string][]byte{
+		"short header":   {0x80, 0},
+		"short payload":  {0x80, 0, 0, 100, 1, 2, 3, 4, 5},
+		"bad checksum":   {0x80, 0, 0, 2, 1, 2, 3, 4, 5, 6},
+		"zero allocated": make([]byte, 64),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "starfish-file")
+			assert.Nil(t, err)
+			defer os.RemoveAll(dir)
+			conf, gs := writeFileStore(t, dir)
+			segment := segmentFileName(conf.FileDir, 1)
+			fi, err := os.Stat(segment)
+			assert.Nil(t, err)
+			appendBytes(t, segment, tail)
+
+			sessionManager, err := reloadFileStore(conf)
+			assert.Nil(t, err)
+			restored := sessionManager.FindGlobalSession(gs.XID)
+			assert.NotNil(t, restored)
+			assert.Equal(t, 1, len(restored.BranchSessions))
+			truncated, err := os.Stat(segment)
+			assert.Nil(t, err)
+			assert.Equal(t, fi.Size(), truncated.Size())
+		})
+	}
+}
+
+func TestFileTransactionStoreManager_CorruptFrame(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starfish-file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	conf, _ := writeFileStore(t, dir)
+	segment := segmentFileName(conf.FileDir, 1)
+
+	data, err := ioutil.ReadFile(segment)
+	assert.Nil(t, err)
+	data[10] ^= 0xff
+	assert.Nil(t, ioutil.WriteFile(segment, data, 0644))
+
+	_, err = reloadFileStore(conf)
+	assert.Equal(t, ErrCorruptDataFile, errors.Cause(err))
+	problems, err := VerifyStore(config.StoreConfig{StoreMode: "file", FileStoreConfig: conf})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(problems))
+	assert.Contains(t, problems[0].Problem, "checksum mismatch")
+}
+
+func TestFileTransactionStoreManager_CorruptLength(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starfish-file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	conf, _ := writeFileStore(t, dir)
+	segment := segmentFileName(conf.FileDir, 1)
+
+	// the length of the first frame runs past the end of the file, the frame
+	// of the branch still follows it
+	data, err := ioutil.ReadFile(segment)
+	assert.Nil(t, err)
+	binary.BigEndian.PutUint32(data, uint32(len(data))|frameChecksumFlag)
+	assert.Nil(t, ioutil.WriteFile(segment, data, 0644))
+
+	_, err = reloadFileStore(conf)
+	assert.Equal(t, ErrCorruptDataFile, errors.Cause(err))
+	fi, err := os.Stat(segment)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), fi.Size())
+	problems, err := VerifyStore(config.StoreConfig{StoreMode: "file", FileStoreConfig: conf})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(problems))
+	assert.Contains(t, problems[0].Problem, "runs past the end of the file")
+}
+
+func TestFileTransactionStoreManager_ReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starfish-file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	conf, gs := writeFileStore(t, dir)
+	segment := segmentFileName(conf.FileDir, 1)
+	appendBytes(t, segment, []byte{0x80, 0, 0, 100, 1, 2, 3, 4, 5})
+	fi, err := os.Stat(segment)
+	assert.Nil(t, err)
+
+	// the offline tools read the sessions before the torn tail, which is left
+	// to the TC that may still be writing it
+	sessionManager, err := OpenSessionManager(config.StoreConfig{StoreMode: "file", FileStoreConfig: conf})
+	assert.Nil(t, err)
+	restored := sessionManager.FindGlobalSession(gs.XID)
+	assert.NotNil(t, restored)
+	assert.Equal(t, 1, len(restored.BranchSessions))
+	assert.NotNil(t, sessionManager.AddGlobalSession(globalSessionProvider(t)))
+	releaseSessionManager(sessionManager)
+
+	untouched, err := os.Stat(segment)
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Size(), untouched.Size())
+	files, err := scanLogFiles(conf.FileDir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{segment}, files.replay(0))
+}
+
+func TestFileTransactionStoreManager_LegacyFrame(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starfish-file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	conf := config.FileStoreConfig{FileDir: filepath.Join(dir, "root.data")}
+
+	gs := globalSessionProvider(t)
+	gs.Begin()
+	data, err := (&TransactionWriteStore{SessionRequest: gs, LogOperation: LogOperationGlobalAdd}).Encode()
+	assert.Nil(t, err)
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	assert.Nil(t, ioutil.WriteFile(conf.FileDir, append(frame, data...), 0644))
+
+	sessionManager, err := reloadFileStore(conf)
+	assert.Nil(t, err)
+	assert.NotNil(t, sessionManager.FindGlobalSession(gs.XID))
+}
+
+func TestFileTransactionStoreManager_TornSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starfish-file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	conf, _ := writeFileStore(t, dir)
+	appendBytes(t, segmentFileName(conf.FileDir, 1), []byte{0x80, 0})
+	writeFileStore(t, dir)
+
+	_, err = reloadFileStore(conf)
+	assert.Equal(t, ErrCorruptDataFile, errors.Cause(err))
+	problems, err := VerifyStore(config.StoreConfig{StoreMode: "file", FileStoreConfig: conf})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(problems))
+	assert.Contains(t, problems[0].Problem, "is torn")
+}
+
+func TestFileTransactionStoreManager_Compaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starfish-file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	conf := config.FileStoreConfig{FileDir: filepath.Join(dir, "root.data"), FlushDiskMode: config.FlushdiskModeNoneModel,
+		SegmentSize: 512, MaxSegments: 2}
+
+	sessionManager := NewFileBasedSessionManager(conf).(*FileBasedSessionManager)
+	live := globalSessionProvider(t)
+	live.Begin()
+	assert.Nil(t, sessionManager.AddGlobalSession(live))
+	assert.Nil(t, sessionManager.AddBranchSession(live, session.NewBranchSessionByGlobal(live, session.WithBsResourceID("tb_1"))))
+	for i := 0; i < 50; i++ {
+		gs := globalSessionProvider(t)
+		gs.Begin()
+		assert.Nil(t, sessionManager.AddGlobalSession(gs))
+		assert.Nil(t, sessionManager.RemoveGlobalSession(gs))
+	}
+	live.Status = meta.GlobalStatusCommitting
+	assert.Nil(t, sessionManager.UpdateGlobalSessionStatus(live, meta.GlobalStatusCommitting))
+	sessionManager.TransactionStoreManager.Shutdown()
+
+	files, err := scanLogFiles(conf.FileDir)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", files.snapshot)
+	assert.Equal(t, 0, len(files.stale))
+	_, err = os.Stat(segmentFileName(conf.FileDir, 1))
+	assert.True(t, os.IsNotExist(err))
+
+	reloaded, err := reloadFileStore(conf)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(reloaded.AllSessions()))
+	restored := reloaded.FindGlobalSession(live.XID)
+	assert.NotNil(t, restored)
+	assert.Equal(t, meta.GlobalStatusCommitting, restored.Status)
+	assert.Equal(t, 1, len(restored.BranchSessions))
+}
+
+func TestFileTransactionStoreManager_CompactLegacyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starfish-file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	conf := config.FileStoreConfig{FileDir: filepath.Join(dir, "root.data"), FlushDiskMode: config.FlushdiskModeNoneModel,
+		SegmentSize: 512, MaxSegments: 1}
+
+	history := globalSessionProvider(t)
+	history.Begin()
+	current := globalSessionProvider(t)
+	current.Begin()
+	for fileName, gs := range map[string]*session.GlobalSession{conf.FileDir + HisDataFilenamePostfix: history, conf.FileDir: current} {
+		data, err := (&TransactionWriteStore{SessionRequest: gs, LogOperation: LogOperationGlobalAdd}).Encode()
+		assert.Nil(t, err)
+		assert.Nil(t, ioutil.WriteFile(fileName, encodeDataFrame(data), 0644))
+	}
+
+	sessionManager, err := reloadFileStore(conf)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(sessionManager.AllSessions()))
+	sessionManager = NewFileBasedSessionManager(conf).(*FileBasedSessionManager)
+	for i := 0; i < 20; i++ {
+		gs := globalSessionProvider(t)
+		gs.Begin()
+		assert.Nil(t, sessionManager.AddGlobalSession(gs))
+		assert.Nil(t, sessionManager.RemoveGlobalSession(gs))
+	}
+	sessionManager.TransactionStoreManager.Shutdown()
+
+	for _, fileName := range []string{conf.FileDir + HisDataFilenamePostfix, conf.FileDir} {
+		_, err := os.Stat(fileName)
+		assert.True(t, os.IsNotExist(err))
+	}
+	sessionManager, err = reloadFileStore(conf)
+	assert.Nil(t, err)
+	assert.NotNil(t, sessionManager.FindGlobalSession(history.XID))
+	assert.NotNil(t, sessionManager.FindGlobalSession(current.XID))
+}
@@ -17,13 +17,23 @@
 
 package holder
 
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
 import (
 	"github.com/go-xorm/xorm"
 
+	"github.com/pkg/errors"
+
 	"xorm.io/builder"
 )
 
 import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
 	"github.com/transaction-mesh/starfish/pkg/tc/model"
 	"github.com/transaction-mesh/starfish/pkg/util/log"
 )
@@ -43,14 +53,34 @@ const (
         status, client_id, application_data, gmt_create, gmt_modified) values(?, ?, ?, ?, ?, ?, ?, ?, ?, now(6), now(6))`
 	UpdateBranchTransactionDO = "update branch_table set status = ?, gmt_modified = now(6) where xid = ? and branch_id = ?"
 	DeleteBranchTransactionDO = "delete from branch_table where xid = ? and branch_id = ?"
-	QueryMaxTransactionID     = "select max(transaction_id) as maxTransactionID from global_table where transaction_id < ? and transaction_id > ?"
-	QueryMaxBranchID          = "select max(branch_id) as maxBranchID from branch_table where branch_id < ? and branch_id > ?"
+	QueryMaxTransactionID     = `select coalesce(max(transaction_id), 0) as max_transaction_id from global_table
+		where transaction_id < ? and transaction_id > ?`
+	QueryMaxBranchID = `select coalesce(max(branch_id), 0) as max_branch_id from branch_table
+		where branch_id < ? and branch_id > ?`
+
+	UpdateGlobalTransactionDOs = "update global_table set status = ?, gmt_modified = now() where xid in (%s)"
+	DeleteGlobalTransactionDOs = "delete from global_table where xid in (%s)"
+	UpdateBranchTransactionDOs = "update branch_table set status = ?, gmt_modified = now(6) where branch_id in (%s)"
+	DeleteBranchTransactionDOs = "delete from branch_table where branch_id in (%s)"
+
+	QueryOrphanBranchTransactionDOs = `select xid, branch_id, transaction_id, resource_group_id, resource_id, branch_type, status, client_id,
+	    application_data, gmt_create, gmt_modified from branch_table where xid not in (select xid from global_table)`
+)
+
+// The statements of PostgreSQL differing from the ones above, now() of
+// PostgreSQL is of microsecond precision and takes no argument.
+const (
+	InsertBranchTransactionDOPostgres = `insert into branch_table (xid, branch_id, transaction_id, resource_group_id, resource_id, branch_type,
+        status, client_id, application_data, gmt_create, gmt_modified) values(?, ?, ?, ?, ?, ?, ?, ?, ?, now(), now())`
+	UpdateBranchTransactionDOPostgres  = "update branch_table set status = ?, gmt_modified = now() where xid = ? and branch_id = ?"
+	UpdateBranchTransactionDOsPostgres = "update branch_table set status = ?, gmt_modified = now() where branch_id in (%s)"
 )
 
 type LogStore interface {
 	QueryGlobalTransactionDOByXID(xid string) *model.GlobalTransactionDO
 	QueryGlobalTransactionDOByTransactionID(transactionID int64) *model.GlobalTransactionDO
 	QueryGlobalTransactionDOByStatuses(statuses []int, limit int) []*model.GlobalTransactionDO
+	QueryGlobalTransactionDOByCondition(condition model.SessionCondition) []*model.GlobalTransactionDO
 	InsertGlobalTransactionDO(globalTransaction model.GlobalTransactionDO) bool
 	UpdateGlobalTransactionDO(globalTransaction model.GlobalTransactionDO) bool
 	DeleteGlobalTransactionDO(globalTransaction model.GlobalTransactionDO) bool
@@ -60,10 +90,32 @@ type LogStore interface {
 	UpdateBranchTransactionDO(branchTransaction model.BranchTransactionDO) bool
 	DeleteBranchTransactionDO(branchTransaction model.BranchTransactionDO) bool
 	GetCurrentMaxSessionID(high int64, low int64) int64
+	QueryOrphanBranchTransactionDOs() []*model.BranchTransactionDO
 }
 
 type LogStoreDataBaseDAO struct {
 	engine *xorm.Engine
+
+	insertBranchTransactionDO  string
+	updateBranchTransactionDO  string
+	updateBranchTransactionDOs string
+}
+
+// NewLogStoreDataBaseDAO returns a log store writing the sql dialect of driver,
+// mysql or postgres.
+func NewLogStoreDataBaseDAO(engine *xorm.Engine, driver string) *LogStoreDataBaseDAO {
+	dao := &LogStoreDataBaseDAO{
+		engine:                     engine,
+		insertBranchTransactionDO:  InsertBranchTransactionDO,
+		updateBranchTransactionDO:  UpdateBranchTransactionDO,
+		updateBranchTransactionDOs: UpdateBranchTransactionDOs,
+	}
+	if driver == config.DBDriverPostgres {
+		dao.insertBranchTransactionDO = InsertBranchTransactionDOPostgres
+		dao.updateBranchTransactionDO = UpdateBranchTransactionDOPostgres
+		dao.updateBranchTransactionDOs = UpdateBranchTransactionDOsPostgres
+	}
+	return dao
 }
 
 func (dao *LogStoreDataBaseDAO) QueryGlobalTransactionDOByXID(xid string) *model.GlobalTransactionDO {
@@ -106,6 +158,28 @@ func (dao *LogStoreDataBaseDAO) QueryGlobalTransactionDOByStatuses(statuses []in
 	return globalTransactionDOs
 }
 
+// QueryGlobalTransactionDOByCondition returns the global transactions matching
+// every field of condition, sorted and paged by the database.
+func (dao *LogStoreDataBaseDAO) QueryGlobalTransactionDOByCondition(condition model.SessionCondition) []*model.GlobalTransactionDO {
+	var globalTransactionDOs []*model.GlobalTransactionDO
+	query := dao.engine.Table("global_table").
+		Where(sessionConditionCond(condition)).
+		OrderBy(sessionConditionOrder(condition))
+	if condition.Limit > 0 || condition.Offset > 0 {
+		limit := condition.Limit
+		if limit <= 0 {
+			limit = math.MaxInt32
+		}
+		query = query.Limit(limit, condition.Offset)
+	}
+	err := query.Find(&globalTransactionDOs)
+
+	if err != nil {
+		log.Errorf(err.Error())
+	}
+	return globalTransactionDOs
+}
+
 func (dao *LogStoreDataBaseDAO) InsertGlobalTransactionDO(globalTransaction model.GlobalTransactionDO) bool {
 	_, err := dao.engine.Exec(InsertGlobalTransactionDO,
 		globalTransaction.XID,
@@ -154,8 +228,18 @@ func (dao *LogStoreDataBaseDAO) QueryBranchTransactionDOByXIDs(xids []string) []
 	return branchTransactionDos
 }
 
+// QueryOrphanBranchTransactionDOs returns the branches whose global transaction no longer exists.
+func (dao *LogStoreDataBaseDAO) QueryOrphanBranchTransactionDOs() []*model.BranchTransactionDO {
+	var branchTransactionDos []*model.BranchTransactionDO
+	err := dao.engine.SQL(QueryOrphanBranchTransactionDOs).Find(&branchTransactionDos)
+	if err != nil {
+		log.Errorf(err.Error())
+	}
+	return branchTransactionDos
+}
+
 func (dao *LogStoreDataBaseDAO) InsertBranchTransactionDO(branchTransaction model.BranchTransactionDO) bool {
-	_, err := dao.engine.Exec(InsertBranchTransactionDO,
+	_, err := dao.engine.Exec(dao.insertBranchTransactionDO,
 		branchTransaction.XID,
 		branchTransaction.BranchID,
 		branchTransaction.TransactionID,
@@ -170,7 +254,7 @@ func (dao *LogStoreDataBaseDAO) InsertBranchTransactionDO(branchTransaction mode
 }
 
 func (dao *LogStoreDataBaseDAO) UpdateBranchTransactionDO(branchTransaction model.BranchTransactionDO) bool {
-	_, err := dao.engine.Exec(UpdateBranchTransactionDO,
+	_, err := dao.engine.Exec(dao.updateBranchTransactionDO,
 		branchTransaction.Status,
 		branchTransaction.XID,
 		branchTransaction.BranchID)
@@ -186,16 +270,94 @@ func (dao *LogStoreDataBaseDAO) DeleteBranchTransactionDO(branchTransaction mode
 	return err == nil
 }
 
+// WriteBatch writes the session writes of a group commit in one transaction,
+// the writes of a kind are merged into multi-row statements.
+func (dao *LogStoreDataBaseDAO) WriteBatch(writes []*sessionWrite) error {
+	session := dao.engine.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, statement := range groupSessionWrites(writes) {
+		if _, err := session.Exec(dao.batchSQL(statement)...); err != nil {
+			session.Rollback()
+			return errors.Wrapf(err, "%s of %d sessions", statement.logOperation, len(statement.writes))
+		}
+	}
+	return errors.WithStack(session.Commit())
+}
+
+// batchSQL returns the statement followed by its arguments.
+func (dao *LogStoreDataBaseDAO) batchSQL(statement *batchStatement) []interface{} {
+	var (
+		sql  string
+		args []interface{}
+		rows = len(statement.writes)
+	)
+	switch statement.logOperation {
+	case LogOperationGlobalAdd:
+		sql = multiRowInsert(InsertGlobalTransactionDO, rows)
+		for _, write := range statement.writes {
+			globalTransaction := write.globalTransactionDO
+			args = append(args, globalTransaction.XID, globalTransaction.TransactionID, globalTransaction.Status,
+				globalTransaction.ApplicationID, globalTransaction.TransactionServiceGroup, globalTransaction.TransactionName,
+				globalTransaction.Timeout, globalTransaction.BeginTime, globalTransaction.ApplicationData)
+		}
+	case LogOperationGlobalUpdate:
+		sql = fmt.Sprintf(UpdateGlobalTransactionDOs, placeholders(rows))
+		args = append(args, statement.status)
+		for _, write := range statement.writes {
+			args = append(args, write.globalTransactionDO.XID)
+		}
+	case LogOperationGlobalRemove:
+		sql = fmt.Sprintf(DeleteGlobalTransactionDOs, placeholders(rows))
+		for _, write := range statement.writes {
+			args = append(args, write.globalTransactionDO.XID)
+		}
+	case LogOperationBranchAdd:
+		sql = multiRowInsert(dao.insertBranchTransactionDO, rows)
+		for _, write := range statement.writes {
+			branchTransaction := write.branchTransactionDO
+			args = append(args, branchTransaction.XID, branchTransaction.BranchID, branchTransaction.TransactionID,
+				branchTransaction.ResourceGroupID, branchTransaction.ResourceID, branchTransaction.BranchType,
+				branchTransaction.Status, branchTransaction.ClientID, branchTransaction.ApplicationData)
+		}
+	case LogOperationBranchUpdate:
+		sql = fmt.Sprintf(dao.updateBranchTransactionDOs, placeholders(rows))
+		args = append(args, statement.status)
+		for _, write := range statement.writes {
+			args = append(args, write.branchTransactionDO.BranchID)
+		}
+	case LogOperationBranchRemove:
+		sql = fmt.Sprintf(DeleteBranchTransactionDOs, placeholders(rows))
+		for _, write := range statement.writes {
+			args = append(args, write.branchTransactionDO.BranchID)
+		}
+	}
+	return append([]interface{}{sql}, args...)
+}
+
+// multiRowInsert repeats the values of a single row insert statement.
+func multiRowInsert(statement string, rows int) string {
+	i := strings.Index(statement, "values") + len("values")
+	values := strings.TrimSpace(statement[i:])
+	return statement[:i] + " " + strings.TrimSuffix(strings.Repeat(values+", ", rows), ", ")
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
 func (dao *LogStoreDataBaseDAO) GetCurrentMaxSessionID(high int64, low int64) int64 {
 	var maxTransactionID, maxBranchID int64
 	_, err := dao.engine.SQL(QueryMaxTransactionID, high, low).
-		Cols("maxTransactionID").
+		Cols("max_transaction_id").
 		Get(&maxTransactionID)
 	if err != nil {
 		log.Errorf(err.Error())
 	}
 	_, err = dao.engine.SQL(QueryMaxBranchID, high, low).
-		Cols("maxBranchID").
+		Cols("max_branch_id").
 		Get(&maxBranchID)
 	if err != nil {
 		log.Errorf(err.Error())
@@ -205,3 +367,51 @@ func (dao *LogStoreDataBaseDAO) GetCurrentMaxSessionID(high int64, low int64) in
 	}
 	return maxBranchID
 }
+
+// sessionConditionCond is the where clause of condition on global_table, the
+// same fields matchSessionCondition filters by.
+func sessionConditionCond(condition model.SessionCondition) builder.Cond {
+	cond := builder.NewCond()
+	if condition.XID != "" {
+		cond = cond.And(builder.Eq{"xid": condition.XID})
+	}
+	if condition.TransactionID != 0 {
+		cond = cond.And(builder.Eq{"transaction_id": condition.TransactionID})
+	}
+	if condition.Status != meta.GlobalStatusUnknown {
+		cond = cond.And(builder.Eq{"status": int32(condition.Status)})
+	}
+	if len(condition.Statuses) > 0 {
+		statuses := make([]int32, 0, len(condition.Statuses))
+		for _, status := range condition.Statuses {
+			statuses = append(statuses, int32(status))
+		}
+		cond = cond.And(builder.In("status", statuses))
+	}
+	if condition.ApplicationID != "" {
+		cond = cond.And(builder.Eq{"application_id": condition.ApplicationID})
+	}
+	if condition.TransactionName != "" {
+		cond = cond.And(builder.Eq{"transaction_name": condition.TransactionName})
+	}
+	if condition.BeginTimeFrom > 0 {
+		cond = cond.And(builder.Gte{"begin_time": condition.BeginTimeFrom})
+	}
+	if before := beginTimeBefore(condition); before > 0 {
+		cond = cond.And(builder.Lt{"begin_time": before})
+	}
+	return cond
+}
+
+// sessionConditionOrder is the order by clause of condition, the column comes
+// from the known sort fields only.
+func sessionConditionOrder(condition model.SessionCondition) string {
+	column, ok := model.ValueOfSessionSortField(string(condition.SortBy))
+	if !ok {
+		column = model.SortByBeginTime
+	}
+	if condition.Descending {
+		return fmt.Sprintf("%s desc, transaction_id desc", column)
+	}
+	return fmt.Sprintf("%s asc, transaction_id asc", column)
+}
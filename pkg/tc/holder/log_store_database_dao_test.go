@@ -0,0 +1,69 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"xorm.io/builder"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+)
+
+func TestNewLogStoreDataBaseDAO_Dialect(t *testing.T) {
+	mysql := NewLogStoreDataBaseDAO(nil, config.DBDriverMySQL)
+	assert.Equal(t, InsertBranchTransactionDO, mysql.insertBranchTransactionDO)
+	assert.Equal(t, UpdateBranchTransactionDO, mysql.updateBranchTransactionDO)
+
+	postgres := NewLogStoreDataBaseDAO(nil, config.DBDriverPostgres)
+	assert.NotContains(t, postgres.insertBranchTransactionDO, "now(6)")
+	assert.NotContains(t, postgres.updateBranchTransactionDO, "now(6)")
+
+	assert.Equal(t, config.DBDriverMySQL, config.DBStoreConfig{}.DriverName())
+	assert.Equal(t, config.DBDriverPostgres, config.DBStoreConfig{Driver: "postgres"}.DriverName())
+}
+
+func TestSessionConditionCond(t *testing.T) {
+	sql, err := builder.ToBoundSQL(sessionConditionCond(model.SessionCondition{}))
+	assert.Nil(t, err)
+	assert.Equal(t, "", sql)
+
+	sql, err = builder.ToBoundSQL(sessionConditionCond(model.SessionCondition{
+		Statuses:      []meta.GlobalStatus{meta.GlobalStatusBegin, meta.GlobalStatusCommitRetrying},
+		ApplicationID: "demo-order",
+		BeginTimeFrom: 1000,
+		BeginTimeTo:   2000,
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, "status IN (1,3) AND application_id='demo-order' AND begin_time>=1000 AND begin_time<2000", sql)
+
+	assert.Equal(t, "begin_time asc, transaction_id asc", sessionConditionOrder(model.SessionCondition{}))
+	assert.Equal(t, "status desc, transaction_id desc",
+		sessionConditionOrder(model.SessionCondition{SortBy: model.SortByStatus, Descending: true}))
+	// only the known sort fields reach the sql.
+	assert.Equal(t, "begin_time asc, transaction_id asc",
+		sessionConditionOrder(model.SessionCondition{SortBy: "xid; drop table global_table"}))
+}
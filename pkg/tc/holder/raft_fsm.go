@@ -0,0 +1,261 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+import (
+	"github.com/hashicorp/raft"
+
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+)
+
+// sessionFSM applies replicated TransactionWriteStore entries to the session map.
+// The leader changes its live sessions under their lock before it proposes an
+// entry, and may still hold that lock while it waits for the entry, so entries
+// this process proposed only add or remove sessions from the map. Every other
+// entry, on a follower or replayed before this node took over, is applied under
+// the session lock since readers like the admin server share those sessions.
+type sessionFSM struct {
+	sync.RWMutex
+	sessionMap map[string]*session.GlobalSession
+	// proposer tags the entries this process proposed, see RaftSessionManager.apply.
+	proposer []byte
+}
+
+func newSessionFSM(proposer []byte) *sessionFSM {
+	return &sessionFSM{
+		sessionMap: make(map[string]*session.GlobalSession),
+		proposer:   proposer,
+	}
+}
+
+func (fsm *sessionFSM) Apply(entry *raft.Log) interface{} {
+	if entry.Type != raft.LogCommand || len(entry.Data) == 0 {
+		return nil
+	}
+	store := &TransactionWriteStore{LogOperation: LogOperation(entry.Data[len(entry.Data)-1])}
+	if _, err := store.getSessionInstanceByOperation(); err != nil {
+		log.Errorf("raft log %d carries an unknown operation: %v", entry.Index, err)
+		return err
+	}
+	store.Decode(entry.Data)
+
+	fsm.Lock()
+	defer fsm.Unlock()
+	fsm.apply(store, bytes.Equal(entry.Extensions, fsm.proposer))
+	return nil
+}
+
+func (fsm *sessionFSM) apply(store *TransactionWriteStore, proposed bool) {
+	switch store.LogOperation {
+	case LogOperationGlobalAdd, LogOperationGlobalUpdate:
+		globalSession := store.SessionRequest.(*session.GlobalSession)
+		found := fsm.sessionMap[globalSession.XID]
+		if found == nil {
+			globalSession.Active = globalSession.Status == meta.GlobalStatusBegin
+			fsm.sessionMap[globalSession.XID] = globalSession
+		} else if !proposed {
+			found.Lock()
+			found.Status = globalSession.Status
+			found.Active = found.Active && found.Status == meta.GlobalStatusBegin
+			found.Unlock()
+		}
+	case LogOperationGlobalRemove:
+		globalSession := store.SessionRequest.(*session.GlobalSession)
+		delete(fsm.sessionMap, globalSession.XID)
+	case LogOperationBranchAdd, LogOperationBranchUpdate:
+		branchSession := store.SessionRequest.(*session.BranchSession)
+		found := fsm.sessionMap[branchSession.XID]
+		if found == nil {
+			log.Warnf("GlobalSession Does Not Exists For BranchSession [%d/%s]", branchSession.BranchID, branchSession.XID)
+			return
+		}
+		if proposed {
+			return
+		}
+		found.Lock()
+		existingBranch := findBranch(found, branchSession.BranchID)
+		if existingBranch == nil {
+			found.BranchSessions[branchSession] = true
+		} else {
+			existingBranch.Status = branchSession.Status
+		}
+		found.Unlock()
+	case LogOperationBranchRemove:
+		branchSession := store.SessionRequest.(*session.BranchSession)
+		found := fsm.sessionMap[branchSession.XID]
+		if found == nil || proposed {
+			return
+		}
+		found.Lock()
+		existingBranch := findBranch(found, branchSession.BranchID)
+		if existingBranch != nil {
+			found.Remove(existingBranch)
+		}
+		found.Unlock()
+	}
+}
+
+func findBranch(globalSession *session.GlobalSession, branchID int64) *session.BranchSession {
+	for branchSession := range globalSession.BranchSessions {
+		if branchSession.BranchID == branchID {
+			return branchSession
+		}
+	}
+	return nil
+}
+
+// Snapshot only collects the sessions, Persist encodes each one under its lock
+// on the snapshot goroutine. Taking a session lock here would block Apply,
+// while the leader may hold that lock waiting for its entry to be applied.
+func (fsm *sessionFSM) Snapshot() (raft.FSMSnapshot, error) {
+	fsm.RLock()
+	defer fsm.RUnlock()
+
+	snapshot := &sessionSnapshot{sessions: make([]*session.GlobalSession, 0, len(fsm.sessionMap))}
+	for _, globalSession := range fsm.sessionMap {
+		snapshot.sessions = append(snapshot.sessions, globalSession)
+	}
+	return snapshot, nil
+}
+
+func (fsm *sessionFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	sessionMap := make(map[string]*session.GlobalSession)
+	reader := bufio.NewReader(rc)
+	for {
+		globalSession, err := decodeSessionWithBranches(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		globalSession.Active = globalSession.Status == meta.GlobalStatusBegin
+		sessionMap[globalSession.XID] = globalSession
+	}
+
+	fsm.Lock()
+	fsm.sessionMap = sessionMap
+	fsm.Unlock()
+	return nil
+}
+
+// encodeSessionWithBranches frames a global session followed by its branches:
+// [len][global] [count] ([len][branch])*.
+func encodeSessionWithBranches(globalSession *session.GlobalSession) ([]byte, error) {
+	gsData, err := globalSession.Encode()
+	if err != nil {
+		return nil, err
+	}
+	result := appendFrame(nil, gsData)
+
+	branchSessions := globalSession.GetSortedBranches()
+	count := make([]byte, 4)
+	binary.BigEndian.PutUint32(count, uint32(len(branchSessions)))
+	result = append(result, count...)
+	for _, branchSession := range branchSessions {
+		bsData, err := branchSession.Encode()
+		if err != nil {
+			return nil, err
+		}
+		result = appendFrame(result, bsData)
+	}
+	return result, nil
+}
+
+func decodeSessionWithBranches(reader io.Reader) (*session.GlobalSession, error) {
+	gsData, err := readFrame(reader)
+	if err != nil {
+		return nil, err
+	}
+	globalSession := session.NewGlobalSession()
+	globalSession.Decode(gsData)
+
+	count := make([]byte, 4)
+	if _, err := io.ReadFull(reader, count); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	for i := uint32(0); i < binary.BigEndian.Uint32(count); i++ {
+		bsData, err := readFrame(reader)
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		branchSession := session.NewBranchSession()
+		branchSession.Decode(bsData)
+		globalSession.BranchSessions[branchSession] = true
+	}
+	return globalSession, nil
+}
+
+func appendFrame(dst []byte, data []byte) []byte {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(data)))
+	dst = append(dst, length...)
+	return append(dst, data...)
+}
+
+func readFrame(reader io.Reader) ([]byte, error) {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(length))
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
+
+// sessionSnapshot may hold a session changed after the snapshot index, the
+// entries replayed on top of it are applied idempotently.
+type sessionSnapshot struct {
+	sessions []*session.GlobalSession
+}
+
+func (snapshot *sessionSnapshot) Persist(sink raft.SnapshotSink) error {
+	for _, globalSession := range snapshot.sessions {
+		globalSession.Lock()
+		data, err := encodeSessionWithBranches(globalSession)
+		globalSession.Unlock()
+		if err == nil {
+			_, err = sink.Write(data)
+		}
+		if err != nil {
+			sink.Cancel()
+			return err
+		}
+	}
+	return sink.Close()
+}
+
+func (snapshot *sessionSnapshot) Release() {}
@@ -0,0 +1,329 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/hashicorp/raft"
+
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+)
+
+const (
+	defaultRaftApplyTimeout   = 5 * time.Second
+	defaultRaftSnapshotRetain = 2
+	raftTransportMaxPool      = 3
+	raftTransportTimeout      = 10 * time.Second
+)
+
+// ClusterSessionManager is a SessionManager replicated across several TC nodes.
+// Only the leader may write, followers forward client requests to it.
+type ClusterSessionManager interface {
+	SessionManager
+
+	// IsLeader reports whether this node currently leads the cluster.
+	IsLeader() bool
+
+	// LeaderForwardAddress returns the forward address of the current leader,
+	// or an empty string while no leader is known.
+	LeaderForwardAddress() string
+
+	// PeerForwardAddresses returns the forward addresses of the other nodes,
+	// resource managers connected to them are reached through these.
+	PeerForwardAddresses() []string
+
+	// LeadershipChanged delivers true when this node gains leadership and false
+	// when it loses it.
+	LeadershipChanged() <-chan bool
+
+	// Shutdown stops replication.
+	Shutdown() error
+}
+
+// RaftSessionManager replicates every LogOperation through raft, the session map
+// is maintained by the raft FSM on every node of the cluster.
+type RaftSessionManager struct {
+	conf         config.RaftStoreConfig
+	raft         *raft.Raft
+	fsm          *sessionFSM
+	transport    *raft.NetworkTransport
+	closers      []io.Closer
+	leadershipCh chan bool
+}
+
+func NewRaftSessionManager(conf config.RaftStoreConfig) (*RaftSessionManager, error) {
+	local, ok := conf.LocalServer()
+	if !ok {
+		return nil, errors.Errorf("raft node %s is not listed in servers", conf.NodeID)
+	}
+	if conf.ApplyTimeout <= 0 {
+		conf.ApplyTimeout = defaultRaftApplyTimeout
+	}
+	if conf.SnapshotRetain <= 0 {
+		conf.SnapshotRetain = defaultRaftSnapshotRetain
+	}
+
+	sessionManager := &RaftSessionManager{
+		conf:         conf,
+		fsm:          newSessionFSM([]byte(fmt.Sprintf("%s/%d", conf.NodeID, time.Now().UnixNano()))),
+		leadershipCh: make(chan bool, 16),
+	}
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(conf.NodeID)
+	raftConfig.LogOutput = raftLogWriter{}
+	raftConfig.NotifyCh = sessionManager.leadershipCh
+	if conf.SnapshotThreshold > 0 {
+		raftConfig.SnapshotThreshold = conf.SnapshotThreshold
+	}
+	if conf.SnapshotInterval > 0 {
+		raftConfig.SnapshotInterval = conf.SnapshotInterval
+	}
+
+	var (
+		logStore    raft.LogStore
+		stableStore raft.StableStore
+		snapshots   raft.SnapshotStore
+	)
+	if conf.DataDir == "" {
+		inmemStore := raft.NewInmemStore()
+		logStore, stableStore, snapshots = inmemStore, inmemStore, raft.NewInmemSnapshotStore()
+	} else {
+		if err := os.MkdirAll(conf.DataDir, 0755); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		boltStore, err := raftboltdb.NewBoltStore(filepath.Join(conf.DataDir, "raft.db"))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		sessionManager.closers = append(sessionManager.closers, boltStore)
+		fileSnapshots, err := raft.NewFileSnapshotStore(conf.DataDir, conf.SnapshotRetain, raftLogWriter{})
+		if err != nil {
+			sessionManager.close()
+			return nil, errors.WithStack(err)
+		}
+		logStore, stableStore, snapshots = boltStore, boltStore, fileSnapshots
+	}
+
+	transport, err := raft.NewTCPTransport(local.Addr, nil, raftTransportMaxPool, raftTransportTimeout, raftLogWriter{})
+	if err != nil {
+		sessionManager.close()
+		return nil, errors.WithStack(err)
+	}
+	sessionManager.transport = transport
+	sessionManager.closers = append(sessionManager.closers, transport)
+
+	hasState, err := raft.HasExistingState(logStore, stableStore, snapshots)
+	if err != nil {
+		sessionManager.close()
+		return nil, errors.WithStack(err)
+	}
+	if !hasState {
+		configuration := raft.Configuration{}
+		for _, server := range conf.Servers {
+			configuration.Servers = append(configuration.Servers, raft.Server{
+				ID:      raft.ServerID(server.NodeID),
+				Address: raft.ServerAddress(server.Addr),
+			})
+		}
+		err = raft.BootstrapCluster(raftConfig, logStore, stableStore, snapshots, transport, configuration)
+		if err != nil && err != raft.ErrCantBootstrap {
+			sessionManager.close()
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	sessionManager.raft, err = raft.NewRaft(raftConfig, sessionManager.fsm, logStore, stableStore, snapshots, transport)
+	if err != nil {
+		sessionManager.close()
+		return nil, errors.WithStack(err)
+	}
+	return sessionManager, nil
+}
+
+func (sessionManager *RaftSessionManager) AddGlobalSession(globalSession *session.GlobalSession) error {
+	err := sessionManager.apply(LogOperationGlobalAdd, globalSession)
+	if err != nil {
+		return err
+	}
+	// The FSM stored a decoded copy, hand the leader's map the live session so
+	// that later lookups see the fields that are not replicated.
+	sessionManager.fsm.Lock()
+	if _, ok := sessionManager.fsm.sessionMap[globalSession.XID]; ok {
+		sessionManager.fsm.sessionMap[globalSession.XID] = globalSession
+	}
+	sessionManager.fsm.Unlock()
+	return nil
+}
+
+func (sessionManager *RaftSessionManager) FindGlobalSession(xid string) *session.GlobalSession {
+	return sessionManager.FindGlobalSessionWithBranchSessions(xid, true)
+}
+
+func (sessionManager *RaftSessionManager) FindGlobalSessionWithBranchSessions(xid string, withBranchSessions bool) *session.GlobalSession {
+	sessionManager.fsm.RLock()
+	defer sessionManager.fsm.RUnlock()
+	return sessionManager.fsm.sessionMap[xid]
+}
+
+func (sessionManager *RaftSessionManager) UpdateGlobalSessionStatus(globalSession *session.GlobalSession, status meta.GlobalStatus) error {
+	return sessionManager.apply(LogOperationGlobalUpdate, globalSession)
+}
+
+func (sessionManager *RaftSessionManager) RemoveGlobalSession(globalSession *session.GlobalSession) error {
+	return sessionManager.apply(LogOperationGlobalRemove, globalSession)
+}
+
+func (sessionManager *RaftSessionManager) AddBranchSession(globalSession *session.GlobalSession, branchSession *session.BranchSession) error {
+	return sessionManager.apply(LogOperationBranchAdd, branchSession)
+}
+
+func (sessionManager *RaftSessionManager) UpdateBranchSessionStatus(branchSession *session.BranchSession, status meta.BranchStatus) error {
+	return sessionManager.apply(LogOperationBranchUpdate, branchSession)
+}
+
+func (sessionManager *RaftSessionManager) RemoveBranchSession(globalSession *session.GlobalSession, branchSession *session.BranchSession) error {
+	return sessionManager.apply(LogOperationBranchRemove, branchSession)
+}
+
+func (sessionManager *RaftSessionManager) AllSessions() []*session.GlobalSession {
+	sessionManager.fsm.RLock()
+	defer sessionManager.fsm.RUnlock()
+	var sessions = make([]*session.GlobalSession, 0, len(sessionManager.fsm.sessionMap))
+	for _, globalSession := range sessionManager.fsm.sessionMap {
+		sessions = append(sessions, globalSession)
+	}
+	return sessions
+}
+
+func (sessionManager *RaftSessionManager) FindGlobalSessions(condition model.SessionCondition) []*session.GlobalSession {
+	if condition.History {
+		return GetSessionArchive().FindGlobalSessions(condition)
+	}
+	return selectGlobalSessions(sessionManager.AllSessions(), condition)
+}
+
+// Reload waits until every entry committed before this node became leader has
+// been applied to the local session map.
+func (sessionManager *RaftSessionManager) Reload() error {
+	if err := sessionManager.raft.Barrier(sessionManager.conf.ApplyTimeout).Error(); err != nil {
+		return errors.Wrap(err, "raft barrier")
+	}
+	return nil
+}
+
+func (sessionManager *RaftSessionManager) IsLeader() bool {
+	return sessionManager.raft.State() == raft.Leader
+}
+
+func (sessionManager *RaftSessionManager) LeaderForwardAddress() string {
+	leader := sessionManager.raft.Leader()
+	if leader == "" {
+		return ""
+	}
+	for _, server := range sessionManager.conf.Servers {
+		if raft.ServerAddress(server.Addr) == leader {
+			return server.ForwardAddr
+		}
+	}
+	return ""
+}
+
+func (sessionManager *RaftSessionManager) PeerForwardAddresses() []string {
+	addrs := make([]string, 0, len(sessionManager.conf.Servers))
+	for _, server := range sessionManager.conf.Servers {
+		if server.NodeID != sessionManager.conf.NodeID {
+			addrs = append(addrs, server.ForwardAddr)
+		}
+	}
+	return addrs
+}
+
+func (sessionManager *RaftSessionManager) LeadershipChanged() <-chan bool {
+	return sessionManager.leadershipCh
+}
+
+// Snapshot forces a raft snapshot, which also truncates the replicated log.
+func (sessionManager *RaftSessionManager) Snapshot() error {
+	return sessionManager.raft.Snapshot().Error()
+}
+
+func (sessionManager *RaftSessionManager) Shutdown() error {
+	err := sessionManager.raft.Shutdown().Error()
+	sessionManager.close()
+	return err
+}
+
+func (sessionManager *RaftSessionManager) close() {
+	for _, closer := range sessionManager.closers {
+		closer.Close()
+	}
+	sessionManager.closers = nil
+}
+
+func (sessionManager *RaftSessionManager) apply(logOperation LogOperation, sessionStorable session.SessionStorable) error {
+	log.Debugf("MANAGER[raft] SESSION[%v] %s", sessionStorable, logOperation.String())
+	store := &TransactionWriteStore{
+		SessionRequest: sessionStorable,
+		LogOperation:   logOperation,
+	}
+	data, err := store.Encode()
+	if err != nil {
+		return meta.NewTransactionException(err,
+			meta.WithTransactionExceptionCode(meta.TransactionExceptionCodeFailedWriteSession))
+	}
+	// the caller already changed the session, the FSM must not apply the entry to it again.
+	future := sessionManager.raft.ApplyLog(raft.Log{Data: data, Extensions: sessionManager.fsm.proposer},
+		sessionManager.conf.ApplyTimeout)
+	if err := future.Error(); err != nil {
+		return meta.NewTransactionException(err,
+			meta.WithTransactionExceptionCode(meta.TransactionExceptionCodeFailedWriteSession),
+			meta.WithMessage(fmt.Sprintf("Fail to replicate %s", logOperation.String())))
+	}
+	if err, ok := future.Response().(error); ok {
+		return meta.NewTransactionException(err,
+			meta.WithTransactionExceptionCode(meta.TransactionExceptionCodeFailedWriteSession))
+	}
+	return nil
+}
+
+// raftLogWriter routes the raft library output to the starfish logger.
+type raftLogWriter struct{}
+
+func (raftLogWriter) Write(p []byte) (int, error) {
+	log.Info(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
@@ -0,0 +1,250 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/hashicorp/raft"
+
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+func TestRaftSessionManager_Replication(t *testing.T) {
+	servers := raftServersProvider(t, 3)
+	managers := make(map[string]*RaftSessionManager)
+	for _, server := range servers {
+		sessionManager, err := NewRaftSessionManager(config.RaftStoreConfig{NodeID: server.NodeID, Servers: servers})
+		assert.Nil(t, err)
+		managers[server.NodeID] = sessionManager
+	}
+	defer func() {
+		for _, sessionManager := range managers {
+			sessionManager.Shutdown()
+		}
+	}()
+
+	leaderID := waitForLeader(t, managers)
+	leader := managers[leaderID]
+
+	gs := globalSessionProvider(t)
+	gs.Begin()
+	assert.Nil(t, leader.AddGlobalSession(gs))
+	bs := session.NewBranchSessionByGlobal(gs,
+		session.WithBsResourceID("tb_1"),
+		session.WithBsLockKey("t_1:1"),
+		session.WithBsBranchType(meta.BranchTypeAT),
+		session.WithBsApplicationData([]byte("{\"data\":\"test\"}")),
+	)
+	gs.Add(bs)
+	assert.Nil(t, leader.AddBranchSession(gs, bs))
+	gs.Status = meta.GlobalStatusCommitting
+	assert.Nil(t, leader.UpdateGlobalSessionStatus(gs, meta.GlobalStatusCommitting))
+
+	assert.True(t, leader.FindGlobalSession(gs.XID) == gs)
+	for id, sessionManager := range managers {
+		if id == leaderID {
+			continue
+		}
+		assert.Equal(t, meta.TransactionExceptionCodeFailedWriteSession,
+			sessionManager.AddGlobalSession(globalSessionProvider(t)).(*meta.TransactionException).Code)
+		assert.Equal(t, leader.raft.Leader(), sessionManager.raft.Leader())
+		assert.Equal(t, servers[indexOf(servers, leaderID)].ForwardAddr, sessionManager.LeaderForwardAddress())
+		replicated := waitForSession(t, sessionManager, gs.XID, meta.GlobalStatusCommitting)
+		assert.Equal(t, 1, len(replicated.BranchSessions))
+		assert.Equal(t, bs.BranchID, replicated.GetSortedBranches()[0].BranchID)
+		assert.Equal(t, bs.LockKey, replicated.GetSortedBranches()[0].LockKey)
+	}
+
+	// The survivors elect a new leader which keeps serving the session.
+	assert.Nil(t, leader.Shutdown())
+	delete(managers, leaderID)
+	newLeader := managers[waitForLeader(t, managers)]
+	found := newLeader.FindGlobalSession(gs.XID)
+	assert.NotNil(t, found)
+	assert.Nil(t, newLeader.RemoveGlobalSession(found))
+	for _, sessionManager := range managers {
+		waitForSessionRemoved(t, sessionManager, gs.XID)
+	}
+}
+
+func TestRaftSessionManager_SnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starfish-raft")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := config.RaftStoreConfig{NodeID: "tc-1", Servers: raftServersProvider(t, 1), DataDir: dir}
+	sessionManager, err := NewRaftSessionManager(conf)
+	assert.Nil(t, err)
+	waitForLeader(t, map[string]*RaftSessionManager{conf.NodeID: sessionManager})
+
+	gs := globalSessionProvider(t)
+	gs.Begin()
+	assert.Nil(t, sessionManager.AddGlobalSession(gs))
+	bs := session.NewBranchSessionByGlobal(gs, session.WithBsResourceID("tb_1"), session.WithBsBranchType(meta.BranchTypeTCC))
+	gs.Add(bs)
+	assert.Nil(t, sessionManager.AddBranchSession(gs, bs))
+	assert.Nil(t, sessionManager.Snapshot())
+
+	// Written after the snapshot, so only the log has it.
+	gs2 := globalSessionProvider(t)
+	gs2.Begin()
+	assert.Nil(t, sessionManager.AddGlobalSession(gs2))
+	assert.Nil(t, sessionManager.Shutdown())
+
+	sessionManager, err = NewRaftSessionManager(conf)
+	assert.Nil(t, err)
+	defer sessionManager.Shutdown()
+	waitForLeader(t, map[string]*RaftSessionManager{conf.NodeID: sessionManager})
+	sessionManager.Reload()
+
+	restored := sessionManager.FindGlobalSession(gs.XID)
+	assert.NotNil(t, restored)
+	assert.Equal(t, meta.GlobalStatusBegin, restored.Status)
+	assert.True(t, restored.Active)
+	assert.Equal(t, 1, len(restored.BranchSessions))
+	assert.Equal(t, meta.BranchTypeTCC, restored.GetSortedBranches()[0].BranchType)
+	assert.NotNil(t, sessionManager.FindGlobalSession(gs2.XID))
+}
+
+// TestRaftSessionManager_SnapshotWhileRegistering snapshots the leader while
+// branches register on its live session the way the core does, under the
+// session lock.
+func TestRaftSessionManager_SnapshotWhileRegistering(t *testing.T) {
+	conf := config.RaftStoreConfig{NodeID: "tc-1", Servers: raftServersProvider(t, 1)}
+	sessionManager, err := NewRaftSessionManager(conf)
+	assert.Nil(t, err)
+	defer sessionManager.Shutdown()
+	waitForLeader(t, map[string]*RaftSessionManager{conf.NodeID: sessionManager})
+
+	gs := globalSessionProvider(t)
+	gs.Begin()
+	assert.Nil(t, sessionManager.AddGlobalSession(gs))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			bs := session.NewBranchSessionByGlobal(gs, session.WithBsResourceID("tb_1"),
+				session.WithBsBranchType(meta.BranchTypeTCC))
+			gs.Lock()
+			gs.Add(bs)
+			err := sessionManager.AddBranchSession(gs, bs)
+			gs.Unlock()
+			assert.Nil(t, err)
+		}
+	}()
+	for snapshotting := true; snapshotting; {
+		select {
+		case <-done:
+			snapshotting = false
+		default:
+			if err := sessionManager.Snapshot(); err != raft.ErrNothingNewToSnapshot {
+				assert.Nil(t, err)
+			}
+		}
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+	assert.Equal(t, 50, len(gs.BranchSessions))
+}
+
+func raftServersProvider(t *testing.T, n int) []config.RaftServerConfig {
+	servers := make([]config.RaftServerConfig, 0, n)
+	for i := 1; i <= n; i++ {
+		servers = append(servers, config.RaftServerConfig{
+			NodeID:      fmt.Sprintf("tc-%d", i),
+			Addr:        freeAddress(t),
+			ForwardAddr: freeAddress(t),
+		})
+	}
+	return servers
+}
+
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func indexOf(servers []config.RaftServerConfig, nodeID string) int {
+	for i, server := range servers {
+		if server.NodeID == nodeID {
+			return i
+		}
+	}
+	return -1
+}
+
+func waitForLeader(t *testing.T, managers map[string]*RaftSessionManager) string {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for id, sessionManager := range managers {
+			if sessionManager.IsLeader() {
+				return id
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return ""
+}
+
+func waitForSession(t *testing.T, sessionManager *RaftSessionManager, xid string, status meta.GlobalStatus) *session.GlobalSession {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		gs := sessionManager.FindGlobalSession(xid)
+		if gs != nil {
+			gs.Lock()
+			replicated := gs.Status == status
+			gs.Unlock()
+			if replicated {
+				return gs
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("session %s was not replicated", xid)
+	return nil
+}
+
+func waitForSessionRemoved(t *testing.T, sessionManager *RaftSessionManager, xid string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if sessionManager.FindGlobalSession(xid) == nil {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("session %s was not removed", xid)
+}
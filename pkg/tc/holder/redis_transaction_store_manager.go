@@ -0,0 +1,390 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"sort"
+	"strconv"
+)
+
+import (
+	"github.com/go-redis/redis/v7"
+
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+	"github.com/transaction-mesh/starfish/pkg/tc/redisstore"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+)
+
+// putGlobalSessionScript stores a global session and moves it from the status
+// index of its stored status to the one of its new status.
+//
+// KEYS: global session, transaction id index, begin time index
+// ARGV: status index prefix, xid, transaction id, status, begin time, fields...
+var putGlobalSessionScript = redis.NewScript(`
+local stored = redis.call('HGET', KEYS[1], 'status')
+if stored then
+	redis.call('ZREM', ARGV[1] .. stored, ARGV[2])
+end
+redis.call('HMSET', KEYS[1], unpack(ARGV, 6))
+redis.call('HSET', KEYS[2], ARGV[3], ARGV[2])
+redis.call('ZADD', ARGV[1] .. ARGV[4], ARGV[5], ARGV[2])
+redis.call('ZADD', KEYS[3], ARGV[5], ARGV[2])
+return 1
+`)
+
+// removeGlobalSessionScript removes a global session and its index entries.
+//
+// KEYS: global session, transaction id index, begin time index
+// ARGV: status index prefix, xid
+var removeGlobalSessionScript = redis.NewScript(`
+local stored = redis.call('HMGET', KEYS[1], 'status', 'transaction_id')
+if stored[1] then
+	redis.call('ZREM', ARGV[1] .. stored[1], ARGV[2])
+end
+if stored[2] then
+	redis.call('HDEL', KEYS[2], stored[2])
+end
+redis.call('ZREM', KEYS[3], ARGV[2])
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// RedisTransactionStoreManager keeps the sessions in redis as hashes, the
+// global sessions are indexed by transaction id, status and begin time.
+type RedisTransactionStoreManager struct {
+	client *redis.Client
+	keys   redisstore.Keys
+}
+
+func NewRedisTransactionStoreManager(client *redis.Client, keyPrefix string) *RedisTransactionStoreManager {
+	return &RedisTransactionStoreManager{client: client, keys: redisstore.Keys{Prefix: keyPrefix}}
+}
+
+// NewRedisSessionManager returns a session manager backed by the redis store,
+// it behaves as the one of the db store mode.
+func NewRedisSessionManager(taskName string, storeManager *RedisTransactionStoreManager) SessionManager {
+	return &DataBaseSessionManager{
+		TaskName:                taskName,
+		TransactionStoreManager: storeManager,
+	}
+}
+
+func (storeManager *RedisTransactionStoreManager) WriteSession(logOperation LogOperation, sessionStorable session.SessionStorable) bool {
+	var err error
+	switch logOperation {
+	case LogOperationGlobalAdd, LogOperationGlobalUpdate:
+		globalTransactionDO := convertGlobalTransactionDO(sessionStorable)
+		if globalTransactionDO == nil {
+			return false
+		}
+		err = storeManager.putGlobalSession(globalTransactionDO)
+	case LogOperationGlobalRemove:
+		globalTransactionDO := convertGlobalTransactionDO(sessionStorable)
+		if globalTransactionDO == nil {
+			return false
+		}
+		err = removeGlobalSessionScript.Run(storeManager.client,
+			[]string{storeManager.keys.Global(globalTransactionDO.XID), storeManager.keys.TransactionIDs(), storeManager.keys.BeginTime()},
+			storeManager.keys.StatusPrefix(), globalTransactionDO.XID).Err()
+	case LogOperationBranchAdd, LogOperationBranchUpdate:
+		branchTransactionDO := convertBranchTransactionDO(sessionStorable)
+		if branchTransactionDO == nil {
+			return false
+		}
+		_, err = storeManager.client.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.HMSet(storeManager.keys.Branch(branchTransactionDO.XID, branchTransactionDO.BranchID), branchTransactionFields(branchTransactionDO))
+			pipe.ZAdd(storeManager.keys.Branches(branchTransactionDO.XID),
+				&redis.Z{Score: float64(branchTransactionDO.BranchID), Member: branchTransactionDO.BranchID})
+			return nil
+		})
+	case LogOperationBranchRemove:
+		branchTransactionDO := convertBranchTransactionDO(sessionStorable)
+		if branchTransactionDO == nil {
+			return false
+		}
+		_, err = storeManager.client.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Del(storeManager.keys.Branch(branchTransactionDO.XID, branchTransactionDO.BranchID))
+			pipe.ZRem(storeManager.keys.Branches(branchTransactionDO.XID), branchTransactionDO.BranchID)
+			return nil
+		})
+	default:
+		err = errors.Errorf("unknown LogOperation:%v", logOperation)
+	}
+	if err != nil {
+		log.Errorf("write %s to redis store failed: %v", logOperation, err)
+		return false
+	}
+	return true
+}
+
+func (storeManager *RedisTransactionStoreManager) putGlobalSession(globalTransactionDO *model.GlobalTransactionDO) error {
+	args := []interface{}{storeManager.keys.StatusPrefix(), globalTransactionDO.XID, globalTransactionDO.TransactionID,
+		globalTransactionDO.Status, globalTransactionDO.BeginTime}
+	for field, value := range globalTransactionFields(globalTransactionDO) {
+		args = append(args, field, value)
+	}
+	return putGlobalSessionScript.Run(storeManager.client,
+		[]string{storeManager.keys.Global(globalTransactionDO.XID), storeManager.keys.TransactionIDs(), storeManager.keys.BeginTime()},
+		args...).Err()
+}
+
+func (storeManager *RedisTransactionStoreManager) ReadSession(xid string) *session.GlobalSession {
+	return storeManager.ReadSessionWithBranchSessions(xid, true)
+}
+
+func (storeManager *RedisTransactionStoreManager) ReadSessionWithBranchSessions(xid string, withBranchSessions bool) *session.GlobalSession {
+	globalSession, err := storeManager.readGlobalSession(xid, withBranchSessions)
+	if err != nil {
+		log.Errorf("read global session %s from redis store failed: %v", xid, err)
+		return nil
+	}
+	return globalSession
+}
+
+// ReadSessionWithSessionCondition looks the sessions up by the most selective
+// indexed field of sessionCondition, then filters them by the other fields
+// and sorts and pages them. An empty condition matches every session.
+func (storeManager *RedisTransactionStoreManager) ReadSessionWithSessionCondition(sessionCondition model.SessionCondition) []*session.GlobalSession {
+	xids, err := storeManager.lookupXIDs(sessionCondition)
+	if err != nil {
+		log.Errorf("query redis store failed: %v", err)
+		return nil
+	}
+	var globalSessions []*session.GlobalSession
+	for _, xid := range xids {
+		globalSession, err := storeManager.readGlobalSession(xid, true)
+		if err != nil {
+			log.Errorf("read global session %s from redis store failed: %v", xid, err)
+			return nil
+		}
+		if globalSession != nil {
+			globalSessions = append(globalSessions, globalSession)
+		}
+	}
+	return selectGlobalSessions(globalSessions, sessionCondition)
+}
+
+func (storeManager *RedisTransactionStoreManager) lookupXIDs(sessionCondition model.SessionCondition) ([]string, error) {
+	switch {
+	case sessionCondition.XID != "":
+		return []string{sessionCondition.XID}, nil
+	case sessionCondition.TransactionID != 0:
+		xid, err := storeManager.client.HGet(storeManager.keys.TransactionIDs(), strconv.FormatInt(sessionCondition.TransactionID, 10)).Result()
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return []string{xid}, err
+	}
+
+	beginTimeRange := &redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if sessionCondition.BeginTimeFrom > 0 {
+		beginTimeRange.Min = strconv.FormatInt(sessionCondition.BeginTimeFrom, 10)
+	}
+	if beforeBeginTime := beginTimeBefore(sessionCondition); beforeBeginTime > 0 {
+		beginTimeRange.Max = "(" + strconv.FormatInt(beforeBeginTime, 10)
+	}
+	statuses := sessionCondition.Statuses
+	if len(statuses) == 0 && sessionCondition.Status != meta.GlobalStatusUnknown {
+		statuses = []meta.GlobalStatus{sessionCondition.Status}
+	}
+	if len(statuses) == 0 {
+		return storeManager.client.ZRangeByScore(storeManager.keys.BeginTime(), beginTimeRange).Result()
+	}
+	var xids []string
+	for _, status := range statuses {
+		statusXIDs, err := storeManager.client.ZRangeByScore(storeManager.keys.Status(int32(status)), beginTimeRange).Result()
+		if err != nil {
+			return nil, err
+		}
+		xids = append(xids, statusXIDs...)
+	}
+	return xids, nil
+}
+
+// OrphanBranchSessions returns the branches whose global session no longer exists.
+func (storeManager *RedisTransactionStoreManager) OrphanBranchSessions() ([]*session.BranchSession, error) {
+	var branchSessions []*session.BranchSession
+	iter := storeManager.client.Scan(0, storeManager.keys.BranchPattern(), 0).Iterator()
+	for iter.Next() {
+		fields, err := storeManager.client.HGetAll(iter.Val()).Result()
+		if err != nil {
+			return nil, err
+		}
+		branchTransactionDO, err := parseBranchTransactionDO(fields)
+		if err != nil {
+			return nil, errors.WithMessage(err, iter.Val())
+		}
+		exists, err := storeManager.client.Exists(storeManager.keys.Global(branchTransactionDO.XID)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if exists == 0 {
+			branchSessions = append(branchSessions, convertBranchSession(branchTransactionDO))
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(branchSessions, func(i, j int) bool {
+		if branchSessions[i].XID != branchSessions[j].XID {
+			return branchSessions[i].XID < branchSessions[j].XID
+		}
+		return branchSessions[i].BranchID < branchSessions[j].BranchID
+	})
+	return branchSessions, nil
+}
+
+func (storeManager *RedisTransactionStoreManager) Shutdown() {
+	if err := storeManager.client.Close(); err != nil {
+		log.Errorf("close redis store failed: %v", err)
+	}
+}
+
+func (storeManager *RedisTransactionStoreManager) readGlobalSession(xid string, withBranchSessions bool) (*session.GlobalSession, error) {
+	fields, err := storeManager.client.HGetAll(storeManager.keys.Global(xid)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	globalTransactionDO, err := parseGlobalTransactionDO(fields)
+	if err != nil {
+		return nil, errors.WithMessage(err, xid)
+	}
+	if !withBranchSessions {
+		return getGlobalSession(globalTransactionDO, nil), nil
+	}
+
+	branchIDs, err := storeManager.client.ZRange(storeManager.keys.Branches(xid), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]*redis.StringStringMapCmd, 0, len(branchIDs))
+	_, err = storeManager.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, member := range branchIDs {
+			branchID, err := strconv.ParseInt(member, 10, 64)
+			if err != nil {
+				return errors.Wrapf(err, "branch id %s", member)
+			}
+			cmds = append(cmds, pipe.HGetAll(storeManager.keys.Branch(xid, branchID)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	branchTransactionDOs := make([]*model.BranchTransactionDO, 0, len(cmds))
+	for _, cmd := range cmds {
+		if len(cmd.Val()) == 0 {
+			continue
+		}
+		branchTransactionDO, err := parseBranchTransactionDO(cmd.Val())
+		if err != nil {
+			return nil, errors.WithMessage(err, xid)
+		}
+		branchTransactionDOs = append(branchTransactionDOs, branchTransactionDO)
+	}
+	return getGlobalSession(globalTransactionDO, branchTransactionDOs), nil
+}
+
+func globalTransactionFields(globalTransactionDO *model.GlobalTransactionDO) map[string]interface{} {
+	return map[string]interface{}{
+		"xid":                       globalTransactionDO.XID,
+		"transaction_id":            globalTransactionDO.TransactionID,
+		"status":                    globalTransactionDO.Status,
+		"application_id":            globalTransactionDO.ApplicationID,
+		"transaction_service_group": globalTransactionDO.TransactionServiceGroup,
+		"transaction_name":          globalTransactionDO.TransactionName,
+		"timeout":                   globalTransactionDO.Timeout,
+		"begin_time":                globalTransactionDO.BeginTime,
+		"application_data":          globalTransactionDO.ApplicationData,
+	}
+}
+
+func parseGlobalTransactionDO(fields map[string]string) (*model.GlobalTransactionDO, error) {
+	globalTransactionDO := &model.GlobalTransactionDO{
+		XID:                     fields["xid"],
+		ApplicationID:           fields["application_id"],
+		TransactionServiceGroup: fields["transaction_service_group"],
+		TransactionName:         fields["transaction_name"],
+		ApplicationData:         []byte(fields["application_data"]),
+	}
+	var err error
+	if globalTransactionDO.TransactionID, err = strconv.ParseInt(fields["transaction_id"], 10, 64); err != nil {
+		return nil, errors.Wrap(err, "transaction_id")
+	}
+	status, err := strconv.ParseInt(fields["status"], 10, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "status")
+	}
+	globalTransactionDO.Status = int32(status)
+	timeout, err := strconv.ParseInt(fields["timeout"], 10, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "timeout")
+	}
+	globalTransactionDO.Timeout = int32(timeout)
+	if globalTransactionDO.BeginTime, err = strconv.ParseInt(fields["begin_time"], 10, 64); err != nil {
+		return nil, errors.Wrap(err, "begin_time")
+	}
+	return globalTransactionDO, nil
+}
+
+func branchTransactionFields(branchTransactionDO *model.BranchTransactionDO) map[string]interface{} {
+	return map[string]interface{}{
+		"xid":               branchTransactionDO.XID,
+		"transaction_id":    branchTransactionDO.TransactionID,
+		"branch_id":         branchTransactionDO.BranchID,
+		"resource_group_id": branchTransactionDO.ResourceGroupID,
+		"resource_id":       branchTransactionDO.ResourceID,
+		"branch_type":       branchTransactionDO.BranchType,
+		"status":            branchTransactionDO.Status,
+		"client_id":         branchTransactionDO.ClientID,
+		"application_data":  branchTransactionDO.ApplicationData,
+	}
+}
+
+func parseBranchTransactionDO(fields map[string]string) (*model.BranchTransactionDO, error) {
+	branchTransactionDO := &model.BranchTransactionDO{
+		XID:             fields["xid"],
+		ResourceGroupID: fields["resource_group_id"],
+		ResourceID:      fields["resource_id"],
+		BranchType:      fields["branch_type"],
+		ClientID:        fields["client_id"],
+		ApplicationData: []byte(fields["application_data"]),
+	}
+	var err error
+	if branchTransactionDO.TransactionID, err = strconv.ParseInt(fields["transaction_id"], 10, 64); err != nil {
+		return nil, errors.Wrap(err, "transaction_id")
+	}
+	if branchTransactionDO.BranchID, err = strconv.ParseInt(fields["branch_id"], 10, 64); err != nil {
+		return nil, errors.Wrap(err, "branch_id")
+	}
+	status, err := strconv.ParseInt(fields["status"], 10, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "status")
+	}
+	branchTransactionDO.Status = int32(status)
+	return branchTransactionDO, nil
+}
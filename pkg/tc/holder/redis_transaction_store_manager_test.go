@@ -0,0 +1,94 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/go-redis/redis/v7"
+
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+	timeutil "github.com/transaction-mesh/starfish/pkg/util/time"
+)
+
+func TestRedisTransactionStoreManager_WriteSession(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer server.Close()
+
+	storeManager := NewRedisTransactionStoreManager(redis.NewClient(&redis.Options{Addr: server.Addr()}), config.DefaultRedisKeyPrefix)
+	defer storeManager.Shutdown()
+	sessionManager := NewRedisSessionManager("", storeManager)
+	gs := globalSessionProvider(t)
+	gs.Status = meta.GlobalStatusBegin
+	gs.BeginTime = int64(timeutil.CurrentTimeMillis()) - 60000
+	gs.ApplicationData = []byte{0, 1, 2}
+	bs := branchSessionProvider(gs)
+	bs.XID = gs.XID
+	assert.Nil(t, sessionManager.AddGlobalSession(gs))
+	assert.Nil(t, sessionManager.AddBranchSession(gs, bs))
+
+	expected := sessionManager.FindGlobalSession(gs.XID)
+	assert.NotNil(t, expected)
+	assert.Equal(t, gs.TransactionID, expected.TransactionID)
+	assert.Equal(t, gs.ApplicationData, expected.ApplicationData)
+	assert.Equal(t, gs.BeginTime, expected.BeginTime)
+	assert.Equal(t, 1, len(expected.BranchSessions))
+	assert.Equal(t, bs.ResourceID, expected.GetSortedBranches()[0].ResourceID)
+
+	byTransactionID := storeManager.ReadSessionWithSessionCondition(model.SessionCondition{TransactionID: gs.TransactionID})
+	assert.Equal(t, 1, len(byTransactionID))
+	byStatus := storeManager.ReadSessionWithSessionCondition(model.SessionCondition{Status: meta.GlobalStatusBegin})
+	assert.Equal(t, 1, len(byStatus))
+	byAge := storeManager.ReadSessionWithSessionCondition(model.SessionCondition{OverTimeAliveMills: 30000})
+	assert.Equal(t, 1, len(byAge))
+	byAge = storeManager.ReadSessionWithSessionCondition(model.SessionCondition{OverTimeAliveMills: 120000})
+	assert.Equal(t, 0, len(byAge))
+
+	gs.Status = meta.GlobalStatusCommitting
+	assert.Nil(t, sessionManager.UpdateGlobalSessionStatus(gs, meta.GlobalStatusCommitting))
+	byStatus = storeManager.ReadSessionWithSessionCondition(model.SessionCondition{Status: meta.GlobalStatusBegin})
+	assert.Equal(t, 0, len(byStatus))
+	byStatus = storeManager.ReadSessionWithSessionCondition(model.SessionCondition{
+		Statuses: []meta.GlobalStatus{meta.GlobalStatusCommitting, meta.GlobalStatusRollingBack}})
+	assert.Equal(t, 1, len(byStatus))
+
+	orphan := session.NewBranchSession(session.WithBsXid(gs.XID+"-removed"), session.WithBsBranchID(2))
+	assert.True(t, storeManager.WriteSession(LogOperationBranchAdd, orphan))
+	orphans, err := storeManager.OrphanBranchSessions()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(orphans))
+	assert.Equal(t, int64(2), orphans[0].BranchID)
+
+	assert.Nil(t, sessionManager.RemoveBranchSession(gs, bs))
+	assert.Nil(t, sessionManager.RemoveGlobalSession(gs))
+	assert.Nil(t, sessionManager.FindGlobalSession(gs.XID))
+	assert.Equal(t, 0, len(sessionManager.AllSessions()))
+	assert.False(t, server.Exists(config.DefaultRedisKeyPrefix+"global:"+gs.XID))
+}
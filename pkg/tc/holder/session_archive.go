@@ -0,0 +1,414 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+	time2 "github.com/transaction-mesh/starfish/pkg/util/time"
+)
+
+// sessionArchiveQueueSize bounds the finished sessions waiting to be written,
+// it is also the most records written together.
+const sessionArchiveQueueSize = 1024
+
+// SessionArchiveDropped counts the finished sessions not archived as the queue
+// of the records waiting to be written was full.
+var SessionArchiveDropped = metrics.NewCounter()
+
+// SessionHistoryRecord is a finished global session with its branches.
+type SessionHistoryRecord struct {
+	Global   *model.GlobalTransactionHistoryDO   `json:"global"`
+	Branches []*model.BranchTransactionHistoryDO `json:"branches,omitempty"`
+}
+
+// SessionHistory keeps the records of a SessionArchive.
+type SessionHistory interface {
+	WriteHistory(records []*SessionHistoryRecord) error
+	// QueryHistory returns at most limit records matching condition, the
+	// latest ended first.
+	QueryHistory(condition model.SessionCondition, limit int) ([]*SessionHistoryRecord, error)
+	// PurgeHistory deletes the records of the sessions ended before endTime,
+	// in milliseconds.
+	PurgeHistory(endTime int64) error
+	Close() error
+}
+
+// SessionArchive records every finished global session into a SessionHistory
+// before it is deleted from the store. The branches removed by phase two and
+// the retries of a global session are kept in memory until it ends, a TC
+// restarting in between loses them.
+//
+// A nil SessionArchive archives nothing, it is nil unless the history is
+// configured.
+type SessionArchive struct {
+	history       SessionHistory
+	retention     time.Duration
+	purgeInterval time.Duration
+	queryLimit    int
+
+	sync.Mutex
+	pending map[string]*pendingSession
+
+	records chan *SessionHistoryRecord
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// pendingSession is what is archived of a global session before it ends.
+type pendingSession struct {
+	branches   []*model.BranchTransactionHistoryDO
+	retryCount int32
+	// modified is when it was last added to, in milliseconds.
+	modified int64
+}
+
+var sessionArchive *SessionArchive
+
+// GetSessionArchive returns the archive of the finished sessions, nil when the
+// history is not configured.
+func GetSessionArchive() *SessionArchive {
+	return sessionArchive
+}
+
+func initSessionArchive(conf config.StoreConfig) {
+	history, err := newSessionHistory(conf.HistoryConfig, conf.DBStoreConfig)
+	if err != nil {
+		panic(err)
+	}
+	if history != nil {
+		sessionArchive = NewSessionArchive(history, conf.HistoryConfig)
+	}
+}
+
+// newSessionHistory opens the history of conf.Mode, nil when it is empty.
+func newSessionHistory(conf config.HistoryConfig, dbConf config.DBStoreConfig) (SessionHistory, error) {
+	switch conf.Mode {
+	case "":
+		return nil, nil
+	case config.HistoryModeDB:
+		if dbConf.Engine == nil {
+			return nil, errors.New("history mode db needs the dsn of the db store")
+		}
+		return NewDataBaseSessionHistory(dbConf.Engine), nil
+	case config.HistoryModeFile:
+		return NewFileSessionHistory(conf.FileDir, conf.FileSize)
+	default:
+		return nil, errors.Errorf("unsupported history mode %s", conf.Mode)
+	}
+}
+
+func NewSessionArchive(history SessionHistory, conf config.HistoryConfig) *SessionArchive {
+	archive := &SessionArchive{
+		history:       history,
+		retention:     conf.Retention,
+		purgeInterval: conf.PurgeInterval,
+		queryLimit:    conf.QueryLimit,
+		pending:       make(map[string]*pendingSession),
+		records:       make(chan *SessionHistoryRecord, sessionArchiveQueueSize),
+		stop:          make(chan struct{}),
+	}
+	if archive.retention <= 0 {
+		archive.retention = config.DefaultHistoryRetention
+	}
+	if archive.purgeInterval <= 0 {
+		archive.purgeInterval = config.DefaultHistoryPurgeInterval
+	}
+	if archive.queryLimit <= 0 {
+		archive.queryLimit = config.DefaultHistoryQueryLimit
+	}
+	archive.stopped.Add(1)
+	go archive.run()
+	return archive
+}
+
+// RecordRetry counts a retry of the phase two of xid.
+func (archive *SessionArchive) RecordRetry(xid string) {
+	if archive == nil {
+		return
+	}
+	archive.Lock()
+	defer archive.Unlock()
+	archive.pendingSession(xid).retryCount++
+}
+
+// ArchiveBranchSession keeps a branch removed from its global session, with
+// the status it ended in, until the global session is archived.
+func (archive *SessionArchive) ArchiveBranchSession(branchSession *session.BranchSession) {
+	if archive == nil {
+		return
+	}
+	branchTransactionDO := convertBranchTransactionHistoryDO(branchSession, int64(time2.CurrentTimeMillis()))
+	archive.Lock()
+	defer archive.Unlock()
+	pending := archive.pendingSession(branchSession.XID)
+	pending.branches = append(pending.branches, branchTransactionDO)
+}
+
+// ArchiveGlobalSession records a global session which reached its final
+// status, with the branches removed before and the ones it still has.
+func (archive *SessionArchive) ArchiveGlobalSession(globalSession *session.GlobalSession) {
+	if archive == nil {
+		return
+	}
+	now := int64(time2.CurrentTimeMillis())
+	record := &SessionHistoryRecord{Global: convertGlobalTransactionHistoryDO(globalSession, now)}
+	archive.Lock()
+	if pending, ok := archive.pending[globalSession.XID]; ok {
+		record.Global.RetryCount = pending.retryCount
+		record.Branches = pending.branches
+		delete(archive.pending, globalSession.XID)
+	}
+	archive.Unlock()
+	for _, branchSession := range globalSession.GetSortedBranches() {
+		record.Branches = append(record.Branches, convertBranchTransactionHistoryDO(branchSession, now))
+	}
+
+	// Phase two does not wait for the history, a record the queue has no room
+	// for is dropped.
+	select {
+	case archive.records <- record:
+	case <-archive.stop:
+		log.Warnf("session archive is shut down, global session %s is not archived", globalSession.XID)
+	default:
+		SessionArchiveDropped.Inc(1)
+		log.Warnf("session archive queue is full, global session %s is not archived", globalSession.XID)
+	}
+}
+
+// FindHistory returns the archived sessions matching condition, the latest
+// ended first.
+func (archive *SessionArchive) FindHistory(condition model.SessionCondition) []*SessionHistoryRecord {
+	if archive == nil {
+		return nil
+	}
+	records, err := archive.history.QueryHistory(condition, archive.queryLimit)
+	if err != nil {
+		log.Errorf("query session history failed: %v", err)
+	}
+	return records
+}
+
+// FindGlobalSessions returns the archived sessions matching condition as
+// global sessions holding their branches.
+func (archive *SessionArchive) FindGlobalSessions(condition model.SessionCondition) []*session.GlobalSession {
+	records := archive.FindHistory(condition)
+	sessions := make([]*session.GlobalSession, 0, len(records))
+	for _, record := range records {
+		sessions = append(sessions, record.GlobalSession())
+	}
+	return sessions
+}
+
+// Shutdown writes the sessions waiting to be archived and closes the history.
+func (archive *SessionArchive) Shutdown() error {
+	if archive == nil {
+		return nil
+	}
+	close(archive.stop)
+	archive.stopped.Wait()
+	return archive.history.Close()
+}
+
+func (archive *SessionArchive) pendingSession(xid string) *pendingSession {
+	pending, ok := archive.pending[xid]
+	if !ok {
+		pending = &pendingSession{}
+		archive.pending[xid] = pending
+	}
+	pending.modified = int64(time2.CurrentTimeMillis())
+	return pending
+}
+
+func (archive *SessionArchive) run() {
+	defer archive.stopped.Done()
+	purgeTicker := time.NewTicker(archive.purgeInterval)
+	defer purgeTicker.Stop()
+	for {
+		select {
+		case record := <-archive.records:
+			archive.write(record)
+		case <-purgeTicker.C:
+			archive.purge()
+		case <-archive.stop:
+			for {
+				select {
+				case record := <-archive.records:
+					archive.write(record)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes record with the ones queued behind it, when they fail together
+// they are written one by one so that a bad record loses only itself.
+func (archive *SessionArchive) write(record *SessionHistoryRecord) {
+	records := []*SessionHistoryRecord{record}
+collect:
+	for len(records) < sessionArchiveQueueSize {
+		select {
+		case record := <-archive.records:
+			records = append(records, record)
+		default:
+			break collect
+		}
+	}
+	err := archive.history.WriteHistory(records)
+	settleBatch(len(records), err, func(i int) error {
+		return archive.history.WriteHistory(records[i : i+1])
+	}, func(i int, err error) {
+		if err != nil {
+			log.Errorf("archive global session %s failed: %v", records[i].Global.XID, err)
+		}
+	})
+}
+
+// purge deletes the history older than the retention, and forgets the pending
+// sessions as old, whose global session was never archived.
+func (archive *SessionArchive) purge() {
+	endTime := int64(time2.CurrentTimeMillis()) - archive.retention.Milliseconds()
+	if err := archive.history.PurgeHistory(endTime); err != nil {
+		log.Errorf("purge session history failed: %v", err)
+	}
+	archive.Lock()
+	defer archive.Unlock()
+	for xid, pending := range archive.pending {
+		if pending.modified < endTime {
+			delete(archive.pending, xid)
+		}
+	}
+}
+
+// GlobalSession returns the global session of the record, holding its branches.
+func (record *SessionHistoryRecord) GlobalSession() *session.GlobalSession {
+	globalTransactionDO := record.Global
+	globalSession := session.NewGlobalSession(
+		session.WithGsXID(globalTransactionDO.XID),
+		session.WithGsApplicationID(globalTransactionDO.ApplicationID),
+		session.WithGsTransactionID(globalTransactionDO.TransactionID),
+		session.WithGsTransactionName(globalTransactionDO.TransactionName),
+		session.WithGsTransactionServiceGroup(globalTransactionDO.TransactionServiceGroup),
+		session.WithGsStatus(meta.GlobalStatus(globalTransactionDO.Status)),
+		session.WithGsTimeout(globalTransactionDO.Timeout),
+		session.WithGsBeginTime(globalTransactionDO.BeginTime),
+		session.WithGsApplicationData(globalTransactionDO.ApplicationData),
+		session.WithGsActive(false),
+	)
+	for _, branchTransactionDO := range record.Branches {
+		branchSession := session.NewBranchSession(
+			session.WithBsXid(branchTransactionDO.XID),
+			session.WithBsTransactionID(branchTransactionDO.TransactionID),
+			session.WithBsApplicationData(branchTransactionDO.ApplicationData),
+			session.WithBsBranchID(branchTransactionDO.BranchID),
+			session.WithBsBranchType(meta.ValueOfBranchType(branchTransactionDO.BranchType)),
+			session.WithBsResourceID(branchTransactionDO.ResourceID),
+			session.WithBsClientID(branchTransactionDO.ClientID),
+			session.WithBsResourceGroupID(branchTransactionDO.ResourceGroupID),
+		)
+		globalSession.Add(branchSession)
+		// Add registers the branch anew, it keeps the status it ended in.
+		branchSession.Status = meta.BranchStatus(branchTransactionDO.Status)
+	}
+	return globalSession
+}
+
+func convertGlobalTransactionHistoryDO(globalSession *session.GlobalSession, endTime int64) *model.GlobalTransactionHistoryDO {
+	return &model.GlobalTransactionHistoryDO{
+		XID:                     globalSession.XID,
+		TransactionID:           globalSession.TransactionID,
+		Status:                  int32(globalSession.Status),
+		ApplicationID:           globalSession.ApplicationID,
+		TransactionServiceGroup: globalSession.TransactionServiceGroup,
+		TransactionName:         globalSession.TransactionName,
+		Timeout:                 globalSession.Timeout,
+		BeginTime:               globalSession.BeginTime,
+		EndTime:                 endTime,
+		ApplicationData:         globalSession.ApplicationData,
+	}
+}
+
+func convertBranchTransactionHistoryDO(branchSession *session.BranchSession, endTime int64) *model.BranchTransactionHistoryDO {
+	return &model.BranchTransactionHistoryDO{
+		XID:             branchSession.XID,
+		TransactionID:   branchSession.TransactionID,
+		BranchID:        branchSession.BranchID,
+		ResourceGroupID: branchSession.ResourceGroupID,
+		ResourceID:      branchSession.ResourceID,
+		BranchType:      branchSession.BranchType.String(),
+		Status:          int32(branchSession.Status),
+		ClientID:        branchSession.ClientID,
+		EndTime:         endTime,
+		ApplicationData: branchSession.ApplicationData,
+	}
+}
+
+// matchHistoryCondition reports whether an archived global session matches
+// condition, OverTimeAliveMills does not apply to a finished session.
+func matchHistoryCondition(globalTransactionDO *model.GlobalTransactionHistoryDO, condition model.SessionCondition) bool {
+	if condition.XID != "" && globalTransactionDO.XID != condition.XID {
+		return false
+	}
+	if condition.TransactionID != 0 && globalTransactionDO.TransactionID != condition.TransactionID {
+		return false
+	}
+	if condition.Status != meta.GlobalStatusUnknown && meta.GlobalStatus(globalTransactionDO.Status) != condition.Status {
+		return false
+	}
+	if len(condition.Statuses) > 0 {
+		matched := false
+		for _, status := range condition.Statuses {
+			if meta.GlobalStatus(globalTransactionDO.Status) == status {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if condition.ApplicationID != "" && globalTransactionDO.ApplicationID != condition.ApplicationID {
+		return false
+	}
+	if condition.TransactionName != "" && globalTransactionDO.TransactionName != condition.TransactionName {
+		return false
+	}
+	if condition.BeginTimeFrom > 0 && globalTransactionDO.BeginTime < condition.BeginTimeFrom {
+		return false
+	}
+	if before := beginTimeBefore(condition); before > 0 && globalTransactionDO.BeginTime >= before {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,217 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+func historyRecordProvider(xid string, endTime int64) *SessionHistoryRecord {
+	return &SessionHistoryRecord{
+		Global: &model.GlobalTransactionHistoryDO{XID: xid, Status: int32(meta.GlobalStatusCommitted), EndTime: endTime},
+		Branches: []*model.BranchTransactionHistoryDO{
+			{XID: xid, BranchID: endTime, Status: int32(meta.BranchStatusPhaseTwoCommitted), EndTime: endTime},
+		},
+	}
+}
+
+func TestSessionArchive_ArchiveGlobalSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starfish-history")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	history, err := NewFileSessionHistory(dir, 0)
+	assert.Nil(t, err)
+	archive := NewSessionArchive(history, config.HistoryConfig{Mode: config.HistoryModeFile})
+
+	gs := globalSessionProvider(t)
+	committed := session.NewBranchSessionByGlobal(gs, session.WithBsResourceID("tb_1"))
+	failed := session.NewBranchSessionByGlobal(gs, session.WithBsResourceID("tb_2"))
+	gs.Add(committed)
+	gs.Add(failed)
+	archive.RecordRetry(gs.XID)
+	archive.RecordRetry(gs.XID)
+	committed.Status = meta.BranchStatusPhaseTwoCommitted
+	gs.Remove(committed)
+	archive.ArchiveBranchSession(committed)
+	failed.Status = meta.BranchStatusPhaseTwoCommitFailedCanNotRetry
+	gs.Status = meta.GlobalStatusCommitFailed
+	archive.ArchiveGlobalSession(gs)
+	assert.Nil(t, archive.Shutdown())
+	assert.Empty(t, archive.pending)
+
+	history, err = NewFileSessionHistory(dir, 0)
+	assert.Nil(t, err)
+	archive = NewSessionArchive(history, config.HistoryConfig{})
+	defer archive.Shutdown()
+	records := archive.FindHistory(model.SessionCondition{XID: gs.XID})
+	assert.Equal(t, 1, len(records))
+	assert.Equal(t, int32(meta.GlobalStatusCommitFailed), records[0].Global.Status)
+	assert.Equal(t, int32(2), records[0].Global.RetryCount)
+	assert.Equal(t, gs.BeginTime, records[0].Global.BeginTime)
+	assert.True(t, records[0].Global.EndTime >= gs.BeginTime)
+	assert.Equal(t, 2, len(records[0].Branches))
+	assert.Empty(t, archive.FindHistory(model.SessionCondition{Status: meta.GlobalStatusRolledBack}))
+
+	sessionArchive = archive
+	defer func() { sessionArchive = nil }()
+	sessionManager := NewDefaultSessionManager("default")
+	globalSessions := sessionManager.FindGlobalSessions(model.SessionCondition{History: true, ApplicationID: gs.ApplicationID})
+	assert.Equal(t, 1, len(globalSessions))
+	assert.Equal(t, meta.GlobalStatusCommitFailed, globalSessions[0].Status)
+	assert.False(t, globalSessions[0].Active)
+	statuses := make(map[int64]meta.BranchStatus)
+	for _, branchSession := range globalSessions[0].GetSortedBranches() {
+		statuses[branchSession.BranchID] = branchSession.Status
+	}
+	assert.Equal(t, map[int64]meta.BranchStatus{
+		committed.BranchID: meta.BranchStatusPhaseTwoCommitted,
+		failed.BranchID:    meta.BranchStatusPhaseTwoCommitFailedCanNotRetry,
+	}, statuses)
+}
+
+func TestSessionArchive_QueueFull(t *testing.T) {
+	history := &blockingSessionHistory{writing: make(chan struct{}, 1), release: make(chan struct{})}
+	archive := NewSessionArchive(history, config.HistoryConfig{})
+
+	// the first record is being written and the queue fills up behind it.
+	archive.ArchiveGlobalSession(session.NewGlobalSession(session.WithGsXID("writing")))
+	<-history.writing
+	for i := 0; i < sessionArchiveQueueSize; i++ {
+		archive.ArchiveGlobalSession(session.NewGlobalSession(session.WithGsXID("queued")))
+	}
+	dropped := SessionArchiveDropped.Count()
+	done := make(chan struct{})
+	go func() {
+		archive.ArchiveGlobalSession(session.NewGlobalSession(session.WithGsXID("dropped")))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("archiving a global session waited for the history")
+	}
+	assert.Equal(t, dropped+1, SessionArchiveDropped.Count())
+
+	close(history.release)
+	assert.Nil(t, archive.Shutdown())
+	assert.Equal(t, sessionArchiveQueueSize+1, len(history.written))
+	for _, xid := range history.written {
+		assert.NotEqual(t, "dropped", xid)
+	}
+}
+
+func TestSessionArchive_WriteOneByOne(t *testing.T) {
+	history := &blockingSessionHistory{writing: make(chan struct{}, 1), release: make(chan struct{}), failing: "bad"}
+	archive := NewSessionArchive(history, config.HistoryConfig{})
+	archive.ArchiveGlobalSession(session.NewGlobalSession(session.WithGsXID("first")))
+	<-history.writing
+	for _, xid := range []string{"good", "bad", "other"} {
+		archive.ArchiveGlobalSession(session.NewGlobalSession(session.WithGsXID(xid)))
+	}
+	close(history.release)
+	assert.Nil(t, archive.Shutdown())
+	// the batch failed on the bad record, the others are written one by one.
+	assert.Equal(t, []string{"first", "good", "other"}, history.written)
+}
+
+// blockingSessionHistory holds the writes until release is closed, a batch
+// holding the failing xid fails.
+type blockingSessionHistory struct {
+	writing chan struct{}
+	release chan struct{}
+	failing string
+	written []string
+}
+
+func (history *blockingSessionHistory) WriteHistory(records []*SessionHistoryRecord) error {
+	select {
+	case history.writing <- struct{}{}:
+	default:
+	}
+	<-history.release
+	for _, record := range records {
+		if record.Global.XID == history.failing {
+			return errors.New("write failed")
+		}
+	}
+	for _, record := range records {
+		history.written = append(history.written, record.Global.XID)
+	}
+	return nil
+}
+
+func (history *blockingSessionHistory) QueryHistory(condition model.SessionCondition, limit int) ([]*SessionHistoryRecord, error) {
+	return nil, nil
+}
+
+func (history *blockingSessionHistory) PurgeHistory(endTime int64) error {
+	return nil
+}
+
+func (history *blockingSessionHistory) Close() error {
+	return nil
+}
+
+func TestFileSessionHistory_RollAndPurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starfish-history")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	history, err := NewFileSessionHistory(dir, 1)
+	assert.Nil(t, err)
+	defer history.Close()
+
+	for i, xid := range []string{"a", "b", "c"} {
+		assert.Nil(t, history.WriteHistory([]*SessionHistoryRecord{historyRecordProvider(xid, int64(i+1)*1000)}))
+	}
+	files, err := filepath.Glob(filepath.Join(dir, historyFilePrefix+"*"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(files))
+
+	records, err := history.QueryHistory(model.SessionCondition{}, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "c", records[0].Global.XID)
+	assert.Equal(t, "b", records[1].Global.XID)
+	assert.Equal(t, int64(3000), records[0].Branches[0].BranchID)
+
+	// the file of a ends before b began, the one of b may hold records after 2500.
+	assert.Nil(t, history.PurgeHistory(2500))
+	records, err = history.QueryHistory(model.SessionCondition{}, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(records))
+	records, err = history.QueryHistory(model.SessionCondition{XID: "a"}, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, records)
+}
@@ -0,0 +1,172 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+import (
+	"github.com/go-xorm/xorm"
+
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/common"
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+	"github.com/transaction-mesh/starfish/pkg/test"
+	"github.com/transaction-mesh/starfish/pkg/util/time"
+)
+
+// The session managers answer a SessionCondition the same way whatever store
+// they read, every one of them runs the cases below over the same sessions.
+
+func TestSessionCondition_DefaultSessionManager(t *testing.T) {
+	testSessionCondition(t, NewDefaultSessionManager("default"))
+}
+
+func TestSessionCondition_FileBasedSessionManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starfish-condition")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sessionManager := NewFileBasedSessionManager(config.FileStoreConfig{FileDir: filepath.Join(dir, "root.data")})
+	defer releaseSessionManager(sessionManager)
+	testSessionCondition(t, sessionManager)
+}
+
+func TestSessionCondition_EmbeddedSessionManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starfish-condition")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storeManager := openEmbeddedStore(t, dir)
+	defer storeManager.Shutdown()
+	testSessionCondition(t, NewEmbeddedSessionManager("", storeManager))
+}
+
+// TestSessionCondition_DataBaseSessionManager runs the cases on the global_table
+// of a MySQL container, the condition is turned into sql there.
+func TestSessionCondition_DataBaseSessionManager(t *testing.T) {
+	mysql := &test.MysqlContainer{
+		Username: "root",
+		Password: "123456",
+		Database: "starfish",
+	}
+	ctx, container := test.SetupMysql(mysql)
+	defer test.CloseConnection(ctx, container)
+	engine, err := xorm.NewEngine(config.DBDriverMySQL, mysql.DataSourceName(ctx, container))
+	assert.Nil(t, err)
+	defer engine.Close()
+
+	testSessionCondition(t, NewDataBaseSessionManager("", config.DBStoreConfig{
+		Driver:        config.DBDriverMySQL,
+		LogQueryLimit: 100,
+		Engine:        engine,
+	}))
+}
+
+// sessionConditionFixture returns the sessions the cases query, they began
+// ten minutes ago plus the given seconds.
+func sessionConditionFixture(now int64) []*session.GlobalSession {
+	common.Init("127.0.0.1", 9876)
+
+	begin := now - 10*60*1000
+	fixtures := []struct {
+		applicationID   string
+		transactionName string
+		status          meta.GlobalStatus
+		seconds         int64
+	}{
+		{"demo-order", "create-order", meta.GlobalStatusBegin, 30},
+		{"demo-order", "create-order", meta.GlobalStatusCommitRetrying, 10},
+		{"demo-stock", "reduce-stock", meta.GlobalStatusBegin, 20},
+		{"demo-stock", "create-order", meta.GlobalStatusRollbackRetrying, 40},
+		{"demo-order", "reduce-stock", meta.GlobalStatusBegin, 20},
+	}
+	globalSessions := make([]*session.GlobalSession, 0, len(fixtures))
+	for _, fixture := range fixtures {
+		globalSessions = append(globalSessions, session.NewGlobalSession(
+			session.WithGsApplicationID(fixture.applicationID),
+			session.WithGsTransactionServiceGroup("my_test_tx_group"),
+			session.WithGsTransactionName(fixture.transactionName),
+			session.WithGsStatus(fixture.status),
+			session.WithGsTimeout(60000),
+			session.WithGsBeginTime(begin+fixture.seconds*1000),
+		))
+	}
+	return globalSessions
+}
+
+func testSessionCondition(t *testing.T, sessionManager SessionManager) {
+	now := int64(time.CurrentTimeMillis())
+	begin := now - 10*60*1000
+	globalSessions := sessionConditionFixture(now)
+	for _, globalSession := range globalSessions {
+		assert.Nil(t, sessionManager.AddGlobalSession(globalSession))
+	}
+
+	cases := []struct {
+		name      string
+		condition model.SessionCondition
+		expected  []int
+	}{
+		{"empty", model.SessionCondition{}, []int{1, 2, 4, 0, 3}},
+		{"status", model.SessionCondition{Status: meta.GlobalStatusBegin}, []int{2, 4, 0}},
+		{"statuses", model.SessionCondition{Statuses: []meta.GlobalStatus{meta.GlobalStatusCommitRetrying,
+			meta.GlobalStatusRollbackRetrying}}, []int{1, 3}},
+		{"application and name", model.SessionCondition{ApplicationID: "demo-order", TransactionName: "create-order"},
+			[]int{1, 0}},
+		{"application and status", model.SessionCondition{ApplicationID: "demo-order", Status: meta.GlobalStatusBegin},
+			[]int{4, 0}},
+		{"xid and application", model.SessionCondition{XID: globalSessions[3].XID, ApplicationID: "demo-order"}, []int{}},
+		{"transaction id", model.SessionCondition{TransactionID: globalSessions[2].TransactionID}, []int{2}},
+		{"begin time range", model.SessionCondition{BeginTimeFrom: begin + 20000, BeginTimeTo: begin + 40000},
+			[]int{2, 4, 0}},
+		{"over time alive", model.SessionCondition{OverTimeAliveMills: 10*60*1000 - 25000}, []int{1, 2, 4}},
+		{"over time alive and begin time", model.SessionCondition{OverTimeAliveMills: 10*60*1000 - 25000,
+			BeginTimeTo: begin + 15000}, []int{1}},
+		{"sort by transaction id", model.SessionCondition{SortBy: model.SortByTransactionID}, []int{0, 1, 2, 3, 4}},
+		{"sort by transaction id descending", model.SessionCondition{SortBy: model.SortByTransactionID, Descending: true},
+			[]int{4, 3, 2, 1, 0}},
+		{"sort by status", model.SessionCondition{SortBy: model.SortByStatus}, []int{0, 2, 4, 1, 3}},
+		{"descending", model.SessionCondition{Descending: true}, []int{3, 0, 4, 2, 1}},
+		{"page", model.SessionCondition{Offset: 1, Limit: 2}, []int{2, 4}},
+		{"last page", model.SessionCondition{Offset: 4, Limit: 10}, []int{3}},
+		{"past the last page", model.SessionCondition{Offset: 5}, []int{}},
+		{"filtered page", model.SessionCondition{Status: meta.GlobalStatusBegin, Descending: true, Limit: 2}, []int{0, 4}},
+	}
+	indexes := make(map[string]int, len(globalSessions))
+	for i, globalSession := range globalSessions {
+		indexes[globalSession.XID] = i
+	}
+	for _, c := range cases {
+		actual := make([]int, 0)
+		for _, globalSession := range sessionManager.FindGlobalSessions(c.condition) {
+			actual = append(actual, indexes[globalSession.XID])
+		}
+		assert.Equal(t, c.expected, actual, c.name)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"github.com/go-xorm/xorm"
+
+	"github.com/pkg/errors"
+
+	"xorm.io/builder"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+)
+
+const (
+	InsertGlobalTransactionHistoryDO = `insert into global_table_history (xid, transaction_id, status, application_id,
+		transaction_service_group, transaction_name, timeout, begin_time, end_time, retry_count, application_data)
+		values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	InsertBranchTransactionHistoryDO = `insert into branch_table_history (xid, branch_id, transaction_id, resource_group_id,
+		resource_id, branch_type, status, client_id, end_time, application_data) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	DeleteBranchTransactionHistoryDOs = `delete from branch_table_history where xid in
+		(select xid from global_table_history where end_time < ?)`
+	DeleteGlobalTransactionHistoryDOs = "delete from global_table_history where end_time < ?"
+)
+
+// DataBaseSessionHistory keeps the archived sessions in global_table_history
+// and branch_table_history, the schema of each driver is under
+// scripts/server/db.
+type DataBaseSessionHistory struct {
+	engine *xorm.Engine
+}
+
+func NewDataBaseSessionHistory(engine *xorm.Engine) *DataBaseSessionHistory {
+	return &DataBaseSessionHistory{engine: engine}
+}
+
+// WriteHistory inserts the records in one transaction.
+func (history *DataBaseSessionHistory) WriteHistory(records []*SessionHistoryRecord) error {
+	session := history.engine.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, record := range records {
+		globalTransaction := record.Global
+		_, err := session.Exec(InsertGlobalTransactionHistoryDO, globalTransaction.XID, globalTransaction.TransactionID,
+			globalTransaction.Status, globalTransaction.ApplicationID, globalTransaction.TransactionServiceGroup,
+			globalTransaction.TransactionName, globalTransaction.Timeout, globalTransaction.BeginTime,
+			globalTransaction.EndTime, globalTransaction.RetryCount, globalTransaction.ApplicationData)
+		if err != nil {
+			session.Rollback()
+			return errors.Wrapf(err, "archive global session %s", globalTransaction.XID)
+		}
+		for _, branchTransaction := range record.Branches {
+			_, err := session.Exec(InsertBranchTransactionHistoryDO, branchTransaction.XID, branchTransaction.BranchID,
+				branchTransaction.TransactionID, branchTransaction.ResourceGroupID, branchTransaction.ResourceID,
+				branchTransaction.BranchType, branchTransaction.Status, branchTransaction.ClientID,
+				branchTransaction.EndTime, branchTransaction.ApplicationData)
+			if err != nil {
+				session.Rollback()
+				return errors.Wrapf(err, "archive branch session %d of %s", branchTransaction.BranchID, globalTransaction.XID)
+			}
+		}
+	}
+	return errors.WithStack(session.Commit())
+}
+
+func (history *DataBaseSessionHistory) QueryHistory(condition model.SessionCondition, limit int) ([]*SessionHistoryRecord, error) {
+	var globalTransactionDOs []*model.GlobalTransactionHistoryDO
+	err := history.engine.Table("global_table_history").
+		Where(sessionConditionCond(condition)).
+		OrderBy("end_time desc").
+		Limit(limit).
+		Find(&globalTransactionDOs)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(globalTransactionDOs) == 0 {
+		return nil, nil
+	}
+
+	records := make([]*SessionHistoryRecord, 0, len(globalTransactionDOs))
+	recordsByXID := make(map[string]*SessionHistoryRecord, len(globalTransactionDOs))
+	xids := make([]string, 0, len(globalTransactionDOs))
+	for _, globalTransactionDO := range globalTransactionDOs {
+		record := &SessionHistoryRecord{Global: globalTransactionDO}
+		records = append(records, record)
+		recordsByXID[globalTransactionDO.XID] = record
+		xids = append(xids, globalTransactionDO.XID)
+	}
+	var branchTransactionDOs []*model.BranchTransactionHistoryDO
+	err = history.engine.Table("branch_table_history").
+		Where(builder.In("xid", xids)).
+		OrderBy("branch_id").
+		Find(&branchTransactionDOs)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, branchTransactionDO := range branchTransactionDOs {
+		if record, ok := recordsByXID[branchTransactionDO.XID]; ok {
+			record.Branches = append(record.Branches, branchTransactionDO)
+		}
+	}
+	return records, nil
+}
+
+// PurgeHistory deletes the branches before their global sessions, so that a
+// failure in between leaves no branch behind.
+func (history *DataBaseSessionHistory) PurgeHistory(endTime int64) error {
+	if _, err := history.engine.Exec(DeleteBranchTransactionHistoryDOs, endTime); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err := history.engine.Exec(DeleteGlobalTransactionHistoryDOs, endTime)
+	return errors.WithStack(err)
+}
+
+// Close leaves the engine open, the db store may share it.
+func (history *DataBaseSessionHistory) Close() error {
+	return nil
+}
@@ -0,0 +1,227 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+)
+
+const (
+	historyFilePrefix = "history-"
+	historyFileSuffix = ".log"
+)
+
+// FileSessionHistory appends the archived sessions as json lines to rolling
+// files of dir, each named after the end time of its first record. A file
+// rolls once it is over fileSize, and is purged once the file after it began
+// before the end time purged.
+type FileSessionHistory struct {
+	dir      string
+	fileSize int64
+
+	sync.Mutex
+	file       *os.File
+	fileOffset int64
+}
+
+func NewFileSessionHistory(dir string, fileSize int64) (*FileSessionHistory, error) {
+	if dir == "" {
+		dir = config.DefaultHistoryFileDir
+	}
+	if fileSize <= 0 {
+		fileSize = config.DefaultHistoryFileSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &FileSessionHistory{dir: dir, fileSize: fileSize}, nil
+}
+
+func (history *FileSessionHistory) WriteHistory(records []*SessionHistoryRecord) error {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return errors.Wrapf(err, "encode global session %s", record.Global.XID)
+		}
+	}
+
+	history.Lock()
+	defer history.Unlock()
+	if history.file == nil || history.fileOffset >= history.fileSize {
+		if err := history.roll(records[0].Global.EndTime); err != nil {
+			return err
+		}
+	}
+	n, err := history.file.Write(buffer.Bytes())
+	history.fileOffset += int64(n)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(history.file.Sync())
+}
+
+// roll closes the current file and opens the one beginning at endTime.
+func (history *FileSessionHistory) roll(endTime int64) error {
+	if history.file != nil {
+		if err := history.file.Close(); err != nil {
+			return errors.WithStack(err)
+		}
+		history.file = nil
+	}
+	file, err := os.OpenFile(historyFileName(history.dir, endTime), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.WithStack(err)
+	}
+	history.file = file
+	history.fileOffset = info.Size()
+	return nil
+}
+
+func (history *FileSessionHistory) QueryHistory(condition model.SessionCondition, limit int) ([]*SessionHistoryRecord, error) {
+	history.Lock()
+	defer history.Unlock()
+	files, err := history.listFiles()
+	if err != nil {
+		return nil, err
+	}
+	var records []*SessionHistoryRecord
+	for i := len(files) - 1; i >= 0 && len(records) < limit; i-- {
+		matched, err := readHistoryFile(files[i].name, condition)
+		if err != nil {
+			return nil, err
+		}
+		for j := len(matched) - 1; j >= 0 && len(records) < limit; j-- {
+			records = append(records, matched[j])
+		}
+	}
+	return records, nil
+}
+
+func (history *FileSessionHistory) PurgeHistory(endTime int64) error {
+	history.Lock()
+	defer history.Unlock()
+	files, err := history.listFiles()
+	if err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(files) && files[i+1].beginTime < endTime; i++ {
+		if err := os.Remove(files[i].name); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func (history *FileSessionHistory) Close() error {
+	history.Lock()
+	defer history.Unlock()
+	if history.file == nil {
+		return nil
+	}
+	err := history.file.Close()
+	history.file = nil
+	return errors.WithStack(err)
+}
+
+type historyFile struct {
+	name      string
+	beginTime int64
+}
+
+// listFiles returns the history files of the directory, the oldest first.
+func (history *FileSessionHistory) listFiles() ([]historyFile, error) {
+	infos, err := ioutil.ReadDir(history.dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var files []historyFile
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, historyFilePrefix) || !strings.HasSuffix(name, historyFileSuffix) {
+			continue
+		}
+		beginTime, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, historyFilePrefix), historyFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, historyFile{name: filepath.Join(history.dir, name), beginTime: beginTime})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].beginTime < files[j].beginTime
+	})
+	return files, nil
+}
+
+func historyFileName(dir string, beginTime int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%016d%s", historyFilePrefix, beginTime, historyFileSuffix))
+}
+
+// readHistoryFile returns the records of the file matching condition in the
+// order they were written, a torn last line is skipped.
+func readHistoryFile(fileName string, condition model.SessionCondition) ([]*SessionHistoryRecord, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+
+	var records []*SessionHistoryRecord
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		record := &SessionHistoryRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return nil, errors.Wrapf(err, "read %s", fileName)
+		}
+		if record.Global != nil && matchHistoryCondition(record.Global, condition) {
+			records = append(records, record)
+		}
+	}
+}
@@ -17,6 +17,10 @@
 
 package holder
 
+import (
+	"go.uber.org/atomic"
+)
+
 import (
 	"github.com/transaction-mesh/starfish/pkg/base/meta"
 	"github.com/transaction-mesh/starfish/pkg/tc/config"
@@ -36,11 +40,16 @@ type SessionHolder struct {
 	AsyncCommittingSessionManager  SessionManager
 	RetryCommittingSessionManager  SessionManager
 	RetryRollbackingSessionManager SessionManager
+
+	// leading is only set when RootSessionManager is a ClusterSessionManager,
+	// it turns true once the sessions were reloaded after winning an election.
+	leading *atomic.Bool
 }
 
 var sessionHolder SessionHolder
 
 func Init() {
+	initSessionArchive(config.GetStoreConfig())
 	if config.GetStoreConfig().StoreMode == "file" {
 		sessionHolder = SessionHolder{
 			RootSessionManager:             NewFileBasedSessionManager(config.GetStoreConfig().FileStoreConfig),
@@ -48,7 +57,7 @@ func Init() {
 			RetryCommittingSessionManager:  NewDefaultSessionManager(RETRY_COMMITTING_SESSION_MANAGER_NAME),
 			RetryRollbackingSessionManager: NewDefaultSessionManager(RETRY_ROLLBACKING_SESSION_MANAGER_NAME),
 		}
-		sessionHolder.reload()
+		mustReload()
 	}
 	if config.GetStoreConfig().StoreMode == "db" {
 		sessionHolder = SessionHolder{
@@ -57,7 +66,50 @@ func Init() {
 			RetryCommittingSessionManager:  NewDataBaseSessionManager(RETRY_COMMITTING_SESSION_MANAGER_NAME, config.GetStoreConfig().DBStoreConfig),
 			RetryRollbackingSessionManager: NewDataBaseSessionManager(RETRY_ROLLBACKING_SESSION_MANAGER_NAME, config.GetStoreConfig().DBStoreConfig),
 		}
-		sessionHolder.reload()
+		mustReload()
+	}
+	if config.GetStoreConfig().StoreMode == "embedded" {
+		storeManager := NewEmbeddedTransactionStoreManager(config.GetStoreConfig().EmbeddedStoreConfig.DB)
+		sessionHolder = SessionHolder{
+			RootSessionManager:             NewEmbeddedSessionManager("", storeManager),
+			AsyncCommittingSessionManager:  NewEmbeddedSessionManager(ASYNC_COMMITTING_SESSION_MANAGER_NAME, storeManager),
+			RetryCommittingSessionManager:  NewEmbeddedSessionManager(RETRY_COMMITTING_SESSION_MANAGER_NAME, storeManager),
+			RetryRollbackingSessionManager: NewEmbeddedSessionManager(RETRY_ROLLBACKING_SESSION_MANAGER_NAME, storeManager),
+		}
+		mustReload()
+	}
+	if config.GetStoreConfig().StoreMode == "redis" {
+		redisConfig := config.GetStoreConfig().RedisStoreConfig
+		storeManager := NewRedisTransactionStoreManager(redisConfig.Client, redisConfig.Prefix())
+		sessionHolder = SessionHolder{
+			RootSessionManager:             NewRedisSessionManager("", storeManager),
+			AsyncCommittingSessionManager:  NewRedisSessionManager(ASYNC_COMMITTING_SESSION_MANAGER_NAME, storeManager),
+			RetryCommittingSessionManager:  NewRedisSessionManager(RETRY_COMMITTING_SESSION_MANAGER_NAME, storeManager),
+			RetryRollbackingSessionManager: NewRedisSessionManager(RETRY_ROLLBACKING_SESSION_MANAGER_NAME, storeManager),
+		}
+		mustReload()
+	}
+	if config.GetStoreConfig().StoreMode == "raft" {
+		rootSessionManager, err := NewRaftSessionManager(config.GetStoreConfig().RaftStoreConfig)
+		if err != nil {
+			panic(err)
+		}
+		sessionHolder = SessionHolder{
+			RootSessionManager:             rootSessionManager,
+			AsyncCommittingSessionManager:  NewDefaultSessionManager(ASYNC_COMMITTING_SESSION_MANAGER_NAME),
+			RetryCommittingSessionManager:  NewDefaultSessionManager(RETRY_COMMITTING_SESSION_MANAGER_NAME),
+			RetryRollbackingSessionManager: NewDefaultSessionManager(RETRY_ROLLBACKING_SESSION_MANAGER_NAME),
+			leading:                        atomic.NewBool(false),
+		}
+		go sessionHolder.watchLeadership(rootSessionManager)
+	}
+}
+
+// mustReload restores the sessions of the store the TC starts on, a store it
+// can not read is fatal.
+func mustReload() {
+	if err := sessionHolder.reload(); err != nil {
+		panic(err)
 	}
 }
 
@@ -65,6 +117,12 @@ func GetSessionHolder() SessionHolder {
 	return sessionHolder
 }
 
+// SetSessionHolder replaces the session holder Init set up, the tests run the
+// coordinator on sessions kept in memory with it.
+func SetSessionHolder(holder SessionHolder) {
+	sessionHolder = holder
+}
+
 func (sessionHolder SessionHolder) FindGlobalSession(xid string) *session.GlobalSession {
 	return sessionHolder.FindGlobalSessionWithBranchSessions(xid, true)
 }
@@ -73,10 +131,67 @@ func (sessionHolder SessionHolder) FindGlobalSessionWithBranchSessions(xid strin
 	return sessionHolder.RootSessionManager.FindGlobalSessionWithBranchSessions(xid, withBranchSessions)
 }
 
-func (sessionHolder SessionHolder) reload() {
+// IsLeader reports whether this TC may serve transactions itself. It is always
+// true unless the sessions are replicated across a cluster.
+func (sessionHolder SessionHolder) IsLeader() bool {
+	if sessionHolder.leading == nil {
+		return true
+	}
+	return sessionHolder.leading.Load()
+}
+
+// Shutdown flushes and closes the store behind the root session manager, or
+// stops replication when the sessions are replicated across a cluster. The
+// session archive is closed first.
+func (sessionHolder SessionHolder) Shutdown() error {
+	if err := GetSessionArchive().Shutdown(); err != nil {
+		log.Errorf("close session history failed: %v", err)
+	}
+	switch sessionManager := sessionHolder.RootSessionManager.(type) {
+	case ClusterSessionManager:
+		return sessionManager.Shutdown()
+	case *FileBasedSessionManager:
+		sessionManager.TransactionStoreManager.Shutdown()
+	case *DataBaseSessionManager:
+		sessionManager.TransactionStoreManager.Shutdown()
+	}
+	return nil
+}
+
+// watchLeadership rebuilds the retry queues and the locks from the replicated
+// sessions when this node becomes leader, and drops them when it steps down.
+func (sessionHolder SessionHolder) watchLeadership(sessionManager ClusterSessionManager) {
+	for isLeader := range sessionManager.LeadershipChanged() {
+		if isLeader {
+			log.Infof("became leader, reloading %d global sessions", len(sessionManager.AllSessions()))
+			if err := sessionHolder.reload(); err != nil {
+				log.Errorf("reload sessions failed: %v", err)
+			}
+			sessionHolder.leading.Store(true)
+		} else {
+			log.Infof("lost leadership")
+			sessionHolder.leading.Store(false)
+			sessionHolder.clearRetrySessions()
+			lock.GetLockManager().CleanAllLocks()
+		}
+	}
+}
+
+func (sessionHolder SessionHolder) clearRetrySessions() {
+	for _, sessionManager := range []SessionManager{sessionHolder.AsyncCommittingSessionManager,
+		sessionHolder.RetryCommittingSessionManager, sessionHolder.RetryRollbackingSessionManager} {
+		for _, globalSession := range sessionManager.AllSessions() {
+			sessionManager.RemoveGlobalSession(globalSession)
+		}
+	}
+}
+
+func (sessionHolder SessionHolder) reload() error {
 	sessionManager, reloadable := sessionHolder.RootSessionManager.(Reloadable)
 	if reloadable {
-		sessionManager.Reload()
+		if err := sessionManager.Reload(); err != nil {
+			return err
+		}
 
 		reloadedSessions := sessionHolder.RootSessionManager.AllSessions()
 		if len(reloadedSessions) > 0 {
@@ -111,4 +226,5 @@ func (sessionHolder SessionHolder) reload() {
 			}
 		}
 	}
+	return nil
 }
@@ -19,6 +19,7 @@ package holder
 
 import (
 	"errors"
+	"sort"
 )
 
 import (
@@ -26,6 +27,7 @@ import (
 	"github.com/transaction-mesh/starfish/pkg/tc/model"
 	"github.com/transaction-mesh/starfish/pkg/tc/session"
 	"github.com/transaction-mesh/starfish/pkg/util/log"
+	"github.com/transaction-mesh/starfish/pkg/util/time"
 )
 
 type SessionManager interface {
@@ -56,7 +58,10 @@ type SessionManager interface {
 	// All sessions collection.
 	AllSessions() []*session.GlobalSession
 
-	// Find global sessions list.
+	// Find global sessions list, the finished ones archived by the
+	// SessionArchive when condition.History is set. Every implementation
+	// answers a condition the same way: the sessions matching all of its
+	// fields, sorted and paged as it asks.
 	FindGlobalSessions(condition model.SessionCondition) []*session.GlobalSession
 }
 
@@ -67,42 +72,42 @@ type AbstractSessionManager struct {
 
 func (sessionManager *AbstractSessionManager) AddGlobalSession(session *session.GlobalSession) error {
 	log.Debugf("MANAGER[%s] SESSION[%v] %s", sessionManager.Name, session, LogOperationGlobalAdd.String())
-	sessionManager.writeSession(LogOperationGlobalAdd, session)
-	return nil
+	return sessionManager.writeSession(LogOperationGlobalAdd, session)
 }
 
 func (sessionManager *AbstractSessionManager) UpdateGlobalSessionStatus(session *session.GlobalSession, status meta.GlobalStatus) error {
 	log.Debugf("MANAGER[%s] SESSION[%v] %s", sessionManager.Name, session, LogOperationGlobalUpdate.String())
-	sessionManager.writeSession(LogOperationGlobalUpdate, session)
-	return nil
+	return sessionManager.writeSession(LogOperationGlobalUpdate, session)
 }
 
 func (sessionManager *AbstractSessionManager) RemoveGlobalSession(session *session.GlobalSession) error {
 	log.Debugf("MANAGER[%s] SESSION[%v] %s", sessionManager.Name, session, LogOperationGlobalRemove.String())
-	sessionManager.writeSession(LogOperationGlobalRemove, session)
-	return nil
+	return sessionManager.writeSession(LogOperationGlobalRemove, session)
 }
 
 func (sessionManager *AbstractSessionManager) AddBranchSession(globalSession *session.GlobalSession, session *session.BranchSession) error {
 	log.Debugf("MANAGER[%s] SESSION[%v] %s", sessionManager.Name, session, LogOperationBranchAdd.String())
-	sessionManager.writeSession(LogOperationBranchAdd, session)
-	return nil
+	return sessionManager.writeSession(LogOperationBranchAdd, session)
 }
 
 func (sessionManager *AbstractSessionManager) UpdateBranchSessionStatus(session *session.BranchSession, status meta.BranchStatus) error {
 	log.Debugf("MANAGER[%s] SESSION[%v] %s", sessionManager.Name, session, LogOperationBranchUpdate.String())
-	sessionManager.writeSession(LogOperationBranchUpdate, session)
-	return nil
+	return sessionManager.writeSession(LogOperationBranchUpdate, session)
 }
 
 func (sessionManager *AbstractSessionManager) RemoveBranchSession(globalSession *session.GlobalSession, session *session.BranchSession) error {
 	log.Debugf("MANAGER[%s] SESSION[%v] %s", sessionManager.Name, session, LogOperationBranchRemove.String())
-	sessionManager.writeSession(LogOperationBranchRemove, session)
-	return nil
+	return sessionManager.writeSession(LogOperationBranchRemove, session)
 }
 
 func (sessionManager *AbstractSessionManager) writeSession(logOperation LogOperation, sessionStorable session.SessionStorable) error {
-	result := sessionManager.TransactionStoreManager.WriteSession(logOperation, sessionStorable)
+	return writeSession(sessionManager.TransactionStoreManager, logOperation, sessionStorable)
+}
+
+// writeSession writes sessionStorable to transactionStoreManager, a failed
+// write is a TransactionException of TransactionExceptionCodeFailedWriteSession.
+func writeSession(transactionStoreManager TransactionStoreManager, logOperation LogOperation, sessionStorable session.SessionStorable) error {
+	result := transactionStoreManager.WriteSession(logOperation, sessionStorable)
 	if !result {
 		if logOperation == LogOperationGlobalAdd {
 			return &meta.TransactionException{
@@ -144,3 +149,109 @@ func (sessionManager *AbstractSessionManager) writeSession(logOperation LogOpera
 	}
 	return nil
 }
+
+// selectGlobalSessions returns the sessions of globalSessions matching every
+// field of condition, sorted and paged by it.
+func selectGlobalSessions(globalSessions []*session.GlobalSession, condition model.SessionCondition) []*session.GlobalSession {
+	selected := make([]*session.GlobalSession, 0, len(globalSessions))
+	for _, globalSession := range globalSessions {
+		if matchSessionCondition(globalSession, condition) {
+			selected = append(selected, globalSession)
+		}
+	}
+	sortGlobalSessions(selected, condition)
+	return pageGlobalSessions(selected, condition)
+}
+
+// sortGlobalSessions sorts globalSessions by condition.SortBy, sessions equal
+// in it are ordered by transaction id so that pages are stable.
+func sortGlobalSessions(globalSessions []*session.GlobalSession, condition model.SessionCondition) {
+	sortKey := func(globalSession *session.GlobalSession) int64 {
+		switch condition.SortBy {
+		case model.SortByTransactionID:
+			return globalSession.TransactionID
+		case model.SortByStatus:
+			return int64(globalSession.Status)
+		default:
+			return globalSession.BeginTime
+		}
+	}
+	sort.SliceStable(globalSessions, func(i, j int) bool {
+		a, b := globalSessions[i], globalSessions[j]
+		if condition.Descending {
+			a, b = b, a
+		}
+		if keyA, keyB := sortKey(a), sortKey(b); keyA != keyB {
+			return keyA < keyB
+		}
+		return a.TransactionID < b.TransactionID
+	})
+}
+
+// pageGlobalSessions returns the page of the sorted globalSessions selected
+// by condition.Offset and condition.Limit.
+func pageGlobalSessions(globalSessions []*session.GlobalSession, condition model.SessionCondition) []*session.GlobalSession {
+	if condition.Offset > 0 {
+		if condition.Offset >= len(globalSessions) {
+			return globalSessions[:0]
+		}
+		globalSessions = globalSessions[condition.Offset:]
+	}
+	if condition.Limit > 0 && condition.Limit < len(globalSessions) {
+		globalSessions = globalSessions[:condition.Limit]
+	}
+	return globalSessions
+}
+
+// beginTimeBefore returns the exclusive upper bound condition puts on the
+// begin time, the tighter of BeginTimeTo and OverTimeAliveMills, zero when
+// there is none.
+func beginTimeBefore(condition model.SessionCondition) int64 {
+	before := condition.BeginTimeTo
+	if condition.OverTimeAliveMills > 0 {
+		overTime := int64(time.CurrentTimeMillis()) - condition.OverTimeAliveMills
+		if before <= 0 || overTime < before {
+			before = overTime
+		}
+	}
+	return before
+}
+
+// matchSessionCondition reports whether globalSession satisfies every field set
+// in condition, zero values do not filter.
+func matchSessionCondition(globalSession *session.GlobalSession, condition model.SessionCondition) bool {
+	if condition.XID != "" && globalSession.XID != condition.XID {
+		return false
+	}
+	if condition.TransactionID != 0 && globalSession.TransactionID != condition.TransactionID {
+		return false
+	}
+	if condition.Status != meta.GlobalStatusUnknown && globalSession.Status != condition.Status {
+		return false
+	}
+	if len(condition.Statuses) > 0 {
+		matched := false
+		for _, status := range condition.Statuses {
+			if globalSession.Status == status {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if condition.ApplicationID != "" && globalSession.ApplicationID != condition.ApplicationID {
+		return false
+	}
+	if condition.TransactionName != "" && globalSession.TransactionName != condition.TransactionName {
+		return false
+	}
+	if condition.BeginTimeFrom > 0 && globalSession.BeginTime < condition.BeginTimeFrom {
+		return false
+	}
+	if before := beginTimeBefore(condition); before > 0 && globalSession.BeginTime >= before {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"fmt"
+	"math"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/lock"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+// StoreCounts is what a session store holds.
+type StoreCounts struct {
+	GlobalSessions int `json:"global_sessions"`
+	BranchSessions int `json:"branch_sessions"`
+	RowLocks       int `json:"row_locks"`
+}
+
+func (counts StoreCounts) String() string {
+	return fmt.Sprintf("%d global sessions, %d branch sessions, %d row locks",
+		counts.GlobalSessions, counts.BranchSessions, counts.RowLocks)
+}
+
+// StoreMigration is the outcome of MigrateStore, what was read from the source
+// and what the target holds once written.
+type StoreMigration struct {
+	Source StoreCounts `json:"source"`
+	Target StoreCounts `json:"target"`
+}
+
+// MigrateStore copies the live sessions of the source store, with the row locks
+// of their branches, into the target store while no TC runs on either. The
+// target has to be empty, the source is left as it is, so that migrating back
+// from the target into a cleared source undoes the migration. The target is
+// read back once written and the migration fails unless it holds as many
+// sessions, branches and row locks as were read from the source.
+func MigrateStore(source config.StoreConfig, target config.StoreConfig) (*StoreMigration, error) {
+	if source.StoreMode == target.StoreMode && storeLocation(source) == storeLocation(target) {
+		return nil, errors.Errorf("source and target are the same %s store", source.StoreMode)
+	}
+	source = withoutQueryLimit(source)
+	target = withoutQueryLimit(target)
+
+	sourceManager, err := OpenSessionManager(source)
+	if err != nil {
+		return nil, errors.WithMessage(err, "open source store")
+	}
+	defer releaseSessionManager(sourceManager)
+	globalSessions := sourceManager.AllSessions()
+	migration := &StoreMigration{Source: countSessions(globalSessions)}
+
+	targetManager, err := openMigrationTarget(target)
+	if err != nil {
+		return nil, errors.WithMessage(err, "open target store")
+	}
+	lockManager := lock.NewLockManager(target)
+	if err := migrateSessions(globalSessions, targetManager, lockManager); err != nil {
+		releaseSessionManager(targetManager)
+		return nil, err
+	}
+	if _, ok := targetManager.(*FileBasedSessionManager); ok {
+		// The file store answers from memory, it is reloaded from its segments.
+		releaseSessionManager(targetManager)
+		if targetManager, err = OpenSessionManager(target); err != nil {
+			return nil, errors.WithMessage(err, "reopen target store")
+		}
+	}
+	defer releaseSessionManager(targetManager)
+	migration.Target = countSessions(targetManager.AllSessions())
+	if lister, ok := lockManager.(lock.RowLockLister); ok {
+		migration.Target.RowLocks = len(lister.ListRowLocks("", ""))
+	}
+	if migration.Target != migration.Source {
+		return migration, errors.Errorf("read %s from the source but the target holds %s", migration.Source, migration.Target)
+	}
+	return migration, nil
+}
+
+func migrateSessions(globalSessions []*session.GlobalSession, sessionManager SessionManager, lockManager lock.LockManager) error {
+	for _, globalSession := range globalSessions {
+		if err := sessionManager.AddGlobalSession(globalSession); err != nil {
+			return errors.WithMessagef(err, "migrate global session %s", globalSession.XID)
+		}
+		for _, branchSession := range globalSession.GetSortedBranches() {
+			if err := sessionManager.AddBranchSession(globalSession, branchSession); err != nil {
+				return errors.WithMessagef(err, "migrate branch session %d of %s", branchSession.BranchID, globalSession.XID)
+			}
+			if !lockManager.AcquireLock(branchSession) {
+				return errors.Errorf("migrate row locks of branch session %d of %s", branchSession.BranchID, globalSession.XID)
+			}
+		}
+	}
+	return nil
+}
+
+// openMigrationTarget opens the target store of a migration, which has to be
+// empty.
+func openMigrationTarget(conf config.StoreConfig) (SessionManager, error) {
+	if conf.StoreMode == "file" {
+		fileDir := fileStoreDir(conf.FileStoreConfig)
+		files, err := scanLogFiles(fileDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(files.replay(0)) > 0 {
+			return nil, errors.Errorf("file store at %s is not empty", fileDir)
+		}
+		conf.FileStoreConfig.FileDir = fileDir
+		// The segments are synced as they roll whatever the flush mode.
+		if conf.FileStoreConfig.FlushDiskMode == config.FlushdiskModeNoneModel {
+			conf.FileStoreConfig.FlushDiskMode = config.FlushdiskModeAsyncModel
+		}
+		return NewFileBasedSessionManager(conf.FileStoreConfig), nil
+	}
+
+	sessionManager, err := OpenSessionManager(conf)
+	if err != nil {
+		return nil, err
+	}
+	if globalSessions := sessionManager.AllSessions(); len(globalSessions) > 0 {
+		releaseSessionManager(sessionManager)
+		return nil, errors.Errorf("%s store is not empty, it holds %d global sessions", conf.StoreMode, len(globalSessions))
+	}
+	if lister, ok := lock.NewLockManager(conf).(lock.RowLockLister); ok {
+		if rowLocks := lister.ListRowLocks("", ""); len(rowLocks) > 0 {
+			releaseSessionManager(sessionManager)
+			return nil, errors.Errorf("%s store is not empty, it holds %d row locks", conf.StoreMode, len(rowLocks))
+		}
+	}
+	return sessionManager, nil
+}
+
+// countSessions counts the row locks through the lock keys of the branches.
+func countSessions(globalSessions []*session.GlobalSession) StoreCounts {
+	counts := StoreCounts{GlobalSessions: len(globalSessions)}
+	for _, globalSession := range globalSessions {
+		for _, branchSession := range globalSession.GetSortedBranches() {
+			counts.BranchSessions++
+			counts.RowLocks += len(lock.CollectRowLocks(branchSession))
+		}
+	}
+	return counts
+}
+
+// storeLocation identifies the store of conf among the stores of its mode.
+func storeLocation(conf config.StoreConfig) string {
+	switch conf.StoreMode {
+	case "file":
+		return fileStoreDir(conf.FileStoreConfig)
+	case "db":
+		return conf.DBStoreConfig.DSN
+	case "embedded":
+		return conf.EmbeddedStoreConfig.Path
+	case "redis":
+		return fmt.Sprintf("%s/%d/%s", conf.RedisStoreConfig.Addr, conf.RedisStoreConfig.DB, conf.RedisStoreConfig.Prefix())
+	default:
+		return ""
+	}
+}
+
+// withoutQueryLimit lifts the limit of the sessions the db store reads at once,
+// a migration reads them all.
+func withoutQueryLimit(conf config.StoreConfig) config.StoreConfig {
+	conf.DBStoreConfig.LogQueryLimit = math.MaxInt32
+	return conf
+}
+
+// releaseSessionManager stops what OpenSessionManager started, the embedded
+// and redis stores are left open to the caller which opened them.
+func releaseSessionManager(sessionManager SessionManager) {
+	switch sessionManager := sessionManager.(type) {
+	case *FileBasedSessionManager:
+		sessionManager.TransactionStoreManager.Shutdown()
+	case *DataBaseSessionManager:
+		if _, ok := sessionManager.TransactionStoreManager.(*DBTransactionStoreManager); ok {
+			sessionManager.TransactionStoreManager.Shutdown()
+		}
+	}
+}
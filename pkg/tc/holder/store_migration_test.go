@@ -0,0 +1,90 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/embedded"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+func TestMigrateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starfish-migrate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fileConf := config.StoreConfig{
+		StoreMode:       "file",
+		FileStoreConfig: config.FileStoreConfig{FileDir: filepath.Join(dir, "root.data")},
+	}
+	db, err := embedded.Open(filepath.Join(dir, "starfish.db"), time.Second, true)
+	assert.Nil(t, err)
+	defer db.Close()
+	embeddedConf := config.StoreConfig{
+		StoreMode:           "embedded",
+		EmbeddedStoreConfig: config.EmbeddedStoreConfig{Path: filepath.Join(dir, "starfish.db"), DB: db},
+	}
+
+	sessionManager := NewFileBasedSessionManager(fileConf.FileStoreConfig)
+	for _, lockKey := range []string{"t_1:1,2", "t_1:3"} {
+		gs := globalSessionProvider(t)
+		gs.Begin()
+		assert.Nil(t, sessionManager.AddGlobalSession(gs))
+		bs := session.NewBranchSessionByGlobal(gs, session.WithBsResourceID("tb_1"), session.WithBsLockKey(lockKey),
+			session.WithBsBranchType(meta.BranchTypeAT))
+		assert.Nil(t, sessionManager.AddBranchSession(gs, bs))
+	}
+	releaseSessionManager(sessionManager)
+
+	expected := StoreCounts{GlobalSessions: 2, BranchSessions: 2, RowLocks: 3}
+	migration, err := MigrateStore(fileConf, embeddedConf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, migration.Source)
+	assert.Equal(t, expected, migration.Target)
+
+	// the target is not empty any more.
+	_, err = MigrateStore(fileConf, embeddedConf)
+	assert.NotNil(t, err)
+	_, err = MigrateStore(fileConf, fileConf)
+	assert.NotNil(t, err)
+
+	// migrating back into a cleared file store.
+	fileConf.FileStoreConfig.FileDir = filepath.Join(dir, "rollback", "root.data")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(fileConf.FileStoreConfig.FileDir), 0755))
+	migration, err = MigrateStore(embeddedConf, fileConf)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, migration.Target)
+	reloaded, err := OpenSessionManager(fileConf)
+	assert.Nil(t, err)
+	defer releaseSessionManager(reloaded)
+	for _, globalSession := range reloaded.AllSessions() {
+		assert.Equal(t, meta.GlobalStatusBegin, globalSession.Status)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/lock"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+// StoreProblem is an inconsistency VerifyStore found in a session store.
+type StoreProblem struct {
+	XID      string `json:"xid,omitempty"`
+	BranchID int64  `json:"branch_id,omitempty"`
+	Problem  string `json:"problem"`
+}
+
+func (problem StoreProblem) String() string {
+	switch {
+	case problem.BranchID != 0:
+		return fmt.Sprintf("[%s/%d] %s", problem.XID, problem.BranchID, problem.Problem)
+	case problem.XID != "":
+		return fmt.Sprintf("[%s] %s", problem.XID, problem.Problem)
+	default:
+		return problem.Problem
+	}
+}
+
+// OpenSessionManager opens the store configured in conf so that it can be
+// inspected while no TC runs on it. The file store is opened read only, a torn
+// tail of its log is left to the TC to truncate. The raft store is owned by
+// the cluster and can only be inspected through the admin api of a running TC.
+func OpenSessionManager(conf config.StoreConfig) (SessionManager, error) {
+	switch conf.StoreMode {
+	case "file":
+		fileDir := fileStoreDir(conf.FileStoreConfig)
+		files, err := scanLogFiles(fileDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(files.replay(0)) == 0 {
+			return nil, errors.Errorf("no file store at %s", fileDir)
+		}
+		conf.FileStoreConfig.FileDir = fileDir
+		sessionManager := newReadOnlyFileBasedSessionManager(conf.FileStoreConfig)
+		if err := sessionManager.Reload(); err != nil {
+			return nil, err
+		}
+		return sessionManager, nil
+	case "db":
+		if conf.DBStoreConfig.Engine == nil {
+			return nil, errors.New("db store has no dsn configured")
+		}
+		return NewDataBaseSessionManager("", conf.DBStoreConfig), nil
+	case "embedded":
+		if conf.EmbeddedStoreConfig.DB == nil {
+			return nil, errors.New("embedded store is not opened")
+		}
+		return NewEmbeddedSessionManager("", NewEmbeddedTransactionStoreManager(conf.EmbeddedStoreConfig.DB)), nil
+	case "redis":
+		if conf.RedisStoreConfig.Client == nil {
+			return nil, errors.New("redis store is not connected")
+		}
+		return NewRedisSessionManager("", NewRedisTransactionStoreManager(conf.RedisStoreConfig.Client, conf.RedisStoreConfig.Prefix())), nil
+	default:
+		return nil, errors.Errorf("store mode %s can not be opened offline", conf.StoreMode)
+	}
+}
+
+// VerifyStore checks the store configured in conf for undecodable records,
+// branches and locks left behind by their global session, finished sessions
+// that were never removed and row locks held by two global sessions.
+func VerifyStore(conf config.StoreConfig) ([]StoreProblem, error) {
+	problems := make([]StoreProblem, 0)
+	if conf.StoreMode == "file" {
+		files, err := scanLogFiles(fileStoreDir(conf.FileStoreConfig))
+		if err != nil {
+			return nil, err
+		}
+		fileNames := files.replay(0)
+		for i, fileName := range fileNames {
+			fileProblems, err := verifyDataFile(fileName, i == len(fileNames)-1 && fileName != files.snapshot)
+			if err != nil {
+				return nil, err
+			}
+			problems = append(problems, fileProblems...)
+		}
+		if len(problems) > 0 {
+			// Replaying an undecodable record would panic.
+			return problems, nil
+		}
+	}
+
+	sessionManager, err := OpenSessionManager(conf)
+	if err != nil {
+		return nil, err
+	}
+	switch sessionManager := sessionManager.(type) {
+	case *FileBasedSessionManager:
+		for _, branchSession := range sessionManager.orphanBranchSessions {
+			problems = append(problems, StoreProblem{XID: branchSession.XID, BranchID: branchSession.BranchID,
+				Problem: "branch session has no global session"})
+		}
+	case *DataBaseSessionManager:
+		if storeManager, ok := sessionManager.TransactionStoreManager.(*EmbeddedTransactionStoreManager); ok {
+			for _, branchSession := range storeManager.OrphanBranchSessions() {
+				problems = append(problems, StoreProblem{XID: branchSession.XID, BranchID: branchSession.BranchID,
+					Problem: "branch session has no global session"})
+			}
+			lockStore := lock.NewLockStoreEmbedded(conf.EmbeddedStoreConfig.DB)
+			for _, lockDO := range lockStore.QueryOrphanLockDOs() {
+				problems = append(problems, StoreProblem{XID: lockDO.Xid, BranchID: lockDO.BranchID,
+					Problem: fmt.Sprintf("lock %s has no branch session", lockDO.RowKey)})
+			}
+			break
+		}
+		if storeManager, ok := sessionManager.TransactionStoreManager.(*RedisTransactionStoreManager); ok {
+			branchSessions, err := storeManager.OrphanBranchSessions()
+			if err != nil {
+				return nil, err
+			}
+			for _, branchSession := range branchSessions {
+				problems = append(problems, StoreProblem{XID: branchSession.XID, BranchID: branchSession.BranchID,
+					Problem: "branch session has no global session"})
+			}
+			lockStore := lock.NewLockStoreRedis(conf.RedisStoreConfig.Client, conf.RedisStoreConfig.Prefix())
+			for _, lockDO := range lockStore.QueryOrphanLockDOs() {
+				problems = append(problems, StoreProblem{XID: lockDO.Xid, BranchID: lockDO.BranchID,
+					Problem: fmt.Sprintf("lock %s has no branch session", lockDO.RowKey)})
+			}
+			break
+		}
+		logStore := NewLogStoreDataBaseDAO(conf.DBStoreConfig.Engine, conf.DBStoreConfig.DriverName())
+		for _, branchTransactionDO := range logStore.QueryOrphanBranchTransactionDOs() {
+			problems = append(problems, StoreProblem{XID: branchTransactionDO.XID, BranchID: branchTransactionDO.BranchID,
+				Problem: "branch_table row has no global_table row"})
+		}
+		lockStore := lock.NewLockStoreDataBaseDao(conf.DBStoreConfig.Engine, conf.DBStoreConfig.DriverName())
+		for _, lockDO := range lockStore.QueryOrphanLockDOs() {
+			problems = append(problems, StoreProblem{XID: lockDO.Xid, BranchID: lockDO.BranchID,
+				Problem: fmt.Sprintf("lock_table row %s has no branch_table row", lockDO.RowKey)})
+		}
+	}
+	return append(problems, verifySessions(sessionManager.AllSessions())...), nil
+}
+
+func fileStoreDir(conf config.FileStoreConfig) string {
+	if conf.FileDir == "" {
+		return config.DefaultFileDir
+	}
+	return conf.FileDir
+}
+
+// verifyDataFile walks the frames written by the FileTransactionStoreManager
+// without decoding the sessions, a torn frame is only dropped on reload at the
+// end of the last file of the log.
+func verifyDataFile(fileName string, last bool) ([]StoreProblem, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var problems []StoreProblem
+	fileSize := int64(len(data))
+	for offset := int64(0); offset < fileSize; {
+		frame, next, err := readDataFrame(bytes.NewReader(data), offset, fileSize)
+		if err == errTornFrame && !last {
+			problems = append(problems, StoreProblem{Problem: fmt.Sprintf("%s: frame at offset %d is torn", fileName, offset)})
+			break
+		}
+		if err == errTornFrame {
+			problems = append(problems, StoreProblem{
+				Problem: fmt.Sprintf("%s: frame at offset %d is truncated, %d bytes are dropped on reload", fileName, offset, fileSize-offset)})
+			break
+		}
+		if err != nil {
+			problems = append(problems, StoreProblem{Problem: fmt.Sprintf("%s: frame at offset %d: %v", fileName, offset, err)})
+			break
+		}
+		store := &TransactionWriteStore{LogOperation: LogOperation(frame[len(frame)-1])}
+		if _, err := store.getSessionInstanceByOperation(); err != nil {
+			problems = append(problems, StoreProblem{
+				Problem: fmt.Sprintf("%s: frame at offset %d has unknown operation %d", fileName, offset, store.LogOperation)})
+		}
+		offset = next
+	}
+	return problems, nil
+}
+
+func verifySessions(globalSessions []*session.GlobalSession) []StoreProblem {
+	var problems []StoreProblem
+	lockHolders := make(map[string]string)
+	for _, globalSession := range globalSessions {
+		switch globalSession.Status {
+		case meta.GlobalStatusCommitted, meta.GlobalStatusCommitFailed, meta.GlobalStatusRolledBack,
+			meta.GlobalStatusRollbackFailed, meta.GlobalStatusTimeoutRolledBack, meta.GlobalStatusTimeoutRollbackFailed,
+			meta.GlobalStatusFinished:
+			problems = append(problems, StoreProblem{XID: globalSession.XID,
+				Problem: fmt.Sprintf("global session is %s but was not removed", globalSession.Status.String())})
+		case meta.GlobalStatusBegin:
+			if globalSession.IsTimeout() {
+				problems = append(problems, StoreProblem{XID: globalSession.XID,
+					Problem: "global session timed out but is still in Begin"})
+			}
+		}
+
+		for _, branchSession := range globalSession.GetSortedBranches() {
+			if branchSession.XID != globalSession.XID {
+				problems = append(problems, StoreProblem{XID: globalSession.XID, BranchID: branchSession.BranchID,
+					Problem: fmt.Sprintf("branch session belongs to %s", branchSession.XID)})
+			}
+			for _, rowLock := range lock.CollectRowLocks(branchSession) {
+				rowKey := strings.Join([]string{rowLock.ResourceID, rowLock.TableName, rowLock.Pk}, lock.LOCK_SPLIT)
+				holder, ok := lockHolders[rowKey]
+				if ok && holder != globalSession.XID {
+					problems = append(problems, StoreProblem{XID: globalSession.XID, BranchID: branchSession.BranchID,
+						Problem: fmt.Sprintf("row %s:%s on %s is also locked by %s", rowLock.TableName, rowLock.Pk, rowLock.ResourceID, holder)})
+				}
+				lockHolders[rowKey] = globalSession.XID
+			}
+		}
+	}
+	return problems
+}
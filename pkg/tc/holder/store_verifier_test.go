@@ -0,0 +1,81 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package holder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+func TestVerifyStore_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starfish-verify")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	conf := config.StoreConfig{
+		StoreMode:       "file",
+		FileStoreConfig: config.FileStoreConfig{FileDir: filepath.Join(dir, "root.data")},
+	}
+
+	sessionManager := NewFileBasedSessionManager(conf.FileStoreConfig)
+	gs := globalSessionProvider(t)
+	gs.Begin()
+	sessionManager.AddGlobalSession(gs)
+	bs := session.NewBranchSessionByGlobal(gs, session.WithBsResourceID("tb_1"), session.WithBsLockKey("t_1:1,2"),
+		session.WithBsBranchType(meta.BranchTypeAT))
+	sessionManager.AddBranchSession(gs, bs)
+
+	problems, err := VerifyStore(conf)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(problems))
+
+	gs2 := globalSessionProvider(t)
+	gs2.Begin()
+	sessionManager.AddGlobalSession(gs2)
+	bs2 := session.NewBranchSessionByGlobal(gs2, session.WithBsResourceID("tb_1"), session.WithBsLockKey("t_1:2"),
+		session.WithBsBranchType(meta.BranchTypeAT))
+	sessionManager.AddBranchSession(gs2, bs2)
+	orphan := session.NewBranchSessionByGlobal(globalSessionProvider(t), session.WithBsResourceID("tb_1"))
+	sessionManager.AddBranchSession(gs2, orphan)
+
+	problems, err = VerifyStore(conf)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(problems))
+	assert.Contains(t, problems, StoreProblem{XID: orphan.XID, BranchID: orphan.BranchID, Problem: "branch session has no global session"})
+
+	file, err := os.OpenFile(segmentFileName(conf.FileStoreConfig.FileDir, 1), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	file.Write([]byte{0, 0, 1, 0, 1})
+	file.Close()
+
+	problems, err = VerifyStore(conf)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(problems))
+	assert.Contains(t, problems[0].Problem, "is truncated")
+}
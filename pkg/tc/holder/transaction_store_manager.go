@@ -73,7 +73,7 @@ func (t LogOperation) String() string {
 
 type Reloadable interface {
 	// Reload states.
-	Reload()
+	Reload() error
 }
 
 type TransactionStoreManager interface {
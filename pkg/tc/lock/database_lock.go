@@ -26,11 +26,15 @@ import (
 )
 
 import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
 	"github.com/transaction-mesh/starfish/pkg/tc/model"
 	"github.com/transaction-mesh/starfish/pkg/tc/session"
 	"github.com/transaction-mesh/starfish/pkg/util/log"
 )
 
+// DataBaseLocker keeps the row locks in a LockStore, the db one holds the
+// shared locks of several xids on a row, the embedded and redis ones keep a
+// single xid per row and refuse shared locks.
 type DataBaseLocker struct {
 	LockStore LockStore
 }
@@ -54,6 +58,13 @@ func (locker *DataBaseLocker) AcquireLock(branchSession *session.BranchSession)
 	return locker.LockStore.AcquireLock(convertToLockDO(locks))
 }
 
+func (locker *DataBaseLocker) SupportsLockMode(lockMode meta.LockMode) bool {
+	if checker, ok := locker.LockStore.(LockModeChecker); ok {
+		return checker.SupportsLockMode(lockMode)
+	}
+	return true
+}
+
 func (locker *DataBaseLocker) ReleaseLock(branchSession *session.BranchSession) bool {
 	if branchSession == nil {
 		log.Info("branchSession can't be null for memory/file locker.")
@@ -80,8 +91,11 @@ func (locker *DataBaseLocker) ReleaseGlobalSessionLock(globalSession *session.Gl
 	return locker.releaseLockByXidBranchIDs(globalSession.XID, branchIDs)
 }
 
-func (locker *DataBaseLocker) IsLockable(xid string, resourceID string, lockKey string) bool {
-	locks := collectRowLocksByLockKeyResourceIDAndXID(lockKey, resourceID, xid)
+func (locker *DataBaseLocker) IsLockable(xid string, resourceID string, lockKey string, lockMode meta.LockMode) bool {
+	locks := collectRowLocksByLockKeyResourceIDAndXID(lockKey, resourceID, xid, lockMode)
+	if len(locks) == 0 {
+		return true
+	}
 	return locker.LockStore.IsLockable(convertToLockDO(locks))
 }
 
@@ -93,6 +107,24 @@ func (locker *DataBaseLocker) GetLockKeyCount() int64 {
 	return locker.LockStore.GetLockCount()
 }
 
+func (locker *DataBaseLocker) ListRowLocks(xid string, resourceID string) []*RowLock {
+	lockDOs := locker.LockStore.QueryLockDOs(xid, resourceID)
+	locks := make([]*RowLock, 0, len(lockDOs))
+	for _, lockDO := range lockDOs {
+		locks = append(locks, &RowLock{
+			XID:           lockDO.Xid,
+			TransactionID: lockDO.TransactionID,
+			BranchID:      lockDO.BranchID,
+			ResourceID:    lockDO.ResourceID,
+			TableName:     lockDO.TableName,
+			Pk:            lockDO.Pk,
+			RowKey:        lockDO.RowKey,
+			LockMode:      lockDO.LockMode,
+		})
+	}
+	return locks
+}
+
 func convertToLockDO(locks []*RowLock) []*model.LockDO {
 	lockDOs := make([]*model.LockDO, 0)
 	if len(locks) == 0 {
@@ -107,6 +139,7 @@ func convertToLockDO(locks []*RowLock) []*model.LockDO {
 			TableName:     lock.TableName,
 			Pk:            lock.Pk,
 			RowKey:        getRowKey(lock.ResourceID, lock.TableName, lock.Pk),
+			LockMode:      lock.LockMode,
 		}
 		lockDOs = append(lockDOs, lockDO)
 	}
@@ -0,0 +1,198 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lock
+
+import (
+	"github.com/rcrowley/go-metrics"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+	"github.com/transaction-mesh/starfish/pkg/util/time"
+)
+
+// deadlockHistorySize is how many of the latest deadlocks are kept for the
+// admin api.
+const deadlockHistorySize = 100
+
+// LockDeadlocks counts the deadlocks of waiting registrations broken.
+var LockDeadlocks = metrics.NewCounter()
+
+// DeadlockDetector is implemented by the lock managers which detect the
+// deadlocks of the registrations waiting for row locks.
+type DeadlockDetector interface {
+	// Deadlocks returns the latest deadlocks detected, the last one last.
+	Deadlocks() []Deadlock
+}
+
+// Deadlock is a cycle of global transactions whose branch registrations wait
+// for the row locks of each other.
+type Deadlock struct {
+	// Time is when the cycle was found, in milliseconds.
+	Time int64
+	// Policy picked the victim.
+	Policy string
+	// Transactions are the global transactions of the cycle, each waits for
+	// the next one and the last one for the first.
+	Transactions []WaitingTransaction
+	// Victim is the xid of the transaction whose registration failed.
+	Victim string
+}
+
+// WaitingTransaction is a global transaction with a branch registration
+// waiting for row locks.
+type WaitingTransaction struct {
+	XID             string
+	TransactionID   int64
+	TransactionName string
+	BeginTime       int64
+	BranchCount     int
+	Priority        int
+	// BranchID is the branch registering, LockMode the mode it asks for and
+	// RowKeys the rows it waits for.
+	BranchID int64
+	LockMode meta.LockMode
+	RowKeys  []string
+}
+
+// detectDeadlock looks for a cycle of waiters through waiter and fails the
+// victim of the cycle found. waiter either just started to wait or its global
+// transaction was just granted rows others wait for. Every cycle is broken as
+// soon as its last edge is added, so only the cycles through the waiter the
+// new edges lead to need to be looked for.
+//
+// Only the rows granted by this lock manager are known, the cycles through the
+// rows locked by the other TC nodes sharing the store are left to the wait
+// timeout.
+func (manager *waitingLockManager) detectDeadlock(waiter *lockWaiter) {
+	cycle := manager.findCycle(waiter)
+	if cycle == nil {
+		return
+	}
+	victim := cycle[0]
+	for _, candidate := range cycle[1:] {
+		if preferVictim(manager.deadlockVictim, candidate.transaction, victim.transaction) {
+			victim = candidate
+		}
+	}
+	victim.victim = true
+	victim.notify()
+
+	deadlock := Deadlock{
+		Time:   int64(time.CurrentTimeMillis()),
+		Policy: manager.deadlockVictim,
+		Victim: victim.transaction.XID,
+	}
+	xids := make([]string, 0, len(cycle))
+	for _, cycleWaiter := range cycle {
+		deadlock.Transactions = append(deadlock.Transactions, cycleWaiter.transaction)
+		xids = append(xids, cycleWaiter.transaction.XID)
+	}
+	if len(manager.deadlocks) == deadlockHistorySize {
+		manager.deadlocks = append(manager.deadlocks[:0], manager.deadlocks[1:]...)
+	}
+	manager.deadlocks = append(manager.deadlocks, deadlock)
+	LockDeadlocks.Inc(1)
+	log.Warnf("Lock wait deadlock of %v, failing the registration of branch %d of %s",
+		xids, victim.transaction.BranchID, victim.transaction.XID)
+}
+
+// findCycle returns the waiters of a cycle from start back to it, or nil when
+// start is not in one.
+func (manager *waitingLockManager) findCycle(start *lockWaiter) []*lockWaiter {
+	visited := make(map[*lockWaiter]bool)
+	var path []*lockWaiter
+	var visit func(waiter *lockWaiter) bool
+	visit = func(waiter *lockWaiter) bool {
+		visited[waiter] = true
+		path = append(path, waiter)
+		for _, next := range manager.waitsFor(waiter) {
+			if next == start || (!visited[next] && visit(next)) {
+				return true
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if visit(start) {
+		return path
+	}
+	return nil
+}
+
+// waitsFor returns the waiters waiter waits for: the ones of the transactions
+// holding its rows in a conflicting mode and the ones queued ahead of it, which
+// get the rows first whatever their modes.
+// The victims already chosen and the waiters cancelled are about to give up
+// and left out.
+func (manager *waitingLockManager) waitsFor(waiter *lockWaiter) []*lockWaiter {
+	var waiters []*lockWaiter
+	seen := make(map[*lockWaiter]bool)
+	add := func(other *lockWaiter) {
+		if other != waiter && !other.victim && !other.cancelled && !seen[other] &&
+			other.transaction.TransactionID != waiter.transaction.TransactionID {
+			seen[other] = true
+			waiters = append(waiters, other)
+		}
+	}
+	for _, rowKey := range waiter.rowKeys {
+		for holder, held := range manager.holders[rowKey] {
+			if !waiter.transaction.LockMode.Compatible(held) {
+				for _, other := range manager.waiting[holder] {
+					add(other)
+				}
+			}
+		}
+		for _, queued := range manager.queues[rowKey].waiters {
+			if queued == waiter {
+				break
+			}
+			add(queued)
+		}
+	}
+	return waiters
+}
+
+// preferVictim reports whether a is a better victim than b under policy, the
+// ties are broken in favour of the youngest transaction.
+func preferVictim(policy string, a WaitingTransaction, b WaitingTransaction) bool {
+	switch policy {
+	case config.DeadlockVictimFewestBranches:
+		if a.BranchCount != b.BranchCount {
+			return a.BranchCount < b.BranchCount
+		}
+	case config.DeadlockVictimLowestPriority:
+		if a.Priority != b.Priority {
+			return a.Priority < b.Priority
+		}
+	}
+	if a.BeginTime != b.BeginTime {
+		return a.BeginTime > b.BeginTime
+	}
+	return a.TransactionID > b.TransactionID
+}
+
+func (manager *waitingLockManager) Deadlocks() []Deadlock {
+	manager.Lock()
+	defer manager.Unlock()
+	deadlocks := make([]Deadlock, len(manager.deadlocks))
+	copy(deadlocks, manager.deadlocks)
+	return deadlocks
+}
@@ -0,0 +1,154 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lock
+
+import (
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+	time2 "github.com/transaction-mesh/starfish/pkg/util/time"
+)
+
+func TestWaitingLockManager_Deadlock(t *testing.T) {
+	lockManager := NewWaitingLockManager(NewLockManager(config.StoreConfig{}), config.LockConfig{WaitTimeout: 5 * time.Second})
+	waiter := lockManager.(LockWaiter)
+	older := waitGlobalSessionProvider("older", int64(time2.CurrentTimeMillis()))
+	younger := waitGlobalSessionProvider("younger", older.BeginTime+1)
+	assert.Nil(t, waitAcquire(waiter, older, "t:1"))
+	assert.Nil(t, waitAcquire(waiter, younger, "t:2"))
+
+	// older waits for younger, younger closes the cycle and is the victim.
+	olderResult := make(chan error, 1)
+	go func() { olderResult <- waitAcquire(waiter, older, "t:2") }()
+	time.Sleep(50 * time.Millisecond)
+	deadlocks := LockDeadlocks.Count()
+	assert.Equal(t, ErrDeadlock, waitAcquire(waiter, younger, "t:1"))
+	assert.Equal(t, deadlocks+1, LockDeadlocks.Count())
+
+	detected := lockManager.(DeadlockDetector).Deadlocks()
+	assert.Equal(t, 1, len(detected))
+	assert.Equal(t, younger.XID, detected[0].Victim)
+	assert.Equal(t, config.DeadlockVictimYoungest, detected[0].Policy)
+	assert.Equal(t, 2, len(detected[0].Transactions))
+	assert.Equal(t, younger.XID, detected[0].Transactions[0].XID)
+	assert.Equal(t, []string{"tb_wait^^^t^^^1"}, detected[0].Transactions[0].RowKeys)
+
+	// the victim rolls back and the older one gets the row.
+	assert.True(t, lockManager.ReleaseGlobalSessionLock(younger))
+	assert.Nil(t, <-olderResult)
+}
+
+func TestWaitingLockManager_DeadlockVictimWaiting(t *testing.T) {
+	lockManager := NewWaitingLockManager(NewLockManager(config.StoreConfig{}), config.LockConfig{
+		WaitTimeout:    5 * time.Second,
+		DeadlockVictim: config.DeadlockVictimLowestPriority,
+		Priorities:     map[string]int{"important": 10},
+	})
+	waiter := lockManager.(LockWaiter)
+	unimportant := waitGlobalSessionProvider("unimportant", int64(time2.CurrentTimeMillis()))
+	important := waitGlobalSessionProvider("important", unimportant.BeginTime+1)
+	assert.Nil(t, waitAcquire(waiter, unimportant, "t:1"))
+	assert.Nil(t, waitAcquire(waiter, important, "t:2"))
+
+	// the waiting registration of the lower priority is failed instead of the
+	// one closing the cycle.
+	unimportantResult := make(chan error, 1)
+	go func() {
+		unimportantResult <- waitAcquire(waiter, unimportant, "t:2")
+	}()
+	time.Sleep(50 * time.Millisecond)
+	importantResult := make(chan error, 1)
+	go func() {
+		importantResult <- waitAcquire(waiter, important, "t:1")
+	}()
+	assert.Equal(t, ErrDeadlock, <-unimportantResult)
+	assert.True(t, lockManager.ReleaseGlobalSessionLock(unimportant))
+	assert.Nil(t, <-importantResult)
+	assert.Equal(t, unimportant.XID, lockManager.(DeadlockDetector).Deadlocks()[0].Victim)
+}
+
+func TestWaitingLockManager_DeadlockClosedOnGrant(t *testing.T) {
+	lockManager := NewWaitingLockManager(NewLockManager(config.StoreConfig{}), config.LockConfig{WaitTimeout: 5 * time.Second})
+	waiter := lockManager.(LockWaiter)
+	older := waitGlobalSessionProvider("older", int64(time2.CurrentTimeMillis()))
+	younger := waitGlobalSessionProvider("younger", older.BeginTime+1)
+	reader := waitGlobalSessionProvider("reader", older.BeginTime+2)
+	assert.Nil(t, waitAcquire(waiter, older, "t:1"))
+	assert.Nil(t, sharedWaitAcquire(waiter, reader, "t:2"))
+
+	// younger waits for older and older for the reader, no cycle yet.
+	youngerResult := make(chan error, 1)
+	go func() { youngerResult <- waitAcquire(waiter, younger, "t:1") }()
+	time.Sleep(50 * time.Millisecond)
+	olderResult := make(chan error, 1)
+	go func() { olderResult <- waitAcquire(waiter, older, "t:2") }()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, len(lockManager.(DeadlockDetector).Deadlocks()))
+
+	// younger shares the row older waits for, the grant closes the cycle.
+	assert.Nil(t, sharedWaitAcquire(waiter, younger, "t:2"))
+	select {
+	case err := <-youngerResult:
+		assert.Equal(t, ErrDeadlock, err)
+	case <-time.After(time.Second):
+		t.Fatal("the cycle closed by a grant was not detected")
+	}
+	detected := lockManager.(DeadlockDetector).Deadlocks()
+	assert.Equal(t, 1, len(detected))
+	assert.Equal(t, younger.XID, detected[0].Victim)
+
+	// the victim and the reader roll back, older gets the row.
+	assert.True(t, lockManager.ReleaseGlobalSessionLock(younger))
+	assert.True(t, lockManager.ReleaseGlobalSessionLock(reader))
+	assert.Nil(t, <-olderResult)
+}
+
+func TestPreferVictim(t *testing.T) {
+	small := WaitingTransaction{TransactionID: 1, BeginTime: 2, BranchCount: 1, Priority: 5}
+	large := WaitingTransaction{TransactionID: 2, BeginTime: 1, BranchCount: 3, Priority: 1}
+	assert.True(t, preferVictim(config.DeadlockVictimYoungest, small, large))
+	assert.True(t, preferVictim(config.DeadlockVictimFewestBranches, small, large))
+	assert.True(t, preferVictim(config.DeadlockVictimLowestPriority, large, small))
+	large.BranchCount = small.BranchCount
+	assert.True(t, preferVictim(config.DeadlockVictimFewestBranches, small, large))
+}
+
+// sharedWaitAcquire registers a branch of globalSession locking lockKey in
+// shared mode, it is added to globalSession once it got the locks.
+func sharedWaitAcquire(waiter LockWaiter, globalSession *session.GlobalSession, lockKey string) error {
+	branchSession := session.NewBranchSessionByGlobal(globalSession,
+		session.WithBsResourceID("tb_wait"),
+		session.WithBsLockKey(lockKey),
+		session.WithBsBranchType(meta.BranchTypeAT),
+		session.WithBsLockMode(meta.LockModeShared),
+	)
+	err := waiter.AcquireBranchLock(globalSession, branchSession)
+	if err == nil {
+		globalSession.Add(branchSession)
+	}
+	return err
+}
@@ -22,6 +22,7 @@ import (
 )
 
 import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
 	"github.com/transaction-mesh/starfish/pkg/tc/config"
 	"github.com/transaction-mesh/starfish/pkg/tc/session"
 )
@@ -41,8 +42,10 @@ type LockManager interface {
 	// ReleaseGlobalSessionLock Unlock boolean.
 	ReleaseGlobalSessionLock(globalSession *session.GlobalSession) bool
 
-	// IsLockable Is lockable boolean.
-	IsLockable(xid string, resourceID string, lockKey string) bool
+	// IsLockable reports whether xid could lock the rows of lockKey in
+	// lockMode, the locks of the branch sessions are acquired in their
+	// LockMode.
+	IsLockable(xid string, resourceID string, lockKey string, lockMode meta.LockMode) bool
 
 	// CleanAllLocks Clean all locks.
 	CleanAllLocks()
@@ -50,15 +53,49 @@ type LockManager interface {
 	GetLockKeyCount() int64
 }
 
+// LockModeChecker is implemented by the lock managers and lock stores that hold
+// the row locks of only some modes, the others hold every mode.
+type LockModeChecker interface {
+	// SupportsLockMode reports whether row locks of lockMode can be held.
+	SupportsLockMode(lockMode meta.LockMode) bool
+}
+
+// SupportsLockMode reports whether lockManager holds the row locks of lockMode.
+func SupportsLockMode(lockManager LockManager, lockMode meta.LockMode) bool {
+	if checker, ok := lockManager.(LockModeChecker); ok {
+		return checker.SupportsLockMode(lockMode)
+	}
+	return true
+}
+
+// RowLockLister is implemented by the lock managers that persist every row lock
+// with its owner, the others only know the locks through the branch lock keys.
+type RowLockLister interface {
+	// ListRowLocks returns the row locks held by xid on resourceID, an empty
+	// argument matches every value.
+	ListRowLocks(xid string, resourceID string) []*RowLock
+}
+
 func Init() {
-	if config.GetStoreConfig().StoreMode == "db" {
-		lockStore := &LockStoreDataBaseDao{engine: config.GetStoreConfig().DBStoreConfig.Engine}
-		lockManager = &DataBaseLocker{LockStore: lockStore}
-	} else {
-		lockManager = &MemoryLocker{
-			LockMap:      &sync.Map{},
-			BucketHolder: &sync.Map{},
-		}
+	lockManager = NewLockManager(config.GetStoreConfig())
+	if conf := config.GetLockConfig(); conf.WaitTimeout > 0 {
+		lockManager = NewWaitingLockManager(lockManager, conf)
+	}
+}
+
+func NewLockManager(conf config.StoreConfig) LockManager {
+	if conf.StoreMode == "db" {
+		return &DataBaseLocker{LockStore: NewLockStoreDataBaseDao(conf.DBStoreConfig.Engine, conf.DBStoreConfig.DriverName())}
+	}
+	if conf.StoreMode == "embedded" {
+		return &DataBaseLocker{LockStore: NewLockStoreEmbedded(conf.EmbeddedStoreConfig.DB)}
+	}
+	if conf.StoreMode == "redis" {
+		return &DataBaseLocker{LockStore: NewLockStoreRedis(conf.RedisStoreConfig.Client, conf.RedisStoreConfig.Prefix())}
+	}
+	return &MemoryLocker{
+		LockMap:      &sync.Map{},
+		BucketHolder: &sync.Map{},
 	}
 }
 
@@ -47,7 +47,7 @@ func TestLockManager_AcquireLock(t *testing.T) {
 func TestLockManager_IsLockable(t *testing.T) {
 	transID := uuid.NextID()
 	common.Init("127.0.0.1", 9876)
-	ok := GetLockManager().IsLockable(common.GenerateXID(transID), "tb_1", "tb_1:13")
+	ok := GetLockManager().IsLockable(common.GenerateXID(transID), "tb_1", "tb_1:13", meta.LockModeExclusive)
 	assert.Equal(t, ok, true)
 }
 
@@ -86,11 +86,11 @@ func TestLockManager_AcquireLock_DeadLock(t *testing.T) {
 func TestLockManager_IsLockable2(t *testing.T) {
 	bs := branchSessionProvider()
 	bs.LockKey = "t:4"
-	result1 := GetLockManager().IsLockable(bs.XID, bs.ResourceID, bs.LockKey)
+	result1 := GetLockManager().IsLockable(bs.XID, bs.ResourceID, bs.LockKey, meta.LockModeExclusive)
 	assert.True(t, result1)
 	GetLockManager().AcquireLock(bs)
 	bs.TransactionID = uuid.NextID()
-	result2 := GetLockManager().IsLockable(bs.XID, bs.ResourceID, bs.LockKey)
+	result2 := GetLockManager().IsLockable(bs.XID, bs.ResourceID, bs.LockKey, meta.LockModeExclusive)
 	assert.False(t, result2)
 }
 
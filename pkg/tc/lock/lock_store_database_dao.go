@@ -17,20 +17,47 @@
 
 package lock
 
+import (
+	"fmt"
+	"sort"
+)
+
 import (
 	"github.com/go-xorm/xorm"
 
+	"github.com/lib/pq"
+
 	"xorm.io/builder"
 )
 
 import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
 	"github.com/transaction-mesh/starfish/pkg/tc/model"
 	"github.com/transaction-mesh/starfish/pkg/util/log"
 )
 
 const (
-	BatchDeleteLockByBranchID = `delete from lock_table where xid = ? AND branch_id = ?`
-	GetLockDOCount            = "select count(1) as total from lock_table"
+	BatchDeleteLockByBranchID       = `delete from lock_table where xid = ? AND branch_id = ?`
+	BatchDeleteSharedLockByBranchID = `delete from lock_shared_table where xid = ? AND branch_id = ?`
+	GetLockDOCount                  = `select (select count(1) from lock_table) + (select count(1) from lock_shared_table) as total`
+	QueryOrphanLockDOs              = `select row_key, xid, transaction_id, branch_id, resource_id, table_name, pk from lock_table
+		where branch_id not in (select branch_id from branch_table)
+		union all select row_key, xid, transaction_id, branch_id, resource_id, table_name, pk from lock_shared_table
+		where branch_id not in (select branch_id from branch_table)`
+
+	// QueryLockDOsByRowKeysPostgres binds the row keys as a single array, the
+	// statement is the same however many locks a branch asks for.
+	QueryLockDOsByRowKeysPostgres = `select row_key, xid, transaction_id, branch_id, resource_id, table_name, pk, gmt_create, gmt_modified
+		from %s where row_key = any(?)`
+)
+
+// The exclusive locks are keyed by row_key in lock_table, so two xids never
+// both insert one. The shared locks are keyed by (row_key, xid) in
+// lock_shared_table, where several xids hold the same row.
+const (
+	lockTable       = "lock_table"
+	sharedLockTable = "lock_shared_table"
 )
 
 type LockStore interface {
@@ -42,10 +69,19 @@ type LockStore interface {
 	UnLockByXIDAndBranchIDs(xid string, branchIDs []int64) bool
 	IsLockable(lockDOs []*model.LockDO) bool
 	GetLockCount() int64
+	QueryLockDOs(xid string, resourceID string) []*model.LockDO
+	QueryOrphanLockDOs() []*model.LockDO
 }
 
 type LockStoreDataBaseDao struct {
 	engine *xorm.Engine
+	driver string
+}
+
+// NewLockStoreDataBaseDao returns a lock store writing the sql dialect of
+// driver, mysql or postgres.
+func NewLockStoreDataBaseDao(engine *xorm.Engine, driver string) *LockStoreDataBaseDao {
+	return &LockStoreDataBaseDao{engine: engine, driver: driver}
 }
 
 func (dao *LockStoreDataBaseDao) AcquireLockByLockDO(lockDO *model.LockDO) bool {
@@ -53,53 +89,103 @@ func (dao *LockStoreDataBaseDao) AcquireLockByLockDO(lockDO *model.LockDO) bool
 	return dao.AcquireLock(lockDOs)
 }
 
+// AcquireLock inserts the rows lockDOs misses into the table of their mode. A
+// concurrent exclusive acquire of the same row fails on the primary key of
+// lock_table, while a shared and an exclusive acquire only see each other once
+// written, so the rows are read again and the insert is undone on a conflict.
 func (dao *LockStoreDataBaseDao) AcquireLock(lockDOs []*model.LockDO) bool {
 	locks, rowKeys := distinctByKey(lockDOs)
-	var existedRowLocks []*model.LockDO
-	err := dao.engine.Table("lock_table").
-		Where(builder.In("row_key", rowKeys)).
-		Find(&existedRowLocks)
+	existedRowLocks, err := dao.queryLockDOsByRowKeys(rowKeys)
 	if err != nil {
 		log.Errorf(err.Error())
 	}
 	currentXID := locks[0].Xid
-	canLock := true
-	existedRowKeys := make([]string, 0)
-	unrepeatedLockDOs := make([]*model.LockDO, 0)
+	lockMode := locks[0].LockMode
+	heldRowLocks := make(map[string]meta.LockMode)
 	for _, rowLock := range existedRowLocks {
-		if rowLock.Xid != currentXID {
+		if rowLock.Xid == currentXID {
+			if held, ok := heldRowLocks[rowLock.RowKey]; !ok || !held.Covers(rowLock.LockMode) {
+				heldRowLocks[rowLock.RowKey] = rowLock.LockMode
+			}
+			continue
+		}
+		if !lockMode.Compatible(rowLock.LockMode) {
 			log.Infof("Global lock on [{%s}:{%s}] is holding by xid {%s} branchID {%d}", "lock_table", rowLock.Pk, rowLock.Xid,
 				rowLock.BranchID)
-			canLock = false
-			break
+			return false
 		}
-		existedRowKeys = append(existedRowKeys, rowLock.RowKey)
 	}
-	if !canLock {
-		return false
-	}
-	if len(existedRowKeys) > 0 {
-		for _, lock := range locks {
-			if !contains(existedRowKeys, lock.RowKey) {
-				unrepeatedLockDOs = append(unrepeatedLockDOs, lock)
-			}
+
+	unrepeatedLockDOs := make([]*model.LockDO, 0)
+	for _, lock := range locks {
+		if held, ok := heldRowLocks[lock.RowKey]; !ok || !held.Covers(lockMode) {
+			unrepeatedLockDOs = append(unrepeatedLockDOs, lock)
 		}
-	} else {
-		unrepeatedLockDOs = locks
 	}
-
 	if len(unrepeatedLockDOs) == 0 {
 		return true
 	}
 
-	_, err = dao.engine.Table("lock_table").Insert(unrepeatedLockDOs)
+	table := lockTableOf(lockMode)
+	_, err = dao.engine.Table(table).Insert(unrepeatedLockDOs)
 	if err != nil {
 		log.Errorf("Global locks batch acquire failed, %v, err: %v", unrepeatedLockDOs, err)
 		return false
 	}
+	if !dao.IsLockable(locks) {
+		log.Infof("Global locks of xid {%s} conflict with a concurrent acquire, roll them back", currentXID)
+		dao.deleteLockDOs(table, unrepeatedLockDOs)
+		return false
+	}
 	return true
 }
 
+func lockTableOf(lockMode meta.LockMode) string {
+	if lockMode == meta.LockModeShared {
+		return sharedLockTable
+	}
+	return lockTable
+}
+
+// queryLockDOsByRowKeys returns the locks of rowKeys of both modes.
+func (dao *LockStoreDataBaseDao) queryLockDOsByRowKeys(rowKeys []string) ([]*model.LockDO, error) {
+	lockDOs, err := dao.queryTableByRowKeys(lockTable, rowKeys)
+	if err != nil {
+		return nil, err
+	}
+	sharedLockDOs, err := dao.queryTableByRowKeys(sharedLockTable, rowKeys)
+	if err != nil {
+		return nil, err
+	}
+	return append(lockDOs, sharedLockDOs...), nil
+}
+
+// queryTableByRowKeys returns the locks of rowKeys held in table in one query.
+func (dao *LockStoreDataBaseDao) queryTableByRowKeys(table string, rowKeys []string) ([]*model.LockDO, error) {
+	var lockDOs []*model.LockDO
+	var err error
+	if dao.driver == config.DBDriverPostgres {
+		err = dao.engine.SQL(fmt.Sprintf(QueryLockDOsByRowKeysPostgres, table), pq.Array(rowKeys)).Find(&lockDOs)
+	} else {
+		err = dao.engine.Table(table).
+			Where(builder.In("row_key", rowKeys)).
+			Find(&lockDOs)
+	}
+	setLockMode(lockDOs, table)
+	return lockDOs, err
+}
+
+// setLockMode fills in the mode of lockDOs read from table, which the mode is
+// not stored in.
+func setLockMode(lockDOs []*model.LockDO, table string) {
+	if table != sharedLockTable {
+		return
+	}
+	for _, lockDO := range lockDOs {
+		lockDO.LockMode = meta.LockModeShared
+	}
+}
+
 func distinctByKey(lockDOs []*model.LockDO) ([]*model.LockDO, []string) {
 	result := make([]*model.LockDO, 0)
 	rowKeys := make([]string, 0)
@@ -115,15 +201,6 @@ func distinctByKey(lockDOs []*model.LockDO) ([]*model.LockDO, []string) {
 	return result, rowKeys
 }
 
-func contains(s []string, e string) bool {
-	for _, a := range s {
-		if a == e {
-			return true
-		}
-	}
-	return false
-}
-
 func (dao *LockStoreDataBaseDao) UnLockByLockDO(lockDO *model.LockDO) bool {
 	var lockDOs = []*model.LockDO{lockDO}
 	return dao.UnLock(lockDOs)
@@ -133,13 +210,18 @@ func (dao *LockStoreDataBaseDao) UnLock(lockDOs []*model.LockDO) bool {
 	if lockDOs != nil && len(lockDOs) == 0 {
 		return true
 	}
+	return dao.deleteLockDOs(lockTable, lockDOs) && dao.deleteLockDOs(sharedLockTable, lockDOs)
+}
+
+// deleteLockDOs deletes the rows of lockDOs the xid of lockDOs holds in table.
+func (dao *LockStoreDataBaseDao) deleteLockDOs(table string, lockDOs []*model.LockDO) bool {
 	rowKeys := make([]string, 0)
 	for _, lockDO := range lockDOs {
 		rowKeys = append(rowKeys, lockDO.RowKey)
 	}
 
 	var lock = model.LockDO{}
-	_, err := dao.engine.Table("lock_table").
+	_, err := dao.engine.Table(table).
 		Where(builder.In("row_key", rowKeys).And(builder.Eq{"xid": lockDOs[0].Xid})).
 		Delete(&lock)
 
@@ -151,43 +233,45 @@ func (dao *LockStoreDataBaseDao) UnLock(lockDOs []*model.LockDO) bool {
 }
 
 func (dao *LockStoreDataBaseDao) UnLockByXIDAndBranchID(xid string, branchID int64) bool {
-	_, err := dao.engine.Exec(BatchDeleteLockByBranchID, xid, branchID)
+	for _, statement := range []string{BatchDeleteLockByBranchID, BatchDeleteSharedLockByBranchID} {
+		_, err := dao.engine.Exec(statement, xid, branchID)
 
-	if err != nil {
-		log.Errorf(err.Error())
-		return false
+		if err != nil {
+			log.Errorf(err.Error())
+			return false
+		}
 	}
 	return true
 }
 
 func (dao *LockStoreDataBaseDao) UnLockByXIDAndBranchIDs(xid string, branchIDs []int64) bool {
-	var lock = model.LockDO{}
-	_, err := dao.engine.Table("lock_table").
-		Where(builder.In("branch_id", branchIDs).And(builder.Eq{"xid": xid})).
-		Delete(&lock)
+	for _, table := range []string{lockTable, sharedLockTable} {
+		var lock = model.LockDO{}
+		_, err := dao.engine.Table(table).
+			Where(builder.In("branch_id", branchIDs).And(builder.Eq{"xid": xid})).
+			Delete(&lock)
 
-	if err != nil {
-		log.Errorf(err.Error())
-		return false
+		if err != nil {
+			log.Errorf(err.Error())
+			return false
+		}
 	}
 	return true
 }
 
 func (dao *LockStoreDataBaseDao) IsLockable(lockDOs []*model.LockDO) bool {
-	var existedRowLocks []*model.LockDO
 	rowKeys := make([]string, 0)
 	for _, lockDO := range lockDOs {
 		rowKeys = append(rowKeys, lockDO.RowKey)
 	}
-	err := dao.engine.Table("lock_table").
-		Where(builder.In("row_key", rowKeys)).
-		Find(&existedRowLocks)
+	existedRowLocks, err := dao.queryLockDOsByRowKeys(rowKeys)
 	if err != nil {
 		log.Errorf(err.Error())
 	}
 	currentXID := lockDOs[0].Xid
+	lockMode := lockDOs[0].LockMode
 	for _, rowLock := range existedRowLocks {
-		if rowLock.Xid != currentXID {
+		if rowLock.Xid != currentXID && !lockMode.Compatible(rowLock.LockMode) {
 			return false
 		}
 	}
@@ -199,3 +283,45 @@ func (dao *LockStoreDataBaseDao) GetLockCount() int64 {
 	dao.engine.SQL(GetLockDOCount).Cols("total").Get(&total)
 	return total
 }
+
+// QueryLockDOs returns the locks held by xid on resourceID, an empty argument
+// matches every value.
+func (dao *LockStoreDataBaseDao) QueryLockDOs(xid string, resourceID string) []*model.LockDO {
+	var result []*model.LockDO
+	for _, table := range []string{lockTable, sharedLockTable} {
+		var lockDOs []*model.LockDO
+		session := dao.engine.Table(table)
+		if xid != "" {
+			session = session.Where("xid = ?", xid)
+		}
+		if resourceID != "" {
+			session = session.And("resource_id = ?", resourceID)
+		}
+		err := session.Find(&lockDOs)
+		if err != nil {
+			log.Errorf(err.Error())
+		}
+		setLockMode(lockDOs, table)
+		result = append(result, lockDOs...)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Xid != result[j].Xid {
+			return result[i].Xid < result[j].Xid
+		}
+		if result[i].BranchID != result[j].BranchID {
+			return result[i].BranchID < result[j].BranchID
+		}
+		return result[i].RowKey < result[j].RowKey
+	})
+	return result
+}
+
+// QueryOrphanLockDOs returns the locks whose branch session no longer exists.
+func (dao *LockStoreDataBaseDao) QueryOrphanLockDOs() []*model.LockDO {
+	var lockDOs []*model.LockDO
+	err := dao.engine.SQL(QueryOrphanLockDOs).Find(&lockDOs)
+	if err != nil {
+		log.Errorf(err.Error())
+	}
+	return lockDOs
+}
@@ -0,0 +1,141 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lock
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+import (
+	"github.com/go-xorm/xorm"
+
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+	"github.com/transaction-mesh/starfish/pkg/test"
+)
+
+// TestLockStoreDataBaseDao_SharedLocks runs the shared and exclusive acquires
+// on the lock_table and lock_shared_table of a MySQL container.
+func TestLockStoreDataBaseDao_SharedLocks(t *testing.T) {
+	mysql := &test.MysqlContainer{
+		Username: "root",
+		Password: "123456",
+		Database: "starfish",
+	}
+	ctx, container := test.SetupMysql(mysql)
+	defer test.CloseConnection(ctx, container)
+	engine, err := xorm.NewEngine(config.DBDriverMySQL, mysql.DataSourceName(ctx, container))
+	assert.Nil(t, err)
+	defer engine.Close()
+	store := NewLockStoreDataBaseDao(engine, config.DBDriverMySQL)
+
+	t.Run("shared then shared", func(t *testing.T) {
+		assert.True(t, store.AcquireLock([]*model.LockDO{daoLockDO("xid-1", 1, "1", meta.LockModeShared)}))
+		assert.True(t, store.AcquireLock([]*model.LockDO{daoLockDO("xid-2", 2, "1", meta.LockModeShared)}))
+		assert.Equal(t, 2, len(store.QueryLockDOs("", "tb_dao")))
+		assert.False(t, store.IsLockable([]*model.LockDO{daoLockDO("xid-3", 3, "1", meta.LockModeExclusive)}))
+
+		assert.True(t, store.UnLockByXIDAndBranchID("xid-1", 1))
+		assert.True(t, store.UnLockByXIDAndBranchID("xid-2", 2))
+		assert.Equal(t, int64(0), store.GetLockCount())
+	})
+
+	t.Run("shared then exclusive", func(t *testing.T) {
+		assert.True(t, store.AcquireLock([]*model.LockDO{daoLockDO("xid-1", 1, "2", meta.LockModeShared)}))
+		assert.False(t, store.AcquireLock([]*model.LockDO{daoLockDO("xid-2", 2, "2", meta.LockModeExclusive)}))
+		// the only holder of a shared row upgrades it.
+		assert.True(t, store.AcquireLock([]*model.LockDO{daoLockDO("xid-1", 3, "2", meta.LockModeExclusive)}))
+		assert.Equal(t, int64(2), store.GetLockCount())
+
+		assert.True(t, store.UnLockByXIDAndBranchIDs("xid-1", []int64{1, 3}))
+		assert.True(t, store.AcquireLock([]*model.LockDO{daoLockDO("xid-2", 2, "2", meta.LockModeExclusive)}))
+		assert.True(t, store.UnLockByXIDAndBranchID("xid-2", 2))
+	})
+
+	t.Run("exclusive then shared", func(t *testing.T) {
+		assert.True(t, store.AcquireLock([]*model.LockDO{daoLockDO("xid-1", 1, "3", meta.LockModeExclusive)}))
+		assert.False(t, store.AcquireLock([]*model.LockDO{daoLockDO("xid-2", 2, "3", meta.LockModeShared)}))
+		// an exclusive row covers a shared acquire of its holder.
+		assert.True(t, store.AcquireLock([]*model.LockDO{daoLockDO("xid-1", 3, "3", meta.LockModeShared)}))
+		assert.Equal(t, int64(1), store.GetLockCount())
+
+		assert.True(t, store.UnLock([]*model.LockDO{daoLockDO("xid-1", 1, "3", meta.LockModeExclusive)}))
+		assert.True(t, store.AcquireLock([]*model.LockDO{daoLockDO("xid-2", 2, "3", meta.LockModeShared)}))
+		assert.True(t, store.UnLockByXIDAndBranchID("xid-2", 2))
+	})
+
+	t.Run("concurrent acquires", func(t *testing.T) {
+		for round := 0; round < 20; round++ {
+			pk := fmt.Sprintf("concurrent-%d", round)
+			var (
+				wg        sync.WaitGroup
+				mu        sync.Mutex
+				shared    int
+				exclusive int
+			)
+			for i := 0; i < 8; i++ {
+				lockMode := meta.LockModeShared
+				if i%2 == 0 {
+					lockMode = meta.LockModeExclusive
+				}
+				wg.Add(1)
+				go func(xid string, lockMode meta.LockMode) {
+					defer wg.Done()
+					if store.AcquireLock([]*model.LockDO{daoLockDO(xid, 1, pk, lockMode)}) {
+						mu.Lock()
+						defer mu.Unlock()
+						if lockMode == meta.LockModeShared {
+							shared++
+						} else {
+							exclusive++
+						}
+					}
+				}(fmt.Sprintf("xid-%d-%d", round, i), lockMode)
+			}
+			wg.Wait()
+
+			// the row is held exclusively by one xid or shared by the readers,
+			// an acquire undone after the re-read leaves nothing behind.
+			lockDOs, err := store.queryLockDOsByRowKeys([]string{"tb_dao^^^t^^^" + pk})
+			assert.Nil(t, err)
+			assert.True(t, exclusive <= 1, pk)
+			if exclusive == 1 {
+				assert.Equal(t, 0, shared, pk)
+				assert.Equal(t, 1, len(lockDOs), pk)
+			} else {
+				assert.Equal(t, shared, len(lockDOs), pk)
+			}
+			for _, lockDO := range lockDOs {
+				assert.True(t, store.UnLockByLockDO(lockDO))
+			}
+		}
+		assert.Equal(t, int64(0), store.GetLockCount())
+	})
+}
+
+func daoLockDO(xid string, branchID int64, pk string, lockMode meta.LockMode) *model.LockDO {
+	return &model.LockDO{Xid: xid, BranchID: branchID, ResourceID: "tb_dao", TableName: "t", Pk: pk,
+		RowKey: "tb_dao^^^t^^^" + pk, LockMode: lockMode}
+}
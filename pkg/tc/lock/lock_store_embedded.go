@@ -0,0 +1,315 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lock
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/embedded"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+)
+
+// errLockConflict rolls back a batch of which a row is locked by another xid.
+var errLockConflict = errors.New("row is locked by another global transaction")
+
+// LockStoreEmbedded keeps the row locks in the embedded bbolt store, a batch of
+// locks is acquired or refused as a whole in one transaction. A row is held by
+// a single xid, shared locks are refused.
+type LockStoreEmbedded struct {
+	db *bolt.DB
+}
+
+func NewLockStoreEmbedded(db *bolt.DB) *LockStoreEmbedded {
+	return &LockStoreEmbedded{db: db}
+}
+
+func (store *LockStoreEmbedded) AcquireLockByLockDO(lockDO *model.LockDO) bool {
+	return store.AcquireLock([]*model.LockDO{lockDO})
+}
+
+func (store *LockStoreEmbedded) SupportsLockMode(lockMode meta.LockMode) bool {
+	return lockMode == meta.LockModeExclusive
+}
+
+func (store *LockStoreEmbedded) AcquireLock(lockDOs []*model.LockDO) bool {
+	locks, _ := distinctByKey(lockDOs)
+	if len(locks) > 0 && !store.SupportsLockMode(locks[0].LockMode) {
+		log.Errorf("Global locks of xid %s are refused, the embedded lock store does not support %s locks",
+			locks[0].Xid, locks[0].LockMode)
+		return false
+	}
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(embedded.LockBucket)
+		for _, lockDO := range locks {
+			existed, err := getLockDO(bucket, lockDO.RowKey)
+			if err != nil {
+				return err
+			}
+			if existed == nil {
+				continue
+			}
+			if existed.Xid != lockDO.Xid {
+				log.Infof("Global lock on [{%s}:{%s}] is holding by xid {%s} branchID {%d}", existed.TableName, existed.Pk,
+					existed.Xid, existed.BranchID)
+				return errLockConflict
+			}
+		}
+		for _, lockDO := range locks {
+			if bucket.Get([]byte(lockDO.RowKey)) != nil {
+				continue
+			}
+			if err := putLockDO(tx, lockDO); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if err != errLockConflict {
+			log.Errorf("Global locks batch acquire failed, %v, err: %v", locks, err)
+		}
+		return false
+	}
+	return true
+}
+
+func (store *LockStoreEmbedded) UnLockByLockDO(lockDO *model.LockDO) bool {
+	return store.UnLock([]*model.LockDO{lockDO})
+}
+
+func (store *LockStoreEmbedded) UnLock(lockDOs []*model.LockDO) bool {
+	if len(lockDOs) == 0 {
+		return true
+	}
+	return store.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(embedded.LockBucket)
+		for _, lockDO := range lockDOs {
+			existed, err := getLockDO(bucket, lockDO.RowKey)
+			if err != nil {
+				return err
+			}
+			if existed != nil && existed.Xid == lockDOs[0].Xid {
+				if err := deleteLockDO(tx, existed); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (store *LockStoreEmbedded) UnLockByXIDAndBranchID(xid string, branchID int64) bool {
+	return store.UnLockByXIDAndBranchIDs(xid, []int64{branchID})
+}
+
+func (store *LockStoreEmbedded) UnLockByXIDAndBranchIDs(xid string, branchIDs []int64) bool {
+	return store.update(func(tx *bolt.Tx) error {
+		for _, branchID := range branchIDs {
+			lockDOs, err := scanBranchLocks(tx, embedded.BranchKey(xid, branchID))
+			if err != nil {
+				return err
+			}
+			for _, lockDO := range lockDOs {
+				if err := deleteLockDO(tx, lockDO); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (store *LockStoreEmbedded) IsLockable(lockDOs []*model.LockDO) bool {
+	if len(lockDOs) > 0 && !store.SupportsLockMode(lockDOs[0].LockMode) {
+		return false
+	}
+	lockable := true
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(embedded.LockBucket)
+		for _, lockDO := range lockDOs {
+			existed, err := getLockDO(bucket, lockDO.RowKey)
+			if err != nil {
+				return err
+			}
+			if existed != nil && existed.Xid != lockDOs[0].Xid {
+				lockable = false
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf(err.Error())
+	}
+	return lockable
+}
+
+func (store *LockStoreEmbedded) GetLockCount() int64 {
+	var total int64
+	store.db.View(func(tx *bolt.Tx) error {
+		total = int64(tx.Bucket(embedded.LockBucket).Stats().KeyN)
+		return nil
+	})
+	return total
+}
+
+// QueryLockDOs returns the locks held by xid on resourceID, an empty argument
+// matches every value.
+func (store *LockStoreEmbedded) QueryLockDOs(xid string, resourceID string) []*model.LockDO {
+	lockDOs := store.queryLockDOs(func(tx *bolt.Tx) ([]*model.LockDO, error) {
+		if xid != "" {
+			return scanBranchLocks(tx, embedded.XIDPrefix(xid))
+		}
+		return scanLocks(tx)
+	})
+	result := make([]*model.LockDO, 0, len(lockDOs))
+	for _, lockDO := range lockDOs {
+		if resourceID == "" || lockDO.ResourceID == resourceID {
+			result = append(result, lockDO)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Xid != result[j].Xid {
+			return result[i].Xid < result[j].Xid
+		}
+		if result[i].BranchID != result[j].BranchID {
+			return result[i].BranchID < result[j].BranchID
+		}
+		return result[i].RowKey < result[j].RowKey
+	})
+	return result
+}
+
+// QueryOrphanLockDOs returns the locks whose branch session no longer exists.
+func (store *LockStoreEmbedded) QueryOrphanLockDOs() []*model.LockDO {
+	return store.queryLockDOs(func(tx *bolt.Tx) ([]*model.LockDO, error) {
+		lockDOs, err := scanLocks(tx)
+		if err != nil {
+			return nil, err
+		}
+		branches := tx.Bucket(embedded.BranchBucket)
+		orphans := make([]*model.LockDO, 0)
+		for _, lockDO := range lockDOs {
+			if branches.Get(embedded.BranchKey(lockDO.Xid, lockDO.BranchID)) == nil {
+				orphans = append(orphans, lockDO)
+			}
+		}
+		return orphans, nil
+	})
+}
+
+func (store *LockStoreEmbedded) update(fn func(tx *bolt.Tx) error) bool {
+	if err := store.db.Update(fn); err != nil {
+		log.Errorf(err.Error())
+		return false
+	}
+	return true
+}
+
+func (store *LockStoreEmbedded) queryLockDOs(fn func(tx *bolt.Tx) ([]*model.LockDO, error)) []*model.LockDO {
+	var lockDOs []*model.LockDO
+	err := store.db.View(func(tx *bolt.Tx) error {
+		var err error
+		lockDOs, err = fn(tx)
+		return err
+	})
+	if err != nil {
+		log.Errorf(err.Error())
+	}
+	return lockDOs
+}
+
+func getLockDO(bucket *bolt.Bucket, rowKey string) (*model.LockDO, error) {
+	data := bucket.Get([]byte(rowKey))
+	if data == nil {
+		return nil, nil
+	}
+	lockDO := &model.LockDO{}
+	if err := json.Unmarshal(data, lockDO); err != nil {
+		return nil, errors.Wrapf(err, "decode lock %s", rowKey)
+	}
+	return lockDO, nil
+}
+
+func putLockDO(tx *bolt.Tx, lockDO *model.LockDO) error {
+	data, err := json.Marshal(lockDO)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(embedded.LockBucket).Put([]byte(lockDO.RowKey), data); err != nil {
+		return err
+	}
+	branchLockKey := append(embedded.BranchKey(lockDO.Xid, lockDO.BranchID), lockDO.RowKey...)
+	return tx.Bucket(embedded.BranchLockBucket).Put(branchLockKey, nil)
+}
+
+func deleteLockDO(tx *bolt.Tx, lockDO *model.LockDO) error {
+	if err := tx.Bucket(embedded.LockBucket).Delete([]byte(lockDO.RowKey)); err != nil {
+		return err
+	}
+	branchLockKey := append(embedded.BranchKey(lockDO.Xid, lockDO.BranchID), lockDO.RowKey...)
+	return tx.Bucket(embedded.BranchLockBucket).Delete(branchLockKey)
+}
+
+// scanBranchLocks returns the locks indexed under prefix, the locks of a xid or
+// of one of its branches.
+func scanBranchLocks(tx *bolt.Tx, prefix []byte) ([]*model.LockDO, error) {
+	var rowKeys []string
+	cursor := tx.Bucket(embedded.BranchLockBucket).Cursor()
+	for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+		_, _, rowKey := embedded.ParseBranchKey(key)
+		rowKeys = append(rowKeys, string(rowKey))
+	}
+	bucket := tx.Bucket(embedded.LockBucket)
+	lockDOs := make([]*model.LockDO, 0, len(rowKeys))
+	for _, rowKey := range rowKeys {
+		lockDO, err := getLockDO(bucket, rowKey)
+		if err != nil {
+			return nil, err
+		}
+		if lockDO != nil {
+			lockDOs = append(lockDOs, lockDO)
+		}
+	}
+	return lockDOs, nil
+}
+
+func scanLocks(tx *bolt.Tx) ([]*model.LockDO, error) {
+	lockDOs := make([]*model.LockDO, 0)
+	err := tx.Bucket(embedded.LockBucket).ForEach(func(key, value []byte) error {
+		lockDO := &model.LockDO{}
+		if err := json.Unmarshal(value, lockDO); err != nil {
+			return errors.Wrapf(err, "decode lock %s", key)
+		}
+		lockDOs = append(lockDOs, lockDO)
+		return nil
+	})
+	return lockDOs, err
+}
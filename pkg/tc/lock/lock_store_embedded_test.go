@@ -0,0 +1,75 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/embedded"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+)
+
+func TestLockStoreEmbedded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedded")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	db, err := embedded.Open(filepath.Join(dir, "starfish.db"), time.Second, true)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	store := NewLockStoreEmbedded(db)
+	lockDO := func(xid string, branchID int64, pk string) *model.LockDO {
+		return &model.LockDO{Xid: xid, BranchID: branchID, ResourceID: "tb_1", TableName: "t", Pk: pk,
+			RowKey: "tb_1^^^t^^^" + pk}
+	}
+
+	assert.True(t, store.AcquireLock([]*model.LockDO{lockDO("xid-1", 1, "1"), lockDO("xid-1", 1, "2")}))
+	assert.True(t, store.AcquireLock([]*model.LockDO{lockDO("xid-1", 2, "2")}))
+	assert.False(t, store.AcquireLock([]*model.LockDO{lockDO("xid-2", 3, "3"), lockDO("xid-2", 3, "1")}))
+	assert.Equal(t, int64(2), store.GetLockCount())
+	assert.False(t, store.IsLockable([]*model.LockDO{lockDO("xid-2", 3, "2")}))
+	assert.True(t, store.IsLockable([]*model.LockDO{lockDO("xid-2", 3, "3")}))
+
+	lockDOs := store.QueryLockDOs("xid-1", "")
+	assert.Equal(t, 2, len(lockDOs))
+	assert.Equal(t, "tb_1^^^t^^^1", lockDOs[0].RowKey)
+	assert.Equal(t, 2, len(store.QueryOrphanLockDOs()))
+
+	assert.True(t, store.UnLockByXIDAndBranchID("xid-1", 1))
+	assert.Equal(t, int64(0), store.GetLockCount())
+	assert.True(t, store.AcquireLock([]*model.LockDO{lockDO("xid-2", 3, "3"), lockDO("xid-2", 3, "1")}))
+	assert.True(t, store.UnLock([]*model.LockDO{lockDO("xid-2", 3, "1")}))
+	assert.Equal(t, 1, len(store.QueryLockDOs("", "tb_1")))
+
+	shared := lockDO("xid-3", 4, "4")
+	shared.LockMode = meta.LockModeShared
+	assert.False(t, store.AcquireLock([]*model.LockDO{shared}))
+	assert.False(t, store.IsLockable([]*model.LockDO{shared}))
+	assert.Equal(t, 0, len(store.QueryLockDOs("xid-3", "")))
+}
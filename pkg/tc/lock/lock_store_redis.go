@@ -0,0 +1,308 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lock
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+import (
+	"github.com/go-redis/redis/v7"
+
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+	"github.com/transaction-mesh/starfish/pkg/tc/redisstore"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+)
+
+// acquireLockScript locks every row of a batch or none of them. It returns the
+// xid holding one of the rows, or an empty string once the rows are locked.
+//
+// KEYS: locked row keys, then the lock and the xid locks of every row
+// ARGV: created time, then xid, transaction id, branch id, resource id, table
+// name, pk and row key of every row
+var acquireLockScript = redis.NewScript(`
+local rows = (#KEYS - 1) / 2
+for i = 1, rows do
+	local holder = redis.call('HGET', KEYS[2 * i], 'xid')
+	if holder and holder ~= ARGV[2 + (i - 1) * 7] then
+		return holder
+	end
+end
+for i = 1, rows do
+	if redis.call('EXISTS', KEYS[2 * i]) == 0 then
+		local arg = 2 + (i - 1) * 7
+		redis.call('HMSET', KEYS[2 * i], 'xid', ARGV[arg], 'transaction_id', ARGV[arg + 1],
+			'branch_id', ARGV[arg + 2], 'resource_id', ARGV[arg + 3], 'table_name', ARGV[arg + 4],
+			'pk', ARGV[arg + 5], 'row_key', ARGV[arg + 6], 'gmt_create', ARGV[1])
+		redis.call('SADD', KEYS[1], ARGV[arg + 6])
+		redis.call('HSET', KEYS[2 * i + 1], ARGV[arg + 6], ARGV[arg + 2])
+	end
+end
+return ''
+`)
+
+// unlockScript releases the rows of a batch held by xid.
+//
+// KEYS: locked row keys, xid locks, then the lock of every row
+// ARGV: xid, then the row key of every row
+var unlockScript = redis.NewScript(`
+for i = 3, #KEYS do
+	if redis.call('HGET', KEYS[i], 'xid') == ARGV[1] then
+		redis.call('DEL', KEYS[i])
+		redis.call('SREM', KEYS[1], ARGV[i - 1])
+	end
+	redis.call('HDEL', KEYS[2], ARGV[i - 1])
+end
+return 1
+`)
+
+// LockStoreRedis keeps the row locks in redis, a batch of locks is acquired or
+// refused as a whole by a script so that the TC nodes sharing the redis never
+// lock a row twice. Shared locks are refused.
+type LockStoreRedis struct {
+	client *redis.Client
+	keys   redisstore.Keys
+}
+
+func NewLockStoreRedis(client *redis.Client, keyPrefix string) *LockStoreRedis {
+	return &LockStoreRedis{client: client, keys: redisstore.Keys{Prefix: keyPrefix}}
+}
+
+func (store *LockStoreRedis) AcquireLockByLockDO(lockDO *model.LockDO) bool {
+	return store.AcquireLock([]*model.LockDO{lockDO})
+}
+
+func (store *LockStoreRedis) SupportsLockMode(lockMode meta.LockMode) bool {
+	return lockMode == meta.LockModeExclusive
+}
+
+func (store *LockStoreRedis) AcquireLock(lockDOs []*model.LockDO) bool {
+	locks, _ := distinctByKey(lockDOs)
+	if len(locks) > 0 && !store.SupportsLockMode(locks[0].LockMode) {
+		log.Errorf("Global locks of xid %s are refused, the redis lock store does not support %s locks",
+			locks[0].Xid, locks[0].LockMode)
+		return false
+	}
+	keys := []string{store.keys.Locks()}
+	args := []interface{}{time.Now().UnixNano() / int64(time.Millisecond)}
+	for _, lockDO := range locks {
+		keys = append(keys, store.keys.Lock(lockDO.RowKey), store.keys.XIDLocks(lockDO.Xid))
+		args = append(args, lockDO.Xid, lockDO.TransactionID, lockDO.BranchID, lockDO.ResourceID,
+			lockDO.TableName, lockDO.Pk, lockDO.RowKey)
+	}
+	holder, err := acquireLockScript.Run(store.client, keys, args...).Text()
+	if err != nil {
+		log.Errorf("Global locks batch acquire failed, %v, err: %v", locks, err)
+		return false
+	}
+	if holder != "" {
+		log.Infof("Global lock on [{%s}] is holding by xid {%s}", locks[0].ResourceID, holder)
+		return false
+	}
+	return true
+}
+
+func (store *LockStoreRedis) UnLockByLockDO(lockDO *model.LockDO) bool {
+	return store.UnLock([]*model.LockDO{lockDO})
+}
+
+func (store *LockStoreRedis) UnLock(lockDOs []*model.LockDO) bool {
+	if len(lockDOs) == 0 {
+		return true
+	}
+	rowKeys := make([]string, 0, len(lockDOs))
+	for _, lockDO := range lockDOs {
+		rowKeys = append(rowKeys, lockDO.RowKey)
+	}
+	return store.unlock(lockDOs[0].Xid, rowKeys)
+}
+
+func (store *LockStoreRedis) UnLockByXIDAndBranchID(xid string, branchID int64) bool {
+	return store.UnLockByXIDAndBranchIDs(xid, []int64{branchID})
+}
+
+func (store *LockStoreRedis) UnLockByXIDAndBranchIDs(xid string, branchIDs []int64) bool {
+	xidLocks, err := store.client.HGetAll(store.keys.XIDLocks(xid)).Result()
+	if err != nil {
+		log.Errorf(err.Error())
+		return false
+	}
+	released := make(map[string]bool, len(branchIDs))
+	for _, branchID := range branchIDs {
+		released[strconv.FormatInt(branchID, 10)] = true
+	}
+	rowKeys := make([]string, 0)
+	for rowKey, branchID := range xidLocks {
+		if released[branchID] {
+			rowKeys = append(rowKeys, rowKey)
+		}
+	}
+	if len(rowKeys) == 0 {
+		return true
+	}
+	return store.unlock(xid, rowKeys)
+}
+
+func (store *LockStoreRedis) unlock(xid string, rowKeys []string) bool {
+	keys := []string{store.keys.Locks(), store.keys.XIDLocks(xid)}
+	args := []interface{}{xid}
+	for _, rowKey := range rowKeys {
+		keys = append(keys, store.keys.Lock(rowKey))
+		args = append(args, rowKey)
+	}
+	if err := unlockScript.Run(store.client, keys, args...).Err(); err != nil {
+		log.Errorf(err.Error())
+		return false
+	}
+	return true
+}
+
+func (store *LockStoreRedis) IsLockable(lockDOs []*model.LockDO) bool {
+	if len(lockDOs) > 0 && !store.SupportsLockMode(lockDOs[0].LockMode) {
+		return false
+	}
+	cmds := make([]*redis.StringCmd, 0, len(lockDOs))
+	_, err := store.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, lockDO := range lockDOs {
+			cmds = append(cmds, pipe.HGet(store.keys.Lock(lockDO.RowKey), "xid"))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		log.Errorf(err.Error())
+		return true
+	}
+	for _, cmd := range cmds {
+		if holder := cmd.Val(); holder != "" && holder != lockDOs[0].Xid {
+			return false
+		}
+	}
+	return true
+}
+
+func (store *LockStoreRedis) GetLockCount() int64 {
+	count, err := store.client.SCard(store.keys.Locks()).Result()
+	if err != nil {
+		log.Errorf(err.Error())
+	}
+	return count
+}
+
+// QueryLockDOs returns the locks held by xid on resourceID, an empty argument
+// matches every value.
+func (store *LockStoreRedis) QueryLockDOs(xid string, resourceID string) []*model.LockDO {
+	var rowKeys []string
+	var err error
+	if xid != "" {
+		rowKeys, err = store.client.HKeys(store.keys.XIDLocks(xid)).Result()
+	} else {
+		rowKeys, err = store.client.SMembers(store.keys.Locks()).Result()
+	}
+	if err != nil {
+		log.Errorf(err.Error())
+		return nil
+	}
+	lockDOs, err := store.readLockDOs(rowKeys)
+	if err != nil {
+		log.Errorf(err.Error())
+		return nil
+	}
+	result := make([]*model.LockDO, 0, len(lockDOs))
+	for _, lockDO := range lockDOs {
+		if (xid == "" || lockDO.Xid == xid) && (resourceID == "" || lockDO.ResourceID == resourceID) {
+			result = append(result, lockDO)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Xid != result[j].Xid {
+			return result[i].Xid < result[j].Xid
+		}
+		if result[i].BranchID != result[j].BranchID {
+			return result[i].BranchID < result[j].BranchID
+		}
+		return result[i].RowKey < result[j].RowKey
+	})
+	return result
+}
+
+// QueryOrphanLockDOs returns the locks whose branch session no longer exists.
+func (store *LockStoreRedis) QueryOrphanLockDOs() []*model.LockDO {
+	lockDOs := store.QueryLockDOs("", "")
+	cmds := make([]*redis.IntCmd, 0, len(lockDOs))
+	_, err := store.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, lockDO := range lockDOs {
+			cmds = append(cmds, pipe.Exists(store.keys.Branch(lockDO.Xid, lockDO.BranchID)))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf(err.Error())
+		return nil
+	}
+	orphans := make([]*model.LockDO, 0)
+	for i, cmd := range cmds {
+		if cmd.Val() == 0 {
+			orphans = append(orphans, lockDOs[i])
+		}
+	}
+	return orphans
+}
+
+func (store *LockStoreRedis) readLockDOs(rowKeys []string) ([]*model.LockDO, error) {
+	cmds := make([]*redis.StringStringMapCmd, 0, len(rowKeys))
+	_, err := store.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, rowKey := range rowKeys {
+			cmds = append(cmds, pipe.HGetAll(store.keys.Lock(rowKey)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	lockDOs := make([]*model.LockDO, 0, len(cmds))
+	for _, cmd := range cmds {
+		fields := cmd.Val()
+		if len(fields) == 0 {
+			continue
+		}
+		lockDO := &model.LockDO{
+			Xid:        fields["xid"],
+			ResourceID: fields["resource_id"],
+			TableName:  fields["table_name"],
+			Pk:         fields["pk"],
+			RowKey:     fields["row_key"],
+		}
+		if lockDO.TransactionID, err = strconv.ParseInt(fields["transaction_id"], 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "transaction_id of lock %s", lockDO.RowKey)
+		}
+		if lockDO.BranchID, err = strconv.ParseInt(fields["branch_id"], 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "branch_id of lock %s", lockDO.RowKey)
+		}
+		createdMillis, _ := strconv.ParseInt(fields["gmt_create"], 10, 64)
+		lockDO.GmtCreate = time.Unix(0, createdMillis*int64(time.Millisecond))
+		lockDOs = append(lockDOs, lockDO)
+	}
+	return lockDOs, nil
+}
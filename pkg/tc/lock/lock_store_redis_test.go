@@ -0,0 +1,112 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lock
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+import (
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/go-redis/redis/v7"
+
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+)
+
+func redisLockDO(xid string, branchID int64, pk string) *model.LockDO {
+	return &model.LockDO{Xid: xid, BranchID: branchID, ResourceID: "tb_1", TableName: "t", Pk: pk,
+		RowKey: "tb_1^^^t^^^" + pk}
+}
+
+func TestLockStoreRedis(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer server.Close()
+
+	store := NewLockStoreRedis(redis.NewClient(&redis.Options{Addr: server.Addr()}), "starfish:")
+	assert.True(t, store.AcquireLock([]*model.LockDO{redisLockDO("xid-1", 1, "1"), redisLockDO("xid-1", 1, "2")}))
+	assert.True(t, store.AcquireLock([]*model.LockDO{redisLockDO("xid-1", 2, "2")}))
+	assert.False(t, store.AcquireLock([]*model.LockDO{redisLockDO("xid-2", 3, "3"), redisLockDO("xid-2", 3, "1")}))
+	assert.Equal(t, int64(2), store.GetLockCount())
+	assert.False(t, store.IsLockable([]*model.LockDO{redisLockDO("xid-2", 3, "2")}))
+	assert.True(t, store.IsLockable([]*model.LockDO{redisLockDO("xid-2", 3, "3")}))
+
+	lockDOs := store.QueryLockDOs("xid-1", "")
+	assert.Equal(t, 2, len(lockDOs))
+	assert.Equal(t, "tb_1^^^t^^^1", lockDOs[0].RowKey)
+	assert.Equal(t, int64(1), lockDOs[1].BranchID)
+	assert.Equal(t, 2, len(store.QueryOrphanLockDOs()))
+
+	assert.True(t, store.UnLockByXIDAndBranchID("xid-1", 1))
+	assert.Equal(t, int64(0), store.GetLockCount())
+	assert.True(t, store.AcquireLock([]*model.LockDO{redisLockDO("xid-2", 3, "3"), redisLockDO("xid-2", 3, "1")}))
+	assert.True(t, store.UnLock([]*model.LockDO{redisLockDO("xid-2", 3, "1")}))
+	assert.Equal(t, 1, len(store.QueryLockDOs("", "tb_1")))
+
+	shared := redisLockDO("xid-3", 4, "4")
+	shared.LockMode = meta.LockModeShared
+	assert.False(t, store.AcquireLock([]*model.LockDO{shared}))
+	assert.False(t, store.IsLockable([]*model.LockDO{shared}))
+	assert.Equal(t, 0, len(store.QueryLockDOs("xid-3", "")))
+}
+
+// TestLockStoreRedis_AcquireLockAcrossNodes races batches of overlapping rows
+// from stores of different TC nodes, every batch is locked as a whole or not
+// at all.
+func TestLockStoreRedis_AcquireLockAcrossNodes(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	acquired := make([]bool, 8)
+	for i := range acquired {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store := NewLockStoreRedis(redis.NewClient(&redis.Options{Addr: server.Addr()}), "starfish:")
+			xid := fmt.Sprintf("xid-%d", i)
+			acquired[i] = store.AcquireLock([]*model.LockDO{redisLockDO(xid, 1, fmt.Sprint(i)),
+				redisLockDO(xid, 1, fmt.Sprint(i+1))})
+		}(i)
+	}
+	wg.Wait()
+
+	store := NewLockStoreRedis(redis.NewClient(&redis.Options{Addr: server.Addr()}), "starfish:")
+	var locked int64
+	for i, ok := range acquired {
+		xid := fmt.Sprintf("xid-%d", i)
+		lockDOs := store.QueryLockDOs(xid, "")
+		if ok {
+			assert.Equal(t, 2, len(lockDOs))
+			locked += 2
+		} else {
+			assert.Equal(t, 0, len(lockDOs))
+		}
+	}
+	assert.Equal(t, locked, store.GetLockCount())
+	assert.True(t, locked > 0)
+}
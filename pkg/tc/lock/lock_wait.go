@@ -0,0 +1,521 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lock
+
+import (
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+	time2 "github.com/transaction-mesh/starfish/pkg/util/time"
+)
+
+var (
+	// LockWaitTime samples the milliseconds the acquisitions spent in the lock
+	// wait queues, whether they got the locks or not.
+	LockWaitTime = metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+	// LockWaitGranted counts the waits which got the locks.
+	LockWaitGranted = metrics.NewCounter()
+	// LockWaitTimedOut counts the waits given up after the wait timeout.
+	LockWaitTimedOut = metrics.NewCounter()
+	// LockWaitCancelled counts the waits stopped as their global transaction
+	// timed out or left Begin.
+	LockWaitCancelled = metrics.NewCounter()
+)
+
+var (
+	// ErrLockConflict fails an acquisition which did not get the locks held
+	// by another global transaction in time.
+	ErrLockConflict = errors.New("row locks held by another global transaction")
+	// ErrDeadlock fails the acquisition of the global transaction chosen as the
+	// victim of a lock wait deadlock.
+	ErrDeadlock = errors.New("chosen as the victim of a lock wait deadlock")
+)
+
+// LockWaiter is implemented by the lock managers which queue an acquisition
+// conflicting with the locks of another global transaction instead of failing
+// it at once.
+type LockWaiter interface {
+	// AcquireBranchLock acquires the locks of branchSession registering into
+	// globalSession, waiting for the conflicting ones no longer than
+	// globalSession lives. It fails with ErrLockConflict when the wait is given
+	// up or cancelled and with ErrDeadlock when the registration is the victim
+	// of a deadlock. The caller must not hold the lock of globalSession.
+	AcquireBranchLock(globalSession *session.GlobalSession, branchSession *session.BranchSession) error
+
+	// CancelWait stops the waits of the registrations of the global transaction
+	// transactionID, which fail with ErrLockConflict. It is called when the
+	// global transaction leaves Begin and can not register branches any more.
+	CancelWait(transactionID int64)
+}
+
+// waitingLockManager queues the acquisitions of a LockManager conflicting with
+// the locks of another global transaction. Every row has a FIFO queue and a
+// waiter retries once it is the first of the queues of all its rows, when one
+// of them is released or every retry interval, so rows are granted in the order
+// the waiters came. A row released while waiters are queued is owed to them,
+// the acquisitions coming later queue behind instead of taking it.
+//
+// The manager also remembers which global transaction holds the rows it
+// granted, so that a waiter starting to wait or a grant can find the cycles of
+// transactions waiting for each other, see detectDeadlock.
+type waitingLockManager struct {
+	LockManager
+	waitTimeout    time.Duration
+	retryInterval  time.Duration
+	deadlockVictim string
+	priorities     map[string]int
+
+	sync.Mutex
+	queues map[string]*rowWaitQueue
+	// waiting are the waiters of every global transaction waiting, by
+	// transaction id.
+	waiting map[int64][]*lockWaiter
+	// holders are the modes the transactions hold each row granted in, by
+	// transaction id, and held the rows granted to each transaction.
+	holders   map[string]map[int64]meta.LockMode
+	held      map[int64]map[string]bool
+	deadlocks []Deadlock
+}
+
+// waitingRowLockLister keeps listing the row locks of a lock manager which
+// persists them.
+type waitingRowLockLister struct {
+	*waitingLockManager
+	RowLockLister
+}
+
+type rowWaitQueue struct {
+	waiters []*lockWaiter
+	// released is set when the row was released with waiters queued.
+	released bool
+}
+
+type lockWaiter struct {
+	transaction WaitingTransaction
+	// rowKeys are the rows queued for, the ones its global transaction
+	// already holds are not.
+	rowKeys []string
+	// wake holds a token when the waiter should retry.
+	wake chan struct{}
+	// victim is set when the waiter is chosen to break a deadlock.
+	victim bool
+	// cancelled is set when its global transaction left Begin.
+	cancelled bool
+}
+
+// NewWaitingLockManager queues the conflicting acquisitions of lockManager for
+// up to conf.WaitTimeout.
+func NewWaitingLockManager(lockManager LockManager, conf config.LockConfig) LockManager {
+	manager := &waitingLockManager{
+		LockManager:    lockManager,
+		waitTimeout:    conf.WaitTimeout,
+		retryInterval:  conf.WaitRetryInterval,
+		deadlockVictim: conf.DeadlockVictim,
+		priorities:     conf.Priorities,
+		queues:         make(map[string]*rowWaitQueue),
+		waiting:        make(map[int64][]*lockWaiter),
+		holders:        make(map[string]map[int64]meta.LockMode),
+		held:           make(map[int64]map[string]bool),
+	}
+	if manager.retryInterval <= 0 {
+		manager.retryInterval = config.DefaultLockWaitRetryInterval
+	}
+	if manager.deadlockVictim == "" {
+		manager.deadlockVictim = config.DeadlockVictimYoungest
+	}
+	if lister, ok := lockManager.(RowLockLister); ok {
+		return &waitingRowLockLister{waitingLockManager: manager, RowLockLister: lister}
+	}
+	return manager
+}
+
+func (manager *waitingLockManager) SupportsLockMode(lockMode meta.LockMode) bool {
+	return SupportsLockMode(manager.LockManager, lockMode)
+}
+
+func (manager *waitingLockManager) AcquireLock(branchSession *session.BranchSession) bool {
+	return manager.AcquireBranchLock(nil, branchSession) == nil
+}
+
+func (manager *waitingLockManager) AcquireBranchLock(globalSession *session.GlobalSession, branchSession *session.BranchSession) error {
+	rowKeys := collectRowKeys(branchSession)
+	if len(rowKeys) == 0 {
+		if !manager.LockManager.AcquireLock(branchSession) {
+			return ErrLockConflict
+		}
+		return nil
+	}
+	transaction := manager.waitingTransaction(globalSession, branchSession, rowKeys)
+	waiter := manager.enqueue(transaction, true)
+	if waiter == nil {
+		if manager.LockManager.AcquireLock(branchSession) {
+			manager.markHeld(branchSession.TransactionID, rowKeys, branchSession.LockMode)
+			return nil
+		}
+		waiter = manager.enqueue(transaction, false)
+	}
+
+	var deadline int64
+	if globalSession != nil {
+		deadline = globalSession.BeginTime + int64(globalSession.Timeout)
+	}
+	start := time.Now()
+	err := manager.wait(branchSession, waiter, deadline)
+	LockWaitTime.Update(time.Since(start).Milliseconds())
+	if err == nil {
+		manager.markHeld(branchSession.TransactionID, rowKeys, branchSession.LockMode)
+	}
+	return err
+}
+
+// waitingTransaction describes the global transaction of a registration which
+// may wait, globalSession is nil for the acquisitions outside of one.
+func (manager *waitingLockManager) waitingTransaction(globalSession *session.GlobalSession,
+	branchSession *session.BranchSession, rowKeys []string) WaitingTransaction {
+	transaction := WaitingTransaction{
+		XID:           branchSession.XID,
+		TransactionID: branchSession.TransactionID,
+		BranchID:      branchSession.BranchID,
+		LockMode:      branchSession.LockMode,
+		RowKeys:       rowKeys,
+	}
+	if globalSession != nil {
+		globalSession.Lock()
+		transaction.BranchCount = len(globalSession.BranchSessions)
+		globalSession.Unlock()
+		transaction.TransactionName = globalSession.TransactionName
+		transaction.BeginTime = globalSession.BeginTime
+		transaction.Priority = manager.priorities[globalSession.TransactionName]
+	}
+	return transaction
+}
+
+// wait retries the acquisition of waiter until it gets the locks, times out, is
+// cancelled or is chosen as the victim of a deadlock.
+func (manager *waitingLockManager) wait(branchSession *session.BranchSession, waiter *lockWaiter, deadline int64) error {
+	granted := false
+	defer func() {
+		manager.dequeue(waiter, granted)
+	}()
+
+	timeout, cancelled := manager.waitTimeout, false
+	if deadline > 0 {
+		if remaining := time.Duration(deadline-int64(time2.CurrentTimeMillis())) * time.Millisecond; remaining < timeout {
+			timeout, cancelled = remaining, true
+		}
+	}
+	if timeout <= 0 {
+		waitGivenUp(branchSession, timeout, cancelled)
+		return ErrLockConflict
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(manager.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-waiter.wake:
+		case <-ticker.C:
+		case <-timer.C:
+			waitGivenUp(branchSession, timeout, cancelled)
+			return ErrLockConflict
+		}
+		first, err := manager.turn(waiter)
+		if err == ErrLockConflict {
+			waitGivenUp(branchSession, timeout, true)
+		}
+		if err != nil {
+			return err
+		}
+		if first && manager.LockManager.AcquireLock(branchSession) {
+			granted = true
+			LockWaitGranted.Inc(1)
+			return nil
+		}
+	}
+}
+
+func waitGivenUp(branchSession *session.BranchSession, timeout time.Duration, cancelled bool) {
+	if cancelled {
+		LockWaitCancelled.Inc(1)
+		log.Infof("Global transaction %s timed out or ended waiting for the locks of branch %d", branchSession.XID, branchSession.BranchID)
+		return
+	}
+	LockWaitTimedOut.Inc(1)
+	log.Infof("Branch %d of %s waited %s for the locks in vain", branchSession.BranchID, branchSession.XID, timeout)
+}
+
+// enqueue appends a waiter of transaction to the queues of the rows it does
+// not hold in a mode covering the one asked for yet. With onlyIfOwed it only does when one of the rows is owed to the
+// waiters already queued, and returns nil otherwise. A waiter appended is
+// checked for deadlocks at once.
+func (manager *waitingLockManager) enqueue(transaction WaitingTransaction, onlyIfOwed bool) *lockWaiter {
+	manager.Lock()
+	defer manager.Unlock()
+	rowKeys := make([]string, 0, len(transaction.RowKeys))
+	for _, rowKey := range transaction.RowKeys {
+		if held, ok := manager.holders[rowKey][transaction.TransactionID]; !ok || !held.Covers(transaction.LockMode) {
+			rowKeys = append(rowKeys, rowKey)
+		}
+	}
+	if onlyIfOwed {
+		owed := false
+		for _, rowKey := range rowKeys {
+			if queue, ok := manager.queues[rowKey]; ok && queue.released {
+				owed = true
+				break
+			}
+		}
+		if !owed {
+			return nil
+		}
+	}
+
+	transaction.RowKeys = rowKeys
+	waiter := &lockWaiter{transaction: transaction, rowKeys: rowKeys, wake: make(chan struct{}, 1)}
+	waiter.wake <- struct{}{}
+	for _, rowKey := range rowKeys {
+		queue, ok := manager.queues[rowKey]
+		if !ok {
+			queue = &rowWaitQueue{}
+			manager.queues[rowKey] = queue
+		}
+		queue.waiters = append(queue.waiters, waiter)
+	}
+	manager.waiting[transaction.TransactionID] = append(manager.waiting[transaction.TransactionID], waiter)
+	manager.detectDeadlock(waiter)
+	return waiter
+}
+
+// dequeue removes waiter from its queues and wakes the waiters it was ahead
+// of. The rows waiter was granted are not owed to the queues any more.
+func (manager *waitingLockManager) dequeue(waiter *lockWaiter, granted bool) {
+	manager.Lock()
+	defer manager.Unlock()
+	transactionID := waiter.transaction.TransactionID
+	for i, waiting := range manager.waiting[transactionID] {
+		if waiting == waiter {
+			manager.waiting[transactionID] = append(manager.waiting[transactionID][:i], manager.waiting[transactionID][i+1:]...)
+			break
+		}
+	}
+	if len(manager.waiting[transactionID]) == 0 {
+		delete(manager.waiting, transactionID)
+	}
+	for _, rowKey := range waiter.rowKeys {
+		queue := manager.queues[rowKey]
+		for i, queued := range queue.waiters {
+			if queued == waiter {
+				queue.waiters = append(queue.waiters[:i], queue.waiters[i+1:]...)
+				break
+			}
+		}
+		if granted {
+			queue.released = false
+		}
+		if len(queue.waiters) == 0 {
+			delete(manager.queues, rowKey)
+			continue
+		}
+		queue.waiters[0].notify()
+	}
+}
+
+// turn reports whether waiter is the first of all its queues, the waiters are
+// appended to all their queues at once so the earliest one is. It fails with
+// ErrLockConflict when the wait was cancelled and with ErrDeadlock when waiter
+// was chosen as the victim of a deadlock.
+func (manager *waitingLockManager) turn(waiter *lockWaiter) (bool, error) {
+	manager.Lock()
+	defer manager.Unlock()
+	if waiter.cancelled {
+		return false, ErrLockConflict
+	}
+	if waiter.victim {
+		return false, ErrDeadlock
+	}
+	for _, rowKey := range waiter.rowKeys {
+		if manager.queues[rowKey].waiters[0] != waiter {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (manager *waitingLockManager) CancelWait(transactionID int64) {
+	manager.Lock()
+	defer manager.Unlock()
+	for _, waiter := range manager.waiting[transactionID] {
+		waiter.cancelled = true
+		waiter.notify()
+	}
+}
+
+// markHeld remembers the rows granted to the global transaction transactionID
+// in lockMode. The holders the grant conflicts with released the rows through
+// another TC node and are forgotten. The waiters queued for the rows now wait
+// for the ones of transactionID too, which may close a cycle.
+func (manager *waitingLockManager) markHeld(transactionID int64, rowKeys []string, lockMode meta.LockMode) {
+	manager.Lock()
+	defer manager.Unlock()
+	rows, ok := manager.held[transactionID]
+	if !ok {
+		rows = make(map[string]bool, len(rowKeys))
+		manager.held[transactionID] = rows
+	}
+	for _, rowKey := range rowKeys {
+		holders, ok := manager.holders[rowKey]
+		if !ok {
+			holders = make(map[int64]meta.LockMode, 1)
+			manager.holders[rowKey] = holders
+		}
+		for holder, held := range holders {
+			if holder != transactionID && !lockMode.Compatible(held) {
+				delete(holders, holder)
+				delete(manager.held[holder], rowKey)
+			}
+		}
+		if held, ok := holders[transactionID]; !ok || !held.Covers(lockMode) {
+			holders[transactionID] = lockMode
+		}
+		rows[rowKey] = true
+	}
+	for _, waiter := range manager.waiting[transactionID] {
+		if !waiter.victim && !waiter.cancelled {
+			manager.detectDeadlock(waiter)
+		}
+	}
+}
+
+// forgetHeld forgets rowKeys held by the global transaction transactionID, all
+// of its rows when rowKeys is nil.
+func (manager *waitingLockManager) forgetHeld(transactionID int64, rowKeys []string) {
+	manager.Lock()
+	defer manager.Unlock()
+	rows := manager.held[transactionID]
+	if rowKeys == nil {
+		for rowKey := range rows {
+			rowKeys = append(rowKeys, rowKey)
+		}
+	}
+	for _, rowKey := range rowKeys {
+		if holders, ok := manager.holders[rowKey]; ok {
+			delete(holders, transactionID)
+			if len(holders) == 0 {
+				delete(manager.holders, rowKey)
+			}
+		}
+		delete(rows, rowKey)
+	}
+	if len(rows) == 0 {
+		delete(manager.held, transactionID)
+	}
+}
+
+func (manager *waitingLockManager) ReleaseLock(branchSession *session.BranchSession) bool {
+	rowKeys := collectRowKeys(branchSession)
+	manager.markReleased(rowKeys)
+	manager.forgetHeld(branchSession.TransactionID, rowKeys)
+	released := manager.LockManager.ReleaseLock(branchSession)
+	manager.wakeFirst(rowKeys)
+	return released
+}
+
+func (manager *waitingLockManager) ReleaseGlobalSessionLock(globalSession *session.GlobalSession) bool {
+	var rowKeys []string
+	for _, branchSession := range globalSession.GetSortedBranches() {
+		rowKeys = append(rowKeys, collectRowKeys(branchSession)...)
+	}
+	manager.markReleased(rowKeys)
+	manager.forgetHeld(globalSession.TransactionID, nil)
+	released := manager.LockManager.ReleaseGlobalSessionLock(globalSession)
+	manager.wakeFirst(rowKeys)
+	return released
+}
+
+func (manager *waitingLockManager) CleanAllLocks() {
+	manager.Lock()
+	rowKeys := make([]string, 0, len(manager.queues))
+	for rowKey, queue := range manager.queues {
+		queue.released = true
+		rowKeys = append(rowKeys, rowKey)
+	}
+	manager.holders = make(map[string]map[int64]meta.LockMode)
+	manager.held = make(map[int64]map[string]bool)
+	manager.Unlock()
+	manager.LockManager.CleanAllLocks()
+	manager.wakeFirst(rowKeys)
+}
+
+// markReleased owes the rows about to be released to their waiters, it is
+// called before the release so that no later acquisition takes them first.
+func (manager *waitingLockManager) markReleased(rowKeys []string) {
+	manager.Lock()
+	defer manager.Unlock()
+	for _, rowKey := range rowKeys {
+		if queue, ok := manager.queues[rowKey]; ok {
+			queue.released = true
+		}
+	}
+}
+
+// wakeFirst wakes the first waiters of the rows released.
+func (manager *waitingLockManager) wakeFirst(rowKeys []string) {
+	manager.Lock()
+	defer manager.Unlock()
+	for _, rowKey := range rowKeys {
+		if queue, ok := manager.queues[rowKey]; ok {
+			queue.waiters[0].notify()
+		}
+	}
+}
+
+func (waiter *lockWaiter) notify() {
+	select {
+	case waiter.wake <- struct{}{}:
+	default:
+	}
+}
+
+// collectRowKeys returns the distinct row keys locked by branchSession.
+func collectRowKeys(branchSession *session.BranchSession) []string {
+	rowLocks := collectRowLocksByBranchSession(branchSession)
+	rowKeys := make([]string, 0, len(rowLocks))
+	seen := make(map[string]bool, len(rowLocks))
+	for _, rowLock := range rowLocks {
+		rowKey := getRowKey(rowLock.ResourceID, rowLock.TableName, rowLock.Pk)
+		if !seen[rowKey] {
+			seen[rowKey] = true
+			rowKeys = append(rowKeys, rowKey)
+		}
+	}
+	return rowKeys
+}
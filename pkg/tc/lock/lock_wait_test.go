@@ -0,0 +1,175 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lock
+
+import (
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/common"
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+	time2 "github.com/transaction-mesh/starfish/pkg/util/time"
+	"github.com/transaction-mesh/starfish/pkg/util/uuid"
+)
+
+func TestWaitingLockManager_GrantOnRelease(t *testing.T) {
+	lockManager := NewWaitingLockManager(NewLockManager(config.StoreConfig{}), config.LockConfig{WaitTimeout: 5 * time.Second})
+	holder := waitBranchSessionProvider("t:1,2")
+	assert.True(t, lockManager.AcquireLock(holder))
+
+	// the waiters queue in the order they came and are granted in that order.
+	first, second := waitBranchSessionProvider("t:2"), waitBranchSessionProvider("t:2,3")
+	firstResult, secondResult := make(chan bool, 1), make(chan bool, 1)
+	go func() { firstResult <- lockManager.AcquireLock(first) }()
+	time.Sleep(50 * time.Millisecond)
+	go func() { secondResult <- lockManager.AcquireLock(second) }()
+	time.Sleep(50 * time.Millisecond)
+
+	granted := LockWaitGranted.Count()
+	assert.True(t, lockManager.ReleaseLock(holder))
+	assert.True(t, <-firstResult)
+	select {
+	case <-secondResult:
+		t.Fatal("the second waiter got a row held by the first one")
+	case <-time.After(150 * time.Millisecond):
+	}
+	// a row locked later by another transaction is not granted before it.
+	assert.True(t, lockManager.ReleaseLock(first))
+	assert.True(t, <-secondResult)
+	assert.Equal(t, granted+2, LockWaitGranted.Count())
+}
+
+func TestWaitingLockManager_Timeout(t *testing.T) {
+	lockManager := NewWaitingLockManager(NewLockManager(config.StoreConfig{}),
+		config.LockConfig{WaitTimeout: 100 * time.Millisecond, WaitRetryInterval: 10 * time.Millisecond})
+	holder := waitBranchSessionProvider("t:1")
+	assert.True(t, lockManager.AcquireLock(holder))
+
+	timedOut := LockWaitTimedOut.Count()
+	assert.False(t, lockManager.AcquireLock(waitBranchSessionProvider("t:1")))
+	assert.Equal(t, timedOut+1, LockWaitTimedOut.Count())
+
+	// the global transaction of the waiter times out before the wait does.
+	cancelled := LockWaitCancelled.Count()
+	waiter := lockManager.(LockWaiter)
+	globalSession := waitGlobalSessionProvider("short", int64(time2.CurrentTimeMillis()))
+	globalSession.Timeout = 20
+	start := time.Now()
+	assert.Equal(t, ErrLockConflict, waitAcquire(waiter, globalSession, "t:1"))
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+	assert.Equal(t, cancelled+1, LockWaitCancelled.Count())
+
+	// the waits left no queue behind.
+	assert.Equal(t, 0, len(lockManager.(*waitingLockManager).queues))
+}
+
+func TestWaitingLockManager_CancelWait(t *testing.T) {
+	lockManager := NewWaitingLockManager(NewLockManager(config.StoreConfig{}), config.LockConfig{WaitTimeout: 5 * time.Second})
+	waiter := lockManager.(LockWaiter)
+	holder := waitGlobalSessionProvider("holder", int64(time2.CurrentTimeMillis()))
+	assert.Nil(t, waitAcquire(waiter, holder, "t:1"))
+
+	// the global transaction of the waiter is rolled back while it waits.
+	globalSession := waitGlobalSessionProvider("cancelled", int64(time2.CurrentTimeMillis()))
+	result := make(chan error, 1)
+	go func() { result <- waitAcquire(waiter, globalSession, "t:1") }()
+	time.Sleep(50 * time.Millisecond)
+	cancelled := LockWaitCancelled.Count()
+	start := time.Now()
+	waiter.CancelWait(globalSession.TransactionID)
+	assert.Equal(t, ErrLockConflict, <-result)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, cancelled+1, LockWaitCancelled.Count())
+	assert.Equal(t, 0, len(lockManager.(*waitingLockManager).queues))
+	assert.Equal(t, 0, len(lockManager.(*waitingLockManager).waiting))
+}
+
+func TestWaitingLockManager_Shared(t *testing.T) {
+	lockManager := NewWaitingLockManager(NewLockManager(config.StoreConfig{}), config.LockConfig{WaitTimeout: 5 * time.Second})
+	reader, otherReader := sharedBranchSessionProvider("t:1"), sharedBranchSessionProvider("t:1")
+	assert.True(t, lockManager.AcquireLock(reader))
+	start := time.Now()
+	assert.True(t, lockManager.AcquireLock(otherReader))
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+
+	// the writer waits for both readers.
+	writerResult := make(chan bool, 1)
+	go func() { writerResult <- lockManager.AcquireLock(waitBranchSessionProvider("t:1")) }()
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, lockManager.ReleaseLock(reader))
+	select {
+	case <-writerResult:
+		t.Fatal("the writer got a row still shared by a reader")
+	case <-time.After(150 * time.Millisecond):
+	}
+	assert.True(t, lockManager.ReleaseLock(otherReader))
+	assert.True(t, <-writerResult)
+}
+
+func waitBranchSessionProvider(lockKey string) *session.BranchSession {
+	common.Init("127.0.0.1", 9876)
+
+	transID := uuid.NextID()
+	return session.NewBranchSession(
+		session.WithBsXid(common.GenerateXID(transID)),
+		session.WithBsTransactionID(transID),
+		session.WithBsBranchID(1),
+		session.WithBsResourceID("tb_wait"),
+		session.WithBsLockKey(lockKey),
+		session.WithBsBranchType(meta.BranchTypeAT),
+	)
+}
+
+func waitGlobalSessionProvider(transactionName string, beginTime int64) *session.GlobalSession {
+	common.Init("127.0.0.1", 9876)
+
+	return session.NewGlobalSession(
+		session.WithGsTransactionName(transactionName),
+		session.WithGsBeginTime(beginTime),
+		session.WithGsTimeout(60000),
+	)
+}
+
+// waitAcquire registers a branch of globalSession locking lockKey, it is added
+// to globalSession once it got the locks.
+func waitAcquire(waiter LockWaiter, globalSession *session.GlobalSession, lockKey string) error {
+	branchSession := session.NewBranchSessionByGlobal(globalSession,
+		session.WithBsResourceID("tb_wait"),
+		session.WithBsLockKey(lockKey),
+		session.WithBsBranchType(meta.BranchTypeAT),
+	)
+	err := waiter.AcquireBranchLock(globalSession, branchSession)
+	if err == nil {
+		globalSession.Add(branchSession)
+	}
+	return err
+}
+
+func sharedBranchSessionProvider(lockKey string) *session.BranchSession {
+	branchSession := waitBranchSessionProvider(lockKey)
+	branchSession.LockMode = meta.LockModeShared
+	return branchSession
+}
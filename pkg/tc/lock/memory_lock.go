@@ -28,6 +28,7 @@ import (
 )
 
 import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
 	"github.com/transaction-mesh/starfish/pkg/base/model"
 	"github.com/transaction-mesh/starfish/pkg/tc/session"
 	"github.com/transaction-mesh/starfish/pkg/util/hashcode"
@@ -85,9 +86,9 @@ func (ml *MemoryLocker) ReleaseGlobalSessionLock(globalSession *session.GlobalSe
 	return releaseLockResult
 }
 
-func (ml *MemoryLocker) IsLockable(xid string, resourceID string, lockKey string) bool {
-	locks := collectRowLocksByLockKeyResourceIDAndXID(lockKey, resourceID, xid)
-	return ml.isLockableByRowLocks(locks)
+func (ml *MemoryLocker) IsLockable(xid string, resourceID string, lockKey string, lockMode meta.LockMode) bool {
+	locks := collectRowLocksByLockKeyResourceIDAndXID(lockKey, resourceID, xid, lockMode)
+	return ml.isLockableByRowLocks(locks, lockMode)
 }
 
 func (ml *MemoryLocker) CleanAllLocks() {
@@ -111,6 +112,10 @@ func (ml *MemoryLocker) acquireLockByRowLocks(branchSession *session.BranchSessi
 
 	dbLockMap, _ := ml.LockMap.LoadOrStore(resourceID, &sync.Map{})
 
+	// undos unlock the rows locked by this call on a conflict, the rows locked
+	// before by the transaction are kept.
+	var undos []func()
+
 	cDbLockMap := dbLockMap.(*sync.Map)
 	for _, rowLock := range rowLocks {
 		tableLockMap, _ := cDbLockMap.LoadOrStore(rowLock.TableName, &sync.Map{})
@@ -123,28 +128,131 @@ func (ml *MemoryLocker) acquireLockByRowLocks(branchSession *session.BranchSessi
 
 		cBucketLockMap := bucketLockMap.(*sync.Map)
 
-		previousLockTransactionID, loaded := cBucketLockMap.LoadOrStore(rowLock.Pk, transactionID)
-		if !loaded {
+		undo, holder, ok := ml.lockRow(cBucketLockMap, rowLock.Pk, transactionID, branchSession.LockMode)
+		if !ok {
+			log.Infof("Global rowLock on [%s:%s] is holding by %v", rowLock.TableName, rowLock.Pk, holder)
+			for i := len(undos) - 1; i >= 0; i-- {
+				undos[i]()
+			}
+			return false
+		}
+		if undo != nil {
+			undos = append(undos, undo)
+		}
+	}
 
-			//No existing rowLock, and now locked by myself
-			keysInHolder, _ := ml.BucketHolder.LoadOrStore(cBucketLockMap, model.NewSet())
+	return true
+}
 
-			sKeysInHolder := keysInHolder.(*model.Set)
-			sKeysInHolder.Add(rowLock.Pk)
+// sharedRowLock is the value of a row locked in shared mode, a row locked
+// exclusively holds the transaction id itself.
+type sharedRowLock struct {
+	sync.Mutex
+	transactionIDs map[int64]bool
+	// removed is set once the value left the bucket, when the last holder
+	// released the row or its holder upgraded it to an exclusive lock.
+	removed bool
+}
 
+// lockRow locks pk of bucketLockMap for transactionID in lockMode. On a
+// conflict it returns false and the holder of the row, otherwise the function
+// undoing the lock unless the transaction held the row in that mode before.
+func (ml *MemoryLocker) lockRow(bucketLockMap *sync.Map, pk string, transactionID int64,
+	lockMode meta.LockMode) (undo func(), holder interface{}, ok bool) {
+	for {
+		var value interface{} = transactionID
+		if lockMode == meta.LockModeShared {
+			value = &sharedRowLock{transactionIDs: map[int64]bool{transactionID: true}}
+		}
+		previous, loaded := bucketLockMap.LoadOrStore(pk, value)
+		if !loaded {
+			//No existing rowLock, and now locked by myself
+			keysInHolder, _ := ml.BucketHolder.LoadOrStore(bucketLockMap, model.NewSet())
+			keysInHolder.(*model.Set).Add(pk)
 			atomic.AddInt64(&ml.LockKeyCount, 1)
-		} else if previousLockTransactionID == transactionID {
+			return func() { ml.unlockRow(bucketLockMap, pk, transactionID) }, nil, true
+		}
+		if previous == transactionID {
 			// Locked by me before
+			return nil, nil, true
+		}
+		shared, isShared := previous.(*sharedRowLock)
+		if !isShared {
+			return nil, previous, false
+		}
+
+		shared.Lock()
+		if shared.removed {
+			shared.Unlock()
+			continue
+		}
+		defer shared.Unlock()
+		if lockMode == meta.LockModeShared {
+			if shared.transactionIDs[transactionID] {
+				return nil, nil, true
+			}
+			shared.transactionIDs[transactionID] = true
+			atomic.AddInt64(&ml.LockKeyCount, 1)
+			return func() { ml.unlockRow(bucketLockMap, pk, transactionID) }, nil, true
+		}
+		// an exclusive lock is granted to the only holder of a shared row.
+		for holderID := range shared.transactionIDs {
+			if holderID != transactionID {
+				return nil, holderID, false
+			}
+		}
+		shared.removed = true
+		bucketLockMap.Store(pk, transactionID)
+		return func() {
+			bucketLockMap.Store(pk, &sharedRowLock{transactionIDs: map[int64]bool{transactionID: true}})
+		}, nil, true
+	}
+}
+
+// unlockRow releases pk of bucketLockMap if transactionID holds it, a shared
+// row is removed with its last holder.
+func (ml *MemoryLocker) unlockRow(bucketLockMap *sync.Map, pk string, transactionID int64) bool {
+	for {
+		value, ok := bucketLockMap.Load(pk)
+		if !ok {
+			return false
+		}
+		if value == transactionID {
+			bucketLockMap.Delete(pk)
+			ml.removeHolderKey(bucketLockMap, pk)
+			atomic.AddInt64(&ml.LockKeyCount, -1)
+			return true
+		}
+		shared, ok := value.(*sharedRowLock)
+		if !ok {
+			return false
+		}
+
+		shared.Lock()
+		if shared.removed {
+			shared.Unlock()
 			continue
-		} else {
-			log.Infof("Global rowLock on [%s:%s] is holding by %d", rowLock.TableName, rowLock.Pk, previousLockTransactionID)
-			// branchSession unlock
-			ml.ReleaseLock(branchSession)
+		}
+		if !shared.transactionIDs[transactionID] {
+			shared.Unlock()
 			return false
 		}
+		delete(shared.transactionIDs, transactionID)
+		atomic.AddInt64(&ml.LockKeyCount, -1)
+		if len(shared.transactionIDs) == 0 {
+			shared.removed = true
+			bucketLockMap.Delete(pk)
+			ml.removeHolderKey(bucketLockMap, pk)
+		}
+		shared.Unlock()
+		return true
 	}
+}
 
-	return true
+func (ml *MemoryLocker) removeHolderKey(bucketLockMap *sync.Map, pk string) {
+	if keysInHolder, ok := ml.BucketHolder.Load(bucketLockMap); ok {
+		keysInHolder.(*model.Set).Remove(pk)
+	}
 }
 
 func (ml *MemoryLocker) releaseLockByRowLocks(branchSession *session.BranchSession, rowLocks []*RowLock) bool {
@@ -156,14 +264,9 @@ func (ml *MemoryLocker) releaseLockByRowLocks(branchSession *session.BranchSessi
 		cBucketLockMap := key.(*sync.Map)
 		keys := value.(*model.Set)
 
+		// keys.List() 是一个新的 slice，移除 key 并不会导致错误发生
 		for _, key := range keys.List() {
-			transID, ok := cBucketLockMap.Load(key)
-			if ok && transID == branchSession.TransactionID {
-				cBucketLockMap.Delete(key)
-				// keys.List() 是一个新的 slice，移除 key 并不会导致错误发生
-				keys.Remove(key)
-				atomic.AddInt64(&ml.LockKeyCount, -1)
-			}
+			ml.unlockRow(cBucketLockMap, key, branchSession.TransactionID)
 		}
 		return true
 	}
@@ -173,7 +276,7 @@ func (ml *MemoryLocker) releaseLockByRowLocks(branchSession *session.BranchSessi
 	return true
 }
 
-func (ml *MemoryLocker) isLockableByRowLocks(rowLocks []*RowLock) bool {
+func (ml *MemoryLocker) isLockableByRowLocks(rowLocks []*RowLock, lockMode meta.LockMode) bool {
 	if rowLocks == nil {
 		return true
 	}
@@ -206,11 +309,28 @@ func (ml *MemoryLocker) isLockableByRowLocks(rowLocks []*RowLock) bool {
 		if !ok || previousLockTransactionID == transactionID {
 			// Locked by me before
 			continue
-		} else {
-			log.Infof("Global rowLock on [%s:%s] is holding by %d", rowLock.TableName, rowLock.Pk, previousLockTransactionID)
-			return false
 		}
+		if shared, ok := previousLockTransactionID.(*sharedRowLock); ok && shared.lockable(transactionID, lockMode) {
+			continue
+		}
+		log.Infof("Global rowLock on [%s:%s] is holding by %v", rowLock.TableName, rowLock.Pk, previousLockTransactionID)
+		return false
 	}
 
 	return true
 }
+
+// lockable reports whether transactionID could lock the shared row in lockMode.
+func (shared *sharedRowLock) lockable(transactionID int64, lockMode meta.LockMode) bool {
+	if lockMode == meta.LockModeShared {
+		return true
+	}
+	shared.Lock()
+	defer shared.Unlock()
+	for holderID := range shared.transactionIDs {
+		if holderID != transactionID {
+			return false
+		}
+	}
+	return true
+}
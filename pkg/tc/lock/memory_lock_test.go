@@ -0,0 +1,74 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lock
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+)
+
+func TestMemoryLocker_AcquireLock_ConflictKeepsHeldRows(t *testing.T) {
+	lockManager := NewLockManager(config.StoreConfig{})
+	other := waitBranchSessionProvider("t:3")
+	assert.True(t, lockManager.AcquireLock(other))
+
+	branch := waitBranchSessionProvider("t:1")
+	assert.True(t, lockManager.AcquireLock(branch))
+	conflicting := waitBranchSessionProvider("t:2,3")
+	conflicting.TransactionID, conflicting.XID, conflicting.BranchID = branch.TransactionID, branch.XID, 2
+	assert.False(t, lockManager.AcquireLock(conflicting))
+
+	// only the rows locked by the failed acquisition are unlocked.
+	assert.Equal(t, int64(2), lockManager.GetLockKeyCount())
+	assert.False(t, lockManager.IsLockable(other.XID, "tb_wait", "t:1", meta.LockModeExclusive))
+	assert.True(t, lockManager.IsLockable(other.XID, "tb_wait", "t:2", meta.LockModeExclusive))
+}
+
+func TestMemoryLocker_AcquireLock_Shared(t *testing.T) {
+	lockManager := NewLockManager(config.StoreConfig{})
+	reader, otherReader := sharedBranchSessionProvider("t:1"), sharedBranchSessionProvider("t:1")
+	assert.True(t, lockManager.AcquireLock(reader))
+	assert.True(t, lockManager.AcquireLock(otherReader))
+	assert.Equal(t, int64(2), lockManager.GetLockKeyCount())
+
+	writer := waitBranchSessionProvider("t:1")
+	assert.False(t, lockManager.AcquireLock(writer))
+	assert.False(t, lockManager.IsLockable(writer.XID, "tb_wait", "t:1", meta.LockModeExclusive))
+	assert.True(t, lockManager.IsLockable(writer.XID, "tb_wait", "t:1", meta.LockModeShared))
+
+	// a shared row is upgraded for its only holder.
+	upgrade := waitBranchSessionProvider("t:1")
+	upgrade.TransactionID, upgrade.XID, upgrade.BranchID = reader.TransactionID, reader.XID, 2
+	assert.False(t, lockManager.AcquireLock(upgrade))
+	assert.True(t, lockManager.ReleaseLock(otherReader))
+	assert.True(t, lockManager.AcquireLock(upgrade))
+	assert.Equal(t, int64(1), lockManager.GetLockKeyCount())
+	assert.False(t, lockManager.AcquireLock(otherReader))
+
+	assert.True(t, lockManager.ReleaseLock(upgrade))
+	assert.Equal(t, int64(0), lockManager.GetLockKeyCount())
+	assert.True(t, lockManager.AcquireLock(writer))
+}
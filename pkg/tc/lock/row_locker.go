@@ -23,6 +23,7 @@ import (
 
 import (
 	"github.com/transaction-mesh/starfish/pkg/base/common"
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
 	"github.com/transaction-mesh/starfish/pkg/tc/session"
 )
 
@@ -44,27 +45,37 @@ type RowLock struct {
 	RowKey string
 
 	Feature string
+
+	LockMode meta.LockMode
+}
+
+// CollectRowLocks returns the row locks held by branchSession.
+func CollectRowLocks(branchSession *session.BranchSession) []*RowLock {
+	return collectRowLocksByBranchSession(branchSession)
 }
 
 func collectRowLocksByBranchSession(branchSession *session.BranchSession) []*RowLock {
 	if branchSession == nil || branchSession.LockKey == "" {
 		return nil
 	}
-	return collectRowLocks(branchSession.LockKey, branchSession.ResourceID, branchSession.XID, branchSession.TransactionID, branchSession.BranchID)
+	return collectRowLocks(branchSession.LockKey, branchSession.ResourceID, branchSession.XID, branchSession.TransactionID,
+		branchSession.BranchID, branchSession.LockMode)
 }
 
 func collectRowLocksByLockKeyResourceIDAndXID(lockKey string,
 	resourceID string,
-	xid string) []*RowLock {
+	xid string,
+	lockMode meta.LockMode) []*RowLock {
 
-	return collectRowLocks(lockKey, resourceID, xid, common.GetTransactionID(xid), 0)
+	return collectRowLocks(lockKey, resourceID, xid, common.GetTransactionID(xid), 0, lockMode)
 }
 
 func collectRowLocks(lockKey string,
 	resourceID string,
 	xid string,
 	transactionID int64,
-	branchID int64) []*RowLock {
+	branchID int64,
+	lockMode meta.LockMode) []*RowLock {
 	var locks = make([]*RowLock, 0)
 	tableGroupedLockKeys := strings.Split(lockKey, ";")
 	for _, tableGroupedLockKey := range tableGroupedLockKeys {
@@ -95,6 +106,7 @@ func collectRowLocks(lockKey string,
 						ResourceID:    resourceID,
 						TableName:     tableName,
 						Pk:            pk,
+						LockMode:      lockMode,
 					}
 					locks = append(locks, rowLock)
 				}
@@ -28,12 +28,24 @@ import (
 import (
 	"github.com/transaction-mesh/starfish/pkg/base/meta"
 	"github.com/transaction-mesh/starfish/pkg/tc/event"
+	"github.com/transaction-mesh/starfish/pkg/tc/holder"
+	"github.com/transaction-mesh/starfish/pkg/tc/lock"
 	"github.com/transaction-mesh/starfish/pkg/util/runtime"
 )
 
 var (
 	SEATA_TRANSACTION = "starfish.transaction"
 
+	SEATA_STORE_BATCH_SIZE = "starfish.store.batch.size"
+
+	SEATA_STORE_BATCH_LATENCY = "starfish.store.batch.latency"
+
+	SEATA_LOCK_WAIT = "starfish.lock.wait"
+
+	SEATA_LOCK_DEADLOCK = "starfish.lock.deadlock"
+
+	SEATA_HISTORY_DROPPED = "starfish.history.dropped"
+
 	NAME_KEY = "name"
 
 	ROLE_KEY = "role"
@@ -73,6 +85,12 @@ var (
 	STATUS_VALUE_COMMITTED = "committed"
 
 	STATUS_VALUE_ROLLBACKED = "rollbacked"
+
+	STATUS_VALUE_GRANTED = "granted"
+
+	STATUS_VALUE_TIMEOUT = "timeout"
+
+	STATUS_VALUE_CANCELLED = "cancelled"
 )
 
 type Counter struct {
@@ -206,6 +224,80 @@ var (
 			STATUS_KEY: STATUS_VALUE_ROLLBACKED,
 		},
 	}
+	// SUMMARY_STORE_BATCH_SIZE is the session writes of the group commits of the db store.
+	SUMMARY_STORE_BATCH_SIZE = &Histogram{
+		Histogram: holder.DBStoreBatchSize,
+		Name:      SEATA_STORE_BATCH_SIZE,
+		Labels: map[string]string{
+			ROLE_KEY:  ROLE_VALUE_TC,
+			METER_KEY: METER_VALUE_SUMMARY,
+		},
+	}
+	// TIMER_STORE_BATCH is the microseconds of the group commits of the db store.
+	TIMER_STORE_BATCH = &Histogram{
+		Histogram: holder.DBStoreBatchLatency,
+		Name:      SEATA_STORE_BATCH_LATENCY,
+		Labels: map[string]string{
+			ROLE_KEY:  ROLE_VALUE_TC,
+			METER_KEY: METER_VALUE_TIMER,
+		},
+	}
+	// COUNTER_LOCK_WAIT_GRANTED, COUNTER_LOCK_WAIT_TIMEOUT and
+	// COUNTER_LOCK_WAIT_CANCELLED count how the waits of the lock wait queue ended.
+	COUNTER_LOCK_WAIT_GRANTED = &Counter{
+		Counter: lock.LockWaitGranted,
+		Name:    SEATA_LOCK_WAIT,
+		Labels: map[string]string{
+			ROLE_KEY:   ROLE_VALUE_TC,
+			METER_KEY:  METER_VALUE_COUNTER,
+			STATUS_KEY: STATUS_VALUE_GRANTED,
+		},
+	}
+	COUNTER_LOCK_WAIT_TIMEOUT = &Counter{
+		Counter: lock.LockWaitTimedOut,
+		Name:    SEATA_LOCK_WAIT,
+		Labels: map[string]string{
+			ROLE_KEY:   ROLE_VALUE_TC,
+			METER_KEY:  METER_VALUE_COUNTER,
+			STATUS_KEY: STATUS_VALUE_TIMEOUT,
+		},
+	}
+	COUNTER_LOCK_WAIT_CANCELLED = &Counter{
+		Counter: lock.LockWaitCancelled,
+		Name:    SEATA_LOCK_WAIT,
+		Labels: map[string]string{
+			ROLE_KEY:   ROLE_VALUE_TC,
+			METER_KEY:  METER_VALUE_COUNTER,
+			STATUS_KEY: STATUS_VALUE_CANCELLED,
+		},
+	}
+	// COUNTER_LOCK_DEADLOCK counts the deadlocks of waiting branch registrations broken.
+	COUNTER_LOCK_DEADLOCK = &Counter{
+		Counter: lock.LockDeadlocks,
+		Name:    SEATA_LOCK_DEADLOCK,
+		Labels: map[string]string{
+			ROLE_KEY:  ROLE_VALUE_TC,
+			METER_KEY: METER_VALUE_COUNTER,
+		},
+	}
+	// COUNTER_HISTORY_DROPPED counts the finished sessions the history had no room to queue.
+	COUNTER_HISTORY_DROPPED = &Counter{
+		Counter: holder.SessionArchiveDropped,
+		Name:    SEATA_HISTORY_DROPPED,
+		Labels: map[string]string{
+			ROLE_KEY:  ROLE_VALUE_TC,
+			METER_KEY: METER_VALUE_COUNTER,
+		},
+	}
+	// TIMER_LOCK_WAIT is the milliseconds branch registrations waited for row locks.
+	TIMER_LOCK_WAIT = &Histogram{
+		Histogram: lock.LockWaitTime,
+		Name:      SEATA_LOCK_WAIT,
+		Labels: map[string]string{
+			ROLE_KEY:  ROLE_VALUE_TC,
+			METER_KEY: METER_VALUE_TIMER,
+		},
+	}
 )
 
 type MetricsSubscriber struct {
@@ -48,9 +48,17 @@ func (exporter *promHttpExporter) Flush(writer io.Writer) {
 	flushCounter(tracker, &sb, COUNTER_ACTIVE)
 	flushCounter(tracker, &sb, COUNTER_COMMITTED)
 	flushCounter(tracker, &sb, COUNTER_ROLLBACKED)
+	flushCounter(tracker, &sb, COUNTER_LOCK_WAIT_GRANTED)
+	flushCounter(tracker, &sb, COUNTER_LOCK_WAIT_TIMEOUT)
+	flushCounter(tracker, &sb, COUNTER_LOCK_WAIT_CANCELLED)
+	flushCounter(tracker, &sb, COUNTER_LOCK_DEADLOCK)
+	flushCounter(tracker, &sb, COUNTER_HISTORY_DROPPED)
 
 	flushHistogram(tracker, &sb, TIMER_COMMITTED)
 	flushHistogram(tracker, &sb, TIMER_ROLLBACK)
+	flushHistogram(tracker, &sb, SUMMARY_STORE_BATCH_SIZE)
+	flushHistogram(tracker, &sb, TIMER_STORE_BATCH)
+	flushHistogram(tracker, &sb, TIMER_LOCK_WAIT)
 
 	w.Write([]byte(sb.String()))
 }
@@ -63,6 +71,8 @@ func flushHistogram(tracker map[string]bool, buf *strings.Builder, histogram *Hi
 	flushGauge(tracker, buf, name+"_min", labels, histogram.Min())
 	// max
 	flushGauge(tracker, buf, name+"_max", labels, histogram.Max())
+	// average
+	flushGauge(tracker, buf, name+"_average", labels, int64(histogram.Mean()))
 }
 
 func flushCounter(tracker map[string]bool, buf *strings.Builder, counter *Counter) {
@@ -21,6 +21,10 @@ import (
 	"time"
 )
 
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+)
+
 // LockDO for persist Lock.
 type LockDO struct {
 	Xid string `xorm:"xid"`
@@ -37,6 +41,9 @@ type LockDO struct {
 
 	RowKey string `xorm:"row_key"`
 
+	// LockMode is not a column, the shared locks are kept in lock_shared_table.
+	LockMode meta.LockMode `xorm:"-"`
+
 	GmtCreate time.Time `xorm:"created"`
 
 	GmtModified time.Time `xorm:"updated"`
@@ -21,11 +21,57 @@ import (
 	"github.com/transaction-mesh/starfish/pkg/base/meta"
 )
 
-// SessionCondition for query GlobalSession
+// SessionSortField is the field global sessions are sorted by, named after
+// its column in global_table.
+type SessionSortField string
+
+const (
+	SortByBeginTime     SessionSortField = "begin_time"
+	SortByTransactionID SessionSortField = "transaction_id"
+	SortByStatus        SessionSortField = "status"
+)
+
+// ValueOfSessionSortField parses a sort field, the empty string is begin_time.
+func ValueOfSessionSortField(field string) (SessionSortField, bool) {
+	switch SessionSortField(field) {
+	case "", SortByBeginTime:
+		return SortByBeginTime, true
+	case SortByTransactionID:
+		return SortByTransactionID, true
+	case SortByStatus:
+		return SortByStatus, true
+	default:
+		return "", false
+	}
+}
+
+// SessionCondition for query GlobalSession, a session matches when it
+// satisfies every field set, zero values do not filter.
 type SessionCondition struct {
 	TransactionID      int64
 	XID                string
 	Status             meta.GlobalStatus
 	Statuses           []meta.GlobalStatus
 	OverTimeAliveMills int64
+	ApplicationID      string
+	TransactionName    string
+
+	// BeginTimeFrom and BeginTimeTo bound the begin time in milliseconds,
+	// from is inclusive and to is exclusive, zero leaves a bound open.
+	BeginTimeFrom int64
+	BeginTimeTo   int64
+
+	// SortBy orders the matched sessions, begin_time when empty, sessions
+	// equal in it are ordered by transaction id. Descending reverses the order.
+	SortBy     SessionSortField
+	Descending bool
+
+	// Offset skips the first sessions of the sorted result, Limit caps the
+	// number returned, zero returns them all.
+	Offset int
+	Limit  int
+
+	// History queries the archived sessions which already finished instead of
+	// the ones in progress.
+	History bool
 }
@@ -0,0 +1,67 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package model
+
+// GlobalTransactionHistoryDO for archive a finished GlobalTransaction.
+type GlobalTransactionHistoryDO struct {
+	XID string `xorm:"xid" json:"xid"`
+
+	TransactionID int64 `xorm:"transaction_id" json:"transaction_id"`
+
+	Status int32 `xorm:"status" json:"status"`
+
+	ApplicationID string `xorm:"application_id" json:"application_id,omitempty"`
+
+	TransactionServiceGroup string `xorm:"transaction_service_group" json:"transaction_service_group,omitempty"`
+
+	TransactionName string `xorm:"transaction_name" json:"transaction_name,omitempty"`
+
+	Timeout int32 `xorm:"timeout" json:"timeout"`
+
+	BeginTime int64 `xorm:"begin_time" json:"begin_time"`
+
+	EndTime int64 `xorm:"end_time" json:"end_time"`
+
+	RetryCount int32 `xorm:"retry_count" json:"retry_count"`
+
+	ApplicationData []byte `xorm:"application_data" json:"application_data,omitempty"`
+}
+
+// BranchTransactionHistoryDO for archive a BranchTransaction of a finished
+// GlobalTransaction.
+type BranchTransactionHistoryDO struct {
+	XID string `xorm:"xid" json:"xid"`
+
+	TransactionID int64 `xorm:"transaction_id" json:"transaction_id"`
+
+	BranchID int64 `xorm:"branch_id" json:"branch_id"`
+
+	ResourceGroupID string `xorm:"resource_group_id" json:"resource_group_id,omitempty"`
+
+	ResourceID string `xorm:"resource_id" json:"resource_id"`
+
+	BranchType string `xorm:"branch_type" json:"branch_type"`
+
+	Status int32 `xorm:"status" json:"status"`
+
+	ClientID string `xorm:"client_id" json:"client_id,omitempty"`
+
+	EndTime int64 `xorm:"end_time" json:"end_time"`
+
+	ApplicationData []byte `xorm:"application_data" json:"application_data,omitempty"`
+}
@@ -0,0 +1,85 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package redisstore lays out the redis store, the sessions and the row locks
+// shared by the TC nodes connected to the same redis.
+package redisstore
+
+import (
+	"strconv"
+)
+
+// Keys builds the keys of the redis store, all of them start with Prefix.
+//
+//	global:{xid}               hash of the global session
+//	global_transaction_id      hash transaction id -> xid
+//	global_status:{status}     sorted set of the xids of status by begin time
+//	global_begin_time          sorted set of all the xids by begin time
+//	branches:{xid}             sorted set of the branch ids of xid
+//	branch:{xid}:{branch id}   hash of the branch session
+//	lock:{row key}             hash of the row lock
+//	locks                      set of all the locked row keys
+//	xid_locks:{xid}            hash row key -> branch id of the locks of xid
+type Keys struct {
+	Prefix string
+}
+
+func (keys Keys) Global(xid string) string {
+	return keys.Prefix + "global:" + xid
+}
+
+func (keys Keys) TransactionIDs() string {
+	return keys.Prefix + "global_transaction_id"
+}
+
+// StatusPrefix is the prefix of the status index keys, the status follows it.
+func (keys Keys) StatusPrefix() string {
+	return keys.Prefix + "global_status:"
+}
+
+func (keys Keys) Status(status int32) string {
+	return keys.StatusPrefix() + strconv.Itoa(int(status))
+}
+
+func (keys Keys) BeginTime() string {
+	return keys.Prefix + "global_begin_time"
+}
+
+func (keys Keys) Branches(xid string) string {
+	return keys.Prefix + "branches:" + xid
+}
+
+// BranchPattern matches the keys of every branch session.
+func (keys Keys) BranchPattern() string {
+	return keys.Prefix + "branch:*"
+}
+
+func (keys Keys) Branch(xid string, branchID int64) string {
+	return keys.Prefix + "branch:" + xid + ":" + strconv.FormatInt(branchID, 10)
+}
+
+func (keys Keys) Lock(rowKey string) string {
+	return keys.Prefix + "lock:" + rowKey
+}
+
+func (keys Keys) Locks() string {
+	return keys.Prefix + "locks"
+}
+
+func (keys Keys) XIDLocks(xid string) string {
+	return keys.Prefix + "xid_locks:" + xid
+}
@@ -0,0 +1,550 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/holder"
+	"github.com/transaction-mesh/starfish/pkg/tc/lock"
+	"github.com/transaction-mesh/starfish/pkg/tc/model"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+)
+
+const (
+	defaultAdminAddress      = "127.0.0.1:9899"
+	defaultAdminAuditLogPath = "admin_audit.log"
+
+	adminSessionsPath  = "/admin/sessions"
+	adminLocksPath     = "/admin/locks"
+	adminClientsPath   = "/admin/clients"
+	adminDeadlocksPath = "/admin/deadlocks"
+
+	AdminActionRollback = "rollback"
+	AdminActionCommit   = "commit"
+	AdminActionAbandon  = "abandon"
+
+	// AdminOperatorHeader optionally names the operator in the audit log.
+	AdminOperatorHeader = "X-Starfish-Operator"
+	// AdminTokenHeader carries the admin token of a POST as "Bearer <token>".
+	AdminTokenHeader = "Authorization"
+)
+
+// AdminServer serves the admin http api:
+//
+//	GET  /admin/sessions?status=&application_id=&transaction_name=&min_age=&max_age=&begin_from=&begin_to=
+//	                    &sort=&desc=&offset=&limit=&history=
+//	GET  /admin/sessions/{xid}
+//	POST /admin/sessions/{xid}/rollback
+//	POST /admin/sessions/{xid}/commit
+//	POST /admin/sessions/{xid}/abandon
+//	GET  /admin/locks?resource=&xid=
+//	GET  /admin/clients?application_id=&version=
+//	GET  /admin/deadlocks
+//
+// Every POST is written to the audit log whether it succeeded or not. A POST
+// must carry the configured token, without one only the callers on the
+// loopback interface may act.
+type AdminServer struct {
+	conf          config.AdminConfig
+	coordinator   *DefaultCoordinator
+	sessionHolder holder.SessionHolder
+	lockManager   lock.LockManager
+	audit         *auditLogger
+	listener      net.Listener
+	server        *http.Server
+}
+
+func NewAdminServer(conf config.AdminConfig, coordinator *DefaultCoordinator) *AdminServer {
+	if conf.Address == "" {
+		conf.Address = defaultAdminAddress
+	}
+	if conf.AuditLogPath == "" {
+		conf.AuditLogPath = defaultAdminAuditLogPath
+	}
+	return &AdminServer{
+		conf:          conf,
+		coordinator:   coordinator,
+		sessionHolder: holder.GetSessionHolder(),
+		lockManager:   lock.GetLockManager(),
+	}
+}
+
+// Serve opens the audit log and accepts admin requests until Close is called.
+func (admin *AdminServer) Serve() error {
+	audit, err := newAuditLogger(admin.conf.AuditLogPath)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", admin.conf.Address)
+	if err != nil {
+		audit.Close()
+		return errors.WithStack(err)
+	}
+	admin.audit = audit
+	admin.listener = listener
+	admin.server = &http.Server{Handler: admin.handler()}
+	go admin.server.Serve(listener)
+	log.Infof("admin server listening on %s", listener.Addr().String())
+	return nil
+}
+
+func (admin *AdminServer) Close() {
+	if admin.server != nil {
+		admin.server.Close()
+	}
+	if admin.audit != nil {
+		admin.audit.Close()
+	}
+}
+
+func (admin *AdminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminSessionsPath, admin.handleListSessions)
+	mux.HandleFunc(adminSessionsPath+"/", admin.handleSession)
+	mux.HandleFunc(adminLocksPath, admin.handleListLocks)
+	mux.HandleFunc(adminClientsPath, admin.handleListClients)
+	mux.HandleFunc(adminDeadlocksPath, admin.handleListDeadlocks)
+	return mux
+}
+
+// AdminError is the body of every failed admin request, Leader is set when a
+// follower rejects an action.
+type AdminError struct {
+	Error  string `json:"error"`
+	Leader string `json:"leader,omitempty"`
+}
+
+func (admin *AdminServer) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	condition, err := parseSessionCondition(r)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if condition.History {
+		records := holder.GetSessionArchive().FindHistory(condition)
+		views := make([]GlobalSessionView, 0, len(records))
+		for _, record := range records {
+			views = append(views, NewHistorySessionView(record))
+		}
+		writeAdminJSON(w, http.StatusOK, views)
+		return
+	}
+	globalSessions := admin.sessionHolder.RootSessionManager.FindGlobalSessions(condition)
+	views := make([]GlobalSessionView, 0, len(globalSessions))
+	for _, globalSession := range globalSessions {
+		views = append(views, NewGlobalSessionView(globalSession))
+	}
+	writeAdminJSON(w, http.StatusOK, views)
+}
+
+func (admin *AdminServer) handleListLocks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	xid := r.URL.Query().Get("xid")
+	var globalSessions []*session.GlobalSession
+	if xid != "" {
+		if globalSession := admin.sessionHolder.FindGlobalSession(xid); globalSession != nil {
+			globalSessions = append(globalSessions, globalSession)
+		}
+	} else {
+		globalSessions = admin.sessionHolder.RootSessionManager.AllSessions()
+	}
+	writeAdminJSON(w, http.StatusOK, ListRowLockViews(admin.lockManager, globalSessions, xid, r.URL.Query().Get("resource")))
+}
+
+// handleListClients lists the clients registered to this server with the
+// version they run, clients of the other servers of a cluster are not listed.
+func (admin *AdminServer) handleListClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	applicationID := r.URL.Query().Get("application_id")
+	clientVersion := r.URL.Query().Get("version")
+	views := make([]ClientView, 0)
+	for _, client := range SessionManager.ListClients() {
+		if applicationID != "" && client.ApplicationID != applicationID {
+			continue
+		}
+		if clientVersion != "" && client.Version != clientVersion {
+			continue
+		}
+		views = append(views, NewClientView(client))
+	}
+	writeAdminJSON(w, http.StatusOK, views)
+}
+
+// handleListDeadlocks lists the latest lock wait deadlocks detected by this
+// server, none when the row locks do not wait.
+func (admin *AdminServer) handleListDeadlocks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	views := make([]DeadlockView, 0)
+	if detector, ok := admin.lockManager.(lock.DeadlockDetector); ok {
+		for _, deadlock := range detector.Deadlocks() {
+			views = append(views, NewDeadlockView(deadlock))
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, views)
+}
+
+func (admin *AdminServer) handleSession(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, adminSessionsPath), "/")
+	xid, action := path, ""
+	if idx := strings.LastIndex(path, "/"); idx >= 0 {
+		xid, action = path[:idx], path[idx+1:]
+	}
+	if xid == "" {
+		writeAdminError(w, http.StatusNotFound, errors.New("xid is required"))
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		globalSession := admin.sessionHolder.FindGlobalSession(xid)
+		if globalSession == nil {
+			writeAdminError(w, http.StatusNotFound, errors.Errorf("global session %s not found", xid))
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, NewGlobalSessionDetailView(globalSession, admin.lockManager))
+	case action != "" && r.Method == http.MethodPost:
+		admin.handleAction(w, r, xid, action)
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, errors.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (admin *AdminServer) handleAction(w http.ResponseWriter, r *http.Request, xid string, action string) {
+	entry := AuditEntry{
+		Time:       time.Now(),
+		Action:     action,
+		XID:        xid,
+		RemoteAddr: r.RemoteAddr,
+		Operator:   r.Header.Get(AdminOperatorHeader),
+	}
+	code, err := admin.authorize(r)
+	var globalSession *session.GlobalSession
+	if err == nil {
+		code, globalSession, err = admin.doAction(xid, action, &entry)
+	}
+	if err != nil {
+		entry.Result = err.Error()
+	} else {
+		entry.Result = "ok"
+	}
+	if auditErr := admin.audit.Write(entry); auditErr != nil {
+		log.Errorf("write admin audit log failed: %v", auditErr)
+	}
+
+	if err != nil {
+		response := AdminError{Error: err.Error()}
+		if code == http.StatusServiceUnavailable {
+			response.Leader = admin.leaderAddress()
+		}
+		writeAdminJSON(w, code, response)
+		return
+	}
+	writeAdminJSON(w, code, NewGlobalSessionDetailView(globalSession, admin.lockManager))
+}
+
+// authorize checks the token of a POST action, or that it comes from the
+// loopback interface when no token is configured.
+func (admin *AdminServer) authorize(r *http.Request) (int, error) {
+	if admin.conf.Token == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err == nil && ip != nil && ip.IsLoopback() {
+			return http.StatusOK, nil
+		}
+		return http.StatusForbidden, errors.New("admin actions from other hosts need admin_config.token")
+	}
+	token := strings.TrimPrefix(r.Header.Get(AdminTokenHeader), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(admin.conf.Token)) != 1 {
+		return http.StatusUnauthorized, errors.New("invalid admin token")
+	}
+	return http.StatusOK, nil
+}
+
+func (admin *AdminServer) doAction(xid string, action string, entry *AuditEntry) (int, *session.GlobalSession, error) {
+	if action != AdminActionRollback && action != AdminActionCommit && action != AdminActionAbandon {
+		return http.StatusNotFound, nil, errors.Errorf("unknown action %s", action)
+	}
+	if !admin.sessionHolder.IsLeader() {
+		return http.StatusServiceUnavailable, nil, errNotLeader
+	}
+	globalSession := admin.sessionHolder.FindGlobalSession(xid)
+	if globalSession == nil {
+		return http.StatusNotFound, nil, errors.Errorf("global session %s not found", xid)
+	}
+	status := lockedStatus(globalSession)
+	entry.StatusBefore = status.String()
+	if !adminActionAllowed(action, status) {
+		return http.StatusConflict, nil, newStatusConflictError(action, xid, status)
+	}
+	// the retry and async commit tasks skip a session claimed here, and the
+	// other way around.
+	if !admin.coordinator.claimSession(xid) {
+		return http.StatusConflict, nil, errors.Errorf("global session %s is being committed or rolled back, try again later", xid)
+	}
+	defer admin.coordinator.releaseSession(xid)
+
+	var err error
+	switch action {
+	case AdminActionRollback:
+		err = admin.forceRollback(globalSession)
+	case AdminActionCommit:
+		err = admin.forceCommit(globalSession)
+	case AdminActionAbandon:
+		err = admin.abandon(globalSession)
+	}
+	entry.StatusAfter = lockedStatus(globalSession).String()
+	if err != nil {
+		if _, ok := err.(*statusConflictError); ok {
+			return http.StatusConflict, nil, err
+		}
+		return http.StatusInternalServerError, nil, err
+	}
+	log.Infof("admin %s global session %s, status %s -> %s", action, xid, entry.StatusBefore, entry.StatusAfter)
+	return http.StatusOK, globalSession, nil
+}
+
+// adminActionAllowed reports whether action applies to a global session in
+// status: rollback to an active transaction or one rolling back, commit to one
+// retrying its commit and abandon to one retrying either.
+func adminActionAllowed(action string, status meta.GlobalStatus) bool {
+	switch action {
+	case AdminActionRollback:
+		return status == meta.GlobalStatusBegin || isRollingBackStatus(status)
+	case AdminActionCommit:
+		return status == meta.GlobalStatusCommitRetrying || status == meta.GlobalStatusAsyncCommitting
+	case AdminActionAbandon:
+		return status == meta.GlobalStatusCommitRetrying || status == meta.GlobalStatusRollbackRetrying ||
+			status == meta.GlobalStatusTimeoutRollbackRetrying
+	}
+	return false
+}
+
+func isRollingBackStatus(status meta.GlobalStatus) bool {
+	return status == meta.GlobalStatusRollingBack || status == meta.GlobalStatusRollbackRetrying ||
+		status == meta.GlobalStatusTimeoutRollingBack || status == meta.GlobalStatusTimeoutRollbackRetrying
+}
+
+// lockedStatus reads the status of globalSession under its lock.
+func lockedStatus(globalSession *session.GlobalSession) meta.GlobalStatus {
+	globalSession.Lock()
+	defer globalSession.Unlock()
+	return globalSession.Status
+}
+
+// forceRollback rolls back an active transaction, or retries the rollback of one
+// already rolling back without waiting for the retry period. The status is
+// checked again once the session is claimed.
+func (admin *AdminServer) forceRollback(globalSession *session.GlobalSession) error {
+	status := lockedStatus(globalSession)
+	switch {
+	case status == meta.GlobalStatusBegin:
+		// Rollback closes the session under its lock, and does nothing when the
+		// TM or the timeout check ended it first.
+		_, err := admin.coordinator.core.Rollback(globalSession.XID)
+		return err
+	case isRollingBackStatus(status):
+		// only the claimed rollback itself moves the session out of these statuses.
+		_, err := admin.coordinator.core.doGlobalRollback(globalSession, true)
+		return err
+	default:
+		return newStatusConflictError(AdminActionRollback, globalSession.XID, status)
+	}
+}
+
+// forceCommit retries the commit of a transaction that already decided to commit.
+func (admin *AdminServer) forceCommit(globalSession *session.GlobalSession) error {
+	status := lockedStatus(globalSession)
+	switch status {
+	case meta.GlobalStatusCommitRetrying, meta.GlobalStatusAsyncCommitting:
+		_, err := admin.coordinator.core.doGlobalCommit(globalSession, true)
+		return err
+	default:
+		return newStatusConflictError(AdminActionCommit, globalSession.XID, status)
+	}
+}
+
+// abandon gives up retrying, the transaction ends as failed and its locks are
+// released. The branches are left as they are for the operator to repair.
+func (admin *AdminServer) abandon(globalSession *session.GlobalSession) error {
+	globalSession.Lock()
+	defer globalSession.Unlock()
+	switch globalSession.Status {
+	case meta.GlobalStatusCommitRetrying:
+		admin.sessionHolder.RetryCommittingSessionManager.RemoveGlobalSession(globalSession)
+		endCommitFailed(globalSession)
+		return nil
+	case meta.GlobalStatusRollbackRetrying, meta.GlobalStatusTimeoutRollbackRetrying:
+		admin.sessionHolder.RetryRollbackingSessionManager.RemoveGlobalSession(globalSession)
+		endRollBackFailed(globalSession)
+		return nil
+	default:
+		return newStatusConflictError(AdminActionAbandon, globalSession.XID, globalSession.Status)
+	}
+}
+
+func (admin *AdminServer) leaderAddress() string {
+	if clusterSessionManager, ok := admin.sessionHolder.RootSessionManager.(holder.ClusterSessionManager); ok {
+		return clusterSessionManager.LeaderForwardAddress()
+	}
+	return ""
+}
+
+type statusConflictError struct {
+	action string
+	xid    string
+	status meta.GlobalStatus
+}
+
+func newStatusConflictError(action string, xid string, status meta.GlobalStatus) *statusConflictError {
+	return &statusConflictError{action: action, xid: xid, status: status}
+}
+
+func (err *statusConflictError) Error() string {
+	return fmt.Sprintf("can not %s global session %s in status %s", err.action, err.xid, err.status.String())
+}
+
+// parseSessionCondition reads the list filters, min_age and max_age are
+// durations such as 30s, begin_from and begin_to are in milliseconds, sort is a
+// model.SessionSortField and history=true lists the archived sessions which
+// already finished.
+func parseSessionCondition(r *http.Request) (model.SessionCondition, error) {
+	query := r.URL.Query()
+	condition := model.SessionCondition{
+		ApplicationID:   query.Get("application_id"),
+		TransactionName: query.Get("transaction_name"),
+	}
+	if value := query.Get("status"); value != "" {
+		status, err := ParseGlobalStatus(value)
+		if err != nil {
+			return condition, err
+		}
+		condition.Status = status
+	}
+	if value := query.Get("min_age"); value != "" {
+		age, err := time.ParseDuration(value)
+		if err != nil {
+			return condition, errors.Errorf("invalid min_age %s", value)
+		}
+		condition.OverTimeAliveMills = age.Milliseconds()
+	}
+	if value := query.Get("max_age"); value != "" {
+		age, err := time.ParseDuration(value)
+		if err != nil {
+			return condition, errors.Errorf("invalid max_age %s", value)
+		}
+		condition.BeginTimeFrom = time.Now().Add(-age).UnixNano() / int64(time.Millisecond)
+	}
+	for param, field := range map[string]*int64{"begin_from": &condition.BeginTimeFrom, "begin_to": &condition.BeginTimeTo} {
+		if value := query.Get(param); value != "" {
+			millis, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || millis < 0 {
+				return condition, errors.Errorf("invalid %s %s", param, value)
+			}
+			*field = millis
+		}
+	}
+	if value := query.Get("sort"); value != "" {
+		sortBy, ok := model.ValueOfSessionSortField(value)
+		if !ok {
+			return condition, errors.Errorf("invalid sort %s", value)
+		}
+		condition.SortBy = sortBy
+	}
+	if value := query.Get("desc"); value != "" {
+		descending, err := strconv.ParseBool(value)
+		if err != nil {
+			return condition, errors.Errorf("invalid desc %s", value)
+		}
+		condition.Descending = descending
+	}
+	for param, field := range map[string]*int{"offset": &condition.Offset, "limit": &condition.Limit} {
+		if value := query.Get(param); value != "" {
+			number, err := strconv.Atoi(value)
+			if err != nil || number < 0 {
+				return condition, errors.Errorf("invalid %s %s", param, value)
+			}
+			*field = number
+		}
+	}
+	if value := query.Get("history"); value != "" {
+		history, err := strconv.ParseBool(value)
+		if err != nil {
+			return condition, errors.Errorf("invalid history %s", value)
+		}
+		condition.History = history
+	}
+	return condition, nil
+}
+
+// ParseGlobalStatus accepts either the name, case insensitive, or the number of
+// a GlobalStatus.
+func ParseGlobalStatus(value string) (meta.GlobalStatus, error) {
+	if number, err := strconv.Atoi(value); err == nil {
+		if number > int(meta.GlobalStatusUnknown) && number <= int(meta.GlobalStatusFinished) {
+			return meta.GlobalStatus(number), nil
+		}
+	} else {
+		for status := meta.GlobalStatusBegin; status <= meta.GlobalStatusFinished; status++ {
+			if strings.EqualFold(status.String(), value) {
+				return status, nil
+			}
+		}
+	}
+	return meta.GlobalStatusUnknown, errors.Errorf("invalid status %s", value)
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("write admin response failed: %v", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	writeAdminJSON(w, code, AdminError{Error: err.Error()})
+}
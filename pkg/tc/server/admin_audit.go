@@ -0,0 +1,75 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+// AuditEntry records one mutating admin action.
+type AuditEntry struct {
+	Time         time.Time `json:"time"`
+	Action       string    `json:"action"`
+	XID          string    `json:"xid"`
+	RemoteAddr   string    `json:"remote_addr"`
+	Operator     string    `json:"operator,omitempty"`
+	StatusBefore string    `json:"status_before,omitempty"`
+	StatusAfter  string    `json:"status_after,omitempty"`
+	Result       string    `json:"result"`
+}
+
+// auditLogger appends AuditEntry as json lines, the file is opened in append
+// mode so that entries survive restarts.
+type auditLogger struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newAuditLogger(path string) (*auditLogger, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &auditLogger{file: file}, nil
+}
+
+func (logger *auditLogger) Write(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if _, err := logger.file.Write(append(data, '\n')); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(logger.file.Sync())
+}
+
+func (logger *auditLogger) Close() error {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	return logger.file.Close()
+}
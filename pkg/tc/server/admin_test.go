@@ -0,0 +1,320 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+import (
+	getty "github.com/apache/dubbo-getty"
+
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/common"
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/tc/holder"
+	"github.com/transaction-mesh/starfish/pkg/tc/lock"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+func TestAdminServer_ListSessions(t *testing.T) {
+	admin, sessionManager, cleanup := adminServerProvider(t)
+	defer cleanup()
+
+	gs := adminGlobalSessionProvider("demo-order", "create-order", meta.GlobalStatusBegin)
+	gs2 := adminGlobalSessionProvider("demo-stock", "reduce-stock", meta.GlobalStatusCommitRetrying)
+	sessionManager.AddGlobalSession(gs)
+	sessionManager.AddGlobalSession(gs2)
+
+	var views []GlobalSessionView
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/sessions", &views))
+	assert.Equal(t, 2, len(views))
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/sessions?status=CommitRetrying", &views))
+	assert.Equal(t, 1, len(views))
+	assert.Equal(t, gs2.XID, views[0].XID)
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet,
+		"/admin/sessions?application_id=demo-order&transaction_name=create-order", &views))
+	assert.Equal(t, 1, len(views))
+	assert.Equal(t, gs.XID, views[0].XID)
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/sessions?min_age=1h", &views))
+	assert.Equal(t, 0, len(views))
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/sessions?max_age=1h", &views))
+	assert.Equal(t, 2, len(views))
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet,
+		"/admin/sessions?sort=transaction_id&desc=true&limit=1", &views))
+	assert.Equal(t, 1, len(views))
+	assert.Equal(t, gs2.XID, views[0].XID)
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet,
+		"/admin/sessions?sort=transaction_id&offset=1", &views))
+	assert.Equal(t, 1, len(views))
+	assert.Equal(t, gs2.XID, views[0].XID)
+
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, admin, http.MethodGet, "/admin/sessions?status=Done", nil))
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, admin, http.MethodGet, "/admin/sessions?min_age=soon", nil))
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, admin, http.MethodGet, "/admin/sessions?sort=xid", nil))
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, admin, http.MethodGet, "/admin/sessions?limit=-1", nil))
+
+	// nothing is archived unless the history is configured.
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/sessions?history=true", &views))
+	assert.Equal(t, 0, len(views))
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, admin, http.MethodGet, "/admin/sessions?history=maybe", nil))
+}
+
+func TestAdminServer_GetSession(t *testing.T) {
+	admin, sessionManager, cleanup := adminServerProvider(t)
+	defer cleanup()
+
+	gs := adminGlobalSessionProvider("demo-order", "create-order", meta.GlobalStatusBegin)
+	bs := session.NewBranchSessionByGlobal(gs,
+		session.WithBsResourceID("jdbc:mysql://127.0.0.1:3306/order"),
+		session.WithBsLockKey("order:1,2;order_item:7"),
+		session.WithBsBranchType(meta.BranchTypeAT),
+	)
+	gs.Add(bs)
+	sessionManager.AddGlobalSession(gs)
+
+	var view GlobalSessionView
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/sessions/"+gs.XID, &view))
+	assert.Equal(t, gs.XID, view.XID)
+	assert.Equal(t, "Begin", view.Status)
+	assert.Equal(t, 1, len(view.Branches))
+	assert.Equal(t, "AT", view.Branches[0].BranchType)
+	locks := []RowLockView{
+		{XID: gs.XID, BranchID: bs.BranchID, ResourceID: "jdbc:mysql://127.0.0.1:3306/order", TableName: "order", Pk: "1", LockMode: "Exclusive"},
+		{XID: gs.XID, BranchID: bs.BranchID, ResourceID: "jdbc:mysql://127.0.0.1:3306/order", TableName: "order", Pk: "2", LockMode: "Exclusive"},
+		{XID: gs.XID, BranchID: bs.BranchID, ResourceID: "jdbc:mysql://127.0.0.1:3306/order", TableName: "order_item", Pk: "7", LockMode: "Exclusive"},
+	}
+	assert.Equal(t, locks, view.Branches[0].Locks)
+
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, admin, http.MethodGet, "/admin/sessions/127.0.0.1:8091:1", nil))
+
+	var lockViews []RowLockView
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet,
+		"/admin/locks?resource=jdbc:mysql://127.0.0.1:3306/order", &lockViews))
+	assert.Equal(t, locks, lockViews)
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/locks?resource=stock", &lockViews))
+	assert.Equal(t, 0, len(lockViews))
+}
+
+func TestAdminServer_ActionAudited(t *testing.T) {
+	admin, sessionManager, cleanup := adminServerProvider(t)
+	defer cleanup()
+
+	gs := adminGlobalSessionProvider("demo-order", "create-order", meta.GlobalStatusBegin)
+	sessionManager.AddGlobalSession(gs)
+
+	assert.Equal(t, http.StatusConflict, adminRequest(t, admin, http.MethodPost, "/admin/sessions/"+gs.XID+"/abandon", nil))
+	assert.Equal(t, http.StatusConflict, adminRequest(t, admin, http.MethodPost, "/admin/sessions/"+gs.XID+"/commit", nil))
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, admin, http.MethodPost, "/admin/sessions/"+gs.XID+"/finish", nil))
+	assert.Equal(t, meta.GlobalStatusBegin, gs.Status)
+
+	data, err := ioutil.ReadFile(admin.conf.AuditLogPath)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, 3, len(lines))
+	var entry AuditEntry
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, AdminActionAbandon, entry.Action)
+	assert.Equal(t, gs.XID, entry.XID)
+	assert.Equal(t, "admin", entry.Operator)
+	assert.Equal(t, "Begin", entry.StatusBefore)
+	assert.Contains(t, entry.Result, "can not abandon")
+}
+
+func TestAdminServer_ActionAuthorized(t *testing.T) {
+	admin, sessionManager, cleanup := adminServerProvider(t)
+	defer cleanup()
+
+	gs := adminGlobalSessionProvider("demo-order", "create-order", meta.GlobalStatusCommitRetrying)
+	sessionManager.AddGlobalSession(gs)
+	target := "/admin/sessions/" + gs.XID + "/abandon"
+
+	// without a token only the loopback interface may act.
+	request := httptest.NewRequest(http.MethodPost, target, nil)
+	recorder := httptest.NewRecorder()
+	admin.handler().ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+	// abandoning a session that is still in Begin is refused once authorized.
+	begin := adminGlobalSessionProvider("demo-order", "create-order", meta.GlobalStatusBegin)
+	sessionManager.AddGlobalSession(begin)
+	admin.conf.Token = "secret"
+	for token, code := range map[string]int{"": http.StatusUnauthorized, "Bearer guess": http.StatusUnauthorized,
+		"Bearer secret": http.StatusConflict} {
+		request = httptest.NewRequest(http.MethodPost, "/admin/sessions/"+begin.XID+"/abandon", nil)
+		if token != "" {
+			request.Header.Set(AdminTokenHeader, token)
+		}
+		recorder = httptest.NewRecorder()
+		admin.handler().ServeHTTP(recorder, request)
+		assert.Equal(t, code, recorder.Code, token)
+	}
+
+	// a session a retry task is driving is left alone.
+	admin.conf.Token = ""
+	assert.True(t, admin.coordinator.claimSession(gs.XID))
+	assert.Equal(t, http.StatusConflict, adminRequest(t, admin, http.MethodPost, target, nil))
+	assert.Equal(t, meta.GlobalStatusCommitRetrying, gs.Status)
+	admin.coordinator.releaseSession(gs.XID)
+}
+
+func TestAdminServer_ListClients(t *testing.T) {
+	admin, _, cleanup := adminServerProvider(t)
+	defer cleanup()
+
+	tm := &adminTestSession{address: "10.0.0.1:40001"}
+	rm := &adminTestSession{address: "10.0.0.2:40002"}
+	SessionManager.RegisterTmGettySession(protocal.RegisterTMRequest{AbstractIdentifyRequest: protocal.AbstractIdentifyRequest{
+		Version: "1.2.0", ApplicationID: "demo-order", TransactionServiceGroup: "my_test_tx_group",
+	}}, tm)
+	SessionManager.RegisterRmGettySession(protocal.RegisterRMRequest{AbstractIdentifyRequest: protocal.AbstractIdentifyRequest{
+		Version: "1.3.0", ApplicationID: "demo-stock", TransactionServiceGroup: "my_test_tx_group",
+	}}, rm)
+	defer SessionManager.ReleaseGettySession(tm)
+	defer SessionManager.ReleaseGettySession(rm)
+
+	var views []ClientView
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/clients", &views))
+	assert.Equal(t, []ClientView{
+		{ApplicationID: "demo-order", TransactionServiceGroup: "my_test_tx_group", Role: "TMRole", Address: tm.address, Version: "1.2.0"},
+		{ApplicationID: "demo-stock", TransactionServiceGroup: "my_test_tx_group", Role: "RMRole", Address: rm.address, Version: "1.3.0"},
+	}, views)
+
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/clients?version=1.3.0", &views))
+	assert.Equal(t, 1, len(views))
+	assert.Equal(t, "demo-stock", views[0].ApplicationID)
+
+	rm.closed = true
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/clients?application_id=demo-stock", &views))
+	assert.Equal(t, 0, len(views))
+}
+
+func TestAdminServer_ListDeadlocks(t *testing.T) {
+	admin, _, cleanup := adminServerProvider(t)
+	defer cleanup()
+
+	var views []DeadlockView
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/deadlocks", &views))
+	assert.Equal(t, 0, len(views))
+
+	admin.lockManager = &adminTestDeadlockDetector{deadlocks: []lock.Deadlock{{
+		Time:   1000,
+		Policy: "youngest",
+		Victim: "xid-2",
+		Transactions: []lock.WaitingTransaction{
+			{XID: "xid-2", TransactionID: 2, BranchID: 21, RowKeys: []string{"jdbc^^^t^^^1"}},
+			{XID: "xid-1", TransactionID: 1, BranchID: 11, RowKeys: []string{"jdbc^^^t^^^2"}},
+		},
+	}}}
+	assert.Equal(t, http.StatusOK, adminRequest(t, admin, http.MethodGet, "/admin/deadlocks", &views))
+	assert.Equal(t, 1, len(views))
+	assert.Equal(t, "xid-2", views[0].Victim)
+	assert.Equal(t, 2, len(views[0].Transactions))
+	assert.Equal(t, int64(11), views[0].Transactions[1].BranchID)
+	assert.Equal(t, []string{"jdbc^^^t^^^2"}, views[0].Transactions[1].RowKeys)
+}
+
+// adminTestDeadlockDetector is a lock manager reporting fixed deadlocks.
+type adminTestDeadlockDetector struct {
+	lock.LockManager
+	deadlocks []lock.Deadlock
+}
+
+func (detector *adminTestDeadlockDetector) Deadlocks() []lock.Deadlock {
+	return detector.deadlocks
+}
+
+// adminTestSession is the part of a getty session the session manager reads.
+type adminTestSession struct {
+	getty.Session
+	address string
+	closed  bool
+}
+
+func (session *adminTestSession) RemoteAddr() string {
+	return session.address
+}
+
+func (session *adminTestSession) IsClosed() bool {
+	return session.closed
+}
+
+func adminServerProvider(t *testing.T) (*AdminServer, holder.SessionManager, func()) {
+	dir, err := ioutil.TempDir("", "starfish-admin")
+	assert.Nil(t, err)
+	audit, err := newAuditLogger(filepath.Join(dir, "audit.log"))
+	assert.Nil(t, err)
+
+	sessionManager := holder.NewDefaultSessionManager("root")
+	admin := &AdminServer{
+		sessionHolder: holder.SessionHolder{
+			RootSessionManager:             sessionManager,
+			AsyncCommittingSessionManager:  holder.NewDefaultSessionManager(holder.ASYNC_COMMITTING_SESSION_MANAGER_NAME),
+			RetryCommittingSessionManager:  holder.NewDefaultSessionManager(holder.RETRY_COMMITTING_SESSION_MANAGER_NAME),
+			RetryRollbackingSessionManager: holder.NewDefaultSessionManager(holder.RETRY_ROLLBACKING_SESSION_MANAGER_NAME),
+		},
+		coordinator: &DefaultCoordinator{},
+		audit:       audit,
+	}
+	admin.conf.AuditLogPath = filepath.Join(dir, "audit.log")
+	return admin, sessionManager, func() {
+		audit.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func adminGlobalSessionProvider(applicationID string, transactionName string, status meta.GlobalStatus) *session.GlobalSession {
+	common.Init("127.0.0.1", 8091)
+	gs := session.NewGlobalSession(
+		session.WithGsApplicationID(applicationID),
+		session.WithGsTransactionServiceGroup("my_test_tx_group"),
+		session.WithGsTransactionName(transactionName),
+		session.WithGsTimeout(60000),
+	)
+	gs.Begin()
+	gs.Status = status
+	return gs
+}
+
+func adminRequest(t *testing.T, admin *AdminServer, method string, target string, v interface{}) int {
+	request := httptest.NewRequest(method, target, nil)
+	request.RemoteAddr = "127.0.0.1:40000"
+	request.Header.Set(AdminOperatorHeader, "admin")
+	recorder := httptest.NewRecorder()
+	admin.handler().ServeHTTP(recorder, request)
+	if v != nil && recorder.Code == http.StatusOK {
+		assert.Nil(t, json.Unmarshal(recorder.Body.Bytes(), v))
+	}
+	return recorder.Code
+}
@@ -0,0 +1,230 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/holder"
+	"github.com/transaction-mesh/starfish/pkg/tc/lock"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+// GlobalSessionView is the json form of a global session served by the admin api.
+type GlobalSessionView struct {
+	XID                     string              `json:"xid"`
+	TransactionID           int64               `json:"transaction_id"`
+	Status                  string              `json:"status"`
+	ApplicationID           string              `json:"application_id"`
+	TransactionServiceGroup string              `json:"transaction_service_group"`
+	TransactionName         string              `json:"transaction_name"`
+	Timeout                 int32               `json:"timeout"`
+	BeginTime               int64               `json:"begin_time"`
+	Active                  bool                `json:"active"`
+	Branches                []BranchSessionView `json:"branches,omitempty"`
+
+	// EndTime and RetryCount are only set on the archived sessions.
+	EndTime    int64 `json:"end_time,omitempty"`
+	RetryCount int32 `json:"retry_count,omitempty"`
+}
+
+// BranchSessionView is the json form of a branch session, with the row locks it holds.
+type BranchSessionView struct {
+	BranchID        int64         `json:"branch_id"`
+	ResourceGroupID string        `json:"resource_group_id,omitempty"`
+	ResourceID      string        `json:"resource_id"`
+	BranchType      string        `json:"branch_type"`
+	Status          string        `json:"status"`
+	ClientID        string        `json:"client_id"`
+	Locks           []RowLockView `json:"locks,omitempty"`
+}
+
+// RowLockView is one row lock held by a branch session.
+type RowLockView struct {
+	XID        string `json:"xid"`
+	BranchID   int64  `json:"branch_id"`
+	ResourceID string `json:"resource_id"`
+	TableName  string `json:"table_name"`
+	Pk         string `json:"pk"`
+	LockMode   string `json:"lock_mode"`
+}
+
+// ClientView is a client registered to the server and the version it runs.
+type ClientView struct {
+	ApplicationID           string `json:"application_id"`
+	TransactionServiceGroup string `json:"transaction_service_group"`
+	Role                    string `json:"role"`
+	Address                 string `json:"address"`
+	Version                 string `json:"version"`
+}
+
+// DeadlockView is a lock wait deadlock, each transaction waited for the next
+// one and the last one for the first.
+type DeadlockView struct {
+	Time         int64                    `json:"time"`
+	Policy       string                   `json:"policy"`
+	Victim       string                   `json:"victim"`
+	Transactions []WaitingTransactionView `json:"transactions"`
+}
+
+// WaitingTransactionView is a global transaction of a deadlock with the branch
+// registration that waited and the rows it waited for.
+type WaitingTransactionView struct {
+	XID             string   `json:"xid"`
+	TransactionID   int64    `json:"transaction_id"`
+	TransactionName string   `json:"transaction_name"`
+	BeginTime       int64    `json:"begin_time"`
+	BranchCount     int      `json:"branch_count"`
+	Priority        int      `json:"priority"`
+	BranchID        int64    `json:"branch_id"`
+	LockMode        string   `json:"lock_mode"`
+	RowKeys         []string `json:"row_keys"`
+}
+
+func NewDeadlockView(deadlock lock.Deadlock) DeadlockView {
+	view := DeadlockView{
+		Time:         deadlock.Time,
+		Policy:       deadlock.Policy,
+		Victim:       deadlock.Victim,
+		Transactions: make([]WaitingTransactionView, 0, len(deadlock.Transactions)),
+	}
+	for _, transaction := range deadlock.Transactions {
+		view.Transactions = append(view.Transactions, WaitingTransactionView{
+			XID:             transaction.XID,
+			TransactionID:   transaction.TransactionID,
+			TransactionName: transaction.TransactionName,
+			BeginTime:       transaction.BeginTime,
+			BranchCount:     transaction.BranchCount,
+			Priority:        transaction.Priority,
+			BranchID:        transaction.BranchID,
+			LockMode:        transaction.LockMode.String(),
+			RowKeys:         transaction.RowKeys,
+		})
+	}
+	return view
+}
+
+func NewClientView(client ClientInfo) ClientView {
+	return ClientView{
+		ApplicationID:           client.ApplicationID,
+		TransactionServiceGroup: client.TransactionServiceGroup,
+		Role:                    client.Role.String(),
+		Address:                 client.Address,
+		Version:                 client.Version,
+	}
+}
+
+func NewGlobalSessionView(globalSession *session.GlobalSession) GlobalSessionView {
+	return GlobalSessionView{
+		XID:                     globalSession.XID,
+		TransactionID:           globalSession.TransactionID,
+		Status:                  globalSession.Status.String(),
+		ApplicationID:           globalSession.ApplicationID,
+		TransactionServiceGroup: globalSession.TransactionServiceGroup,
+		TransactionName:         globalSession.TransactionName,
+		Timeout:                 globalSession.Timeout,
+		BeginTime:               globalSession.BeginTime,
+		Active:                  globalSession.Active,
+	}
+}
+
+// NewGlobalSessionDetailView also lists the branch sessions and their row locks.
+func NewGlobalSessionDetailView(globalSession *session.GlobalSession, lockManager lock.LockManager) GlobalSessionView {
+	view := NewGlobalSessionView(globalSession)
+	locks := ListRowLockViews(lockManager, []*session.GlobalSession{globalSession}, globalSession.XID, "")
+	for _, branchSession := range globalSession.GetSortedBranches() {
+		branchView := BranchSessionView{
+			BranchID:        branchSession.BranchID,
+			ResourceGroupID: branchSession.ResourceGroupID,
+			ResourceID:      branchSession.ResourceID,
+			BranchType:      branchSession.BranchType.String(),
+			Status:          branchSession.Status.String(),
+			ClientID:        branchSession.ClientID,
+		}
+		for _, rowLock := range locks {
+			if rowLock.BranchID == branchSession.BranchID {
+				branchView.Locks = append(branchView.Locks, rowLock)
+			}
+		}
+		view.Branches = append(view.Branches, branchView)
+	}
+	return view
+}
+
+// NewHistorySessionView is the view of an archived session with the branches
+// it had, in the status each ended in.
+func NewHistorySessionView(record *holder.SessionHistoryRecord) GlobalSessionView {
+	globalTransaction := record.Global
+	view := GlobalSessionView{
+		XID:                     globalTransaction.XID,
+		TransactionID:           globalTransaction.TransactionID,
+		Status:                  meta.GlobalStatus(globalTransaction.Status).String(),
+		ApplicationID:           globalTransaction.ApplicationID,
+		TransactionServiceGroup: globalTransaction.TransactionServiceGroup,
+		TransactionName:         globalTransaction.TransactionName,
+		Timeout:                 globalTransaction.Timeout,
+		BeginTime:               globalTransaction.BeginTime,
+		EndTime:                 globalTransaction.EndTime,
+		RetryCount:              globalTransaction.RetryCount,
+	}
+	for _, branchTransaction := range record.Branches {
+		view.Branches = append(view.Branches, BranchSessionView{
+			BranchID:        branchTransaction.BranchID,
+			ResourceGroupID: branchTransaction.ResourceGroupID,
+			ResourceID:      branchTransaction.ResourceID,
+			BranchType:      branchTransaction.BranchType,
+			Status:          meta.BranchStatus(branchTransaction.Status).String(),
+			ClientID:        branchTransaction.ClientID,
+		})
+	}
+	return view
+}
+
+// ListRowLockViews returns the row locks held by xid on resourceID, an empty
+// argument matches every value. They are read from the lock store when it
+// keeps them, otherwise derived from the lock keys of globalSessions.
+func ListRowLockViews(lockManager lock.LockManager, globalSessions []*session.GlobalSession,
+	xid string, resourceID string) []RowLockView {
+	var rowLocks []*lock.RowLock
+	if lister, ok := lockManager.(lock.RowLockLister); ok {
+		rowLocks = lister.ListRowLocks(xid, resourceID)
+	} else {
+		for _, globalSession := range globalSessions {
+			if xid != "" && globalSession.XID != xid {
+				continue
+			}
+			for _, branchSession := range globalSession.GetSortedBranches() {
+				if resourceID == "" || branchSession.ResourceID == resourceID {
+					rowLocks = append(rowLocks, lock.CollectRowLocks(branchSession)...)
+				}
+			}
+		}
+	}
+
+	views := make([]RowLockView, 0, len(rowLocks))
+	for _, rowLock := range rowLocks {
+		views = append(views, RowLockView{
+			XID:        rowLock.XID,
+			BranchID:   rowLock.BranchID,
+			ResourceID: rowLock.ResourceID,
+			TableName:  rowLock.TableName,
+			Pk:         rowLock.Pk,
+			LockMode:   rowLock.LockMode.String(),
+		})
+	}
+	return views
+}
@@ -0,0 +1,145 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/auth"
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/holder"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+const defaultMaxClockSkew = 5 * time.Minute
+
+// Authenticator verifies the credential of registering clients and restricts
+// registered clients to the global transactions of their application.
+type Authenticator struct {
+	enabled      bool
+	maxClockSkew time.Duration
+	applications map[string]config.ApplicationAuth
+
+	findGlobalSession func(xid string) *session.GlobalSession
+}
+
+func NewAuthenticator(conf config.AuthConfig) *Authenticator {
+	maxClockSkew := conf.MaxClockSkew
+	if maxClockSkew <= 0 {
+		maxClockSkew = defaultMaxClockSkew
+	}
+	applications := make(map[string]config.ApplicationAuth, len(conf.Applications))
+	for _, application := range conf.Applications {
+		applications[application.ApplicationID] = application
+	}
+	return &Authenticator{
+		enabled:      conf.Enabled,
+		maxClockSkew: maxClockSkew,
+		applications: applications,
+		findGlobalSession: func(xid string) *session.GlobalSession {
+			return holder.GetSessionHolder().FindGlobalSession(xid)
+		},
+	}
+}
+
+// Authenticate checks the application of request is known, may register to
+// its transaction service group and signed headMap with its secret.
+func (authenticator *Authenticator) Authenticate(request protocal.AbstractIdentifyRequest, headMap map[string]string) error {
+	if !authenticator.enabled {
+		return nil
+	}
+	application, ok := authenticator.applications[request.ApplicationID]
+	if !ok {
+		return errors.Errorf("unknown application %s", request.ApplicationID)
+	}
+	if !containsString(application.TransactionServiceGroups, request.TransactionServiceGroup) {
+		return errors.Errorf("application %s is not allowed to register to transaction service group %s",
+			request.ApplicationID, request.TransactionServiceGroup)
+	}
+	if err := auth.Verify(application.Secret, request.ApplicationID, request.TransactionServiceGroup,
+		headMap, time.Now(), authenticator.maxClockSkew); err != nil {
+		return errors.Wrapf(err, "authenticate application %s", request.ApplicationID)
+	}
+	return nil
+}
+
+// Authorize checks the client of ctx may operate on the global transaction msg
+// refers to. Only the application which began a global transaction may end it
+// or query its status, branches may also be registered and reported by the
+// applications of the same transaction service group.
+func (authenticator *Authenticator) Authorize(msg protocal.MessageTypeAware, ctx RpcContext) error {
+	if !authenticator.enabled {
+		return nil
+	}
+	var (
+		xid    string
+		branch bool
+	)
+	switch req := msg.(type) {
+	case protocal.GlobalCommitRequest:
+		xid = req.XID
+	case protocal.GlobalRollbackRequest:
+		xid = req.XID
+	case protocal.GlobalStatusRequest:
+		xid = req.XID
+	case protocal.GlobalReportRequest:
+		xid = req.XID
+	case protocal.BranchRegisterRequest:
+		xid, branch = req.XID, true
+	case protocal.BranchReportRequest:
+		xid, branch = req.XID, true
+	case protocal.GlobalLockQueryRequest:
+		xid, branch = req.XID, true
+	default:
+		return nil
+	}
+
+	globalSession := authenticator.findGlobalSession(xid)
+	if globalSession == nil {
+		// reported as not existing by the handler of msg
+		return nil
+	}
+	if globalSession.ApplicationID == ctx.ApplicationID {
+		return nil
+	}
+	if branch && globalSession.TransactionServiceGroup != "" &&
+		globalSession.TransactionServiceGroup == ctx.TransactionServiceGroup {
+		return nil
+	}
+	return meta.NewTransactionException(
+		errors.Errorf("application %s is not allowed to operate on global transaction %s of application %s",
+			ctx.ApplicationID, xid, globalSession.ApplicationID),
+		meta.WithTransactionExceptionCode(meta.TransactionExceptionCodeUnauthorized))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
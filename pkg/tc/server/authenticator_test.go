@@ -0,0 +1,104 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/auth"
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+func TestAuthenticator_Authenticate(t *testing.T) {
+	authenticator := authenticatorProvider()
+	request := protocal.AbstractIdentifyRequest{ApplicationID: "order-service", TransactionServiceGroup: "my_test_tx_group"}
+	headMap := auth.SignedHeadMap("order-secret", "order-service", "my_test_tx_group", time.Now())
+	assert.Nil(t, authenticator.Authenticate(request, headMap))
+
+	// signed by the secret of another application
+	assert.NotNil(t, authenticator.Authenticate(request,
+		auth.SignedHeadMap("stock-secret", "order-service", "my_test_tx_group", time.Now())))
+	assert.NotNil(t, authenticator.Authenticate(request, nil))
+
+	unknown := protocal.AbstractIdentifyRequest{ApplicationID: "unknown-service", TransactionServiceGroup: "my_test_tx_group"}
+	assert.NotNil(t, authenticator.Authenticate(unknown,
+		auth.SignedHeadMap("order-secret", "unknown-service", "my_test_tx_group", time.Now())))
+
+	otherGroup := protocal.AbstractIdentifyRequest{ApplicationID: "order-service", TransactionServiceGroup: "other_tx_group"}
+	assert.NotNil(t, authenticator.Authenticate(otherGroup,
+		auth.SignedHeadMap("order-secret", "order-service", "other_tx_group", time.Now())))
+
+	// everyone is accepted while auth is disabled
+	assert.Nil(t, NewAuthenticator(config.AuthConfig{}).Authenticate(unknown, nil))
+}
+
+func TestAuthenticator_Authorize(t *testing.T) {
+	authenticator := authenticatorProvider()
+	gs := adminGlobalSessionProvider("order-service", "CreateOrder", meta.GlobalStatusBegin)
+	authenticator.findGlobalSession = func(xid string) *session.GlobalSession {
+		if xid == gs.XID {
+			return gs
+		}
+		return nil
+	}
+	order := RpcContext{ApplicationID: "order-service", TransactionServiceGroup: "my_test_tx_group"}
+	stock := RpcContext{ApplicationID: "stock-service", TransactionServiceGroup: "my_test_tx_group"}
+	intruder := RpcContext{ApplicationID: "intruder-service", TransactionServiceGroup: "other_tx_group"}
+
+	commit := protocal.GlobalCommitRequest{AbstractGlobalEndRequest: protocal.AbstractGlobalEndRequest{XID: gs.XID}}
+	assert.Nil(t, authenticator.Authorize(commit, order))
+	err := authenticator.Authorize(commit, stock)
+	var trxException *meta.TransactionException
+	assert.True(t, errors.As(err, &trxException))
+	assert.Equal(t, meta.TransactionExceptionCodeUnauthorized, trxException.Code)
+
+	branchRegister := protocal.BranchRegisterRequest{XID: gs.XID, BranchType: meta.BranchTypeAT, ResourceID: "stock"}
+	assert.Nil(t, authenticator.Authorize(branchRegister, order))
+	assert.Nil(t, authenticator.Authorize(branchRegister, stock))
+	assert.NotNil(t, authenticator.Authorize(branchRegister, intruder))
+
+	rollback := protocal.GlobalRollbackRequest{AbstractGlobalEndRequest: protocal.AbstractGlobalEndRequest{XID: gs.XID}}
+	assert.NotNil(t, authenticator.Authorize(rollback, intruder))
+
+	// unknown transactions are left to the handlers
+	missing := protocal.GlobalCommitRequest{AbstractGlobalEndRequest: protocal.AbstractGlobalEndRequest{XID: "127.0.0.1:8091:1"}}
+	assert.Nil(t, authenticator.Authorize(missing, intruder))
+	assert.Nil(t, authenticator.Authorize(protocal.GlobalBeginRequest{Timeout: 60000}, intruder))
+}
+
+func authenticatorProvider() *Authenticator {
+	return NewAuthenticator(config.AuthConfig{
+		Enabled: true,
+		Applications: []config.ApplicationAuth{
+			{ApplicationID: "order-service", Secret: "order-secret", TransactionServiceGroups: []string{"my_test_tx_group"}},
+			{ApplicationID: "stock-service", Secret: "stock-secret", TransactionServiceGroups: []string{"my_test_tx_group"}},
+			{ApplicationID: "intruder-service", Secret: "intruder-secret", TransactionServiceGroups: []string{"other_tx_group"}},
+		},
+	})
+}
@@ -0,0 +1,67 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/common/version"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+)
+
+// checkClientVersion refuses a client whose version is outside the configured
+// window, naming the window so the operator knows what to upgrade to.
+func checkClientVersion(conf config.VersionConfig, clientVersion string) error {
+	if conf.MinClientVersion == "" && conf.MaxClientVersion == "" {
+		return nil
+	}
+	if _, err := version.Parse(clientVersion); err != nil {
+		return errors.Errorf("client version %q is unknown, supported client versions are %s",
+			clientVersion, clientVersionWindow(conf))
+	}
+	if conf.MinClientVersion != "" {
+		if c, err := version.Compare(clientVersion, conf.MinClientVersion); err != nil || c < 0 {
+			return errors.Errorf("client version %s is too old, supported client versions are %s",
+				clientVersion, clientVersionWindow(conf))
+		}
+	}
+	if conf.MaxClientVersion != "" {
+		if c, err := version.Compare(clientVersion, conf.MaxClientVersion); err != nil || c > 0 {
+			return errors.Errorf("client version %s is too new, supported client versions are %s",
+				clientVersion, clientVersionWindow(conf))
+		}
+	}
+	return nil
+}
+
+// clientVersionWindow is the value of protocal.HeadClientVersions.
+func clientVersionWindow(conf config.VersionConfig) string {
+	return conf.MinClientVersion + "-" + conf.MaxClientVersion
+}
+
+// versionHeadMap advertises the versions the server supports on the responses
+// to register requests.
+func versionHeadMap(conf config.VersionConfig) map[string]string {
+	return map[string]string{
+		protocal.HeadProtocolVersions: protocal.SupportedProtocolVersions(),
+		protocal.HeadClientVersions:   clientVersionWindow(conf),
+	}
+}
@@ -0,0 +1,48 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+)
+
+func TestCheckClientVersion(t *testing.T) {
+	assert.Nil(t, checkClientVersion(config.VersionConfig{}, ""))
+
+	conf := config.VersionConfig{MinClientVersion: "1.1.0", MaxClientVersion: "1.9"}
+	for _, accepted := range []string{"1.1.0", "v1.4.2", "1.9.0"} {
+		assert.Nil(t, checkClientVersion(conf, accepted), accepted)
+	}
+	for _, refused := range []string{"", "dev", "1.0.9", "1.9.1", "2.0.0"} {
+		err := checkClientVersion(conf, refused)
+		if assert.NotNil(t, err, refused) {
+			assert.Contains(t, err.Error(), "supported client versions are 1.1.0-1.9")
+		}
+	}
+
+	assert.Nil(t, checkClientVersion(config.VersionConfig{MinClientVersion: "1.1.0"}, "3.0.0"))
+	assert.NotNil(t, checkClientVersion(config.VersionConfig{MaxClientVersion: "1.9"}, "3.0.0"))
+}
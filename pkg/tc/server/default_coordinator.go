@@ -18,6 +18,7 @@
 package server
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -36,7 +37,6 @@ import (
 	getty2 "github.com/transaction-mesh/starfish/pkg/base/getty"
 	"github.com/transaction-mesh/starfish/pkg/base/meta"
 	"github.com/transaction-mesh/starfish/pkg/base/protocal"
-	"github.com/transaction-mesh/starfish/pkg/base/protocal/codec"
 	"github.com/transaction-mesh/starfish/pkg/tc/config"
 	"github.com/transaction-mesh/starfish/pkg/tc/event"
 	"github.com/transaction-mesh/starfish/pkg/tc/holder"
@@ -50,24 +50,52 @@ import (
 const (
 	RpcRequestTimeout   = 30 * time.Second
 	AlwaysRetryBoundary = 0
+
+	drainCheckPeriod = 100 * time.Millisecond
 )
 
+var errDraining = errors.New("this transaction coordinator is shutting down")
+
 type DefaultCoordinator struct {
-	conf        *config.ServerConfig
-	core        TransactionCoordinator
-	idGenerator *atomic.Uint32
-	futures     *sync.Map
+	conf          *config.ServerConfig
+	core          TransactionCoordinator
+	idGenerator   *atomic.Uint32
+	futures       *sync.Map
+	forwarder     *Forwarder
+	authenticator *Authenticator
+
+	// draining is set once the coordinator refuses new global transactions,
+	// inflight counts the transaction requests being processed.
+	draining *atomic.Bool
+	inflight *atomic.Int64
+
+	// driving holds the xids of the global sessions a retry task or an admin
+	// action is committing or rolling back, only one of them drives a session
+	// at a time.
+	driving sync.Map
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	loops  sync.WaitGroup
 }
 
 func NewDefaultCoordinator(conf *config.ServerConfig) *DefaultCoordinator {
+	ctx, cancel := context.WithCancel(context.Background())
 	coordinator := &DefaultCoordinator{
-		conf:        conf,
-		idGenerator: &atomic.Uint32{},
-		futures:     &sync.Map{},
+		conf:          conf,
+		idGenerator:   &atomic.Uint32{},
+		futures:       &sync.Map{},
+		authenticator: NewAuthenticator(conf.AuthConfig),
+		draining:      atomic.NewBool(false),
+		inflight:      atomic.NewInt64(0),
+		ctx:           ctx,
+		cancel:        cancel,
 	}
-	core := NewCore(coordinator)
+	core := NewCore(coordinator, conf.PhaseTwoConfig)
 	coordinator.core = core
+	coordinator.forwarder = NewForwarder(coordinator)
 
+	coordinator.loops.Add(5)
 	go coordinator.processTimeoutCheck()
 	go coordinator.processRetryRollingBack()
 	go coordinator.processRetryCommitting()
@@ -76,6 +104,21 @@ func NewDefaultCoordinator(conf *config.ServerConfig) *DefaultCoordinator {
 	return coordinator
 }
 
+// beginRequest counts msg as in flight, it refuses to begin new global
+// transactions once the coordinator is draining.
+func (coordinator *DefaultCoordinator) beginRequest(msg protocal.MessageTypeAware) error {
+	coordinator.inflight.Inc()
+	if msg.GetTypeCode() == protocal.TypeGlobalBegin && coordinator.draining.Load() {
+		coordinator.inflight.Dec()
+		return errDraining
+	}
+	return nil
+}
+
+func (coordinator *DefaultCoordinator) endRequest() {
+	coordinator.inflight.Dec()
+}
+
 func (coordinator *DefaultCoordinator) sendAsyncRequestWithResponse(session getty.Session, msg interface{}, timeout time.Duration) (interface{}, error) {
 	if timeout <= time.Duration(0) {
 		return nil, errors.New("timeout should more than 0ms")
@@ -96,7 +139,7 @@ func (coordinator *DefaultCoordinator) sendAsyncRequest(session getty.Session, m
 	rpcMessage := protocal.RpcMessage{
 		ID:          int32(coordinator.idGenerator.Inc()),
 		MessageType: protocal.MSGTypeRequestOneway,
-		Codec:       codec.SEATA,
+		Codec:       SessionManager.GetCodecFromGettySession(session),
 		Compressor:  0,
 		Body:        msg,
 	}
@@ -139,6 +182,10 @@ func (coordinator *DefaultCoordinator) defaultSendResponse(request protocal.RpcM
 	} else {
 		resp.MessageType = protocal.MSGTypeResponse
 	}
+	switch msg.(type) {
+	case protocal.RegisterTMResponse, protocal.RegisterRMResponse:
+		resp.HeadMap = versionHeadMap(coordinator.conf.VersionConfig)
+	}
 	pkgLen, sendLen, err := session.WritePkg(resp, time.Duration(0))
 	if err != nil || (pkgLen != 0 && pkgLen != sendLen) {
 		log.Warnf("start to close the session because %d of %d bytes data is sent success. err:%+v", sendLen, pkgLen, err)
@@ -148,62 +195,45 @@ func (coordinator *DefaultCoordinator) defaultSendResponse(request protocal.RpcM
 	}
 }
 
-func (coordinator *DefaultCoordinator) processTimeoutCheck() {
+// runPeriodically calls handle every period until the coordinator is stopped.
+func (coordinator *DefaultCoordinator) runPeriodically(period time.Duration, handle func()) {
+	defer coordinator.loops.Done()
 	for {
-		timer := time.NewTimer(coordinator.conf.TimeoutRetryPeriod)
+		timer := time.NewTimer(period)
 		select {
+		case <-coordinator.ctx.Done():
+			timer.Stop()
+			return
 		case <-timer.C:
-			coordinator.timeoutCheck()
+			handle()
 		}
-		timer.Stop()
 	}
 }
 
+func (coordinator *DefaultCoordinator) processTimeoutCheck() {
+	coordinator.runPeriodically(coordinator.conf.TimeoutRetryPeriod, coordinator.timeoutCheck)
+}
+
 func (coordinator *DefaultCoordinator) processRetryRollingBack() {
-	for {
-		timer := time.NewTimer(coordinator.conf.RollingBackRetryPeriod)
-		select {
-		case <-timer.C:
-			coordinator.handleRetryRollingBack()
-		}
-		timer.Stop()
-	}
+	coordinator.runPeriodically(coordinator.conf.RollingBackRetryPeriod, coordinator.handleRetryRollingBack)
 }
 
 func (coordinator *DefaultCoordinator) processRetryCommitting() {
-	for {
-		timer := time.NewTimer(coordinator.conf.CommittingRetryPeriod)
-		select {
-		case <-timer.C:
-			coordinator.handleRetryCommitting()
-		}
-		timer.Stop()
-	}
+	coordinator.runPeriodically(coordinator.conf.CommittingRetryPeriod, coordinator.handleRetryCommitting)
 }
 
 func (coordinator *DefaultCoordinator) processAsyncCommitting() {
-	for {
-		timer := time.NewTimer(coordinator.conf.AsyncCommittingRetryPeriod)
-		select {
-		case <-timer.C:
-			coordinator.handleAsyncCommitting()
-		}
-		timer.Stop()
-	}
+	coordinator.runPeriodically(coordinator.conf.AsyncCommittingRetryPeriod, coordinator.handleAsyncCommitting)
 }
 
 func (coordinator *DefaultCoordinator) processUndoLogDelete() {
-	for {
-		timer := time.NewTimer(coordinator.conf.LogDeletePeriod)
-		select {
-		case <-timer.C:
-			coordinator.undoLogDelete()
-		}
-		timer.Stop()
-	}
+	coordinator.runPeriodically(coordinator.conf.LogDeletePeriod, coordinator.undoLogDelete)
 }
 
 func (coordinator *DefaultCoordinator) timeoutCheck() {
+	if !holder.GetSessionHolder().IsLeader() {
+		return
+	}
 	allSessions := holder.GetSessionHolder().RootSessionManager.AllSessions()
 	if allSessions == nil && len(allSessions) <= 0 {
 		return
@@ -236,6 +266,9 @@ func (coordinator *DefaultCoordinator) timeoutCheck() {
 }
 
 func (coordinator *DefaultCoordinator) handleRetryRollingBack() {
+	if !holder.GetSessionHolder().IsLeader() {
+		return
+	}
 	rollingBackSessions := holder.GetSessionHolder().RetryRollbackingSessionManager.AllSessions()
 	if rollingBackSessions == nil && len(rollingBackSessions) <= 0 {
 		return
@@ -253,10 +286,17 @@ func (coordinator *DefaultCoordinator) handleRetryRollingBack() {
 			log.Errorf("GlobalSession rollback retry timeout and removed [%s]", rollingBackSession.XID)
 			continue
 		}
-		_, err := coordinator.core.doGlobalRollback(rollingBackSession, true)
-		if err != nil {
-			log.Infof("Failed to retry rolling back [%s]", rollingBackSession.XID)
+		if !coordinator.claimSession(rollingBackSession.XID) {
+			continue
+		}
+		if isRollingBackStatus(lockedStatus(rollingBackSession)) {
+			holder.GetSessionArchive().RecordRetry(rollingBackSession.XID)
+			_, err := coordinator.core.doGlobalRollback(rollingBackSession, true)
+			if err != nil {
+				log.Infof("Failed to retry rolling back [%s]", rollingBackSession.XID)
+			}
 		}
+		coordinator.releaseSession(rollingBackSession.XID)
 	}
 }
 
@@ -268,6 +308,9 @@ func isRetryTimeout(now int64, timeout int64, beginTime int64) bool {
 }
 
 func (coordinator *DefaultCoordinator) handleRetryCommitting() {
+	if !holder.GetSessionHolder().IsLeader() {
+		return
+	}
 	ssMgr := holder.GetSessionHolder().RetryCommittingSessionManager
 	committingSessions := ssMgr.AllSessions()
 	if committingSessions == nil && len(committingSessions) <= 0 {
@@ -280,30 +323,57 @@ func (coordinator *DefaultCoordinator) handleRetryCommitting() {
 			log.Errorf("GlobalSession commit retry timeout and removed [%s]", committingSession.XID)
 			continue
 		}
-		_, err := coordinator.core.doGlobalCommit(committingSession, true)
-		if err != nil {
-			log.Infof("Failed to retry committing [%s]", committingSession.XID)
+		if !coordinator.claimSession(committingSession.XID) {
+			continue
 		}
+		if lockedStatus(committingSession) == meta.GlobalStatusCommitRetrying {
+			holder.GetSessionArchive().RecordRetry(committingSession.XID)
+			_, err := coordinator.core.doGlobalCommit(committingSession, true)
+			if err != nil {
+				log.Infof("Failed to retry committing [%s]", committingSession.XID)
+			}
+		}
+		coordinator.releaseSession(committingSession.XID)
 	}
 }
 
 func (coordinator *DefaultCoordinator) handleAsyncCommitting() {
+	if !holder.GetSessionHolder().IsLeader() {
+		return
+	}
 	asyncCommittingSessions := holder.GetSessionHolder().AsyncCommittingSessionManager.AllSessions()
 	if asyncCommittingSessions == nil && len(asyncCommittingSessions) <= 0 {
 		return
 	}
 	for _, asyncCommittingSession := range asyncCommittingSessions {
-		if asyncCommittingSession.Status != meta.GlobalStatusAsyncCommitting {
+		if !coordinator.claimSession(asyncCommittingSession.XID) {
 			continue
 		}
-		_, err := coordinator.core.doGlobalCommit(asyncCommittingSession, true)
-		if err != nil {
-			log.Infof("Failed to async committing [%s]", asyncCommittingSession.XID)
+		if lockedStatus(asyncCommittingSession) == meta.GlobalStatusAsyncCommitting {
+			_, err := coordinator.core.doGlobalCommit(asyncCommittingSession, true)
+			if err != nil {
+				log.Infof("Failed to async committing [%s]", asyncCommittingSession.XID)
+			}
 		}
+		coordinator.releaseSession(asyncCommittingSession.XID)
 	}
 }
 
+// claimSession marks the global session xid as driven by the caller, it reports
+// false when a retry task or an admin action already drives it.
+func (coordinator *DefaultCoordinator) claimSession(xid string) bool {
+	_, claimed := coordinator.driving.LoadOrStore(xid, true)
+	return !claimed
+}
+
+func (coordinator *DefaultCoordinator) releaseSession(xid string) {
+	coordinator.driving.Delete(xid)
+}
+
 func (coordinator *DefaultCoordinator) undoLogDelete() {
+	if !holder.GetSessionHolder().IsLeader() {
+		return
+	}
 	saveDays := coordinator.conf.UndoConfig.LogSaveDays
 	for key, session := range SessionManager.GetRmSessions() {
 		resourceID := key
@@ -318,5 +388,40 @@ func (coordinator *DefaultCoordinator) undoLogDelete() {
 	}
 }
 
-func (coordinator *DefaultCoordinator) Stop() {
+// Drain stops beginning new global transactions and waits until the requests
+// in flight are done or ctx expires, it returns how many were left unfinished.
+func (coordinator *DefaultCoordinator) Drain(ctx context.Context) int64 {
+	coordinator.draining.Store(true)
+	ticker := time.NewTicker(drainCheckPeriod)
+	defer ticker.Stop()
+	for {
+		inflight := coordinator.inflight.Load()
+		if inflight <= 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return inflight
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop cancels the retry loops and waits for the running rounds to return
+// until ctx expires.
+func (coordinator *DefaultCoordinator) Stop(ctx context.Context) error {
+	coordinator.cancel()
+	coordinator.forwarder.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		coordinator.loops.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return errors.New("retry loops did not stop before the shutdown deadline")
+	}
 }
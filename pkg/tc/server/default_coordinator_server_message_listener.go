@@ -22,7 +22,10 @@ import (
 )
 
 import (
+	"github.com/transaction-mesh/starfish/common/version"
+	"github.com/transaction-mesh/starfish/pkg/base/getty/tlsconfig"
 	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/tc/holder"
 	"github.com/transaction-mesh/starfish/pkg/util/log"
 )
 
@@ -46,6 +49,28 @@ func (coordinator *DefaultCoordinator) OnTrxMessage(rpcMessage protocal.RpcMessa
 }
 
 func (coordinator *DefaultCoordinator) handleTrxMessage(msg protocal.MessageTypeAware, ctx RpcContext) protocal.MessageTypeAware {
+	if err := coordinator.beginRequest(msg); err != nil {
+		return failedResponse(msg, err)
+	}
+	defer coordinator.endRequest()
+
+	sessionHolder := holder.GetSessionHolder()
+	if clusterSessionManager, ok := sessionHolder.RootSessionManager.(holder.ClusterSessionManager); ok && !sessionHolder.IsLeader() {
+		resp, err := coordinator.forwarder.Forward(clusterSessionManager.LeaderForwardAddress(), msg, ctx)
+		if err != nil {
+			log.Errorf("forward message %d to leader failed: %v", msg.GetTypeCode(), err)
+			return failedResponse(msg, err)
+		}
+		return resp
+	}
+	return coordinator.processTrxMessage(msg, ctx)
+}
+
+func (coordinator *DefaultCoordinator) processTrxMessage(msg protocal.MessageTypeAware, ctx RpcContext) protocal.MessageTypeAware {
+	if err := coordinator.authenticator.Authorize(msg, ctx); err != nil {
+		log.Errorf("refuse message %d from %s: %v", msg.GetTypeCode(), ctx.ClientID, err)
+		return failedResponse(msg, err)
+	}
 	switch msg.GetTypeCode() {
 	case protocal.TypeGlobalBegin:
 		req := msg.(protocal.GlobalBeginRequest)
@@ -86,22 +111,68 @@ func (coordinator *DefaultCoordinator) handleTrxMessage(msg protocal.MessageType
 
 func (coordinator *DefaultCoordinator) OnRegRmMessage(rpcMessage protocal.RpcMessage, session getty.Session) {
 	message := rpcMessage.Body.(protocal.RegisterRMRequest)
+	if err := coordinator.checkRegistration(rpcMessage, session, message.AbstractIdentifyRequest); err != nil {
+		log.Errorf("refuse to register rm %s from %s: %v", message.ApplicationID, session.RemoteAddr(), err)
+		coordinator.SendResponse(rpcMessage, session, protocal.RegisterRMResponse{AbstractIdentifyResponse: refusedIdentifyResponse(err)})
+		return
+	}
 
-	//version things
 	SessionManager.RegisterRmGettySession(message, session)
+	SessionManager.RegisterCodec(session, rpcMessage.Codec)
 	log.Debugf("checkAuth for rpc_client:%s,vgroup:%s,applicationID:%s", session.RemoteAddr(), message.TransactionServiceGroup, message.ApplicationID)
 
-	coordinator.SendResponse(rpcMessage, session, protocal.RegisterRMResponse{AbstractIdentifyResponse: protocal.AbstractIdentifyResponse{Identified: true}})
+	coordinator.SendResponse(rpcMessage, session, protocal.RegisterRMResponse{AbstractIdentifyResponse: identifiedResponse()})
 }
 
 func (coordinator *DefaultCoordinator) OnRegTmMessage(rpcMessage protocal.RpcMessage, session getty.Session) {
 	message := rpcMessage.Body.(protocal.RegisterTMRequest)
+	if err := coordinator.checkRegistration(rpcMessage, session, message.AbstractIdentifyRequest); err != nil {
+		log.Errorf("refuse to register tm %s from %s: %v", message.ApplicationID, session.RemoteAddr(), err)
+		coordinator.SendResponse(rpcMessage, session, protocal.RegisterTMResponse{AbstractIdentifyResponse: refusedIdentifyResponse(err)})
+		return
+	}
 
-	//version things
 	SessionManager.RegisterTmGettySession(message, session)
+	SessionManager.RegisterCodec(session, rpcMessage.Codec)
 	log.Debugf("checkAuth for rpc_client:%s,vgroup:%s,applicationID:%s", session.RemoteAddr(), message.TransactionServiceGroup, message.ApplicationID)
 
-	coordinator.SendResponse(rpcMessage, session, protocal.RegisterTMResponse{AbstractIdentifyResponse: protocal.AbstractIdentifyResponse{Identified: true}})
+	coordinator.SendResponse(rpcMessage, session, protocal.RegisterTMResponse{AbstractIdentifyResponse: identifiedResponse()})
+}
+
+// checkRegistration binds the application id a client registers with to the
+// identity of its tls certificate when client authentication is enabled, then
+// verifies the credential and the client version of the request.
+func (coordinator *DefaultCoordinator) checkRegistration(rpcMessage protocal.RpcMessage, session getty.Session,
+	request protocal.AbstractIdentifyRequest) error {
+	tlsConfig := coordinator.conf.GettyConfig.TLSConfig
+	if tlsConfig.Enabled && tlsConfig.ClientAuth {
+		if err := tlsconfig.VerifyApplicationID(session.Conn(), request.ApplicationID); err != nil {
+			return err
+		}
+	}
+	if err := coordinator.authenticator.Authenticate(request, rpcMessage.HeadMap); err != nil {
+		return err
+	}
+	return checkClientVersion(coordinator.conf.VersionConfig, request.Version)
+}
+
+// identifiedResponse tells the client the release version of the server.
+func identifiedResponse() protocal.AbstractIdentifyResponse {
+	return protocal.AbstractIdentifyResponse{
+		Version:    version.Version,
+		Identified: true,
+	}
+}
+
+func refusedIdentifyResponse(err error) protocal.AbstractIdentifyResponse {
+	return protocal.AbstractIdentifyResponse{
+		AbstractResultMessage: protocal.AbstractResultMessage{
+			ResultCode: protocal.ResultCodeFailed,
+			Msg:        err.Error(),
+		},
+		Version:    version.Version,
+		Identified: false,
+	}
 }
 
 func (coordinator *DefaultCoordinator) OnCheckMessage(rpcMessage protocal.RpcMessage, session getty.Session) {
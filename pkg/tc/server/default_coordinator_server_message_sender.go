@@ -29,6 +29,7 @@ import (
 
 import (
 	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/tc/holder"
 )
 
 func (coordinator *DefaultCoordinator) SendResponse(request protocal.RpcMessage, session getty.Session, msg interface{}) {
@@ -49,6 +50,10 @@ func (coordinator *DefaultCoordinator) SendSyncRequest(resourceID string, client
 func (coordinator *DefaultCoordinator) SendSyncRequestWithTimeout(resourceID string, clientID string, message interface{}, timeout time.Duration) (interface{}, error) {
 	session, err := SessionManager.GetGettySession(resourceID, clientID)
 	if err != nil {
+		// the resource manager may be connected to a follower of the cluster.
+		if clusterSessionManager, ok := holder.GetSessionHolder().RootSessionManager.(holder.ClusterSessionManager); ok {
+			return coordinator.forwarder.Deliver(clusterSessionManager.PeerForwardAddresses(), resourceID, clientID, message, timeout)
+		}
 		return nil, errors.WithStack(err)
 	}
 	return coordinator.sendAsyncRequestWithResponse(session, message, timeout)
@@ -143,7 +143,8 @@ func (coordinator *DefaultCoordinator) doGlobalRollback(request protocal.GlobalR
 
 func (coordinator *DefaultCoordinator) doBranchRegister(request protocal.BranchRegisterRequest, ctx RpcContext) protocal.BranchRegisterResponse {
 	var resp = protocal.BranchRegisterResponse{}
-	branchID, err := coordinator.core.BranchRegister(request.BranchType, request.ResourceID, ctx.ClientID, request.XID, request.ApplicationData, request.LockKey)
+	branchID, err := coordinator.core.BranchRegisterWithLockMode(request.BranchType, request.ResourceID, ctx.ClientID, request.XID, request.ApplicationData,
+		request.LockKey, request.LockMode)
 	if err != nil {
 		resp.ResultCode = protocal.ResultCodeFailed
 		var trxException *meta.TransactionException
@@ -184,7 +185,7 @@ func (coordinator *DefaultCoordinator) doBranchReport(request protocal.BranchRep
 
 func (coordinator *DefaultCoordinator) doLockCheck(request protocal.GlobalLockQueryRequest, ctx RpcContext) protocal.GlobalLockQueryResponse {
 	var resp = protocal.GlobalLockQueryResponse{}
-	result, err := coordinator.core.LockQuery(request.BranchType, request.ResourceID, request.XID, request.LockKey)
+	result, err := coordinator.core.LockQueryWithLockMode(request.BranchType, request.ResourceID, request.XID, request.LockKey, request.LockMode)
 	if err != nil {
 		resp.ResultCode = protocal.ResultCodeFailed
 		var trxException *meta.TransactionException
@@ -0,0 +1,69 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+)
+
+func TestDefaultCoordinator_Drain(t *testing.T) {
+	coordinator := drainCoordinatorProvider()
+
+	commit := protocal.GlobalCommitRequest{}
+	assert.Nil(t, coordinator.beginRequest(commit))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, int64(1), coordinator.Drain(ctx))
+
+	// in-flight transactions may still finish, new ones are refused
+	assert.Nil(t, coordinator.beginRequest(protocal.BranchRegisterRequest{}))
+	coordinator.endRequest()
+	assert.Equal(t, errDraining, coordinator.beginRequest(protocal.GlobalBeginRequest{}))
+	resp := coordinator.handleTrxMessage(protocal.GlobalBeginRequest{}, RpcContext{})
+	assert.Equal(t, protocal.ResultCodeFailed, resp.(protocal.GlobalBeginResponse).ResultCode)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		coordinator.endRequest()
+	}()
+	assert.Equal(t, int64(0), coordinator.Drain(context.Background()))
+
+	assert.Nil(t, coordinator.Stop(context.Background()))
+}
+
+func drainCoordinatorProvider() *DefaultCoordinator {
+	return NewDefaultCoordinator(&config.ServerConfig{
+		TimeoutRetryPeriod:         time.Hour,
+		RollingBackRetryPeriod:     time.Hour,
+		CommittingRetryPeriod:      time.Hour,
+		AsyncCommittingRetryPeriod: time.Hour,
+		LogDeletePeriod:            time.Hour,
+	})
+}
@@ -24,6 +24,7 @@ import (
 import (
 	"github.com/transaction-mesh/starfish/pkg/base/meta"
 	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
 	"github.com/transaction-mesh/starfish/pkg/tc/event"
 	"github.com/transaction-mesh/starfish/pkg/tc/holder"
 	"github.com/transaction-mesh/starfish/pkg/tc/lock"
@@ -39,7 +40,7 @@ import (
  *  +--------------------+-----------------------+--------------------+
  *  |	                 |Begin                  |                    |
  *  |                    |BranchRegister         |                    |
- *  |       AT&TCC       |BranchReport           |branchCommit        |
+ *  |     AT&TCC&XA      |BranchReport           |branchCommit        |
  *  |    (DefaultCore)   |Commit                 |branchRollback      |
  *  |                    |Rollback               |                    |
  *  |                    |GetStatus              |                    |
@@ -47,8 +48,8 @@ import (
  *  |	      AT         |LockQuery              |                    |
  *  +--------------------+-----------------------+--------------------+
  *  |                    |(GlobalReport)         |                    |
- *  |                    |doGlobalCommit         |                    |
- *  |        SAGA        |doGlobalRollBack       |                    |
+ *  |                    |doGlobalCommit         |branchCommit        |
+ *  |        SAGA        |doGlobalRollBack       |branchRollback      |
  *  |                    |doGlobalReport         |                    |
  *  +--------------------+-----------------------+--------------------+
  *
@@ -88,19 +89,46 @@ type DefaultCore struct {
 	ATCore
 	SAGACore
 	coreMap map[meta.BranchType]interface{}
+	// phaseTwo sends the phase two requests of the branches concurrently, they
+	// are sent one after another when it is nil.
+	phaseTwo *phaseTwoExecutor
 }
 
-func NewCore(sender ServerMessageSender) TransactionCoordinator {
+func NewCore(sender ServerMessageSender, conf config.PhaseTwoConfig) TransactionCoordinator {
 	return &DefaultCore{
 		AbstractCore: AbstractCore{MessageSender: sender},
 		ATCore:       ATCore{},
-		SAGACore:     SAGACore{},
+		SAGACore:     SAGACore{AbstractCore: AbstractCore{MessageSender: sender}},
 		coreMap:      make(map[meta.BranchType]interface{}),
+		phaseTwo:     newPhaseTwoExecutor(conf.Workers),
 	}
 }
 
+// branchSessionLock acquires the row locks of branchSession, a lock manager
+// queuing the conflicting acquisitions waits no longer than globalSession lives
+// and fails the registration chosen as the victim of a deadlock.
 func (core *ATCore) branchSessionLock(globalSession *session.GlobalSession, branchSession *session.BranchSession) error {
-	result := lock.GetLockManager().AcquireLock(branchSession)
+	if !lock.SupportsLockMode(lock.GetLockManager(), branchSession.LockMode) {
+		return &meta.TransactionException{
+			Code: meta.TransactionExceptionCodeBranchRegisterFailed,
+			Message: fmt.Sprintf("Branch lock acquire failed, the lock store does not support %s locks xid = %s branchID = %d",
+				branchSession.LockMode, globalSession.XID, branchSession.BranchID),
+		}
+	}
+	var result bool
+	if waiter, ok := lock.GetLockManager().(lock.LockWaiter); ok {
+		err := waiter.AcquireBranchLock(globalSession, branchSession)
+		if err == lock.ErrDeadlock {
+			return &meta.TransactionException{
+				Code: meta.TransactionExceptionCodeDeadlock,
+				Message: fmt.Sprintf("Branch lock acquire failed as the victim of a deadlock xid = %s branchID = %d",
+					globalSession.XID, branchSession.BranchID),
+			}
+		}
+		result = err == nil
+	} else {
+		result = lock.GetLockManager().AcquireLock(branchSession)
+	}
 	if !result {
 		return &meta.TransactionException{
 			Code: meta.TransactionExceptionCodeLockKeyConflict,
@@ -119,20 +147,166 @@ func (core *ATCore) branchSessionUnlock(branchSession *session.BranchSession) er
 func (core *ATCore) LockQuery(branchType meta.BranchType,
 	resourceID string,
 	xid string,
-	lockKeys string) bool {
-	return lock.GetLockManager().IsLockable(xid, resourceID, lockKeys)
+	lockKeys string,
+	lockMode meta.LockMode) bool {
+	return lock.GetLockManager().IsLockable(xid, resourceID, lockKeys, lockMode)
 }
 
+// doGlobalCommit confirms the saga branches in registration order. The forward actions of a saga
+// already took effect in phase one, so a branch which failed there can not be committed, the global
+// transaction is turned into a compensation and left to the rollback retry task.
 func (core *SAGACore) doGlobalCommit(globalSession *session.GlobalSession, retrying bool) (bool, error) {
+	for _, bs := range globalSession.GetSortedBranches() {
+		if bs.Status == meta.BranchStatusPhaseOneFailed {
+			log.Errorf("Saga branch failed in phase one, global[%s] will be compensated, branchID = %d", globalSession.XID, bs.BranchID)
+			queueToRetryRollback(globalSession)
+			return false, nil
+		}
+		branchStatus, err := core.branchCommit(globalSession, bs)
+		if err != nil {
+			log.Errorf("Exception committing saga branch xid = %s branchID = %d", globalSession.XID, bs.BranchID)
+			if !retrying {
+				queueToRetryCommit(globalSession)
+			}
+			return false, err
+		}
+		switch branchStatus {
+		case meta.BranchStatusPhaseTwoCommitted:
+			bs.Status = branchStatus
+			removeBranchSession(globalSession, bs)
+			continue
+		case meta.BranchStatusPhaseTwoCommitFailedCanNotRetry:
+			endCommitFailed(globalSession)
+			log.Errorf("Finally, failed to commit saga global[%s] since branch[%d] commit failed", globalSession.XID, bs.BranchID)
+			return false, nil
+		default:
+			if !retrying {
+				queueToRetryCommit(globalSession)
+			}
+			log.Errorf("Failed to commit saga global[%s] since branch[%d] commit failed, will retry later.", globalSession.XID, bs.BranchID)
+			return false, nil
+		}
+	}
+	if globalSession.HasBranch() {
+		log.Infof("Saga global[%s] committing is NOT done.", globalSession.XID)
+		return false, nil
+	}
 	return true, nil
 }
 
+// doGlobalRollback compensates the saga branches in reverse registration order, a compensation is
+// never skipped: the first branch which can not be compensated stops the rollback.
 func (core *SAGACore) doGlobalRollback(globalSession *session.GlobalSession, retrying bool) (bool, error) {
+	for _, bs := range globalSession.GetReverseSortedBranches() {
+		if bs.Status == meta.BranchStatusPhaseOneFailed {
+			// the forward action did not take effect, nothing to compensate.
+			removeBranchSession(globalSession, bs)
+			continue
+		}
+		branchStatus, err := core.branchRollback(globalSession, bs)
+		if err != nil {
+			log.Errorf("Exception compensating saga branch xid = %s branchID = %d", globalSession.XID, bs.BranchID)
+			if !retrying {
+				queueToRetryRollback(globalSession)
+			}
+			return false, err
+		}
+		switch branchStatus {
+		case meta.BranchStatusPhaseTwoRolledBack:
+			bs.Status = branchStatus
+			removeBranchSession(globalSession, bs)
+			log.Infof("Successfully compensate saga branch xid = %s branchID = %d", globalSession.XID, bs.BranchID)
+			continue
+		case meta.BranchStatusPhaseTwoRollbackFailedCanNotRetry:
+			endRollBackFailed(globalSession)
+			log.Errorf("Failed to compensate saga branch and stop retry xid = %s branchID = %d", globalSession.XID, bs.BranchID)
+			return false, nil
+		default:
+			log.Errorf("Failed to compensate saga branch xid = %s branchID = %d, will retry later.", globalSession.XID, bs.BranchID)
+			if !retrying {
+				queueToRetryRollback(globalSession)
+			}
+			return false, nil
+		}
+	}
+	if globalSession.HasBranch() {
+		log.Infof("Saga global[%s] rolling back is NOT done.", globalSession.XID)
+		return false, nil
+	}
 	return true, nil
 }
 
-func (core *SAGACore) doGlobalReport(globalSession *session.GlobalSession, xid string, param meta.GlobalStatus) error {
-	return nil
+// sagaReportTransitions lists the statuses a saga global session may be in when the saga state
+// machine reports a status, the retrying and final statuses follow the phase two they belong to.
+var sagaReportTransitions = map[meta.GlobalStatus][]meta.GlobalStatus{
+	meta.GlobalStatusCommitting:         {meta.GlobalStatusBegin},
+	meta.GlobalStatusRollingBack:        {meta.GlobalStatusBegin},
+	meta.GlobalStatusTimeoutRollingBack: {meta.GlobalStatusBegin},
+
+	meta.GlobalStatusCommitRetrying: {meta.GlobalStatusBegin, meta.GlobalStatusCommitting},
+	meta.GlobalStatusCommitted:      {meta.GlobalStatusBegin, meta.GlobalStatusCommitting, meta.GlobalStatusCommitRetrying},
+	meta.GlobalStatusCommitFailed:   {meta.GlobalStatusBegin, meta.GlobalStatusCommitting, meta.GlobalStatusCommitRetrying},
+
+	meta.GlobalStatusRollbackRetrying: {meta.GlobalStatusBegin, meta.GlobalStatusRollingBack},
+	meta.GlobalStatusRolledBack:       {meta.GlobalStatusBegin, meta.GlobalStatusRollingBack, meta.GlobalStatusRollbackRetrying},
+	meta.GlobalStatusRollbackFailed:   {meta.GlobalStatusBegin, meta.GlobalStatusRollingBack, meta.GlobalStatusRollbackRetrying},
+
+	meta.GlobalStatusTimeoutRollbackRetrying: {meta.GlobalStatusBegin, meta.GlobalStatusTimeoutRollingBack},
+	meta.GlobalStatusTimeoutRolledBack:       {meta.GlobalStatusBegin, meta.GlobalStatusTimeoutRollingBack, meta.GlobalStatusTimeoutRollbackRetrying},
+	meta.GlobalStatusTimeoutRollbackFailed:   {meta.GlobalStatusBegin, meta.GlobalStatusTimeoutRollingBack, meta.GlobalStatusTimeoutRollbackRetrying},
+}
+
+// doGlobalReport applies the status reported by the saga state machine. A final status ends the
+// global session, a retrying status hands it over to the retry tasks of the coordinator. It reports
+// whether the core has to drive the phase two the reported status starts, a status reported again
+// is ignored and a status the current one can not move to is refused.
+func (core *SAGACore) doGlobalReport(globalSession *session.GlobalSession, xid string, globalStatus meta.GlobalStatus) (bool, error) {
+	if globalSession.Status == globalStatus {
+		return false, nil
+	}
+	allowed := false
+	for _, status := range sagaReportTransitions[globalStatus] {
+		if globalSession.Status == status {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false, &meta.TransactionException{
+			Code: meta.TransactionExceptionCodeGlobalTransactionStatusInvalid,
+			Message: fmt.Sprintf("Could not report global status xid = %s status = %s while current status is %s",
+				xid, globalStatus.String(), globalSession.Status.String()),
+		}
+	}
+	if globalSession.Active {
+		globalSession.Active = false
+	}
+	drive := false
+	switch globalStatus {
+	case meta.GlobalStatusCommitting, meta.GlobalStatusRollingBack, meta.GlobalStatusTimeoutRollingBack:
+		changeGlobalSessionStatus(globalSession, globalStatus)
+		drive = true
+	case meta.GlobalStatusCommitRetrying:
+		queueToRetryCommit(globalSession)
+	case meta.GlobalStatusRollbackRetrying, meta.GlobalStatusTimeoutRollbackRetrying:
+		holder.GetSessionHolder().RetryRollbackingSessionManager.AddGlobalSession(globalSession)
+		changeGlobalSessionStatus(globalSession, globalStatus)
+	default:
+		for _, bs := range globalSession.GetSortedBranches() {
+			removeBranchSession(globalSession, bs)
+		}
+		changeGlobalSessionStatus(globalSession, globalStatus)
+		lock.GetLockManager().ReleaseGlobalSessionLock(globalSession)
+		endGlobalSession(globalSession)
+
+		runtime.GoWithRecover(func() {
+			evt := event.NewGlobalTransactionEvent(globalSession.TransactionID, event.RoleTC, globalSession.TransactionName, globalSession.BeginTime,
+				int64(time.CurrentTimeMillis()), globalSession.Status)
+			event.EventBus.GlobalTransactionEventChannel <- evt
+		}, nil)
+	}
+	log.Infof("Successfully report saga global status xid = %s, status = %s", xid, globalStatus.String())
+	return drive, nil
 }
 
 func (core *DefaultCore) Begin(applicationID string, transactionServiceGroup string, name string, timeout int32) (string, error) {
@@ -165,32 +339,57 @@ func (core *DefaultCore) BranchRegister(branchType meta.BranchType,
 	xid string,
 	applicationData []byte,
 	lockKeys string) (int64, error) {
+	return core.BranchRegisterWithLockMode(branchType, resourceID, clientID, xid, applicationData, lockKeys,
+		meta.LockModeExclusive)
+}
+
+func (core *DefaultCore) BranchRegisterWithLockMode(branchType meta.BranchType,
+	resourceID string,
+	clientID string,
+	xid string,
+	applicationData []byte,
+	lockKeys string,
+	lockMode meta.LockMode) (int64, error) {
 	gs, err := assertGlobalSessionNotNull(xid, false)
 	if err != nil {
 		return 0, err
 	}
-	defer gs.Unlock()
 	gs.Lock()
-
 	err1 := globalSessionStatusCheck(gs)
 	if err1 != nil {
-		return 0, err
+		gs.Unlock()
+		return 0, err1
 	}
 
-	bs := session.NewBranchSessionByGlobal(*gs,
+	bs := session.NewBranchSessionByGlobal(gs,
 		session.WithBsBranchType(branchType),
 		session.WithBsResourceID(resourceID),
 		session.WithBsApplicationData(applicationData),
 		session.WithBsLockKey(lockKeys),
+		session.WithBsLockMode(lockMode),
 		session.WithBsClientID(clientID),
 	)
+	gs.Unlock()
 
+	// XA branches are isolated by the database's own locks, only AT needs global row locks.
+	// The locks may be waited for, which is done without holding the global session so that
+	// the timeout check and the TM can end it meanwhile, cancelling the wait.
 	if branchType == meta.BranchTypeAT {
 		err2 := core.ATCore.branchSessionLock(gs, bs)
 		if err2 != nil {
 			return 0, err2
 		}
 	}
+
+	defer gs.Unlock()
+	gs.Lock()
+	err1 = globalSessionStatusCheck(gs)
+	if err1 != nil {
+		if branchType == meta.BranchTypeAT {
+			core.ATCore.branchSessionUnlock(bs)
+		}
+		return 0, err1
+	}
 	gs.Add(bs)
 	err3 := holder.GetSessionHolder().RootSessionManager.AddBranchSession(gs, bs)
 	if err3 != nil {
@@ -265,10 +464,26 @@ func (core *DefaultCore) BranchReport(branchType meta.BranchType,
 }
 
 func (core *DefaultCore) LockQuery(branchType meta.BranchType, resourceID string, xid string, lockKeys string) (bool, error) {
-	return true, nil
+	return core.LockQueryWithLockMode(branchType, resourceID, xid, lockKeys, meta.LockModeExclusive)
+}
+
+// LockQueryWithLockMode checks the row locks of the AT branches, the other
+// branch types hold none.
+func (core *DefaultCore) LockQueryWithLockMode(branchType meta.BranchType, resourceID string, xid string, lockKeys string,
+	lockMode meta.LockMode) (bool, error) {
+	if branchType != meta.BranchTypeAT {
+		return true, nil
+	}
+	if !lock.SupportsLockMode(lock.GetLockManager(), lockMode) {
+		return false, &meta.TransactionException{
+			Code:    meta.TransactionExceptionCodeLockableCheckFailed,
+			Message: fmt.Sprintf("Lock query failed, the lock store does not support %s locks xid = %s", lockMode, xid),
+		}
+	}
+	return core.ATCore.LockQuery(branchType, resourceID, xid, lockKeys, lockMode), nil
 }
 
-func (core *DefaultCore) branchCommit(globalSession *session.GlobalSession, branchSession *session.BranchSession) (meta.BranchStatus, error) {
+func (core *AbstractCore) branchCommit(globalSession *session.GlobalSession, branchSession *session.BranchSession) (meta.BranchStatus, error) {
 	request := protocal.BranchCommitRequest{}
 	request.XID = branchSession.XID
 	request.BranchID = branchSession.BranchID
@@ -286,7 +501,7 @@ func (core *DefaultCore) branchCommit(globalSession *session.GlobalSession, bran
 	return resp, err
 }
 
-func (core *DefaultCore) branchCommitSend(request protocal.BranchCommitRequest,
+func (core *AbstractCore) branchCommitSend(request protocal.BranchCommitRequest,
 	globalSession *session.GlobalSession, branchSession *session.BranchSession) (meta.BranchStatus, error) {
 	resp, err := core.MessageSender.SendSyncRequest(branchSession.ResourceID, branchSession.ClientID, request)
 	if err != nil {
@@ -296,7 +511,7 @@ func (core *DefaultCore) branchCommitSend(request protocal.BranchCommitRequest,
 	return response.BranchStatus, nil
 }
 
-func (core *DefaultCore) branchRollback(globalSession *session.GlobalSession, branchSession *session.BranchSession) (meta.BranchStatus, error) {
+func (core *AbstractCore) branchRollback(globalSession *session.GlobalSession, branchSession *session.BranchSession) (meta.BranchStatus, error) {
 	request := protocal.BranchRollbackRequest{}
 	request.XID = branchSession.XID
 	request.BranchID = branchSession.BranchID
@@ -314,7 +529,7 @@ func (core *DefaultCore) branchRollback(globalSession *session.GlobalSession, br
 	return resp, err
 }
 
-func (core *DefaultCore) branchRollbackSend(request protocal.BranchRollbackRequest,
+func (core *AbstractCore) branchRollbackSend(request protocal.BranchRollbackRequest,
 	globalSession *session.GlobalSession, branchSession *session.BranchSession) (meta.BranchStatus, error) {
 	resp, err := core.MessageSender.SendSyncRequest(branchSession.ResourceID, branchSession.ClientID, request)
 	if err != nil {
@@ -383,6 +598,14 @@ func (core *DefaultCore) doGlobalCommit(globalSession *session.GlobalSession, re
 
 	if globalSession.IsSaga() {
 		success, err = core.SAGACore.doGlobalCommit(globalSession, retrying)
+	} else if core.phaseTwo != nil {
+		if committed, err := core.doBranchesCommit(globalSession, retrying); !committed {
+			return false, err
+		}
+		if globalSession.HasBranch() {
+			log.Infof("Global[%s] committing is NOT done.", globalSession.XID)
+			return false, nil
+		}
 	} else {
 		for _, bs := range globalSession.GetSortedBranches() {
 			if bs.Status == meta.BranchStatusPhaseOneFailed {
@@ -402,6 +625,7 @@ func (core *DefaultCore) doGlobalCommit(globalSession *session.GlobalSession, re
 			}
 			switch branchStatus {
 			case meta.BranchStatusPhaseTwoCommitted:
+				bs.Status = branchStatus
 				removeBranchSession(globalSession, bs)
 				continue
 			case meta.BranchStatusPhaseTwoCommitFailedCanNotRetry:
@@ -497,8 +721,15 @@ func (core *DefaultCore) doGlobalRollback(globalSession *session.GlobalSession,
 
 	if globalSession.IsSaga() {
 		success, err = core.SAGACore.doGlobalRollback(globalSession, retrying)
+	} else if core.phaseTwo != nil {
+		if rolledBack, err := core.doBranchesRollback(globalSession, retrying); !rolledBack {
+			return false, err
+		}
+		if !rollbackDone(globalSession) {
+			return false, nil
+		}
 	} else {
-		for _, bs := range globalSession.GetSortedBranches() {
+		for _, bs := range globalSession.GetReverseSortedBranches() {
 			if bs.Status == meta.BranchStatusPhaseOneFailed {
 				removeBranchSession(globalSession, bs)
 				continue
@@ -513,6 +744,7 @@ func (core *DefaultCore) doGlobalRollback(globalSession *session.GlobalSession,
 			}
 			switch branchStatus {
 			case meta.BranchStatusPhaseTwoRolledBack:
+				bs.Status = branchStatus
 				removeBranchSession(globalSession, bs)
 				log.Infof("Successfully rollback branch xid=%d branchID=%d", globalSession.XID, bs.BranchID)
 				continue
@@ -529,15 +761,7 @@ func (core *DefaultCore) doGlobalRollback(globalSession *session.GlobalSession,
 			}
 		}
 
-		// In db mode, there is a problem of inconsistent data in multiple copies, resulting in new branch
-		// transaction registration when rolling back.
-		// 1. New branch transaction and rollback branch transaction have no data association
-		// 2. New branch transaction has data association with rollback branch transaction
-		// The second query can solve the first problem, and if it is the second problem, it may cause a rollback
-		// failure due to data changes.
-		gs := holder.GetSessionHolder().RootSessionManager.FindGlobalSession(globalSession.XID)
-		if gs != nil && gs.HasBranch() {
-			log.Infof("Global[%d] rolling back is NOT done.", globalSession.XID)
+		if !rollbackDone(globalSession) {
 			return false, nil
 		}
 	}
@@ -555,6 +779,139 @@ func (core *DefaultCore) doGlobalRollback(globalSession *session.GlobalSession,
 	return success, err
 }
 
+// rollbackDone reports whether no branch of globalSession is left to roll back.
+func rollbackDone(globalSession *session.GlobalSession) bool {
+	// In db mode, there is a problem of inconsistent data in multiple copies, resulting in new branch
+	// transaction registration when rolling back.
+	// 1. New branch transaction and rollback branch transaction have no data association
+	// 2. New branch transaction has data association with rollback branch transaction
+	// The second query can solve the first problem, and if it is the second problem, it may cause a rollback
+	// failure due to data changes.
+	gs := holder.GetSessionHolder().RootSessionManager.FindGlobalSession(globalSession.XID)
+	if gs != nil && gs.HasBranch() {
+		log.Infof("Global[%d] rolling back is NOT done.", globalSession.XID)
+		return false
+	}
+	return true
+}
+
+// doBranchesCommit commits the branches of globalSession by the phase two
+// executor and handles the results in the order of the branches, as the loop
+// of doGlobalCommit does. A branch failed in phase one is rolled back once the
+// ones before it are committed, the ones after it are left to a later round.
+// It reports whether the global commit may go on.
+func (core *DefaultCore) doBranchesCommit(globalSession *session.GlobalSession, retrying bool) (bool, error) {
+	branchSessions := globalSession.GetSortedBranches()
+	var phaseOneFailed *session.BranchSession
+	for i, bs := range branchSessions {
+		if bs.Status == meta.BranchStatusPhaseOneFailed {
+			phaseOneFailed, branchSessions = bs, branchSessions[:i]
+			break
+		}
+	}
+
+	results := core.phaseTwo.execute(branchSessions, commitGroup, func(bs *session.BranchSession) (meta.BranchStatus, error) {
+		return core.branchCommit(globalSession, bs)
+	}, meta.BranchStatusPhaseTwoCommitted)
+	for _, result := range results {
+		if result.sent && result.err == nil && result.status == meta.BranchStatusPhaseTwoCommitted {
+			result.branchSession.Status = result.status
+			removeBranchSession(globalSession, result.branchSession)
+		}
+	}
+	for _, result := range results {
+		bs := result.branchSession
+		if !result.sent || (result.err == nil && result.status == meta.BranchStatusPhaseTwoCommitted) {
+			continue
+		}
+		if result.err != nil {
+			log.Errorf("Exception committing branch %v", bs)
+			if !retrying {
+				queueToRetryCommit(globalSession)
+			}
+			return false, result.err
+		}
+		switch result.status {
+		case meta.BranchStatusPhaseTwoCommitFailedCanNotRetry:
+			if globalSession.CanBeCommittedAsync() {
+				log.Errorf("By [%s], failed to commit branch %v", result.status.String(), bs)
+				continue
+			}
+			endCommitFailed(globalSession)
+			log.Errorf("Finally, failed to commit global[%s] since branch[%d] commit failed", globalSession.XID, bs.BranchID)
+			return false, nil
+		default:
+			if !retrying {
+				queueToRetryCommit(globalSession)
+				return false, nil
+			}
+			if globalSession.CanBeCommittedAsync() {
+				log.Errorf("By [%s], failed to commit branch %v", result.status.String(), bs)
+				continue
+			}
+			log.Errorf("ResultCodeFailed to commit global[%s] since branch[%d] commit failed, will retry later.", globalSession.XID, bs.BranchID)
+			return false, nil
+		}
+	}
+
+	if phaseOneFailed != nil {
+		if _, err := core.branchRollback(globalSession, phaseOneFailed); err == nil {
+			removeBranchSession(globalSession, phaseOneFailed)
+		}
+	}
+	return true, nil
+}
+
+// doBranchesRollback rolls the branches of globalSession back by the phase two
+// executor, newest branch first, and handles the results in that order as the
+// loop of doGlobalRollback does. It reports whether the global rollback may go
+// on.
+func (core *DefaultCore) doBranchesRollback(globalSession *session.GlobalSession, retrying bool) (bool, error) {
+	branchSessions := make([]*session.BranchSession, 0)
+	for _, bs := range globalSession.GetReverseSortedBranches() {
+		if bs.Status == meta.BranchStatusPhaseOneFailed {
+			removeBranchSession(globalSession, bs)
+			continue
+		}
+		branchSessions = append(branchSessions, bs)
+	}
+
+	results := core.phaseTwo.execute(branchSessions, rollbackGroup, func(bs *session.BranchSession) (meta.BranchStatus, error) {
+		return core.branchRollback(globalSession, bs)
+	}, meta.BranchStatusPhaseTwoRolledBack)
+	for _, result := range results {
+		if result.sent && result.err == nil && result.status == meta.BranchStatusPhaseTwoRolledBack {
+			result.branchSession.Status = result.status
+			removeBranchSession(globalSession, result.branchSession)
+			log.Infof("Successfully rollback branch xid=%s branchID=%d", globalSession.XID, result.branchSession.BranchID)
+		}
+	}
+	for _, result := range results {
+		bs := result.branchSession
+		if !result.sent || (result.err == nil && result.status == meta.BranchStatusPhaseTwoRolledBack) {
+			continue
+		}
+		if result.err != nil {
+			log.Errorf("Exception rolling back branch xid=%s branchID=%d", globalSession.XID, bs.BranchID)
+			if !retrying {
+				queueToRetryRollback(globalSession)
+			}
+			return false, result.err
+		}
+		if result.status == meta.BranchStatusPhaseTwoRollbackFailedCanNotRetry {
+			endRollBackFailed(globalSession)
+			log.Infof("ResultCodeFailed to rollback branch and stop retry xid=%s branchID=%d", globalSession.XID, bs.BranchID)
+			return false, nil
+		}
+		log.Infof("ResultCodeFailed to rollback branch xid=%s branchID=%d", globalSession.XID, bs.BranchID)
+		if !retrying {
+			queueToRetryRollback(globalSession)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
 func (core *DefaultCore) GetStatus(xid string) (meta.GlobalStatus, error) {
 	gs := holder.GetSessionHolder().RootSessionManager.FindGlobalSession(xid)
 	if gs == nil {
@@ -569,15 +926,32 @@ func (core *DefaultCore) GlobalReport(xid string, globalStatus meta.GlobalStatus
 	if gs == nil {
 		return globalStatus, nil
 	}
-	core.doGlobalReport(gs, xid, globalStatus)
+	drive, err := func(gs *session.GlobalSession) (bool, error) {
+		gs.Lock()
+		defer gs.Unlock()
+		return core.doGlobalReport(gs, xid, globalStatus)
+	}(gs)
+	if err != nil {
+		return gs.Status, err
+	}
+	if drive {
+		if globalStatus == meta.GlobalStatusCommitting {
+			_, err = core.doGlobalCommit(gs, false)
+		} else {
+			_, err = core.doGlobalRollback(gs, false)
+		}
+		if err != nil {
+			return gs.Status, err
+		}
+	}
 	return gs.Status, nil
 }
 
-func (core *DefaultCore) doGlobalReport(globalSession *session.GlobalSession, xid string, globalStatus meta.GlobalStatus) error {
+func (core *DefaultCore) doGlobalReport(globalSession *session.GlobalSession, xid string, globalStatus meta.GlobalStatus) (bool, error) {
 	if globalSession.IsSaga() {
 		return core.SAGACore.doGlobalReport(globalSession, xid, globalStatus)
 	}
-	return nil
+	return false, nil
 }
 
 func endRollBacked(globalSession *session.GlobalSession) {
@@ -587,7 +961,7 @@ func endRollBacked(globalSession *session.GlobalSession) {
 		changeGlobalSessionStatus(globalSession, meta.GlobalStatusRolledBack)
 	}
 	lock.GetLockManager().ReleaseGlobalSessionLock(globalSession)
-	holder.GetSessionHolder().RootSessionManager.RemoveGlobalSession(globalSession)
+	endGlobalSession(globalSession)
 }
 
 func endRollBackFailed(globalSession *session.GlobalSession) {
@@ -597,7 +971,7 @@ func endRollBackFailed(globalSession *session.GlobalSession) {
 		changeGlobalSessionStatus(globalSession, meta.GlobalStatusRollbackFailed)
 	}
 	lock.GetLockManager().ReleaseGlobalSessionLock(globalSession)
-	holder.GetSessionHolder().RootSessionManager.RemoveGlobalSession(globalSession)
+	endGlobalSession(globalSession)
 }
 
 func queueToRetryRollback(globalSession *session.GlobalSession) {
@@ -619,13 +993,13 @@ func isTimeoutGlobalStatus(status meta.GlobalStatus) bool {
 func endCommitted(globalSession *session.GlobalSession) {
 	changeGlobalSessionStatus(globalSession, meta.GlobalStatusCommitted)
 	lock.GetLockManager().ReleaseGlobalSessionLock(globalSession)
-	holder.GetSessionHolder().RootSessionManager.RemoveGlobalSession(globalSession)
+	endGlobalSession(globalSession)
 }
 
 func endCommitFailed(globalSession *session.GlobalSession) {
 	changeGlobalSessionStatus(globalSession, meta.GlobalStatusCommitFailed)
 	lock.GetLockManager().ReleaseGlobalSessionLock(globalSession)
-	holder.GetSessionHolder().RootSessionManager.RemoveGlobalSession(globalSession)
+	endGlobalSession(globalSession)
 }
 
 func queueToRetryCommit(globalSession *session.GlobalSession) {
@@ -639,12 +1013,32 @@ func asyncCommit(globalSession *session.GlobalSession) {
 }
 
 func changeGlobalSessionStatus(globalSession *session.GlobalSession, status meta.GlobalStatus) {
+	leavingBegin := globalSession.Status == meta.GlobalStatusBegin && status != meta.GlobalStatusBegin
 	globalSession.Status = status
 	holder.GetSessionHolder().RootSessionManager.UpdateGlobalSessionStatus(globalSession, status)
+	if leavingBegin {
+		cancelLockWait(globalSession)
+	}
+}
+
+// cancelLockWait fails the branch registrations of globalSession still waiting
+// for row locks, it can not take branches any more.
+func cancelLockWait(globalSession *session.GlobalSession) {
+	if waiter, ok := lock.GetLockManager().(lock.LockWaiter); ok {
+		waiter.CancelWait(globalSession.TransactionID)
+	}
 }
 
 func removeBranchSession(globalSession *session.GlobalSession, branchSession *session.BranchSession) {
 	lock.GetLockManager().ReleaseLock(branchSession)
 	globalSession.Remove(branchSession)
+	holder.GetSessionArchive().ArchiveBranchSession(branchSession)
 	holder.GetSessionHolder().RootSessionManager.RemoveBranchSession(globalSession, branchSession)
 }
+
+// endGlobalSession archives a global session in its final status, then removes
+// it from the store.
+func endGlobalSession(globalSession *session.GlobalSession) {
+	holder.GetSessionArchive().ArchiveGlobalSession(globalSession)
+	holder.GetSessionHolder().RootSessionManager.RemoveGlobalSession(globalSession)
+}
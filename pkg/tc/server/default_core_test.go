@@ -0,0 +1,240 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	getty "github.com/apache/dubbo-getty"
+
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/holder"
+	"github.com/transaction-mesh/starfish/pkg/tc/lock"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+func TestSAGACore_CommitOrder(t *testing.T) {
+	core, sender, restore := sagaCoreProvider()
+	defer restore()
+	gs := sagaGlobalSessionProvider("saga-commit", meta.GlobalStatusBegin, 3)
+
+	status, err := core.Commit(gs.XID)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.GlobalStatusCommitted, status)
+	// the saga branches are confirmed in registration order.
+	assert.Equal(t, []int64{1, 2, 3}, sender.committed())
+	assert.Empty(t, sender.rolledBack())
+	assert.Nil(t, holder.GetSessionHolder().RootSessionManager.FindGlobalSession(gs.XID))
+}
+
+func TestSAGACore_CompensationOrder(t *testing.T) {
+	core, sender, restore := sagaCoreProvider()
+	defer restore()
+	gs := sagaGlobalSessionProvider("saga-rollback", meta.GlobalStatusBegin, 3)
+	gs.GetBranch(2).Status = meta.BranchStatusPhaseOneFailed
+
+	status, err := core.Rollback(gs.XID)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.GlobalStatusRolledBack, status)
+	// the saga branches are compensated newest first, a failed forward action is not compensated.
+	assert.Equal(t, []int64{3, 1}, sender.rolledBack())
+	assert.Empty(t, sender.committed())
+
+	gs = sagaGlobalSessionProvider("saga-rollback-retry", meta.GlobalStatusBegin, 3)
+	sender.rollbackStatus[2] = meta.BranchStatusPhaseTwoRollbackFailedRetryable
+	status, err = core.Rollback(gs.XID)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.GlobalStatusRollbackRetrying, status)
+	// an older branch is not compensated before the newer ones.
+	assert.Equal(t, []int64{3, 1, 3, 2}, sender.rolledBack())
+	assert.NotNil(t, holder.GetSessionHolder().RetryRollbackingSessionManager.FindGlobalSession(gs.XID))
+}
+
+func TestSAGACore_GlobalReport(t *testing.T) {
+	core, sender, restore := sagaCoreProvider()
+	defer restore()
+
+	tests := []struct {
+		current  meta.GlobalStatus
+		reported meta.GlobalStatus
+		expected meta.GlobalStatus
+		ended    bool
+	}{
+		{meta.GlobalStatusBegin, meta.GlobalStatusCommitting, meta.GlobalStatusCommitted, true},
+		{meta.GlobalStatusBegin, meta.GlobalStatusRollingBack, meta.GlobalStatusRolledBack, true},
+		{meta.GlobalStatusBegin, meta.GlobalStatusTimeoutRollingBack, meta.GlobalStatusTimeoutRolledBack, true},
+		{meta.GlobalStatusCommitting, meta.GlobalStatusCommitRetrying, meta.GlobalStatusCommitRetrying, false},
+		{meta.GlobalStatusRollingBack, meta.GlobalStatusRollbackRetrying, meta.GlobalStatusRollbackRetrying, false},
+		{meta.GlobalStatusTimeoutRollingBack, meta.GlobalStatusTimeoutRollbackRetrying, meta.GlobalStatusTimeoutRollbackRetrying, false},
+		{meta.GlobalStatusCommitRetrying, meta.GlobalStatusCommitted, meta.GlobalStatusCommitted, true},
+		{meta.GlobalStatusCommitting, meta.GlobalStatusCommitFailed, meta.GlobalStatusCommitFailed, true},
+		{meta.GlobalStatusRollbackRetrying, meta.GlobalStatusRolledBack, meta.GlobalStatusRolledBack, true},
+		{meta.GlobalStatusRollingBack, meta.GlobalStatusRollbackFailed, meta.GlobalStatusRollbackFailed, true},
+		{meta.GlobalStatusTimeoutRollbackRetrying, meta.GlobalStatusTimeoutRolledBack, meta.GlobalStatusTimeoutRolledBack, true},
+		{meta.GlobalStatusTimeoutRollingBack, meta.GlobalStatusTimeoutRollbackFailed, meta.GlobalStatusTimeoutRollbackFailed, true},
+	}
+	for _, test := range tests {
+		gs := sagaGlobalSessionProvider("saga-report", test.current, 2)
+		status, err := core.GlobalReport(gs.XID, test.reported)
+		assert.Nil(t, err, test.reported.String())
+		assert.Equal(t, test.expected, status, test.reported.String())
+		assert.False(t, gs.Active, test.reported.String())
+		found := holder.GetSessionHolder().RootSessionManager.FindGlobalSession(gs.XID)
+		assert.Equal(t, test.ended, found == nil, test.reported.String())
+		if found != nil {
+			holder.GetSessionHolder().RootSessionManager.RemoveGlobalSession(found)
+		}
+	}
+	// only the in-progress statuses drive the phase two.
+	assert.Equal(t, []int64{1, 2}, sender.committed())
+	assert.Equal(t, []int64{2, 1, 2, 1}, sender.rolledBack())
+}
+
+func TestSAGACore_GlobalReportInvalid(t *testing.T) {
+	core, sender, restore := sagaCoreProvider()
+	defer restore()
+
+	tests := []struct {
+		current  meta.GlobalStatus
+		reported meta.GlobalStatus
+	}{
+		{meta.GlobalStatusBegin, meta.GlobalStatusBegin + 100},
+		{meta.GlobalStatusBegin, meta.GlobalStatusAsyncCommitting},
+		{meta.GlobalStatusCommitting, meta.GlobalStatusRollingBack},
+		{meta.GlobalStatusRollingBack, meta.GlobalStatusCommitted},
+		{meta.GlobalStatusCommitRetrying, meta.GlobalStatusRollbackFailed},
+		{meta.GlobalStatusRollbackRetrying, meta.GlobalStatusTimeoutRolledBack},
+		{meta.GlobalStatusTimeoutRollingBack, meta.GlobalStatusRolledBack},
+	}
+	for _, test := range tests {
+		gs := sagaGlobalSessionProvider("saga-report-invalid", test.current, 2)
+		gs.Active = true
+		status, err := core.GlobalReport(gs.XID, test.reported)
+		assert.NotNil(t, err, test.reported.String())
+		assert.Equal(t, meta.TransactionExceptionCodeGlobalTransactionStatusInvalid, err.(*meta.TransactionException).Code)
+		assert.Equal(t, test.current, status)
+		// a refused report leaves the session as it was.
+		assert.True(t, gs.Active)
+		assert.Equal(t, 2, len(gs.BranchSessions))
+		holder.GetSessionHolder().RootSessionManager.RemoveGlobalSession(gs)
+	}
+
+	// a status reported again is ignored.
+	gs := sagaGlobalSessionProvider("saga-report-again", meta.GlobalStatusCommitting, 2)
+	status, err := core.GlobalReport(gs.XID, meta.GlobalStatusCommitting)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.GlobalStatusCommitting, status)
+	assert.Empty(t, sender.committed())
+	assert.Empty(t, sender.rolledBack())
+}
+
+type sagaTestMessageSender struct {
+	ServerMessageSender
+
+	mu             sync.Mutex
+	commits        []int64
+	rollbacks      []int64
+	rollbackStatus map[int64]meta.BranchStatus
+}
+
+func (sender *sagaTestMessageSender) SendSyncRequest(resourceID string, clientID string, message interface{}) (interface{}, error) {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	switch request := message.(type) {
+	case protocal.BranchCommitRequest:
+		sender.commits = append(sender.commits, request.BranchID)
+		resp := protocal.BranchCommitResponse{}
+		resp.BranchStatus = meta.BranchStatusPhaseTwoCommitted
+		return resp, nil
+	case protocal.BranchRollbackRequest:
+		sender.rollbacks = append(sender.rollbacks, request.BranchID)
+		resp := protocal.BranchRollbackResponse{}
+		resp.BranchStatus = meta.BranchStatusPhaseTwoRolledBack
+		if status, ok := sender.rollbackStatus[request.BranchID]; ok {
+			resp.BranchStatus = status
+		}
+		return resp, nil
+	}
+	return nil, nil
+}
+
+func (sender *sagaTestMessageSender) SendSyncRequestWithTimeout(resourceID string, clientID string, message interface{},
+	timeout time.Duration) (interface{}, error) {
+	return sender.SendSyncRequest(resourceID, clientID, message)
+}
+
+func (sender *sagaTestMessageSender) SendSyncRequestByGetty(session getty.Session, message interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (sender *sagaTestMessageSender) committed() []int64 {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	return append([]int64(nil), sender.commits...)
+}
+
+func (sender *sagaTestMessageSender) rolledBack() []int64 {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	return append([]int64(nil), sender.rollbacks...)
+}
+
+func sagaCoreProvider() (TransactionCoordinator, *sagaTestMessageSender, func()) {
+	previous := holder.GetSessionHolder()
+	holder.SetSessionHolder(holder.SessionHolder{
+		RootSessionManager:             holder.NewDefaultSessionManager("root"),
+		AsyncCommittingSessionManager:  holder.NewDefaultSessionManager(holder.ASYNC_COMMITTING_SESSION_MANAGER_NAME),
+		RetryCommittingSessionManager:  holder.NewDefaultSessionManager(holder.RETRY_COMMITTING_SESSION_MANAGER_NAME),
+		RetryRollbackingSessionManager: holder.NewDefaultSessionManager(holder.RETRY_ROLLBACKING_SESSION_MANAGER_NAME),
+	})
+	lock.Init()
+	sender := &sagaTestMessageSender{rollbackStatus: make(map[int64]meta.BranchStatus)}
+	return NewCore(sender, config.PhaseTwoConfig{}), sender, func() {
+		holder.SetSessionHolder(previous)
+	}
+}
+
+// sagaGlobalSessionProvider adds a saga global session with branches 1..branches to the root session manager.
+func sagaGlobalSessionProvider(xid string, status meta.GlobalStatus, branches int64) *session.GlobalSession {
+	gs := session.NewGlobalSession(
+		session.WithGsXID(xid),
+		session.WithGsStatus(status),
+		session.WithGsActive(false),
+	)
+	for branchID := int64(1); branchID <= branches; branchID++ {
+		gs.Add(session.NewBranchSession(
+			session.WithBsXid(xid),
+			session.WithBsBranchID(branchID),
+			session.WithBsBranchType(meta.BranchTypeSAGA),
+			session.WithBsResourceID("saga"),
+			session.WithBsStatus(meta.BranchStatusRegistered),
+		))
+	}
+	holder.GetSessionHolder().RootSessionManager.AddGlobalSession(gs)
+	return gs
+}
@@ -0,0 +1,465 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/auth"
+	config2 "github.com/transaction-mesh/starfish/pkg/base/config"
+	"github.com/transaction-mesh/starfish/pkg/base/getty/tlsconfig"
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal/codec"
+	"github.com/transaction-mesh/starfish/pkg/tc/holder"
+	"github.com/transaction-mesh/starfish/pkg/util/log"
+)
+
+const (
+	forwardServiceMethod = "Forwarder.Handle"
+	deliverServiceMethod = "Forwarder.Deliver"
+)
+
+var (
+	errNotLeader     = errors.New("this transaction coordinator is not the leader")
+	errNoRmChannel   = errors.New("no channel to the resource manager on this transaction coordinator")
+	errRmUnreachable = errors.New("no transaction coordinator holds a channel to the resource manager")
+	errNoSecret      = errors.New("raft secret is required to authenticate the requests between transaction coordinators")
+)
+
+// Credential identifies the node a request comes from, HeadMap carries the
+// signature of the request by the secret of the cluster.
+type Credential struct {
+	NodeID  string
+	HeadMap map[string]string
+}
+
+// ForwardRequest carries a transaction message a follower received from a
+// client, together with the identity of that client.
+type ForwardRequest struct {
+	Credential
+	ApplicationID           string
+	TransactionServiceGroup string
+	ClientID                string
+	Version                 string
+	Message                 []byte
+}
+
+type ForwardResponse struct {
+	Message []byte
+}
+
+// DeliverRequest carries a phase two request the leader has no channel for,
+// the node the resource manager is connected to sends it on.
+type DeliverRequest struct {
+	Credential
+	ResourceID string
+	ClientID   string
+	Timeout    time.Duration
+	Message    []byte
+}
+
+func (request ForwardRequest) digest() string {
+	return digest(forwardServiceMethod, request.ApplicationID, request.TransactionServiceGroup,
+		request.ClientID, request.Version, string(request.Message))
+}
+
+func (request DeliverRequest) digest() string {
+	return digest(deliverServiceMethod, request.ResourceID, request.ClientID,
+		request.Timeout.String(), string(request.Message))
+}
+
+// digest hashes fields prefixed by their lengths, so that no two requests
+// share a signature.
+func digest(fields ...string) string {
+	hash := sha256.New()
+	for _, field := range fields {
+		hash.Write([]byte(strconv.Itoa(len(field)) + ":" + field))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Forwarder serves the transaction messages followers forward to the leader.
+// The nodes sign every request with the secret of the cluster and talk tls
+// when the getty tls config is enabled, requests of unknown nodes or with a
+// bad signature are refused.
+type Forwarder struct {
+	coordinator  *DefaultCoordinator
+	nodeID       string
+	secret       string
+	peers        map[string]bool
+	maxClockSkew time.Duration
+	timeout      time.Duration
+	tlsConfig    config2.TLSConfig
+	listener     net.Listener
+
+	mu         sync.Mutex
+	clients    map[string]*rpc.Client
+	tlsBuilder *tlsconfig.Builder
+}
+
+func NewForwarder(coordinator *DefaultCoordinator) *Forwarder {
+	forwarder := &Forwarder{
+		coordinator:  coordinator,
+		peers:        make(map[string]bool),
+		maxClockSkew: defaultMaxClockSkew,
+		timeout:      RpcRequestTimeout,
+		clients:      make(map[string]*rpc.Client),
+	}
+	if conf := coordinator.conf; conf != nil {
+		raftConf := conf.StoreConfig.RaftStoreConfig
+		forwarder.nodeID = raftConf.NodeID
+		forwarder.secret = raftConf.Secret
+		for _, server := range raftConf.Servers {
+			forwarder.peers[server.NodeID] = true
+		}
+		if raftConf.ForwardTimeout > 0 {
+			forwarder.timeout = raftConf.ForwardTimeout
+		}
+		if conf.AuthConfig.MaxClockSkew > 0 {
+			forwarder.maxClockSkew = conf.AuthConfig.MaxClockSkew
+		}
+		forwarder.tlsConfig = conf.GettyConfig.TLSConfig
+	}
+	return forwarder
+}
+
+// Serve accepts forwarded requests on addr until Close is called.
+func (forwarder *Forwarder) Serve(addr string) error {
+	if forwarder.secret == "" {
+		return errNoSecret
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Forwarder", &forwardService{forwarder: forwarder}); err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if forwarder.tlsConfig.Enabled {
+		builder, err := tlsconfig.NewServerBuilder(forwarder.tlsConfig)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		tlsConfig, _ := builder.BuildTlsConfig()
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	forwarder.listener = listener
+	go server.Accept(listener)
+	log.Infof("forwarder listening on %s", listener.Addr().String())
+	return nil
+}
+
+// Forward sends msg to the leader and returns its response.
+func (forwarder *Forwarder) Forward(addr string, msg protocal.MessageTypeAware, ctx RpcContext) (protocal.MessageTypeAware, error) {
+	if addr == "" {
+		return nil, errors.New("no leader elected")
+	}
+	client, err := forwarder.getClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	request := ForwardRequest{
+		ApplicationID:           ctx.ApplicationID,
+		TransactionServiceGroup: ctx.TransactionServiceGroup,
+		ClientID:                ctx.ClientID,
+		Version:                 ctx.Version,
+		Message:                 codec.MessageEncoder(codec.SEATA, msg),
+	}
+	request.Credential = forwarder.sign(request.digest())
+	var response ForwardResponse
+	call := client.Go(forwardServiceMethod, request, &response, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-time.After(forwarder.timeout):
+		// the connection may be stuck, the next request dials again
+		forwarder.dropClient(addr, client)
+		return nil, errors.Errorf("wait response from leader %s timeout", addr)
+	}
+	if err != nil {
+		if err == rpc.ErrShutdown {
+			forwarder.dropClient(addr, client)
+		}
+		return nil, err
+	}
+	result, _ := codec.MessageDecoder(codec.SEATA, response.Message)
+	resp, ok := result.(protocal.MessageTypeAware)
+	if !ok {
+		return nil, errors.Errorf("leader %s returned an undecodable response", addr)
+	}
+	return resp, nil
+}
+
+// Deliver asks the peers at addrs in turn to send msg to the resource manager
+// identified by resourceID and clientID, and returns the response of the first
+// peer holding a channel to it.
+func (forwarder *Forwarder) Deliver(addrs []string, resourceID string, clientID string,
+	msg interface{}, timeout time.Duration) (interface{}, error) {
+	request := DeliverRequest{
+		ResourceID: resourceID,
+		ClientID:   clientID,
+		Timeout:    timeout,
+		Message:    codec.MessageEncoder(codec.SEATA, msg),
+	}
+	request.Credential = forwarder.sign(request.digest())
+	for _, addr := range addrs {
+		client, err := forwarder.getClient(addr)
+		if err != nil {
+			log.Warnf("connect to transaction coordinator %s failed: %v", addr, err)
+			continue
+		}
+		var response ForwardResponse
+		call := client.Go(deliverServiceMethod, request, &response, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-time.After(timeout):
+			forwarder.dropClient(addr, client)
+			return nil, errors.Errorf("wait response from transaction coordinator %s timeout", addr)
+		}
+		if err == rpc.ErrShutdown {
+			forwarder.dropClient(addr, client)
+		}
+		if err != nil {
+			if err.Error() != errNoRmChannel.Error() {
+				log.Warnf("deliver message to transaction coordinator %s failed: %v", addr, err)
+			}
+			continue
+		}
+		result, _ := codec.MessageDecoder(codec.SEATA, response.Message)
+		if result == nil {
+			return nil, errors.Errorf("transaction coordinator %s returned an undecodable response", addr)
+		}
+		return result, nil
+	}
+	return nil, errors.Wrapf(errRmUnreachable, "resourceID %s clientID %s", resourceID, clientID)
+}
+
+func (forwarder *Forwarder) sign(digest string) Credential {
+	return Credential{
+		NodeID:  forwarder.nodeID,
+		HeadMap: auth.SignedHeadMap(forwarder.secret, forwarder.nodeID, digest, time.Now()),
+	}
+}
+
+// authenticate checks credential comes from a node of the cluster and signs
+// the request hashed to digest.
+func (forwarder *Forwarder) authenticate(credential Credential, digest string) error {
+	if forwarder.secret == "" {
+		return errNoSecret
+	}
+	if !forwarder.peers[credential.NodeID] {
+		return errors.Errorf("unknown transaction coordinator %q", credential.NodeID)
+	}
+	if err := auth.Verify(forwarder.secret, credential.NodeID, digest, credential.HeadMap,
+		time.Now(), forwarder.maxClockSkew); err != nil {
+		return errors.Wrapf(err, "authenticate transaction coordinator %s", credential.NodeID)
+	}
+	return nil
+}
+
+func (forwarder *Forwarder) getClient(addr string) (*rpc.Client, error) {
+	if forwarder.secret == "" {
+		return nil, errNoSecret
+	}
+	forwarder.mu.Lock()
+	client, ok := forwarder.clients[addr]
+	forwarder.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+	// dial without the lock, an unreachable node does not hold up the others
+	conn, err := forwarder.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	forwarder.mu.Lock()
+	defer forwarder.mu.Unlock()
+	if cached, ok := forwarder.clients[addr]; ok {
+		conn.Close()
+		return cached, nil
+	}
+	client = rpc.NewClient(conn)
+	forwarder.clients[addr] = client
+	return client, nil
+}
+
+func (forwarder *Forwarder) dial(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: forwarder.timeout}
+	if !forwarder.tlsConfig.Enabled {
+		return dialer.Dial("tcp", addr)
+	}
+	builder, err := forwarder.clientTLSBuilder()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, _ := builder.BuildTlsConfig()
+	return tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+}
+
+// clientTLSBuilder returns the tls builder of the connections to the other
+// nodes, the certificate of the node is its client certificate as well.
+func (forwarder *Forwarder) clientTLSBuilder() (*tlsconfig.Builder, error) {
+	forwarder.mu.Lock()
+	defer forwarder.mu.Unlock()
+	if forwarder.tlsBuilder == nil {
+		builder, err := tlsconfig.NewClientBuilder(forwarder.tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		forwarder.tlsBuilder = builder
+	}
+	return forwarder.tlsBuilder, nil
+}
+
+func (forwarder *Forwarder) dropClient(addr string, client *rpc.Client) {
+	forwarder.mu.Lock()
+	defer forwarder.mu.Unlock()
+	if forwarder.clients[addr] == client {
+		delete(forwarder.clients, addr)
+	}
+	client.Close()
+}
+
+func (forwarder *Forwarder) Close() {
+	if forwarder.listener != nil {
+		forwarder.listener.Close()
+	}
+	forwarder.mu.Lock()
+	defer forwarder.mu.Unlock()
+	for addr, client := range forwarder.clients {
+		client.Close()
+		delete(forwarder.clients, addr)
+	}
+}
+
+type forwardService struct {
+	forwarder *Forwarder
+}
+
+// Handle never forwards again, a stale leader rejects the request instead of
+// bouncing it around the cluster.
+func (service *forwardService) Handle(request ForwardRequest, response *ForwardResponse) error {
+	if err := service.forwarder.authenticate(request.Credential, request.digest()); err != nil {
+		log.Warnf("refuse forwarded request: %v", err)
+		return err
+	}
+	if !holder.GetSessionHolder().IsLeader() {
+		return errNotLeader
+	}
+	decoded, _ := codec.MessageDecoder(codec.SEATA, request.Message)
+	msg, ok := decoded.(protocal.MessageTypeAware)
+	if !ok {
+		return errors.New("undecodable forwarded message")
+	}
+	coordinator := service.forwarder.coordinator
+	if err := coordinator.beginRequest(msg); err != nil {
+		return err
+	}
+	defer coordinator.endRequest()
+
+	ctx := RpcContext{
+		ApplicationID:           request.ApplicationID,
+		TransactionServiceGroup: request.TransactionServiceGroup,
+		ClientID:                request.ClientID,
+		Version:                 request.Version,
+	}
+	result := coordinator.processTrxMessage(msg, ctx)
+	if result == nil {
+		return errors.Errorf("unsupported forwarded message type %d", msg.GetTypeCode())
+	}
+	response.Message = codec.MessageEncoder(codec.SEATA, result)
+	return nil
+}
+
+// Deliver sends a phase two request to a resource manager connected to this
+// node. It never looks further, the leader already asks every peer in turn.
+func (service *forwardService) Deliver(request DeliverRequest, response *ForwardResponse) error {
+	if err := service.forwarder.authenticate(request.Credential, request.digest()); err != nil {
+		log.Warnf("refuse delivered request: %v", err)
+		return err
+	}
+	session, err := SessionManager.GetGettySession(request.ResourceID, request.ClientID)
+	if err != nil {
+		return errNoRmChannel
+	}
+	msg, _ := codec.MessageDecoder(codec.SEATA, request.Message)
+	if msg == nil {
+		return errors.New("undecodable delivered message")
+	}
+	result, err := service.forwarder.coordinator.SendSyncRequestByGettyWithTimeout(session, msg, request.Timeout)
+	if err != nil {
+		return err
+	}
+	response.Message = codec.MessageEncoder(codec.SEATA, result)
+	return nil
+}
+
+// failedResponse builds the response a client expects for msg when it could
+// not be processed, either locally or by the leader.
+func failedResponse(msg protocal.MessageTypeAware, err error) protocal.MessageTypeAware {
+	result := protocal.AbstractTransactionResponse{
+		AbstractResultMessage: protocal.AbstractResultMessage{
+			ResultCode: protocal.ResultCodeFailed,
+			Msg:        fmt.Sprintf("RuntimeException[%s]", err.Error()),
+		},
+	}
+	var trxException *meta.TransactionException
+	if errors.As(err, &trxException) {
+		result.TransactionExceptionCode = trxException.Code
+		result.Msg = fmt.Sprintf("TransactionException[%s]", err.Error())
+	}
+	globalEnd := protocal.AbstractGlobalEndResponse{AbstractTransactionResponse: result}
+	switch msg.GetTypeCode() {
+	case protocal.TypeGlobalBegin:
+		return protocal.GlobalBeginResponse{AbstractTransactionResponse: result}
+	case protocal.TypeGlobalStatus:
+		return protocal.GlobalStatusResponse{AbstractGlobalEndResponse: globalEnd}
+	case protocal.TypeGlobalReport:
+		return protocal.GlobalReportResponse{AbstractGlobalEndResponse: globalEnd}
+	case protocal.TypeGlobalCommit:
+		return protocal.GlobalCommitResponse{AbstractGlobalEndResponse: globalEnd}
+	case protocal.TypeGlobalRollback:
+		return protocal.GlobalRollbackResponse{AbstractGlobalEndResponse: globalEnd}
+	case protocal.TypeBranchRegister:
+		return protocal.BranchRegisterResponse{AbstractTransactionResponse: result}
+	case protocal.TypeBranchStatusReport:
+		return protocal.BranchReportResponse{AbstractTransactionResponse: result}
+	case protocal.TypeGlobalLockQuery:
+		return protocal.GlobalLockQueryResponse{AbstractTransactionResponse: result}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/stretchr/testify/assert"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal/codec"
+	"github.com/transaction-mesh/starfish/pkg/tc/config"
+)
+
+func newTestForwarder(nodeID, secret string) *Forwarder {
+	conf := &config.ServerConfig{}
+	conf.StoreConfig.RaftStoreConfig = config.RaftStoreConfig{
+		NodeID:  nodeID,
+		Secret:  secret,
+		Servers: []config.RaftServerConfig{{NodeID: "tc-1"}, {NodeID: "tc-2"}},
+	}
+	return NewForwarder(&DefaultCoordinator{conf: conf})
+}
+
+func testDeliverRequest() DeliverRequest {
+	request := protocal.BranchCommitRequest{}
+	request.XID = "127.0.0.1:8091:1"
+	request.BranchID = 2
+	request.ResourceID = "jdbc:mysql://127.0.0.1:3306/order"
+	request.BranchType = meta.BranchTypeAT
+	return DeliverRequest{
+		ResourceID: request.ResourceID,
+		ClientID:   "order-svc:127.0.0.1:40000",
+		Timeout:    time.Second,
+		Message:    codec.MessageEncoder(codec.SEATA, request),
+	}
+}
+
+func TestForwarder_DeliverWithoutRmChannel(t *testing.T) {
+	peer := newTestForwarder("tc-2", "s3cret")
+	assert.Nil(t, peer.Serve("127.0.0.1:0"))
+	defer peer.Close()
+
+	forwarder := newTestForwarder("tc-1", "s3cret")
+	defer forwarder.Close()
+
+	request := protocal.BranchCommitRequest{}
+	request.XID = "127.0.0.1:8091:1"
+	request.BranchID = 2
+	request.ResourceID = "jdbc:mysql://127.0.0.1:3306/order"
+	request.BranchType = meta.BranchTypeAT
+
+	// an unreachable peer is skipped, the reachable one holds no channel either.
+	_, err := forwarder.Deliver([]string{"127.0.0.1:1", peer.listener.Addr().String()},
+		request.ResourceID, "order-svc:127.0.0.1:40000", request, time.Second)
+	assert.True(t, errors.Is(err, errRmUnreachable))
+}
+
+func TestForwarder_RequiresSecret(t *testing.T) {
+	peer := newTestForwarder("tc-2", "")
+	assert.Equal(t, errNoSecret, peer.Serve("127.0.0.1:0"))
+	_, err := peer.Deliver([]string{"127.0.0.1:1"}, "jdbc:mysql://127.0.0.1:3306/order",
+		"order-svc:127.0.0.1:40000", protocal.BranchCommitRequest{}, time.Second)
+	assert.True(t, errors.Is(err, errRmUnreachable))
+}
+
+func TestForwarder_RefuseUnauthenticated(t *testing.T) {
+	peer := newTestForwarder("tc-2", "s3cret")
+	assert.Nil(t, peer.Serve("127.0.0.1:0"))
+	defer peer.Close()
+
+	client, err := rpc.Dial("tcp", peer.listener.Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	var response ForwardResponse
+	unsigned := testDeliverRequest()
+	err = client.Call(deliverServiceMethod, unsigned, &response)
+	assert.EqualError(t, err, `unknown transaction coordinator ""`)
+
+	forged := testDeliverRequest()
+	forged.Credential = newTestForwarder("tc-1", "guessed").sign(forged.digest())
+	err = client.Call(deliverServiceMethod, forged, &response)
+	assert.EqualError(t, err, "authenticate transaction coordinator tc-1: signature mismatch")
+
+	tampered := testDeliverRequest()
+	tampered.Credential = newTestForwarder("tc-1", "s3cret").sign(tampered.digest())
+	tampered.ClientID = "stock-svc:127.0.0.1:40001"
+	err = client.Call(deliverServiceMethod, tampered, &response)
+	assert.EqualError(t, err, "authenticate transaction coordinator tc-1: signature mismatch")
+
+	forward := ForwardRequest{ApplicationID: "order-svc", Message: unsigned.Message}
+	forward.Credential = newTestForwarder("tc-3", "s3cret").sign(forward.digest())
+	err = client.Call(forwardServiceMethod, forward, &response)
+	assert.EqualError(t, err, `unknown transaction coordinator "tc-3"`)
+
+	// a signed request passes, no resource manager is connected to the peer.
+	signed := testDeliverRequest()
+	signed.Credential = newTestForwarder("tc-1", "s3cret").sign(signed.digest())
+	err = client.Call(deliverServiceMethod, signed, &response)
+	assert.EqualError(t, err, errNoRmChannel.Error())
+}
+
+func TestForwarder_ForwardTimeout(t *testing.T) {
+	// the leader accepts the connection but never responds.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			ioutil.ReadAll(conn)
+			conn.Close()
+		}
+	}()
+
+	forwarder := newTestForwarder("tc-1", "s3cret")
+	forwarder.timeout = 100 * time.Millisecond
+	defer forwarder.Close()
+
+	start := time.Now()
+	_, err = forwarder.Forward(listener.Addr().String(), protocal.GlobalStatusRequest{}, RpcContext{})
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+	forwarder.mu.Lock()
+	assert.Empty(t, forwarder.clients)
+	forwarder.mu.Unlock()
+}
@@ -18,6 +18,7 @@
 package server
 
 import (
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -33,6 +34,7 @@ import (
 	"github.com/transaction-mesh/starfish/pkg/base/meta"
 	"github.com/transaction-mesh/starfish/pkg/base/model"
 	"github.com/transaction-mesh/starfish/pkg/base/protocal"
+	"github.com/transaction-mesh/starfish/pkg/base/protocal/codec"
 	"github.com/transaction-mesh/starfish/pkg/util/log"
 )
 
@@ -50,6 +52,15 @@ var (
 
 	// applicationID -> resourceIDs
 	client_resources = sync.Map{}
+
+	// session -> codec type the client registered with
+	session_codecs = sync.Map{}
+
+	// session -> transaction service group the client registered to
+	session_servicegroups = sync.Map{}
+
+	// session -> version the client registered with
+	session_versions = sync.Map{}
 )
 
 const (
@@ -82,6 +93,22 @@ func (manager *GettySessionManager) GetRoleFromGettySession(session getty.Sessio
 	return 0
 }
 
+// RegisterCodec records the codec a client registered with, the requests the
+// server sends on the session are encoded with it.
+func (manager *GettySessionManager) RegisterCodec(session getty.Session, codecType byte) {
+	session_codecs.Store(session, codecType)
+}
+
+// GetCodecFromGettySession returns the codec of session, SEATA if the client did
+// not register yet.
+func (manager *GettySessionManager) GetCodecFromGettySession(session getty.Session) byte {
+	codecType, ok := session_codecs.Load(session)
+	if ok {
+		return codecType.(byte)
+	}
+	return codec.SEATA
+}
+
 func (manager *GettySessionManager) GetContextFromIdentified(session getty.Session) *RpcContext {
 	var applicationID, resourceIDs string
 
@@ -98,9 +125,14 @@ func (manager *GettySessionManager) GetContextFromIdentified(session getty.Sessi
 	}
 
 	role := manager.GetRoleFromGettySession(session)
+	var transactionServiceGroup string
+	if group, ok := session_servicegroups.Load(session); ok {
+		transactionServiceGroup = group.(string)
+	}
 
 	return NewRpcContext(
 		WithRpcContextClientRole(role),
+		WithRpcContextTxServiceGroup(transactionServiceGroup),
 		WithRpcContextApplicationID(applicationID),
 		WithRpcContextClientID(buildClientID(applicationID, session)),
 		WithRpcContextResourceSet(dbKeyToSet(resourceIDs)),
@@ -108,6 +140,47 @@ func (manager *GettySessionManager) GetContextFromIdentified(session getty.Sessi
 	)
 }
 
+// ClientInfo describes a registered client session.
+type ClientInfo struct {
+	ApplicationID           string
+	TransactionServiceGroup string
+	Role                    meta.TransactionRole
+	Address                 string
+	Version                 string
+}
+
+// ListClients returns the open client sessions ordered by application id and
+// address.
+func (manager *GettySessionManager) ListClients() []ClientInfo {
+	var clients []ClientInfo
+	identified_sessions.Range(func(key, value interface{}) bool {
+		session := key.(getty.Session)
+		if session.IsClosed() {
+			return true
+		}
+		client := ClientInfo{
+			ApplicationID: value.(string),
+			Role:          manager.GetRoleFromGettySession(session),
+			Address:       session.RemoteAddr(),
+		}
+		if group, ok := session_servicegroups.Load(session); ok {
+			client.TransactionServiceGroup = group.(string)
+		}
+		if version, ok := session_versions.Load(session); ok {
+			client.Version = version.(string)
+		}
+		clients = append(clients, client)
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].ApplicationID != clients[j].ApplicationID {
+			return clients[i].ApplicationID < clients[j].ApplicationID
+		}
+		return clients[i].Address < clients[j].Address
+	})
+	return clients
+}
+
 func dbKeyToSet(dbKey string) *model.Set {
 	if dbKey == "" {
 		return nil
@@ -125,8 +198,6 @@ func buildClientID(applicationID string, session getty.Session) string {
 }
 
 func (manager *GettySessionManager) RegisterTmGettySession(request protocal.RegisterTMRequest, session getty.Session) {
-	//todo check version, if not match, refuse to register
-	//todo check transaction service group, if not match, refuse to register
 	ip := getClientIpFromGettySession(session)
 	port := getClientPortFromGettySession(session)
 
@@ -138,11 +209,11 @@ func (manager *GettySessionManager) RegisterTmGettySession(request protocal.Regi
 
 	session_transactionroles.Store(session, meta.TMRole)
 	identified_sessions.Store(session, request.ApplicationID)
+	session_servicegroups.Store(session, request.TransactionServiceGroup)
+	session_versions.Store(session, request.Version)
 }
 
 func (manager *GettySessionManager) RegisterRmGettySession(request protocal.RegisterRMRequest, session getty.Session) {
-	//todo check version, if not match, refuse to register
-	//todo check transaction service group, if not match, refuse to register
 	ip := getClientIpFromGettySession(session)
 	port := getClientPortFromGettySession(session)
 
@@ -154,6 +225,8 @@ func (manager *GettySessionManager) RegisterRmGettySession(request protocal.Regi
 
 	session_transactionroles.Store(session, meta.RMRole)
 	identified_sessions.Store(session, request.ApplicationID)
+	session_servicegroups.Store(session, request.TransactionServiceGroup)
+	session_versions.Store(session, request.Version)
 	client_resources.Store(request.ApplicationID, request.ResourceIDs)
 }
 
@@ -389,4 +462,7 @@ func getClientPortFromGettySession(session getty.Session) int {
 func (manager *GettySessionManager) ReleaseGettySession(session getty.Session) {
 	session_transactionroles.Delete(session)
 	identified_sessions.Delete(session)
+	session_codecs.Delete(session)
+	session_servicegroups.Delete(session)
+	session_versions.Delete(session)
 }
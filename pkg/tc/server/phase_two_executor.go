@@ -0,0 +1,113 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"sync"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+// phaseTwoExecutor sends the phase two requests of the branches of a global
+// transaction concurrently. The requests of all the global transactions share
+// a bounded pool of workers, the branches of a group are sent in order and the
+// rest of a group is not sent once a branch of it fails.
+type phaseTwoExecutor struct {
+	workers chan struct{}
+}
+
+// phaseTwoResult is the outcome of the phase two request of a branch, sent is
+// false when the request was not sent as an earlier branch of its group failed.
+type phaseTwoResult struct {
+	branchSession *session.BranchSession
+	status        meta.BranchStatus
+	err           error
+	sent          bool
+}
+
+// newPhaseTwoExecutor returns an executor of workers workers, or nil when
+// workers does not allow any concurrency and the branches are sent one after
+// another.
+func newPhaseTwoExecutor(workers int) *phaseTwoExecutor {
+	if workers <= 1 {
+		return nil
+	}
+	return &phaseTwoExecutor{workers: make(chan struct{}, workers)}
+}
+
+// execute sends every branch of branchSessions by send, the branches of the
+// same group in the order given and a branch not ordered in a group of its own.
+// A group stops at the first branch which does not reach the status done. The
+// results are in the order of branchSessions.
+func (executor *phaseTwoExecutor) execute(branchSessions []*session.BranchSession,
+	groupOf func(branchSession *session.BranchSession) (group string, ordered bool),
+	send func(branchSession *session.BranchSession) (meta.BranchStatus, error),
+	done meta.BranchStatus) []phaseTwoResult {
+	results := make([]phaseTwoResult, len(branchSessions))
+	var groups [][]int
+	groupIndexes := make(map[string]int)
+	for i, branchSession := range branchSessions {
+		results[i].branchSession = branchSession
+		group, ordered := groupOf(branchSession)
+		index, ok := groupIndexes[group]
+		if !ordered || !ok {
+			index = len(groups)
+			if ordered {
+				groupIndexes[group] = index
+			}
+			groups = append(groups, nil)
+		}
+		groups[index] = append(groups[index], i)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(groups))
+	for _, group := range groups {
+		go func(group []int) {
+			defer wg.Done()
+			for _, i := range group {
+				executor.workers <- struct{}{}
+				status, err := send(results[i].branchSession)
+				<-executor.workers
+				results[i].status, results[i].err, results[i].sent = status, err, true
+				if err != nil || status != done {
+					return
+				}
+			}
+		}(group)
+	}
+	wg.Wait()
+	return results
+}
+
+// commitGroup groups the branches whose commits must keep their order. An AT
+// branch commit only deletes its undo logs and goes in a group of its own, the
+// other branches of a resource are committed in the order they registered.
+func commitGroup(branchSession *session.BranchSession) (string, bool) {
+	return branchSession.ResourceID, branchSession.BranchType != meta.BranchTypeAT
+}
+
+// rollbackGroup groups the branches by resource, the branches of a resource
+// may have changed the same rows and are rolled back in the order given, which
+// is the reverse of the order they registered.
+func rollbackGroup(branchSession *session.BranchSession) (string, bool) {
+	return branchSession.ResourceID, true
+}
@@ -0,0 +1,142 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"go.uber.org/atomic"
+)
+
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+	"github.com/transaction-mesh/starfish/pkg/tc/session"
+)
+
+func TestPhaseTwoExecutor_Execute(t *testing.T) {
+	assert.Nil(t, newPhaseTwoExecutor(1))
+	executor := newPhaseTwoExecutor(2)
+
+	branchSessions := []*session.BranchSession{
+		phaseTwoBranchSessionProvider(1, meta.BranchTypeTCC, "stock"),
+		phaseTwoBranchSessionProvider(2, meta.BranchTypeAT, "order"),
+		phaseTwoBranchSessionProvider(3, meta.BranchTypeTCC, "stock"),
+		phaseTwoBranchSessionProvider(4, meta.BranchTypeAT, "order"),
+		phaseTwoBranchSessionProvider(5, meta.BranchTypeAT, "order"),
+		phaseTwoBranchSessionProvider(6, meta.BranchTypeTCC, "stock"),
+	}
+	var (
+		mu       sync.Mutex
+		sent     []int64
+		running  = atomic.NewInt32(0)
+		parallel = atomic.NewInt32(0)
+	)
+	results := executor.execute(branchSessions, commitGroup, func(bs *session.BranchSession) (meta.BranchStatus, error) {
+		current := running.Inc()
+		defer running.Dec()
+		for {
+			max := parallel.Load()
+			if current <= max || parallel.CAS(max, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		sent = append(sent, bs.BranchID)
+		mu.Unlock()
+		// the second stock branch fails, the one after it is not sent.
+		if bs.BranchID == 3 || bs.BranchID == 4 {
+			return meta.BranchStatusPhaseTwoCommitFailedRetryable, nil
+		}
+		return meta.BranchStatusPhaseTwoCommitted, nil
+	}, meta.BranchStatusPhaseTwoCommitted)
+
+	assert.Equal(t, int32(2), parallel.Load())
+	assert.Equal(t, 6, len(results))
+	for i, result := range results {
+		assert.Equal(t, branchSessions[i], result.branchSession)
+	}
+	assert.Equal(t, meta.BranchStatusPhaseTwoCommitted, results[0].status)
+	assert.Equal(t, meta.BranchStatusPhaseTwoCommitFailedRetryable, results[2].status)
+	// a failed AT branch does not hold the others back.
+	assert.Equal(t, meta.BranchStatusPhaseTwoCommitFailedRetryable, results[3].status)
+	assert.True(t, results[4].sent)
+	assert.False(t, results[5].sent)
+	assert.Equal(t, 5, len(sent))
+
+	// the branches of a resource are sent in order.
+	var stock []int64
+	for _, branchID := range sent {
+		if branchSessions[branchID-1].ResourceID == "stock" {
+			stock = append(stock, branchID)
+		}
+	}
+	assert.Equal(t, []int64{1, 3}, stock)
+}
+
+func TestPhaseTwoExecutor_RollbackGroup(t *testing.T) {
+	executor := newPhaseTwoExecutor(4)
+	// the core passes the branches newest first.
+	branchSessions := []*session.BranchSession{
+		phaseTwoBranchSessionProvider(3, meta.BranchTypeAT, "order"),
+		phaseTwoBranchSessionProvider(2, meta.BranchTypeAT, "stock"),
+		phaseTwoBranchSessionProvider(1, meta.BranchTypeAT, "order"),
+	}
+	var (
+		mu    sync.Mutex
+		order []int64
+	)
+	results := executor.execute(branchSessions, rollbackGroup, func(bs *session.BranchSession) (meta.BranchStatus, error) {
+		if bs.ResourceID == "order" {
+			mu.Lock()
+			order = append(order, bs.BranchID)
+			mu.Unlock()
+		}
+		return meta.BranchStatusPhaseTwoRolledBack, nil
+	}, meta.BranchStatusPhaseTwoRolledBack)
+	for _, result := range results {
+		assert.Equal(t, meta.BranchStatusPhaseTwoRolledBack, result.status)
+	}
+	// the AT branches of a resource are rolled back in reverse registration order.
+	assert.Equal(t, []int64{3, 1}, order)
+
+	results = executor.execute(branchSessions, rollbackGroup, func(bs *session.BranchSession) (meta.BranchStatus, error) {
+		if bs.BranchID == 3 {
+			return meta.BranchStatusPhaseTwoRollbackFailedRetryable, nil
+		}
+		return meta.BranchStatusPhaseTwoRolledBack, nil
+	}, meta.BranchStatusPhaseTwoRolledBack)
+
+	// an older branch of a resource is not rolled back before the newer ones.
+	assert.True(t, results[0].sent)
+	assert.Equal(t, meta.BranchStatusPhaseTwoRolledBack, results[1].status)
+	assert.False(t, results[2].sent)
+}
+
+func phaseTwoBranchSessionProvider(branchID int64, branchType meta.BranchType, resourceID string) *session.BranchSession {
+	return session.NewBranchSession(
+		session.WithBsBranchID(branchID),
+		session.WithBsBranchType(branchType),
+		session.WithBsResourceID(resourceID),
+	)
+}
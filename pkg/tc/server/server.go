@@ -18,11 +18,14 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -32,28 +35,56 @@ import (
 
 	gxnet "github.com/dubbogo/gost/net"
 	"github.com/dubbogo/gost/sync"
+
+	"github.com/pkg/errors"
 )
 
 import (
 	"github.com/transaction-mesh/starfish/pkg/base/extension"
 	"github.com/transaction-mesh/starfish/pkg/base/getty/readwriter"
+	"github.com/transaction-mesh/starfish/pkg/base/getty/tlsconfig"
 	"github.com/transaction-mesh/starfish/pkg/base/registry"
 	"github.com/transaction-mesh/starfish/pkg/tc/config"
+	"github.com/transaction-mesh/starfish/pkg/tc/holder"
 	"github.com/transaction-mesh/starfish/pkg/util/log"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
 type Server struct {
-	conf       *config.ServerConfig
-	tcpServer  getty.Server
-	rpcHandler *DefaultCoordinator
+	conf        *config.ServerConfig
+	tcpServer   getty.Server
+	rpcHandler  *DefaultCoordinator
+	pkgHandler  *readwriter.RpcPackageHandler
+	tlsBuilder  *tlsconfig.Builder
+	adminServer *AdminServer
+
+	registry registry.Registry
+	address  *registry.Address
 }
 
 func NewServer() *Server {
 	s := &Server{
 		conf: config.GetServerConfig(),
 	}
+	pkgHandler, err := readwriter.NewRpcPackageHandler(s.conf.GettyConfig.Compressor,
+		s.conf.GettyConfig.CompressThreshold, s.conf.GettyConfig.GettySessionParam.MaxMsgLen)
+	if err != nil {
+		panic(err)
+	}
+	s.pkgHandler = pkgHandler
+	if s.conf.GettyConfig.TLSConfig.Enabled {
+		tlsBuilder, err := tlsconfig.NewServerBuilder(s.conf.GettyConfig.TLSConfig)
+		if err != nil {
+			panic(err)
+		}
+		s.tlsBuilder = tlsBuilder
+	}
 	coordinator := NewDefaultCoordinator(s.conf)
 	s.rpcHandler = coordinator
+	if s.conf.AdminConfig.Enabled {
+		s.adminServer = NewAdminServer(s.conf.AdminConfig, coordinator)
+	}
 
 	return s
 }
@@ -69,21 +100,22 @@ func (s *Server) newSession(session getty.Session) error {
 		session.SetCompressType(getty.CompressZip)
 	}
 
-	if tcpConn, ok = session.Conn().(*net.TCPConn); !ok {
+	// tcp parameters do not apply to tls connections, getty dials and accepts them
+	if tcpConn, ok = session.Conn().(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(conf.GettyConfig.GettySessionParam.TCPNoDelay)
+		tcpConn.SetKeepAlive(conf.GettyConfig.GettySessionParam.TCPKeepAlive)
+		if conf.GettyConfig.GettySessionParam.TCPKeepAlive {
+			tcpConn.SetKeepAlivePeriod(conf.GettyConfig.GettySessionParam.KeepAlivePeriod)
+		}
+		tcpConn.SetReadBuffer(conf.GettyConfig.GettySessionParam.TCPRBufSize)
+		tcpConn.SetWriteBuffer(conf.GettyConfig.GettySessionParam.TCPWBufSize)
+	} else if _, ok = session.Conn().(*tls.Conn); !ok {
 		panic(fmt.Sprintf("%s, session.conn{%#v} is not tcp connection\n", session.Stat(), session.Conn()))
 	}
 
-	tcpConn.SetNoDelay(conf.GettyConfig.GettySessionParam.TCPNoDelay)
-	tcpConn.SetKeepAlive(conf.GettyConfig.GettySessionParam.TCPKeepAlive)
-	if conf.GettyConfig.GettySessionParam.TCPKeepAlive {
-		tcpConn.SetKeepAlivePeriod(conf.GettyConfig.GettySessionParam.KeepAlivePeriod)
-	}
-	tcpConn.SetReadBuffer(conf.GettyConfig.GettySessionParam.TCPRBufSize)
-	tcpConn.SetWriteBuffer(conf.GettyConfig.GettySessionParam.TCPWBufSize)
-
 	session.SetName(conf.GettyConfig.GettySessionParam.SessionName)
 	session.SetMaxMsgLen(conf.GettyConfig.GettySessionParam.MaxMsgLen)
-	session.SetPkgHandler(readwriter.RpcPkgHandler)
+	session.SetPkgHandler(s.pkgHandler)
 	session.SetEventListener(s.rpcHandler)
 	session.SetReadTimeout(conf.GettyConfig.GettySessionParam.TCPReadTimeout)
 	session.SetWriteTimeout(conf.GettyConfig.GettySessionParam.TCPWriteTimeout)
@@ -94,16 +126,34 @@ func (s *Server) newSession(session getty.Session) error {
 	return nil
 }
 
-func (s *Server) Start(addr string) {
-	tcpServer := getty.NewTCPServer(
+func (s *Server) Start(addr string) error {
+	options := []getty.ServerOption{
 		getty.WithLocalAddress(addr),
 		getty.WithServerTaskPool(gxsync.NewTaskPoolSimple(0)),
-	)
+	}
+	if s.tlsBuilder != nil {
+		options = append(options,
+			getty.WithServerSslEnabled(true),
+			getty.WithServerTlsConfigBuilder(s.tlsBuilder),
+		)
+	}
+	tcpServer := getty.NewTCPServer(options...)
 	tcpServer.RunEventLoop(s.newSession)
 	log.Debugf("s bind addr{%s} ok!", addr)
 	s.tcpServer = tcpServer
+	if s.conf.StoreConfig.StoreMode == "raft" {
+		local, _ := s.conf.StoreConfig.RaftStoreConfig.LocalServer()
+		if err := s.rpcHandler.forwarder.Serve(local.ForwardAddr); err != nil {
+			panic(err)
+		}
+	}
+	if s.adminServer != nil {
+		if err := s.adminServer.Serve(); err != nil {
+			panic(err)
+		}
+	}
 	//向注册中心注册实例
-	registryInstance(s.conf)
+	s.registryInstance()
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	for {
@@ -111,31 +161,81 @@ func (s *Server) Start(addr string) {
 		log.Info("get a signal %s", sig.String())
 		switch sig {
 		case syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
-			s.Stop()
-			time.Sleep(time.Second)
-			return
+			return s.Stop()
 		case syscall.SIGHUP:
 		default:
-			return
+			return nil
 		}
 	}
 }
 
-func registryInstance(config *config.ServerConfig) {
-	reg, err := extension.GetRegistry(config.RegistryConfig.Mode)
+func (s *Server) registryInstance() {
+	reg, err := extension.GetRegistry(s.conf.RegistryConfig.Mode)
 	if err != nil {
 		log.Error("Registry can not connect success, program is going to panic.Error message is %s", err.Error())
 		panic(err.Error())
 	}
 	ip, _ := gxnet.GetLocalIP()
-	port, _ := strconv.Atoi(config.Port)
-	reg.Register(&registry.Address{
+	port, _ := strconv.Atoi(s.conf.Port)
+	s.registry = reg
+	s.address = &registry.Address{
 		IP:   ip,
 		Port: uint64(port),
-	})
+	}
+	reg.Register(s.address)
 }
 
-func (s *Server) Stop() {
-	s.tcpServer.Close()
-	s.rpcHandler.Stop()
+// Stop drains the server: it deregisters from the registry, refuses new global
+// transactions, waits for the in-flight requests and the retry rounds until
+// the shutdown timeout, then closes the listeners and the session store. The
+// returned error reports the work that was left unfinished.
+func (s *Server) Stop() error {
+	timeout := s.conf.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if s.registry != nil {
+		if err := s.registry.UnRegister(s.address); err != nil {
+			log.Errorf("unregister %s:%d failed: %v", s.address.IP, s.address.Port, err)
+		}
+		s.registry.Stop()
+	}
+
+	var unfinished []string
+	if inflight := s.rpcHandler.Drain(ctx); inflight > 0 {
+		unfinished = append(unfinished, fmt.Sprintf("%d requests still in flight", inflight))
+	}
+	if err := s.rpcHandler.Stop(ctx); err != nil {
+		unfinished = append(unfinished, err.Error())
+	}
+	if s.tcpServer != nil {
+		s.tcpServer.Close()
+	}
+	if s.adminServer != nil {
+		s.adminServer.Close()
+	}
+
+	sessionHolder := holder.GetSessionHolder()
+	pending := 0
+	for _, sessionManager := range []holder.SessionManager{sessionHolder.AsyncCommittingSessionManager,
+		sessionHolder.RetryCommittingSessionManager, sessionHolder.RetryRollbackingSessionManager} {
+		if sessionManager != nil {
+			pending += len(sessionManager.AllSessions())
+		}
+	}
+	if pending > 0 {
+		log.Infof("%d global sessions are left to retry after restart", pending)
+	}
+	if err := sessionHolder.Shutdown(); err != nil {
+		unfinished = append(unfinished, fmt.Sprintf("shutdown session store failed: %v", err))
+	}
+
+	if len(unfinished) > 0 {
+		return errors.Errorf("server stopped with unfinished work: %s", strings.Join(unfinished, ", "))
+	}
+	log.Info("server stopped")
+	return nil
 }
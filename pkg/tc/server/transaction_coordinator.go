@@ -26,7 +26,7 @@ import (
 
 type TransactionCoordinatorInbound interface {
 	tm.TransactionManager
-	rm.ResourceManagerOutbound
+	rm.LockModeResourceManagerOutbound
 }
 
 type TransactionCoordinatorOutbound interface {
@@ -47,6 +47,6 @@ type TransactionCoordinator interface {
 	// Do global rollback.
 	doGlobalRollback(globalSession *session.GlobalSession, retrying bool) (bool, error)
 
-	// Do global report.
-	doGlobalReport(globalSession *session.GlobalSession, xid string, param meta.GlobalStatus) error
+	// Do global report, it reports whether the reported status starts a phase two the core has to drive.
+	doGlobalReport(globalSession *session.GlobalSession, xid string, param meta.GlobalStatus) (bool, error)
 }
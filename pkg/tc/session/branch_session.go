@@ -54,6 +54,9 @@ type BranchSession struct {
 	ClientID string
 
 	ApplicationData []byte
+
+	// LockMode is the mode the rows of LockKey are locked in.
+	LockMode meta.LockMode
 }
 
 type BranchSessionOption func(session *BranchSession)
@@ -118,6 +121,12 @@ func WithBsApplicationData(applicationData []byte) BranchSessionOption {
 	}
 }
 
+func WithBsLockMode(lockMode meta.LockMode) BranchSessionOption {
+	return func(session *BranchSession) {
+		session.LockMode = lockMode
+	}
+}
+
 func NewBranchSession(opts ...BranchSessionOption) *BranchSession {
 	session := &BranchSession{
 		BranchID: uuid.NextID(),
@@ -129,7 +138,7 @@ func NewBranchSession(opts ...BranchSessionOption) *BranchSession {
 	return session
 }
 
-func NewBranchSessionByGlobal(gs GlobalSession, opts ...BranchSessionOption) *BranchSession {
+func NewBranchSessionByGlobal(gs *GlobalSession, opts ...BranchSessionOption) *BranchSession {
 	bs := &BranchSession{
 		XID:           gs.XID,
 		TransactionID: gs.TransactionID,
@@ -204,6 +213,7 @@ func (bs *BranchSession) Encode() ([]byte, error) {
 
 	w.WriteByte(byte(bs.BranchType))
 	w.WriteByte(byte(bs.Status))
+	w.WriteByte(byte(bs.LockMode))
 
 	return b.Bytes(), nil
 }
@@ -247,6 +257,12 @@ func (bs *BranchSession) Decode(b []byte) {
 
 	status, _ := r.ReadByte()
 	bs.Status = meta.BranchStatus(status)
+
+	// The sessions stored before the lock modes end here, their locks are
+	// exclusive.
+	if lockMode, err := r.ReadByte(); err == nil {
+		bs.LockMode = meta.LockMode(lockMode)
+	}
 }
 
 func calBranchSessionSize(resourceIDLen int,
@@ -263,6 +279,7 @@ func calBranchSessionSize(resourceIDLen int,
 		4 + // applicationDataBytes.length
 		4 + // xidBytes.size
 		1 + // statusCode
+		1 + // lockMode
 		resourceIDLen +
 		lockKeyLen +
 		clientIDLen +
@@ -42,6 +42,13 @@ func TestBranchSession_Encode_Decode(t *testing.T) {
 	assert.Equal(t, bs.LockKey, newBs.LockKey)
 	assert.Equal(t, bs.ClientID, newBs.ClientID)
 	assert.Equal(t, bs.ApplicationData, newBs.ApplicationData)
+	assert.Equal(t, meta.LockModeShared, newBs.LockMode)
+
+	// the sessions encoded before the lock modes hold exclusive locks.
+	oldBs := &BranchSession{}
+	oldBs.Decode(result[:len(result)-1])
+	assert.Equal(t, bs.LockKey, oldBs.LockKey)
+	assert.Equal(t, meta.LockModeExclusive, oldBs.LockMode)
 }
 
 func branchSessionProvider() *BranchSession {
@@ -55,6 +62,7 @@ func branchSessionProvider() *BranchSession {
 		WithBsStatus(meta.BranchStatusUnknown),
 		WithBsClientID("c1"),
 		WithBsApplicationData([]byte("{\"data\":\"test\"}")),
+		WithBsLockMode(meta.LockModeShared),
 	)
 
 	return bs
@@ -150,7 +150,7 @@ func (gs *GlobalSession) Remove(branchSession *BranchSession) {
 
 func (gs *GlobalSession) CanBeCommittedAsync() bool {
 	for branchSession := range gs.BranchSessions {
-		if branchSession.BranchType == meta.BranchTypeTCC {
+		if branchSession.BranchType != meta.BranchTypeAT {
 			return false
 		}
 	}
@@ -161,8 +161,6 @@ func (gs *GlobalSession) IsSaga() bool {
 	for branchSession := range gs.BranchSessions {
 		if branchSession.BranchType == meta.BranchTypeSAGA {
 			return true
-		} else {
-			return false
 		}
 	}
 	return false
@@ -182,6 +180,7 @@ func (gs *GlobalSession) GetSortedBranches() []*BranchSession {
 	for branchSession := range gs.BranchSessions {
 		branchSessions = append(branchSessions, branchSession)
 	}
+	sort.Sort(BranchSessionSlice(branchSessions))
 	return branchSessions
 }
 
@@ -194,7 +193,7 @@ func (gs *GlobalSession) GetReverseSortedBranches() []*BranchSession {
 type BranchSessionSlice []*BranchSession
 
 func (p BranchSessionSlice) Len() int           { return len(p) }
-func (p BranchSessionSlice) Less(i, j int) bool { return p[i].CompareTo(p[j]) > 0 }
+func (p BranchSessionSlice) Less(i, j int) bool { return p[i].CompareTo(p[j]) < 0 }
 func (p BranchSessionSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 
 func (gs *GlobalSession) GetBranch(branchID int64) *BranchSession {
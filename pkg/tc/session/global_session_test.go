@@ -25,6 +25,10 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+import (
+	"github.com/transaction-mesh/starfish/pkg/base/meta"
+)
+
 func TestGlobalSession_Encode_Decode(t *testing.T) {
 	gs := globalSessionProvider()
 	result, err := gs.Encode()
@@ -40,6 +44,36 @@ func TestGlobalSession_Encode_Decode(t *testing.T) {
 	assert.Equal(t, newGs.TransactionName, gs.TransactionName)
 }
 
+func TestGlobalSession_SortedBranches(t *testing.T) {
+	gs := globalSessionProvider()
+	for _, branchID := range []int64{3, 1, 2} {
+		gs.Add(NewBranchSession(WithBsBranchID(branchID), WithBsBranchType(meta.BranchTypeSAGA)))
+	}
+
+	sorted := gs.GetSortedBranches()
+	assert.Equal(t, int64(1), sorted[0].BranchID)
+	assert.Equal(t, int64(2), sorted[1].BranchID)
+	assert.Equal(t, int64(3), sorted[2].BranchID)
+
+	reversed := gs.GetReverseSortedBranches()
+	assert.Equal(t, int64(3), reversed[0].BranchID)
+	assert.Equal(t, int64(2), reversed[1].BranchID)
+	assert.Equal(t, int64(1), reversed[2].BranchID)
+
+	assert.True(t, gs.IsSaga())
+	assert.False(t, gs.CanBeCommittedAsync())
+}
+
+func TestGlobalSession_CanBeCommittedAsync(t *testing.T) {
+	gs := globalSessionProvider()
+	gs.Add(NewBranchSession(WithBsBranchID(1), WithBsBranchType(meta.BranchTypeAT)))
+	assert.True(t, gs.CanBeCommittedAsync())
+
+	gs.Add(NewBranchSession(WithBsBranchID(2), WithBsBranchType(meta.BranchTypeXA)))
+	assert.False(t, gs.CanBeCommittedAsync())
+	assert.False(t, gs.IsSaga())
+}
+
 func globalSessionProvider() *GlobalSession {
 	gs := NewGlobalSession(
 		WithGsApplicationID("demo-cmd"),
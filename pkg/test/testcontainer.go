@@ -45,12 +45,11 @@ type MysqlContainer struct {
 func SetupMysql(tester *MysqlContainer) (context.Context, testcontainers.Container) {
 	log.Info("setup mysql container")
 	ctx := context.Background()
-	seedDataPath, err := os.Getwd()
+	mountPath, err := schemaDir()
 	if err != nil {
-		log.Errorf("Error get working directory: %s", err)
+		log.Errorf("Error find the db schema: %s", err)
 		panic(fmt.Sprintf("%v", err))
 	}
-	mountPath := seedDataPath + "/../../scripts/server/db"
 	slashPath := filepath.ToSlash(mountPath)
 	req := testcontainers.ContainerRequest{
 		Image: "mysql:latest",
@@ -59,8 +58,9 @@ func SetupMysql(tester *MysqlContainer) (context.Context, testcontainers.Contain
 			"MYSQL_DATABASE":      tester.Database,
 		},
 		ExposedPorts: []string{"3306/tcp", "33060/tcp"},
+		// only the mysql schema, the directory also holds the ones of other databases
 		BindMounts: map[string]string{
-			"/docker-entrypoint-initdb.d": slashPath,
+			"/docker-entrypoint-initdb.d/mysql.sql": slashPath + "/mysql.sql",
 		},
 		WaitingFor: wait.ForLog("port: 3306  MySQL Community Server - GPL"),
 		//.WithStartupTimeout(time.Minute * 2),
@@ -76,14 +76,37 @@ func SetupMysql(tester *MysqlContainer) (context.Context, testcontainers.Contain
 	return ctx, container
 }
 
-func (tester MysqlContainer) OpenConnection(ctx context.Context, container testcontainers.Container) (*sql.DB, error) {
+// schemaDir returns scripts/server/db of the repository, it is looked up from
+// the working directory of the test upwards.
+func schemaDir() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		schemaDir := filepath.Join(dir, "scripts", "server", "db")
+		if _, err := os.Stat(filepath.Join(schemaDir, "mysql.sql")); err == nil {
+			return schemaDir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("scripts/server/db/mysql.sql not found above the working directory")
+		}
+		dir = parent
+	}
+}
+
+// DataSourceName returns the dsn of the database of container.
+func (tester MysqlContainer) DataSourceName(ctx context.Context, container testcontainers.Container) string {
 	host, _ := container.Host(ctx)
 	p, _ := container.MappedPort(ctx, "3306/tcp")
 	port := p.Int()
-	connectionString := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?tls=skip-verify&parseTime=true&multiStatements=true",
+	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?tls=skip-verify&parseTime=true&multiStatements=true",
 		tester.Username, tester.Password, host, port, tester.Database)
+}
 
-	db, err := sql.Open("mysql", connectionString)
+func (tester MysqlContainer) OpenConnection(ctx context.Context, container testcontainers.Container) (*sql.DB, error) {
+	db, err := sql.Open("mysql", tester.DataSourceName(ctx, container))
 
 	if err != nil {
 		log.Error("error connect to db: %+v\n", err)
@@ -0,0 +1,17 @@
+-- -------------------------------- The script used by the AT resource manager --------------------------------
+-- create the undo_log table in every business database that takes part in AT global transactions
+CREATE TABLE IF NOT EXISTS `undo_log`
+(
+    `id`            BIGINT       NOT NULL AUTO_INCREMENT,
+    `branch_id`     BIGINT       NOT NULL,
+    `xid`           VARCHAR(128) NOT NULL,
+    `context`       VARCHAR(128) NOT NULL,
+    `rollback_info` LONGBLOB     NOT NULL,
+    `log_status`    INT          NOT NULL,
+    `log_created`   DATETIME(6)  NOT NULL,
+    `log_modified`  DATETIME(6)  NOT NULL,
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `ux_undo_log` (`xid`, `branch_id`),
+    KEY `idx_log_created` (`log_created`)
+) ENGINE = InnoDB
+  DEFAULT CHARSET = utf8;
@@ -0,0 +1,112 @@
+-- -------------------------------- The script used when storeMode is 'db' and db.driver is 'postgres' --------------------------------
+
+-- the table to store GlobalSession data
+CREATE TABLE IF NOT EXISTS global_table
+(
+    xid                       VARCHAR(128) NOT NULL,
+    transaction_id            BIGINT,
+    status                    SMALLINT     NOT NULL,
+    application_id            VARCHAR(32),
+    transaction_service_group VARCHAR(32),
+    transaction_name          VARCHAR(128),
+    timeout                   INT,
+    begin_time                BIGINT,
+    application_data          BYTEA,
+    gmt_create                TIMESTAMP(0),
+    gmt_modified              TIMESTAMP(0),
+    CONSTRAINT pk_global_table PRIMARY KEY (xid)
+);
+
+CREATE INDEX IF NOT EXISTS idx_gmt_modified_status ON global_table (gmt_modified, status);
+CREATE INDEX IF NOT EXISTS idx_transaction_id ON global_table (transaction_id);
+
+-- the table to store BranchSession data
+CREATE TABLE IF NOT EXISTS branch_table
+(
+    branch_id         BIGINT       NOT NULL,
+    xid               VARCHAR(128) NOT NULL,
+    transaction_id    BIGINT,
+    resource_group_id VARCHAR(32),
+    resource_id       VARCHAR(256),
+    branch_type       VARCHAR(8),
+    status            SMALLINT,
+    client_id         VARCHAR(64),
+    application_data  BYTEA,
+    gmt_create        TIMESTAMP(6),
+    gmt_modified      TIMESTAMP(6),
+    CONSTRAINT pk_branch_table PRIMARY KEY (branch_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_xid ON branch_table (xid);
+
+-- the table to store lock data
+CREATE TABLE IF NOT EXISTS lock_table
+(
+    row_key        VARCHAR(128) NOT NULL,
+    xid            VARCHAR(96),
+    transaction_id BIGINT,
+    branch_id      BIGINT       NOT NULL,
+    resource_id    VARCHAR(256),
+    table_name     VARCHAR(32),
+    pk             VARCHAR(36),
+    gmt_create     TIMESTAMP(0),
+    gmt_modified   TIMESTAMP(0),
+    CONSTRAINT pk_lock_table PRIMARY KEY (row_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_branch_id ON lock_table (branch_id);
+
+-- the table to store shared lock data, several xids hold a row together
+CREATE TABLE IF NOT EXISTS lock_shared_table
+(
+    row_key        VARCHAR(128) NOT NULL,
+    xid            VARCHAR(96)  NOT NULL,
+    transaction_id BIGINT,
+    branch_id      BIGINT       NOT NULL,
+    resource_id    VARCHAR(256),
+    table_name     VARCHAR(32),
+    pk             VARCHAR(36),
+    gmt_create     TIMESTAMP(0),
+    gmt_modified   TIMESTAMP(0),
+    CONSTRAINT pk_lock_shared_table PRIMARY KEY (row_key, xid)
+);
+
+CREATE INDEX IF NOT EXISTS idx_shared_branch_id ON lock_shared_table (branch_id);
+
+-- the table to archive finished GlobalSession data when history.mode is 'db'
+CREATE TABLE IF NOT EXISTS global_table_history
+(
+    xid                       VARCHAR(128) NOT NULL,
+    transaction_id            BIGINT,
+    status                    SMALLINT     NOT NULL,
+    application_id            VARCHAR(32),
+    transaction_service_group VARCHAR(32),
+    transaction_name          VARCHAR(128),
+    timeout                   INT,
+    begin_time                BIGINT,
+    end_time                  BIGINT,
+    retry_count               INT,
+    application_data          BYTEA,
+    CONSTRAINT pk_global_table_history PRIMARY KEY (xid)
+);
+
+CREATE INDEX IF NOT EXISTS idx_history_end_time ON global_table_history (end_time);
+CREATE INDEX IF NOT EXISTS idx_history_transaction_id ON global_table_history (transaction_id);
+
+-- the table to archive the BranchSession data of the finished GlobalSessions
+CREATE TABLE IF NOT EXISTS branch_table_history
+(
+    branch_id         BIGINT       NOT NULL,
+    xid               VARCHAR(128) NOT NULL,
+    transaction_id    BIGINT,
+    resource_group_id VARCHAR(32),
+    resource_id       VARCHAR(256),
+    branch_type       VARCHAR(8),
+    status            SMALLINT,
+    client_id         VARCHAR(64),
+    end_time          BIGINT,
+    application_data  BYTEA,
+    CONSTRAINT pk_branch_table_history PRIMARY KEY (branch_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_history_xid ON branch_table_history (xid);
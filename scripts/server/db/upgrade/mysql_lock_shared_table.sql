@@ -0,0 +1,20 @@
+-- -------------------------------- Upgrade the 'db' store to shared row locks --------------------------------
+
+USE `starfish`;
+
+-- the shared locks are kept apart from lock_table, whose primary key stays row_key
+CREATE TABLE IF NOT EXISTS `lock_shared_table`
+(
+    `row_key`        VARCHAR(128) NOT NULL,
+    `xid`            VARCHAR(96)  NOT NULL,
+    `transaction_id` BIGINT,
+    `branch_id`      BIGINT       NOT NULL,
+    `resource_id`    VARCHAR(256),
+    `table_name`     VARCHAR(32),
+    `pk`             VARCHAR(36),
+    `gmt_create`     DATETIME,
+    `gmt_modified`   DATETIME,
+    PRIMARY KEY (`row_key`, `xid`),
+    KEY `idx_branch_id` (`branch_id`)
+) ENGINE = InnoDB
+  DEFAULT CHARSET = utf8;
@@ -0,0 +1,18 @@
+-- -------------------------------- Upgrade the 'db' store to shared row locks --------------------------------
+
+-- the shared locks are kept apart from lock_table, whose primary key stays row_key
+CREATE TABLE IF NOT EXISTS lock_shared_table
+(
+    row_key        VARCHAR(128) NOT NULL,
+    xid            VARCHAR(96)  NOT NULL,
+    transaction_id BIGINT,
+    branch_id      BIGINT       NOT NULL,
+    resource_id    VARCHAR(256),
+    table_name     VARCHAR(32),
+    pk             VARCHAR(36),
+    gmt_create     TIMESTAMP(0),
+    gmt_modified   TIMESTAMP(0),
+    CONSTRAINT pk_lock_shared_table PRIMARY KEY (row_key, xid)
+);
+
+CREATE INDEX IF NOT EXISTS idx_shared_branch_id ON lock_shared_table (branch_id);